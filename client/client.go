@@ -0,0 +1,233 @@
+// Package client calls the control API which `myclinic-backup serve`
+// provides, so that other programs, such as the myclinic server, can show
+// the state of backups and start them without knowing the protocol.
+//
+// The API is JSON over HTTP(S) under /v1, authenticated with the token of
+// the api section of the configuration as a bearer token:
+//
+//	GET  /v1/profiles             []ProfileStatus
+//	GET  /v1/backups?profile=P    []Backup
+//	POST /v1/backups              BackupRequest -> Run (202)
+//	POST /v1/restores             RestoreRequest -> Run (202)
+//	POST /v1/verifications        VerifyRequest -> Run (202)
+//	GET  /v1/runs                 []Run, newest first
+//	GET  /v1/runs/ID              Run
+//	GET  /v1/runs/ID/events       RunEvent per line until the run ends
+//
+// The events of a run stream as they happen.
+//
+// Errors are returned with a status of 400 or above and a body of the form
+// {"error": "message"}. Starting a run on a profile which has one running
+// fails with 409 Conflict.
+//
+// A "backup before closing" action, for example, is
+//
+//	c := client.New("https://backup.clinic.local:9130", token)
+//	run, err := c.StartBackup(ctx, &client.BackupRequest{Profile: "myclinic", Trigger: client.TriggerShutdown})
+//	if err == nil {
+//		run, err = c.Wait(ctx, run.ID, nil)
+//	}
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errNoResult = errors.New("run has no result yet")
+
+// Client calls the API of one server.
+type Client struct {
+	// BaseURL is the scheme and address the server listens on, e.g.
+	// https://backup.clinic.local:9130.
+	BaseURL string
+	Token   string
+	// HTTPClient is used for requests (default http.DefaultClient). Its
+	// timeout must allow for following events, which lasts as long as a
+	// run.
+	HTTPClient *http.Client
+}
+
+// New returns a client of the server at baseURL.
+func New(baseURL string, token string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), Token: token}
+}
+
+// Error is an error reported by the server.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("myclinic-backup API: %s (%d)", e.Message, e.StatusCode)
+}
+
+// IsConflict reports whether err is the server refusing to start a run
+// because one is already running on the profile.
+func IsConflict(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusConflict
+}
+
+// do sends a request with body, if not nil, encoded as JSON and returns
+// the response, which the caller must close, or the error reported.
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(msg, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(msg))
+		}
+		return nil, &Error{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	return resp, nil
+}
+
+// call sends a request and decodes the JSON response into out.
+func (c *Client) call(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Profiles returns the freshness of the backups of every profile the
+// server serves.
+func (c *Client) Profiles(ctx context.Context) ([]*ProfileStatus, error) {
+	var statuses []*ProfileStatus
+	return statuses, c.call(ctx, http.MethodGet, "/v1/profiles", nil, &statuses)
+}
+
+// Backups returns the catalog of backups of the profile, or of every
+// profile if profile is empty.
+func (c *Client) Backups(ctx context.Context, profile string) ([]*Backup, error) {
+	path := "/v1/backups"
+	if profile != "" {
+		path += "?profile=" + url.QueryEscape(profile)
+	}
+	var backups []*Backup
+	return backups, c.call(ctx, http.MethodGet, path, nil, &backups)
+}
+
+// StartBackup starts a backup and returns the run, which goes on in the
+// background.
+func (c *Client) StartBackup(ctx context.Context, req *BackupRequest) (*Run, error) {
+	var run Run
+	return &run, c.call(ctx, http.MethodPost, "/v1/backups", req, &run)
+}
+
+// StartRestore starts a restore, which overwrites the target database.
+func (c *Client) StartRestore(ctx context.Context, req *RestoreRequest) (*Run, error) {
+	var run Run
+	return &run, c.call(ctx, http.MethodPost, "/v1/restores", req, &run)
+}
+
+// StartVerification starts a verification of a stored backup.
+func (c *Client) StartVerification(ctx context.Context, req *VerifyRequest) (*Run, error) {
+	var run Run
+	return &run, c.call(ctx, http.MethodPost, "/v1/verifications", req, &run)
+}
+
+// Runs returns the runs started since the server started, newest first.
+func (c *Client) Runs(ctx context.Context) ([]*Run, error) {
+	var runs []*Run
+	return runs, c.call(ctx, http.MethodGet, "/v1/runs", nil, &runs)
+}
+
+// Run returns the run with the ID.
+func (c *Client) Run(ctx context.Context, id string) (*Run, error) {
+	var run Run
+	return &run, c.call(ctx, http.MethodGet, "/v1/runs/"+url.PathEscape(id), nil, &run)
+}
+
+// Events calls f with each event of the run, from the first, as they
+// happen, until the run ends, f returns an error or ctx is done.
+func (c *Client) Events(ctx context.Context, id string, f func(*RunEvent) error) error {
+	resp, err := c.do(ctx, http.MethodGet, "/v1/runs/"+url.PathEscape(id)+"/events", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e RunEvent
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return err
+		}
+		err = f(&e)
+		if err != nil {
+			return err
+		}
+		if e.Status != "" {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// Wait follows the run until it ends, calling progress, if not nil, with
+// each message, and returns the finished run. A failed run is returned
+// along with an error holding its message.
+func (c *Client) Wait(ctx context.Context, id string, progress func(message string)) (*Run, error) {
+	err := c.Events(ctx, id, func(e *RunEvent) error {
+		if progress != nil && e.Status == "" {
+			progress(e.Message)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	run, err := c.Run(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if run.Status == StatusFailed {
+		return run, fmt.Errorf("%s of %s failed: %s", run.Kind, run.Profile, run.Error)
+	}
+	return run, nil
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The types below are the wire format of version 1 of the API. Within v1
+// fields are only ever added, never renamed or removed, so clients built
+// against an older version of this package keep working.
+
+// ProfileStatus is the freshness of the backups of a profile, as returned
+// by GET /v1/profiles.
+type ProfileStatus struct {
+	Profile string `json:"profile"`
+	// Time is of the latest backup, nil if there is none.
+	Time       *time.Time `json:"time,omitempty"`
+	AgeSeconds int64      `json:"age_seconds,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	S3Key      string     `json:"s3_key,omitempty"`
+	// Overdue is set when the latest backup is older than the max_age of
+	// the profile.
+	Overdue bool `json:"overdue"`
+}
+
+// Backup is an entry of the catalog of backups, as returned by
+// GET /v1/backups.
+type Backup struct {
+	RunID   string `json:"run_id"`
+	Profile string `json:"profile"`
+	// Kind is empty for database dumps, "grants" for the accounts and
+	// grants stored with a dump, and "put" for artifacts named Name.
+	Kind          string    `json:"kind,omitempty"`
+	Name          string    `json:"name,omitempty"`
+	Time          time.Time `json:"time"`
+	BackupFile    string    `json:"backup_file"`
+	EncryptedFile string    `json:"encrypted_file"`
+	// S3Key is empty if the backup was not uploaded.
+	S3Bucket        string          `json:"s3_bucket"`
+	S3Key           string          `json:"s3_key"`
+	Size            int64           `json:"size"`
+	SHA256          string          `json:"sha256"`
+	EncryptedSize   int64           `json:"encrypted_size"`
+	EncryptedSHA256 string          `json:"encrypted_sha256,omitempty"`
+	Binlog          *BinlogPosition `json:"binlog,omitempty"`
+	Verifications   []*Verification `json:"verifications,omitempty"`
+	Label           string          `json:"label,omitempty"`
+	Note            string          `json:"note,omitempty"`
+	// Trigger is one of the Trigger constants, or empty for backups
+	// recorded before triggers were.
+	Trigger string `json:"trigger,omitempty"`
+}
+
+// BinlogPosition is the position of the source server at the time of a
+// dump.
+type BinlogPosition struct {
+	File       string `json:"file"`
+	Position   int64  `json:"position"`
+	GTIDPurged string `json:"gtid_purged,omitempty"`
+}
+
+// Verification is a check done on a stored backup.
+type Verification struct {
+	Time time.Time `json:"time"`
+	// Kind is "verify", "drill" or "spot-check".
+	Kind  string `json:"kind"`
+	Deep  bool   `json:"deep"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Triggers a backup request may state.
+const (
+	TriggerManual     = "manual"
+	TriggerPreUpgrade = "pre-upgrade"
+	TriggerShutdown   = "shutdown"
+)
+
+// BackupRequest is the body of POST /v1/backups.
+type BackupRequest struct {
+	Profile string `json:"profile"`
+	// Trigger is recorded as the reason for the backup (default "api").
+	Trigger string `json:"trigger,omitempty"`
+	// Label and Note are recorded with the backup. A label is up to 64
+	// letters, digits, '.', '_' and '-'.
+	Label string `json:"label,omitempty"`
+	Note  string `json:"note,omitempty"`
+}
+
+// RestoreRequest is the body of POST /v1/restores.
+type RestoreRequest struct {
+	Profile string `json:"profile"`
+	// RunID selects the backup (default the latest uploaded one).
+	RunID string `json:"run_id,omitempty"`
+	// TargetDB is restored into. It is required, and may be the database
+	// of the profile.
+	TargetDB string `json:"target_db"`
+}
+
+// VerifyRequest is the body of POST /v1/verifications.
+type VerifyRequest struct {
+	Profile string `json:"profile"`
+	// RunID selects the backup (default the latest uploaded one).
+	RunID string `json:"run_id,omitempty"`
+	// Deep also loads the backup into a temporary database.
+	Deep bool `json:"deep,omitempty"`
+}
+
+// Kinds of runs.
+const (
+	KindBackup  = "backup"
+	KindRestore = "restore"
+	KindVerify  = "verify"
+	KindPrune   = "prune"
+)
+
+// Statuses of runs.
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Run is an operation started through the API, which runs in the
+// background on the server.
+type Run struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	Profile  string     `json:"profile"`
+	Status   string     `json:"status"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Progress is the latest progress message.
+	Progress string `json:"progress,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Result depends on Kind; see BackupResult, RestoreResult and
+	// VerifyResult.
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// Done reports whether the run has finished, successfully or not.
+func (r *Run) Done() bool {
+	return r.Status != StatusRunning
+}
+
+// BackupResult is the result of a backup run.
+type BackupResult struct {
+	Profile       string    `json:"profile"`
+	RunID         string    `json:"run_id"`
+	Trigger       string    `json:"trigger,omitempty"`
+	Success       bool      `json:"success"`
+	Started       time.Time `json:"started"`
+	Finished      time.Time `json:"finished"`
+	BackupFile    string    `json:"backup_file,omitempty"`
+	EncryptedFile string    `json:"encrypted_file,omitempty"`
+	S3Key         string    `json:"s3_key,omitempty"`
+	// Size is that of the encrypted backup.
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// BackupResult decodes the result of a backup run.
+func (r *Run) BackupResult() (*BackupResult, error) {
+	var v BackupResult
+	return &v, r.decodeResult(&v)
+}
+
+// RestoreResult decodes the result of a restore run: the backup restored.
+func (r *Run) RestoreResult() (*Backup, error) {
+	var v Backup
+	return &v, r.decodeResult(&v)
+}
+
+// RestoreCheck is the outcome of a check run after a restore, one of the
+// after_restore checks of the profile.
+type RestoreCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// RestoreChecks decodes the checks run after the restore of a restore run,
+// which fails if any of them did.
+func (r *Run) RestoreChecks() ([]*RestoreCheck, error) {
+	var v struct {
+		Checks []*RestoreCheck `json:"checks"`
+	}
+	return v.Checks, r.decodeResult(&v)
+}
+
+// RestoreSnapshot decodes the backup taken before the restore of a restore
+// run, from which the restore can be undone, or nil if the profile takes
+// none or there was nothing to back up.
+func (r *Run) RestoreSnapshot() (*Backup, error) {
+	var v struct {
+		Snapshot *Backup `json:"snapshot"`
+	}
+	return v.Snapshot, r.decodeResult(&v)
+}
+
+// VerifyResult decodes the result of a verification run.
+func (r *Run) VerifyResult() (*Verification, error) {
+	var v Verification
+	return &v, r.decodeResult(&v)
+}
+
+func (r *Run) decodeResult(v interface{}) error {
+	if len(r.Result) == 0 {
+		return errNoResult
+	}
+	return json.Unmarshal(r.Result, v)
+}
+
+// RunEvent is a progress message of a run, or with Status set its outcome,
+// which is the last event.
+type RunEvent struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+	Status  string    `json:"status,omitempty"`
+}
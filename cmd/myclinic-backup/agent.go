@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ServerConfig is an authenticated HTTP server of the tool. Requests must
+// carry the token as a bearer token, and are served over TLS if a
+// certificate is given.
+type ServerConfig struct {
+	Listen    string `yaml:"listen"`
+	TokenFile string `yaml:"token_file"`
+	CertFile  string `yaml:"cert_file"`
+	KeyFile   string `yaml:"key_file"`
+}
+
+func (s *ServerConfig) validate(name string) error {
+	if s.Listen == "" || s.TokenFile == "" {
+		return fmt.Errorf("%s: listen and token_file are required", name)
+	}
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return fmt.Errorf("%s: cert_file and key_file must be given together", name)
+	}
+	return nil
+}
+
+// loopback reports whether the server listens only on a loopback address,
+// which other hosts cannot reach.
+func (s *ServerConfig) loopback() bool {
+	host, _, err := net.SplitHostPort(s.Listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serve serves h to clients presenting the token.
+func (s *ServerConfig) serve(h http.Handler) error {
+	token, err := readSecretFile(s.TokenFile)
+	if err != nil {
+		return err
+	}
+	return s.listen(requireToken(token, h))
+}
+
+// listen serves h, which checks the token itself.
+func (s *ServerConfig) listen(h http.Handler) error {
+	server := &http.Server{
+		Addr:    s.Listen,
+		Handler: h,
+	}
+	if fipsMode {
+		server.TLSConfig = fipsTLSConfig()
+	}
+	defer onInterrupt(func() { server.Close() })()
+	if s.CertFile != "" {
+		return server.ListenAndServeTLS(s.CertFile, s.KeyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// Trailers carrying the metadata of a dump served by the agent, or the
+// error which cut it short.
+const (
+	headerRunID  = "X-Backup-Run-Id"
+	headerTime   = "X-Backup-Time"
+	headerSize   = "X-Backup-Size"
+	headerSHA256 = "X-Backup-Sha256"
+	headerError  = "X-Backup-Error"
+)
+
+// requireToken rejects requests without the bearer token.
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func findProfile(profiles []*Profile, name string) *Profile {
+	for _, p := range profiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// agentHandler serves GET /v1/dump?profile=NAME, which dumps the profile
+// and returns it encrypted with the profile's key, so that the controller
+// never sees plain data. The token and the certificate the controller pins
+// with ca_file authenticate the two ends.
+func agentHandler(config *Config, profiles []*Profile) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/profiles", func(w http.ResponseWriter, r *http.Request) {
+		var names []string
+		for _, p := range profiles {
+			names = append(names, p.Name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(names)
+	})
+	mux.HandleFunc("/v1/dump", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p := findProfile(profiles, r.URL.Query().Get("profile"))
+		if p == nil {
+			http.Error(w, "unknown profile", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(stdout, tr("[%s] dump requested by %s\n"), p.Name, r.RemoteAddr)
+		// The dump is streamed, so what is only known at its end follows it
+		// in trailers.
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Trailer", strings.Join([]string{headerRunID, headerTime, headerSize, headerSHA256, headerError}, ", "))
+		body := &countingWriter{w: w, hash: ioutil.Discard}
+		started := time.Now()
+		meta, err := dumpTo(config, p, body, true, true)
+		rec := &AuditRecord{
+			Time:      time.Now(),
+			Profile:   p.Name,
+			Trigger:   triggerController,
+			User:      currentUser(),
+			Command:   "agent dump for " + r.RemoteAddr,
+			Stages:    []string{stageDump, stageEncrypt},
+			Artifacts: []string{"controller " + r.RemoteAddr},
+			Outcome:   "success",
+		}
+		rec.Host, _ = os.Hostname()
+		if err != nil {
+			rec.RunID = newRunID()
+			rec.Outcome = "failure"
+			rec.Error = redactError(err)
+		} else {
+			rec.RunID = meta.RunID
+			rec.SHA256 = meta.SHA256
+		}
+		if aerr := auditLog.Append(rec); aerr != nil {
+			fmt.Fprintf(stderr, tr("audit log: %v\n"), aerr)
+		}
+		h := &HistoryRecord{RunID: rec.RunID, Profile: p.Name, Kind: historyAgent, Trigger: triggerController,
+			Started: started, Finished: rec.Time, Success: err == nil, Error: rec.Error}
+		if err == nil {
+			h.Size = body.n
+		}
+		recordHistory(h)
+		if err != nil {
+			fmt.Fprintf(stderr, tr("[%s] dump failed: %v\n"), p.Name, err)
+			if body.n == 0 {
+				http.Error(w, redactError(err), http.StatusInternalServerError)
+			} else {
+				w.Header().Set(headerError, redactError(err))
+			}
+			return
+		}
+		w.Header().Set(headerRunID, meta.RunID)
+		w.Header().Set(headerTime, meta.Time.Format(time.RFC3339))
+		w.Header().Set(headerSize, fmt.Sprint(meta.Size))
+		w.Header().Set(headerSHA256, meta.SHA256)
+	})
+	return mux
+}
+
+func agentCommand(config *Config, profiles []*Profile, args []string) error {
+	if config.Agent == nil {
+		return fmt.Errorf("agent is not configured")
+	}
+	applyResourceLimits(config)
+	fmt.Fprintf(stdout, tr("agent listening on %s\n"), config.Agent.Listen)
+	return config.Agent.serve(agentHandler(config, profiles))
+}
+
+// agentClient returns the HTTP client for talking to an agent, trusting
+// caFile in addition to the system roots if it is given.
+func agentClient(caFile string) (*http.Client, error) {
+	client := &http.Client{Timeout: 6 * time.Hour}
+	if caFile == "" && !fipsMode {
+		return client, nil
+	}
+	config := &tls.Config{}
+	if fipsMode {
+		config = fipsTLSConfig()
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config}
+	return client, nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of operations started through the API.
+const (
+	operationBackup  = "backup"
+	operationRestore = "restore"
+	operationVerify  = "verify"
+	operationPrune   = "prune"
+)
+
+// Operation is a backup, restore or verification started through the API.
+// It runs in the background; its status is polled with GET /v1/runs/ID, or
+// its progress followed with GET /v1/runs/ID/events. Package client
+// publishes it as Run.
+type Operation struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	Profile  string     `json:"profile"`
+	Status   string     `json:"status"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Progress is the latest progress message.
+	Progress string      `json:"progress,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	events   []*OperationEvent
+	// changed is closed and replaced whenever an event is added.
+	changed chan struct{}
+}
+
+// OperationEvent is a progress message of an operation, or with Status set
+// its outcome.
+type OperationEvent struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+	Status  string    `json:"status,omitempty"`
+}
+
+// addEvent must be called with the lock of the operations held.
+func (op *Operation) addEvent(e *OperationEvent) {
+	op.events = append(op.events, e)
+	if e.Status == "" {
+		op.Progress = e.Message
+	}
+	close(op.changed)
+	op.changed = make(chan struct{})
+}
+
+// operationLog turns the progress messages written to it into events of
+// the operation.
+type operationLog struct {
+	ops *operations
+	op  *Operation
+}
+
+func (l *operationLog) Write(p []byte) (int, error) {
+	l.ops.mu.Lock()
+	defer l.ops.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.op.addEvent(&OperationEvent{Time: time.Now(), Message: line})
+	}
+	return len(p), nil
+}
+
+// Statuses of operations.
+const (
+	statusRunning   = "running"
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+)
+
+// operations keeps the operations started since the server started.
+type operations struct {
+	mu  sync.Mutex
+	ops map[string]*Operation
+}
+
+func newOperations() *operations {
+	return &operations{ops: make(map[string]*Operation)}
+}
+
+// start runs f in the background as a new operation, unless an operation
+// on the same profile is still running.
+func (o *operations) start(kind string, profile string, f func(log io.Writer) (interface{}, error)) (*Operation, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, op := range o.ops {
+		if op.Profile == profile && op.Status == statusRunning {
+			return nil, fmt.Errorf("%s of %s is in progress (%s)", op.Kind, profile, op.ID)
+		}
+	}
+	op := &Operation{ID: newRunID(), Kind: kind, Profile: profile, Status: statusRunning, Started: time.Now(),
+		changed: make(chan struct{})}
+	o.ops[op.ID] = op
+	go func() {
+		result, err := f(&operationLog{ops: o, op: op})
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		now := time.Now()
+		op.Finished = &now
+		op.Result = result
+		if err != nil {
+			op.Status = statusFailed
+			op.Error = redactError(err)
+			op.addEvent(&OperationEvent{Time: now, Message: op.Error, Status: op.Status})
+		} else {
+			op.Status = statusSucceeded
+			op.addEvent(&OperationEvent{Time: now, Message: kind + " succeeded", Status: op.Status})
+		}
+	}()
+	c := *op
+	return &c, nil
+}
+
+func (o *operations) get(id string) (*Operation, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	op, ok := o.ops[id]
+	if !ok {
+		return nil, false
+	}
+	c := *op
+	return &c, true
+}
+
+// eventsSince returns the events of the operation after the first n, and a
+// channel closed when there are more.
+func (o *operations) eventsSince(id string, n int) ([]*OperationEvent, <-chan struct{}, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	op, ok := o.ops[id]
+	if !ok {
+		return nil, nil, false
+	}
+	return op.events[n:], op.changed, true
+}
+
+// list returns the operations, newest first.
+func (o *operations) list() []*Operation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := make([]*Operation, 0, len(o.ops))
+	for _, op := range o.ops {
+		c := *op
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": redactError(err)})
+}
+
+// apiRequest is the body of POST /v1/backups, /v1/restores and
+// /v1/verifications. The wire format is published in package client, which
+// must be kept in step.
+type apiRequest struct {
+	Profile string `json:"profile"`
+	// RunID selects the backup to restore (default the latest).
+	RunID    string `json:"run_id"`
+	TargetDB string `json:"target_db"`
+	// Deep is for verifications; see VerifyConfig.
+	Deep bool `json:"deep"`
+	// Trigger states why a backup is requested, e.g. shutdown (default
+	// api).
+	Trigger string `json:"trigger"`
+	// Label and Note are recorded with a backup; see backup -label.
+	Label string `json:"label"`
+	Note  string `json:"note"`
+}
+
+func findEntry(p *Profile, runID string) (*CatalogEntry, error) {
+	if runID == "" {
+		return latestUploaded(p)
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Profile == p.Name && e.isDump() && e.RunID == runID && e.S3Key != "" {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("no uploaded backup %s of profile %s in catalog", runID, p.Name)
+}
+
+type apiServer struct {
+	config   *Config
+	profiles []*Profile
+	ops      *operations
+}
+
+func (s *apiServer) decodeRequest(w http.ResponseWriter, r *http.Request) (*apiRequest, *Profile, bool) {
+	var req apiRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, nil, false
+	}
+	p := findProfile(s.profiles, req.Profile)
+	if p == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown profile: %s", req.Profile))
+		return nil, nil, false
+	}
+	return &req, p, true
+}
+
+// apiError is an error with the HTTP status it is reported with.
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*apiError); ok {
+		status = e.status
+	}
+	writeError(w, status, err)
+}
+
+// startBackup, startRestore and startVerify start operations; they are
+// shared by the API and the dashboard.
+func (s *apiServer) startBackup(p *Profile, trigger string, label string, note string) (*Operation, error) {
+	op, err := s.ops.start(operationBackup, p.Name, func(log io.Writer) (interface{}, error) {
+		result := runProfile(s.config, p, runOptions{now: time.Now(), trigger: trigger, label: label, note: note,
+			labelled: true, log: log})
+		if !result.Success {
+			return result, fmt.Errorf("%s", result.Error)
+		}
+		return result, nil
+	})
+	if err != nil {
+		return nil, &apiError{http.StatusConflict, err}
+	}
+	return op, nil
+}
+
+func (s *apiServer) startRestore(p *Profile, req *apiRequest) (*Operation, error) {
+	if p.isFiles() || p.isMultiDatabase() {
+		return nil, &apiError{http.StatusBadRequest, fmt.Errorf("profile %s cannot be restored through the API", p.Name)}
+	}
+	e, err := findEntry(p, req.RunID)
+	if err != nil {
+		return nil, &apiError{http.StatusNotFound, err}
+	}
+	// There is nobody to confirm restoring over the live database, so the
+	// database is always named.
+	db := req.TargetDB
+	if db == "" {
+		return nil, &apiError{http.StatusBadRequest, fmt.Errorf("target_db is required")}
+	}
+	op, err := s.ops.start(operationRestore, p.Name, func(log io.Writer) (interface{}, error) {
+		fmt.Fprintf(stdout, tr("[%s] restoring %s into %s (requested through API)\n"),
+			p.Name, entryLocation(e), db)
+		var snap *CatalogEntry
+		if p.RestoreSnapshot {
+			var err error
+			snap, err = takeRestoreSnapshot(s.config, p, e, db, log)
+			if err != nil {
+				return e, err
+			}
+		}
+		fmt.Fprintf(log, "restoring %s into %s\n", entryLocation(e), db)
+		err := restoreStream(p, e, db, log)
+		if err != nil {
+			return e, err
+		}
+		result := &restoreResult{CatalogEntry: e, Snapshot: snap}
+		result.Checks, err = checkRestore(p, db, log)
+		return result, err
+	})
+	if err != nil {
+		return nil, &apiError{http.StatusConflict, err}
+	}
+	return op, nil
+}
+
+func (s *apiServer) startVerify(p *Profile, req *apiRequest) (*Operation, error) {
+	e, err := findEntry(p, req.RunID)
+	if err != nil {
+		return nil, &apiError{http.StatusNotFound, err}
+	}
+	op, err := s.ops.start(operationVerify, p.Name, func(log io.Writer) (interface{}, error) {
+		fmt.Fprintf(log, "verifying %s\n", entryLocation(e))
+		v := &Verification{Time: time.Now(), Kind: "verify", Deep: req.Deep}
+		err := verifyEntry(p, e, req.Deep)
+		if err != nil {
+			v.Error = redactError(err)
+		} else {
+			v.OK = true
+		}
+		if rerr := recordVerification(e, v); rerr != nil {
+			fmt.Fprintf(stderr, tr("[%s] cannot record verification: %v\n"), p.Name, rerr)
+		}
+		return v, err
+	})
+	if err != nil {
+		return nil, &apiError{http.StatusConflict, err}
+	}
+	return op, nil
+}
+
+// handleStart serves a POST starting an operation.
+func (s *apiServer) handleStart(start func(p *Profile, req *apiRequest) (*Operation, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+			return
+		}
+		req, p, ok := s.decodeRequest(w, r)
+		if !ok {
+			return
+		}
+		op, err := start(p, req)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, op)
+	}
+}
+
+// streamEvents sends the events of the operation as they happen, one JSON
+// object per line, until the operation has finished.
+func (s *apiServer) streamEvents(w http.ResponseWriter, r *http.Request, id string) {
+	events, changed, ok := s.ops.eventsSince(id, 0)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown run"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	sent := 0
+	for {
+		for _, e := range events {
+			if enc.Encode(e) != nil {
+				return
+			}
+			if e.Status != "" {
+				return
+			}
+		}
+		sent += len(events)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		events, changed, _ = s.ops.eventsSince(id, sent)
+	}
+}
+
+func (s *apiServer) listBackups(w http.ResponseWriter, r *http.Request) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	profile := r.URL.Query().Get("profile")
+	list := []*CatalogEntry{}
+	for _, e := range entries {
+		if findProfile(s.profiles, e.Profile) != nil && (profile == "" || e.Profile == profile) {
+			list = append(list, e)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/profiles", func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := profileStatuses(s.profiles, time.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	})
+	startBackup := s.handleStart(func(p *Profile, req *apiRequest) (*Operation, error) {
+		trigger := triggerAPI
+		if req.Trigger != "" {
+			if err := validateTrigger(req.Trigger); err != nil {
+				return nil, &apiError{http.StatusBadRequest, err}
+			}
+			trigger = req.Trigger
+		}
+		if err := validateLabel(req.Label); err != nil {
+			return nil, &apiError{http.StatusBadRequest, err}
+		}
+		return s.startBackup(p, trigger, req.Label, req.Note)
+	})
+	mux.HandleFunc("/v1/backups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			s.listBackups(w, r)
+			return
+		}
+		startBackup(w, r)
+	})
+	mux.HandleFunc("/v1/restores", s.handleStart(s.startRestore))
+	mux.HandleFunc("/v1/runs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.ops.list())
+	})
+	mux.HandleFunc("/v1/verifications", s.handleStart(s.startVerify))
+	mux.HandleFunc("/v1/runs/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/v1/runs/")
+		if strings.HasSuffix(id, "/events") {
+			s.streamEvents(w, r, strings.TrimSuffix(id, "/events"))
+			return
+		}
+		op, ok := s.ops.get(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown run"))
+			return
+		}
+		writeJSON(w, http.StatusOK, op)
+	})
+	return mux
+}
+
+// serveCommand serves the API for integrating backup management into other
+// tools, such as the clinic's admin pages.
+func serveCommand(config *Config, profiles []*Profile, args []string) error {
+	if config.API == nil {
+		return fmt.Errorf("api is not configured")
+	}
+	applyResourceLimits(config)
+	s := &apiServer{config: config, profiles: profiles, ops: newOperations()}
+	fmt.Fprintf(stdout, tr("API listening on %s\n"), config.API.Listen)
+	return config.API.serve(s.handler())
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is one entry of the audit log. Each record includes the hash
+// of the previous one, so that altering or removing a record breaks the
+// chain of every later record.
+type AuditRecord struct {
+	RunID     string    `json:"run_id"`
+	Time      time.Time `json:"time"`
+	Profile   string    `json:"profile"`
+	Trigger   string    `json:"trigger"`
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	Command   string    `json:"command"`
+	Stages    []string  `json:"stages"`
+	Artifacts []string  `json:"artifacts"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+// Triggers recorded in the audit log, the catalog and the results of
+// runs.
+const (
+	triggerManual   = "manual"
+	triggerSchedule = "schedule"
+	// triggerController is a dump requested from the agent.
+	triggerController = "controller"
+	triggerAPI        = "api"
+	triggerDashboard  = "dashboard"
+	// triggerPreUpgrade and triggerShutdown are stated by the hooks of
+	// the myclinic upgrade script and of shutting the server down.
+	triggerPreUpgrade = "pre-upgrade"
+	triggerShutdown   = "shutdown"
+	// triggerImport marks backups recorded by catalog import, of which
+	// how they were started is not known.
+	triggerImport = "import"
+	// triggerPreRestore marks the snapshots taken before restores; see
+	// restoresnapshot.go.
+	triggerPreRestore = "pre-restore"
+	// triggerRebase marks the full backups ending chains of binary logs
+	// grown past max_logs or max_days; see rebaseChain.
+	triggerRebase = "rebase"
+)
+
+// statedTriggers are those a caller may give with backup -trigger or in
+// an API request; the others are set by the tool itself.
+var statedTriggers = []string{triggerManual, triggerPreUpgrade, triggerShutdown}
+
+func validateTrigger(trigger string) error {
+	for _, t := range statedTriggers {
+		if trigger == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown trigger %s (one of %s)", trigger, strings.Join(statedTriggers, ", "))
+}
+
+// AuditLog is the append-only, hash-chained log in the state directory.
+type AuditLog struct {
+	path     string
+	mu       sync.Mutex
+	lastHash *string
+	// mirror, if set, also stores each record elsewhere.
+	mirror func(*AuditRecord) error
+}
+
+var auditLog *AuditLog
+
+func newAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+func (c *Config) auditLogPath() string {
+	return filepath.Join(c.StateDir, "audit.log")
+}
+
+func (r *AuditRecord) computeHash() (string, error) {
+	c := *r
+	c.Hash = ""
+	src, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(src)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readAuditLog reads all records, checking the hash chain. On a broken
+// chain it returns the records read so far with an error.
+func readAuditLog(path string) ([]*AuditRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*AuditRecord
+	prev := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		src, err := openLine(scanner.Bytes())
+		if err != nil {
+			return records, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		var r AuditRecord
+		err = json.Unmarshal(src, &r)
+		if err != nil {
+			return records, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if r.PrevHash != prev {
+			return records, fmt.Errorf("%s:%d: chain broken (previous record missing or altered)", path, line)
+		}
+		h, err := r.computeHash()
+		if err != nil {
+			return records, err
+		}
+		if h != r.Hash {
+			return records, fmt.Errorf("%s:%d: record altered", path, line)
+		}
+		records = append(records, &r)
+		prev = r.Hash
+	}
+	return records, scanner.Err()
+}
+
+// records reads all records, waiting for an append in progress.
+func (a *AuditLog) records() ([]*AuditRecord, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return readAuditLog(a.path)
+}
+
+// failureStreaks returns how many of the latest runs of the profile
+// failed in a row, and if the latest succeeded, how many failed in a row
+// before it. Holds and releases are not runs.
+func (a *AuditLog) failureStreaks(profile string) (failures int, recovered int, err error) {
+	records, err := a.records()
+	if err != nil {
+		return 0, 0, err
+	}
+	succeeded := false
+	for i := len(records) - 1; i >= 0; i-- {
+		r := records[i]
+		if r.Profile != profile || (len(r.Stages) == 1 && (r.Stages[0] == "hold" || r.Stages[0] == "release")) {
+			continue
+		}
+		if r.Outcome != "failure" {
+			if succeeded || failures > 0 {
+				break
+			}
+			succeeded = true
+			continue
+		}
+		if succeeded {
+			recovered++
+		} else {
+			failures++
+		}
+	}
+	return failures, recovered, nil
+}
+
+// Append chains the record to the last one and appends it to the log.
+func (a *AuditLog) Append(r *AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastHash == nil {
+		records, err := readAuditLog(a.path)
+		if err != nil {
+			return err
+		}
+		last := ""
+		if len(records) > 0 {
+			last = records[len(records)-1].Hash
+		}
+		a.lastHash = &last
+	}
+	r.PrevHash = *a.lastHash
+	h, err := r.computeHash()
+	if err != nil {
+		return err
+	}
+	r.Hash = h
+	src, err := json.Marshal(r)
+	if err == nil {
+		src, err = sealLine(src)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(a.path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(src, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	a.lastHash = &r.Hash
+	if a.mirror != nil {
+		err = a.mirror(r)
+		if err != nil {
+			return fmt.Errorf("cannot mirror audit record: %v", err)
+		}
+	}
+	return nil
+}
+
+func commandLine() string {
+	return redact(strings.Join(os.Args, " "))
+}
+
+func currentUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return "unknown"
+	}
+	return u.Username
+}
+
+func newAuditRecord(r *backupRun, result *ProfileResult) *AuditRecord {
+	host, _ := os.Hostname()
+	rec := &AuditRecord{
+		RunID:   result.RunID,
+		Time:    result.Finished,
+		Profile: result.Profile,
+		Trigger: r.trigger,
+		User:    currentUser(),
+		Host:    host,
+		Command: commandLine(),
+		Outcome: "success",
+		Error:   result.Error,
+	}
+	if !result.Success {
+		rec.Outcome = "failure"
+	}
+	if r.state != nil {
+		for _, stage := range []string{stageDump, stageEncrypt, stageUpload, stageRecord} {
+			if r.state.Done[stage] {
+				rec.Stages = append(rec.Stages, stage)
+			}
+		}
+		if r.state.Done[stageDump] {
+			rec.Artifacts = append(rec.Artifacts, r.state.BackupFile)
+		}
+		if r.state.Done[stageEncrypt] {
+			rec.Artifacts = append(rec.Artifacts, r.state.EncryptedFile)
+		}
+		if r.state.Done[stageUpload] {
+			rec.Artifacts = append(rec.Artifacts, r.profile.storedLocation(r.state.S3Key))
+		}
+	}
+	rec.Artifacts = append(rec.Artifacts, r.artifacts...)
+	if r.entry != nil {
+		rec.SHA256 = r.entry.SHA256
+	}
+	return rec
+}
+
+func auditVerifyCommand(config *Config, profiles []*Profile, args []string) error {
+	records, err := readAuditLog(config.auditLogPath())
+	if err != nil {
+		return fmt.Errorf("audit log verification failed after %d records: %v", len(records), err)
+	}
+	fmt.Fprintf(stdout, tr("audit log OK: %d records\n"), len(records))
+	return nil
+}
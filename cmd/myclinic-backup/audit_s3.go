@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// AuditS3Config mirrors every audit record to a bucket with S3 Object Lock
+// enabled. Locked objects cannot be deleted or overwritten until their
+// retention expires, even with the credentials used to write them.
+type AuditS3Config struct {
+	Region     string `yaml:"region"`
+	Bucket     string `yaml:"bucket"`
+	Prefix     string `yaml:"prefix"`
+	RoleARN    string `yaml:"role_arn"`
+	ExternalID string `yaml:"external_id"`
+	// LockMode is COMPLIANCE (default) or GOVERNANCE.
+	LockMode   string `yaml:"lock_mode"`
+	RetainDays int    `yaml:"retain_days"`
+}
+
+func (a *AuditS3Config) validate() error {
+	if a.Region == "" || a.Bucket == "" {
+		return fmt.Errorf("audit_s3: region and bucket are required")
+	}
+	if a.RetainDays <= 0 {
+		return fmt.Errorf("audit_s3: retain_days must be positive")
+	}
+	switch a.LockMode {
+	case "":
+		a.LockMode = s3.ObjectLockModeCompliance
+	case s3.ObjectLockModeCompliance, s3.ObjectLockModeGovernance:
+	default:
+		return fmt.Errorf("audit_s3: invalid lock_mode: %s", a.LockMode)
+	}
+	return nil
+}
+
+func (a *AuditS3Config) key(r *AuditRecord) string {
+	name := r.Time.UTC().Format("2006/01/20060102T150405Z") + "-" + r.Hash[:16] + ".json"
+	if metadataKey != nil {
+		name += ".cf"
+	}
+	return normalizePrefix(a.Prefix) + name
+}
+
+// upload stores the record as a locked object. Object Lock requires the
+// Content-MD5 header, or in FIPS mode a SHA-256 checksum instead.
+func (a *AuditS3Config) upload(r *AuditRecord) error {
+	body, err := json.Marshal(r)
+	if err == nil {
+		body, err = sealMetadata(body)
+	}
+	if err != nil {
+		return err
+	}
+	contentType := "application/json"
+	if metadataKey != nil {
+		contentType = "application/octet-stream"
+	}
+	sess, err := newAWSSession(a.Region, "", a.RoleARN, a.ExternalID, "audit")
+	if err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:                    aws.String(a.Bucket),
+		Key:                       aws.String(a.key(r)),
+		Body:                      bytes.NewReader(body),
+		ContentType:               aws.String(contentType),
+		ObjectLockMode:            aws.String(a.LockMode),
+		ObjectLockRetainUntilDate: aws.Time(time.Now().AddDate(0, 0, a.RetainDays)),
+	}
+	if fipsMode {
+		sum := sha256.Sum256(body)
+		sums := &uploadChecksums{sha256: sum[:]}
+		_, err = s3.New(sess).PutObjectWithContext(aws.BackgroundContext(), input, sums.withChecksums,
+			func(r *request.Request) {
+				r.Handlers.Build.PushBack(func(r *request.Request) {
+					r.HTTPRequest.Header.Set(checksumAlgorithmHeader, "SHA256")
+				})
+			})
+		return err
+	}
+	sum := md5.Sum(body)
+	input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	_, err = s3.New(sess).PutObject(input)
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// invokeAxCrypt runs AxCrypt 1.x with -b 2 -e -k -z, which later versions
+// no longer accept.
+const axcryptMajorVersion = "1"
+
+// locateAxCrypt returns the AxCrypt program to run: configured if given,
+// otherwise AxCrypt in PATH, the path registered with Windows, or a
+// standard install location.
+func locateAxCrypt(configured string) (string, error) {
+	if configured != "" {
+		if _, err := os.Stat(configured); err != nil {
+			return "", fmt.Errorf("AxCrypt program %s not found", configured)
+		}
+		return configured, nil
+	}
+	if prog, err := exec.LookPath("AxCrypt"); err == nil {
+		return prog, nil
+	}
+	candidates := axcryptCandidates()
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c, nil
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("AxCrypt is not available on this platform")
+	}
+	return "", fmt.Errorf("AxCrypt not found in PATH or in %s; install AxCrypt 1.x or give the program path",
+		strings.Join(candidates, ", "))
+}
+
+// checkAxCrypt returns the version of prog, or an error if it is not a
+// version supporting the command line options used.
+func checkAxCrypt(prog string) (string, error) {
+	version, err := axcryptVersion(prog)
+	if err != nil {
+		return "", fmt.Errorf("cannot get version of %s: %v", prog, err)
+	}
+	if strings.SplitN(version, ".", 2)[0] != axcryptMajorVersion {
+		return version, fmt.Errorf("%s is AxCrypt %s; only AxCrypt %s.x supports the command line options used",
+			prog, version, axcryptMajorVersion)
+	}
+	return version, nil
+}
+
+func axcryptCheckCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("axcrypt-check", flag.ExitOnError)
+	program := flags.String("program", "", "AxCrypt program to check (default found automatically)")
+	flags.Parse(args)
+	prog, err := locateAxCrypt(*program)
+	if err != nil {
+		return err
+	}
+	version, err := checkAxCrypt(prog)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, tr("%s (version %s)\n"), prog, version)
+	return nil
+}
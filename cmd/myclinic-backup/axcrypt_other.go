@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "fmt"
+
+// AxCrypt is a Windows program.
+func axcryptCandidates() []string {
+	return nil
+}
+
+func axcryptVersion(prog string) (string, error) {
+	return "", fmt.Errorf("AxCrypt is only supported on Windows")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// axcryptAppPathKey is where the installer registers the program path.
+const axcryptAppPathKey = `HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\App Paths\AxCrypt.exe`
+
+// regDefaultValue matches the default value in the output of reg query,
+// whose name is localized, e.g. (既定) on Japanese Windows.
+var regDefaultValue = regexp.MustCompile(`(?m)^\s+\([^)]+\)\s+REG_(?:EXPAND_)?SZ\s+(.+?)\s*$`)
+
+func axcryptCandidates() []string {
+	var candidates []string
+	out, err := exec.Command("reg", "query", axcryptAppPathKey, "/ve").Output()
+	if err == nil {
+		if m := regDefaultValue.FindSubmatch(out); m != nil {
+			candidates = append(candidates, strings.Trim(string(m[1]), `"`))
+		}
+	}
+	for _, env := range []string{"ProgramFiles", "ProgramFiles(x86)"} {
+		dir := os.Getenv(env)
+		if dir != "" {
+			candidates = append(candidates, filepath.Join(dir, "Axantum", "AxCrypt", "AxCrypt.exe"))
+		}
+	}
+	return candidates
+}
+
+// axcryptVersion reads the product version from the program file.
+func axcryptVersion(prog string) (string, error) {
+	script := "(Get-Item -LiteralPath '" + strings.Replace(prog, "'", "''", -1) + "').VersionInfo.ProductVersion"
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	cflib "github.com/hangilc/crypt-file/lib"
+)
+
+// benchLevels are the compression levels measured: fastest, zlib's
+// default, and smallest.
+var benchLevels = []int{1, 6, 9}
+
+// benchUploads are the multipart settings measured. The first is the
+// default of the SDK.
+var benchUploads = []struct {
+	partSize    int64
+	concurrency int
+}{
+	{5 << 20, 5},
+	{16 << 20, 5},
+	{16 << 20, 10},
+	{64 << 20, 10},
+}
+
+// benchResult is the throughput of one stage.
+type benchResult struct {
+	bytes   int64
+	elapsed time.Duration
+}
+
+// rate returns the throughput in bytes per second.
+func (b benchResult) rate() float64 {
+	return float64(b.bytes) / b.elapsed.Seconds()
+}
+
+// time returns how long size bytes take at the measured rate.
+func (b benchResult) time(size int64) time.Duration {
+	return time.Duration(float64(size) / b.rate() * float64(time.Second))
+}
+
+func formatRate(rate float64) string {
+	return formatBytes(int64(rate)) + "/s"
+}
+
+// benchmark measures the stages of a backup of the profile, which may be
+// nil, with synthetic data.
+type benchmark struct {
+	profile    *Profile
+	data       []byte
+	dump       benchResult
+	compress   map[int]benchResult
+	ratio      map[int]float64
+	encrypt    benchResult
+	upload     benchResult
+	partSize   int64
+	uploadConc int
+}
+
+// benchDump measures the dump stage: mysqldump of the database of the
+// profile, or writing the synthetic dump to the disk holding plain dumps.
+func (b *benchmark) benchDump(mysqldump bool) error {
+	p := b.profile
+	if mysqldump {
+		cw := &countingWriter{w: ioutil.Discard, hash: ioutil.Discard}
+		cmd := p.mysqldumpCommand()
+		cmd.Stdout = cw
+		cmd.Stderr = stderr
+		start := time.Now()
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("mysqldump failed: %v", err)
+		}
+		b.dump = benchResult{cw.n, time.Since(start)}
+		return nil
+	}
+	dir := os.TempDir()
+	if p != nil {
+		dir = p.BackupDir
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "bench-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	start := time.Now()
+	_, err = f.Write(b.data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	b.dump = benchResult{int64(len(b.data)), time.Since(start)}
+	return nil
+}
+
+// benchCompress measures compression at each of benchLevels and then
+// encryption of the output of zlib's default level.
+func (b *benchmark) benchCompress() error {
+	b.compress = make(map[int]benchResult)
+	b.ratio = make(map[int]float64)
+	var compressed []byte
+	for _, level := range benchLevels {
+		start := time.Now()
+		out, err := compressLevel(b.data, level)
+		if err != nil {
+			return err
+		}
+		b.compress[level] = benchResult{int64(len(b.data)), time.Since(start)}
+		b.ratio[level] = float64(len(out)) / float64(len(b.data))
+		if level == 6 {
+			compressed = out
+		}
+	}
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	_, err = cflib.Encrypt(key, compressed)
+	if err != nil {
+		return err
+	}
+	b.encrypt = benchResult{int64(len(compressed)), time.Since(start)}
+	return nil
+}
+
+// benchUpload uploads random data with each of benchUploads to the bucket
+// of the profile, deleting it afterwards, and keeps the fastest setting.
+func (b *benchmark) benchUpload(size int64) error {
+	p := b.profile
+	sess, err := newS3Session(p)
+	if err != nil {
+		return fmt.Errorf("cannot create AWS session: %v", err)
+	}
+	// Encrypted data does not compress, so random data stands for it.
+	data := make([]byte, size)
+	_, err = rand.Read(data)
+	if err != nil {
+		return err
+	}
+	svc := s3.New(sess)
+	for i, u := range benchUploads {
+		if i > 0 && u.partSize*2 > size {
+			continue
+		}
+		key := fmt.Sprintf("%sbench/%s-%d", normalizePrefix(p.S3Prefix), time.Now().Format("20060102150405"), i)
+		uploader := s3manager.NewUploader(sess, func(up *s3manager.Uploader) {
+			up.PartSize = u.partSize
+			up.Concurrency = u.concurrency
+		})
+		start := time.Now()
+		_, err := uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(p.S3Bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(data),
+		})
+		if err != nil {
+			return fmt.Errorf("upload failed: %v", err)
+		}
+		r := benchResult{size, time.Since(start)}
+		fmt.Fprintf(stdout, tr("  upload, part size %s, %d at once: %s\n"),
+			formatBytes(u.partSize), u.concurrency, formatRate(r.rate()))
+		_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(p.S3Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			fmt.Fprintf(stderr, tr("warning: cannot delete s3://%s/%s: %v\n"), p.S3Bucket, key, err)
+		}
+		if b.upload.bytes == 0 || r.rate() > b.upload.rate() {
+			b.upload = r
+			b.partSize = u.partSize
+			b.uploadConc = u.concurrency
+		}
+	}
+	return nil
+}
+
+// estimate returns how long a backup of a dump of size bytes takes at the
+// compression level. Upload is left out if it was not measured.
+func (b *benchmark) estimate(size int64, level int) time.Duration {
+	t := b.dump.time(size) + b.compress[level].time(size)
+	compressed := int64(float64(size) * b.ratio[level])
+	t += b.encrypt.time(compressed)
+	if b.upload.bytes > 0 {
+		t += b.upload.time(compressed)
+	}
+	return t
+}
+
+// recommend prints the settings for backing up a dump of size bytes
+// within window: the smallest compression level which fits, and the
+// fastest multipart setting, with the part size raised if a part count
+// over the S3 limit would otherwise be needed.
+func (b *benchmark) recommend(out io.Writer, size int64, window time.Duration) {
+	level := benchLevels[0]
+	fits := false
+	for i := len(benchLevels) - 1; i >= 0; i-- {
+		if b.estimate(size, benchLevels[i]) <= window {
+			level = benchLevels[i]
+			fits = true
+			break
+		}
+	}
+	estimate := b.estimate(size, level)
+	fmt.Fprintf(out, tr("recommended settings for dumps of %s and a backup window of %s (estimated %s):\n"),
+		formatBytes(size), window, estimate.Round(time.Second))
+	fmt.Fprintf(out, "  compression_level: %d\n", level)
+	if b.upload.bytes > 0 {
+		partSize := b.partSize
+		compressed := int64(float64(size) * b.ratio[level])
+		for compressed/partSize >= s3manager.MaxUploadParts {
+			partSize *= 2
+		}
+		fmt.Fprintf(out, "  upload_part_size: %dMB\n", partSize>>20)
+		fmt.Fprintf(out, "  upload_concurrency: %d\n", b.uploadConc)
+	}
+	if !fits {
+		fmt.Fprintf(out, tr("warning: even at the fastest setting the backup takes longer than the window\n"))
+	}
+}
+
+// benchCommand measures the throughput of the stages of a backup on this
+// machine and connection, and recommends settings.
+func benchCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	sizeFlag := flags.String("size", "64MB", "size of the synthetic data")
+	window := flags.Duration("window", time.Hour, "time available for a backup")
+	mysqldump := flags.Bool("mysqldump", false, "measures the dump with mysqldump of the database instead of a disk write")
+	noUpload := flags.Bool("no-upload", false, "does not measure uploads to S3")
+	flags.Parse(args)
+	size, err := parseByteSize(*sizeFlag)
+	if err != nil {
+		return err
+	}
+	if size < minPartSize {
+		return fmt.Errorf("-size must be at least %s", formatBytes(minPartSize))
+	}
+	applyResourceLimits(config)
+	b := &benchmark{}
+	if len(profiles) > 0 {
+		b.profile = profiles[0]
+	}
+	if *mysqldump && (b.profile == nil || b.profile.isFiles()) {
+		return fmt.Errorf("-mysqldump needs a database profile")
+	}
+	var buf bytes.Buffer
+	err = writeSyntheticDump(&buf, size)
+	if err != nil {
+		return err
+	}
+	b.data = buf.Bytes()
+	fmt.Fprintf(stdout, tr("benchmark with %s of synthetic data\n"), formatBytes(int64(len(b.data))))
+	err = b.benchDump(*mysqldump)
+	if err != nil {
+		return err
+	}
+	if *mysqldump {
+		fmt.Fprintf(stdout, tr("  dump (mysqldump of %s): %s\n"), b.profile.Name, formatRate(b.dump.rate()))
+	} else {
+		fmt.Fprintf(stdout, tr("  dump (disk write): %s\n"), formatRate(b.dump.rate()))
+	}
+	err = b.benchCompress()
+	if err != nil {
+		return err
+	}
+	for _, level := range benchLevels {
+		fmt.Fprintf(stdout, tr("  compression level %d: %s, %.0f%% of the original size\n"),
+			level, formatRate(b.compress[level].rate()), b.ratio[level]*100)
+	}
+	fmt.Fprintf(stdout, tr("  encryption: %s\n"), formatRate(b.encrypt.rate()))
+	// Part sizes and concurrency are of uploads to S3.
+	if !*noUpload && b.profile != nil && b.profile.usesS3API() {
+		err = b.benchUpload(size)
+		if err != nil {
+			return err
+		}
+	}
+	// Size the recommendation by the latest dump of the profile if there
+	// is one.
+	dumpSize := size
+	if b.profile != nil {
+		entries, err := catalog.Entries()
+		if err != nil {
+			return err
+		}
+		if e := latestEntry(entries, b.profile.Name); e != nil && e.Size > 0 {
+			dumpSize = e.Size
+		}
+	}
+	b.recommend(stdout, dumpSize, *window)
+	return nil
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hangilc/myclinic-backup/internal/cfstream"
+)
+
+// A nightly dump loses the day's work if the server fails in the
+// afternoon. With binlog set, the binary logs the server writes after each
+// dump are shipped, encrypted, next to it as they are completed, and
+// restore -point-in-time replays them on top of the dump up to the moment
+// before the mistake or the failure. The dump has to record where its logs
+// begin, so binlog needs binlog_coordinates; the logs are read with
+// mysqlbinlog here, which needs the REPLICATION SLAVE privilege.
+
+// BinlogConfig ships the binary logs of the server in daemon mode.
+type BinlogConfig struct {
+	Schedule string `yaml:"schedule"`
+	// MaxLogs and MaxDays bound the chain of logs following a dump, which
+	// a point-in-time restore replays: once it has more logs, or the dump
+	// is older, shipping takes a full backup, which starts a new chain.
+	MaxLogs int `yaml:"max_logs"`
+	MaxDays int `yaml:"max_days"`
+}
+
+const kindBinlog = "binlog"
+
+// pointInTimeLayout is the format of restore -point-in-time, as mysqlbinlog
+// takes it.
+const pointInTimeLayout = "2006-01-02 15:04:05"
+
+func (p *Profile) validateBinlog() error {
+	switch {
+	case p.isFiles():
+		return fmt.Errorf("binlog needs a database")
+	case p.isMultiDatabase():
+		return fmt.Errorf("binlog needs a single database")
+	case !p.BinlogCoordinates:
+		return fmt.Errorf("binlog needs binlog_coordinates, which tell where the logs following a dump begin")
+	case p.DockerContainer != "" || p.Kubernetes != nil || p.SSH != nil:
+		return fmt.Errorf("binlog reads the logs with mysqlbinlog here, which docker_container, kubernetes and ssh do not allow")
+	}
+	if p.Binlog.Schedule != "" {
+		_, err := parseSchedule(p.Binlog.Schedule)
+		if err != nil {
+			return err
+		}
+	}
+	if p.Binlog.MaxLogs < 0 || p.Binlog.MaxDays < 0 {
+		return fmt.Errorf("binlog: max_logs and max_days must not be negative")
+	}
+	return nil
+}
+
+// latestWithCoordinates returns the latest uploaded dump of the profile
+// which recorded its binlog coordinates, taken no later than until unless
+// until is zero.
+func latestWithCoordinates(p *Profile, until time.Time) (*CatalogEntry, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var latest *CatalogEntry
+	for _, e := range catalogBackups(entries, p, dateRange{}) {
+		if e.S3Key != "" && e.Binlog != nil && (until.IsZero() || !e.Time.After(until)) {
+			latest = e
+		}
+	}
+	if latest == nil && !until.IsZero() {
+		return nil, fmt.Errorf("no uploaded backup of profile %s with binlog coordinates was taken before %s",
+			p.Name, until.Format(pointInTimeLayout))
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no uploaded backup of profile %s in catalog has binlog coordinates", p.Name)
+	}
+	return latest, nil
+}
+
+// shippedBinlogs returns the binary logs shipped after the dump, in the
+// order of their numbers.
+func shippedBinlogs(full *CatalogEntry) ([]*CatalogEntry, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var logs []*CatalogEntry
+	for _, e := range entries {
+		if e.Profile == full.Profile && e.Kind == kindBinlog && e.RunID == full.RunID {
+			logs = append(logs, e)
+		}
+	}
+	// By number, as mysql-bin.1000000 follows mysql-bin.999999.
+	sort.Slice(logs, func(i, j int) bool {
+		a, aerr := binlogSequence(logs[i].Name)
+		b, berr := binlogSequence(logs[j].Name)
+		if aerr != nil || berr != nil {
+			return logs[i].Name < logs[j].Name
+		}
+		return a < b
+	})
+	return logs, nil
+}
+
+// binlogSequence returns the number ending the name of a binary log, such
+// as 123 of mysql-bin.000123.
+func binlogSequence(name string) (int, error) {
+	n, err := strconv.Atoi(name[strings.LastIndex(name, ".")+1:])
+	if err != nil {
+		return 0, fmt.Errorf("not the name of a binary log: %s", name)
+	}
+	return n, nil
+}
+
+// serverBinlogs flushes the binary log, so that the events up to now are in
+// completed logs, and returns the completed logs on the server.
+func serverBinlogs(p *Profile) ([]string, error) {
+	err := mysqlExecute(p, "FLUSH BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+	out, err := mysqlQuery(p, "SHOW BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			names = append(names, fields[0])
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("the server has no binary logs")
+	}
+	// The last one is still being written.
+	return names[:len(names)-1], nil
+}
+
+// binlogDir returns the directory next to the dump taken at t which the
+// binary logs following it are kept in.
+func (p *Profile) binlogDir(t time.Time) string {
+	return filepath.Join(p.EncryptedDir, dirPart(t), "binlog-"+t.Format("200601021504"))
+}
+
+// binlogFilePath returns the encrypted file of the binary log shipped
+// after the dump.
+func (p *Profile) binlogFilePath(full *CatalogEntry, name string) string {
+	return filepath.Join(p.binlogDir(full.Time), name+".cf")
+}
+
+// binlogObjectName returns the key of the binary log without opaque_names:
+// the directory of the file under the month of the dump.
+func (p *Profile) binlogObjectName(path string) string {
+	return createS3Key(p.s3KeyPrefix(), filepath.Dir(path)) + "/" + filepath.Base(path)
+}
+
+// shipBinlogs ships the completed binary logs following the latest dump
+// which are not shipped yet, and returns how many it shipped. The logs up to
+// the one the latest dump starts in are first shipped with the dump before
+// it, so that its chain is not left short of the events between its last
+// shipped log and the new dump.
+func shipBinlogs(config *Config, p *Profile, prefix string) (int, error) {
+	full, err := latestWithCoordinates(p, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	prev, err := previousWithCoordinates(p, full)
+	if err != nil {
+		return 0, err
+	}
+	names, err := serverBinlogs(p)
+	if err != nil {
+		return 0, err
+	}
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	work, err := createWorkDir(config.workBase(p), "binlog-"+full.RunID)
+	if err != nil {
+		return 0, err
+	}
+	defer removeWorkDir(work)
+	n := 0
+	if prev != nil {
+		last, err := binlogSequence(full.Binlog.File)
+		if err != nil {
+			return 0, err
+		}
+		shipped, err := shipChain(p, prev, names, last, key, work, prefix)
+		n += shipped
+		if err != nil {
+			// The new chain does not depend on the old one.
+			fmt.Fprintf(stderr, tr("%swarning: the chain following the backup taken %s is not complete: %v\n"),
+				prefix, prev.Time.Format("2006-01-02 15:04"), err)
+		}
+	}
+	shipped, err := shipChain(p, full, names, -1, key, work, prefix)
+	return n + shipped, err
+}
+
+// previousWithCoordinates returns the uploaded dump with binlog coordinates
+// taken before full, or nil if there is none.
+func previousWithCoordinates(p *Profile, full *CatalogEntry) (*CatalogEntry, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var prev *CatalogEntry
+	for _, e := range catalogBackups(entries, p, dateRange{}) {
+		if e.S3Key != "" && e.Binlog != nil && e.Time.Before(full.Time) {
+			prev = e
+		}
+	}
+	return prev, nil
+}
+
+// shipChain ships the logs of names following full, up to the one numbered
+// last unless last is negative, which are not shipped yet.
+func shipChain(p *Profile, full *CatalogEntry, names []string, last int, key []byte, work, prefix string) (int, error) {
+	shipped, err := shippedBinlogs(full)
+	if err != nil {
+		return 0, err
+	}
+	done := make(map[string]bool)
+	for _, e := range shipped {
+		done[e.Name] = true
+	}
+	start := -1
+	for i, name := range names {
+		if name == full.Binlog.File {
+			start = i
+		}
+	}
+	if start < 0 && !done[full.Binlog.File] {
+		return 0, fmt.Errorf("binary log %s, where the backup taken %s ends, is no longer on the server",
+			full.Binlog.File, full.Time.Format("2006-01-02 15:04"))
+	}
+	if start < 0 {
+		start = 0
+	}
+	n := 0
+	for _, name := range names[start:] {
+		if last >= 0 {
+			seq, err := binlogSequence(name)
+			if err != nil {
+				return n, err
+			}
+			if seq > last {
+				break
+			}
+		}
+		if done[name] {
+			continue
+		}
+		err := shipBinlog(p, full, name, key, work)
+		if err != nil {
+			return n, fmt.Errorf("binary log %s: %v", name, err)
+		}
+		fmt.Fprintf(stdout, tr("%sshipped binary log %s\n"), prefix, name)
+		n++
+	}
+	return n, nil
+}
+
+// shipBinlog reads the binary log from the server, encrypts it and stores
+// it with the dump it follows.
+func shipBinlog(p *Profile, full *CatalogEntry, name string, key []byte, work string) error {
+	cmd := p.credentialCommand("mysqlbinlog", "--read-from-remote-server", "--raw",
+		"--result-file="+work+string(filepath.Separator), name)
+	var errOut strings.Builder
+	cmd.Stderr = &errOut
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("mysqlbinlog failed: %w: %s", err, redact(strings.TrimSpace(errOut.String())))
+	}
+	raw := filepath.Join(work, name)
+	defer os.Remove(raw)
+	sum, size, err := hashFile(raw)
+	if err != nil {
+		return err
+	}
+	path := p.binlogFilePath(full, name)
+	tmp := filepath.Join(work, filepath.Base(path))
+	err = encryptFile(key, raw, tmp)
+	if err == nil {
+		err = moveIntoPlace(tmp, path)
+	}
+	if err != nil {
+		return err
+	}
+	encSum, encSize, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	s3Key, err := p.objectKey(p.binlogObjectName(path))
+	if err != nil {
+		return err
+	}
+	storage, err := p.storage()
+	if err != nil {
+		return err
+	}
+	err = storage.Put(s3Key, path)
+	if err != nil {
+		return fmt.Errorf("failed to upload to %s: %v", p.targetName(), err)
+	}
+	objectName := ""
+	if p.OpaqueNames {
+		objectName = p.binlogObjectName(path)
+	}
+	return catalog.Add(&CatalogEntry{
+		RunID:           full.RunID,
+		Profile:         p.Name,
+		Kind:            kindBinlog,
+		Name:            name,
+		Time:            time.Now(),
+		EncryptedFile:   path,
+		S3Bucket:        p.storageBucket(),
+		S3Key:           s3Key,
+		Target:          p.targetURL(),
+		ObjectName:      objectName,
+		Size:            size,
+		SHA256:          sum,
+		EncryptedSize:   encSize,
+		EncryptedSHA256: encSum,
+		CryptoMode:      cryptoMode(),
+		KeyFingerprint:  keyFingerprint(key),
+		Compression:     transfer.compressor.Name(),
+		Instance:        instanceID,
+	})
+}
+
+// encryptFile compresses and encrypts src into dst.
+func encryptFile(key []byte, src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, _, err = encryptTo(key, in, dst)
+	return err
+}
+
+// fetchBinlogs decrypts the binary logs shipped after the dump into dir
+// and returns their files in order. The logs have to follow on from the
+// dump without a gap.
+func fetchBinlogs(p *Profile, full *CatalogEntry, local bool, dir string) ([]string, time.Time, error) {
+	logs, err := shippedBinlogs(full)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(logs) == 0 || logs[0].Name != full.Binlog.File {
+		return nil, time.Time{}, fmt.Errorf("binary log %s, where the backup taken %s ends, was not shipped",
+			full.Binlog.File, full.Time.Format("2006-01-02 15:04"))
+	}
+	var files []string
+	var last time.Time
+	prev := -1
+	for _, e := range logs {
+		seq, err := binlogSequence(e.Name)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if prev >= 0 && seq != prev+1 {
+			return nil, time.Time{}, fmt.Errorf("binary logs are missing before %s", e.Name)
+		}
+		prev = seq
+		src := e
+		if local {
+			src, err = localCopy(e)
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("binary log %s: %v", e.Name, err)
+			}
+		}
+		file := filepath.Join(dir, e.Name)
+		err = fetchBinlog(p, src, file)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("binary log %s: %v", e.Name, err)
+		}
+		files = append(files, file)
+		if e.Time.After(last) {
+			last = e.Time
+		}
+	}
+	return files, last, nil
+}
+
+// fetchBinlog decrypts the shipped binary log into file and checks it
+// against the catalog.
+func fetchBinlog(p *Profile, e *CatalogEntry, file string) error {
+	plain, _, err := openBackupStream(p, e, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), plain)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if errors.Is(err, cfstream.ErrAuth) {
+		return fmt.Errorf("failed authentication (wrong key or corrupted)")
+	}
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != e.SHA256 {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", e.SHA256, sum)
+	}
+	return nil
+}
+
+// replayBinlogs applies the binary logs shipped after the dump, restored
+// into db, to the events before until.
+func replayBinlogs(p *Profile, full *CatalogEntry, db string, until time.Time, local bool, log io.Writer) error {
+	dir, err := ioutil.TempDir("", "myclinic-backup-binlog-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	files, last, err := fetchBinlogs(p, full, local, dir)
+	if err != nil {
+		return err
+	}
+	if last.Before(until) {
+		fmt.Fprintf(log, tr("warning: the binary logs were last shipped %s; changes after that are not restored\n"),
+			last.Format(pointInTimeLayout))
+	}
+	fmt.Fprintf(log, tr("replaying %d binary log(s) up to %s\n"), len(files), until.Format(pointInTimeLayout))
+	// --database filters by the name --rewrite-db gives.
+	args := []string{"--skip-gtids", "--start-position=" + strconv.FormatInt(full.Binlog.Position, 10),
+		"--stop-datetime=" + until.Format(pointInTimeLayout), "--database=" + db}
+	if db != p.Database {
+		args = append(args, "--rewrite-db="+p.Database+"->"+db)
+	}
+	cmd := exec.Command("mysqlbinlog", append(args, files...)...)
+	var errOut strings.Builder
+	cmd.Stderr = &errOut
+	events, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("mysqlbinlog failed: %v", err)
+	}
+	err = mysqlLoad(p, "", events)
+	if err != nil {
+		// mysqlbinlog would block writing what is no longer read.
+		events.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("mysqlbinlog failed: %w: %s", err, strings.TrimSpace(errOut.String()))
+	}
+	return nil
+}
+
+// rebaseReason tells why a full backup should end the chain of binary logs
+// following the dump, or returns "" while the chain is within max_logs and
+// max_days.
+func (p *Profile) rebaseReason(full *CatalogEntry, now time.Time) (string, error) {
+	taken := full.Time.Local().Format("2006-01-02 15:04")
+	if p.Binlog.MaxDays > 0 && now.Sub(full.Time) > time.Duration(p.Binlog.MaxDays)*24*time.Hour {
+		return trf("the backup taken %s is older than max_days of %d", taken, p.Binlog.MaxDays), nil
+	}
+	if p.Binlog.MaxLogs > 0 {
+		logs, err := shippedBinlogs(full)
+		if err != nil {
+			return "", err
+		}
+		if len(logs) > p.Binlog.MaxLogs {
+			return trf("%d binary logs follow the backup taken %s, more than max_logs of %d",
+				len(logs), taken, p.Binlog.MaxLogs), nil
+		}
+	}
+	return "", nil
+}
+
+// rebaseChain takes a full backup when the chain of binary logs following
+// the latest dump has grown past max_logs or max_days, keeping the time a
+// point-in-time restore takes bounded. The logs shipped next start the
+// new chain.
+func rebaseChain(config *Config, p *Profile, prefix string, opts runOptions) error {
+	full, err := latestWithCoordinates(p, time.Time{})
+	if err != nil {
+		return err
+	}
+	reason, err := p.rebaseReason(full, opts.now)
+	if err != nil || reason == "" {
+		return err
+	}
+	fmt.Fprintf(stdout, prefix+tr("%s; taking a full backup to start a new chain\n"), reason)
+	opts.trigger = triggerRebase
+	result := runProfile(config, p, opts)
+	if !result.Success {
+		return fmt.Errorf("full backup failed: %s", result.Error)
+	}
+	return nil
+}
+
+func shipBinlogsCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("ship-binlogs", flag.ExitOnError)
+	flags.Parse(args)
+	failed := false
+	shipping := false
+	for _, p := range profiles {
+		if p.Binlog == nil {
+			continue
+		}
+		shipping = true
+		prefix := ""
+		if len(profiles) > 1 {
+			prefix = "[" + p.Name + "] "
+		}
+		n, err := shipBinlogs(config, p, prefix)
+		if err != nil {
+			fmt.Fprintf(stderr, tr("%sshipping binary logs: %v\n"), prefix, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(stdout, tr("%s%d binary log(s) shipped\n"), prefix, n)
+		err = rebaseChain(config, p, prefix, runOptions{now: time.Now(), labelled: len(profiles) > 1})
+		if err != nil {
+			fmt.Fprintf(stderr, tr("%sstarting a new chain of binary logs: %v\n"), prefix, err)
+			failed = true
+		}
+	}
+	if !shipping {
+		return fmt.Errorf("no profile has binlog set")
+	}
+	if failed {
+		return fmt.Errorf("shipping binary logs failed")
+	}
+	return nil
+}
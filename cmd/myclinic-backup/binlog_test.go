@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRebaseReason(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer withCatalog(dir)()
+	now := time.Date(2020, 1, 10, 3, 0, 0, 0, time.UTC)
+	full := &CatalogEntry{Profile: "myclinic", RunID: "full", Time: now.AddDate(0, 0, -3),
+		Binlog: &BinlogCoordinates{File: "mysql-bin.000001"}}
+	if err := catalog.Add(full); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mysql-bin.000001", "mysql-bin.000002", "mysql-bin.000003"} {
+		err := catalog.Add(&CatalogEntry{Profile: "myclinic", RunID: "full", Kind: kindBinlog, Name: name, Time: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		maxLogs, maxDays int
+		want             string
+	}{
+		{0, 0, ""},
+		{3, 0, ""},
+		{2, 0, "more than max_logs of 2"},
+		{0, 3, ""},
+		{0, 2, "older than max_days of 2"},
+		{3, 2, "older than max_days of 2"},
+	} {
+		p := &Profile{Name: "myclinic", Binlog: &BinlogConfig{MaxLogs: tc.maxLogs, MaxDays: tc.maxDays}}
+		reason, err := p.rebaseReason(full, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want == "" && reason != "" || !strings.Contains(reason, tc.want) {
+			t.Errorf("max_logs %d, max_days %d: reason %q, want %q", tc.maxLogs, tc.maxDays, reason, tc.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CalendarConfig fits the backups of a profile to the days the clinic is
+// open: on closed days the regular schedule is replaced by closed_schedule,
+// and on the last day of the month the clinic is open a labeled month-end
+// backup is taken, which keep_labeled keeps on disk.
+type CalendarConfig struct {
+	// Holidays closes the clinic on the national holidays of Japan.
+	Holidays bool `yaml:"holidays"`
+	// ClosedWeekdays are the weekdays the clinic is closed, e.g. [sun, thu].
+	ClosedWeekdays []string `yaml:"closed_weekdays"`
+	// ClosedDates are further closing days, either on a date, e.g.
+	// 2020-08-14, or every year, e.g. 12-30.
+	ClosedDates []string `yaml:"closed_dates"`
+	// ClosedSchedule is the schedule of backups on closed days; without it
+	// none are taken on closed days.
+	ClosedSchedule string `yaml:"closed_schedule"`
+	// MonthEnd is when the month-end backup is taken on the last business
+	// day of the month, e.g. "0 19 * * *". It replaces a regular backup
+	// due at the same minute.
+	MonthEnd string `yaml:"month_end"`
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// calendar is a parsed CalendarConfig.
+type calendar struct {
+	holidays       bool
+	closedWeekdays map[time.Weekday]bool
+	// closedDates holds dates as 2006-01-02 and yearly ones as 01-02.
+	closedDates    map[string]bool
+	closedSchedule *Schedule
+	monthEnd       *Schedule
+}
+
+func newCalendar(c *CalendarConfig) (*calendar, error) {
+	cal := &calendar{
+		holidays:       c.Holidays,
+		closedWeekdays: make(map[time.Weekday]bool),
+		closedDates:    make(map[string]bool),
+	}
+	for _, name := range c.ClosedWeekdays {
+		found := false
+		for i, w := range weekdayNames {
+			if strings.EqualFold(name, w) || strings.EqualFold(name, time.Weekday(i).String()) {
+				cal.closedWeekdays[time.Weekday(i)] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("closed_weekdays: unknown weekday %s", name)
+		}
+	}
+	for _, date := range c.ClosedDates {
+		_, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			_, err = time.Parse("01-02", date)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("closed_dates: invalid date %s (2020-08-14, or 12-30 for every year)", date)
+		}
+		cal.closedDates[date] = true
+	}
+	var err error
+	if c.ClosedSchedule != "" {
+		cal.closedSchedule, err = parseSchedule(c.ClosedSchedule)
+		if err != nil {
+			return nil, fmt.Errorf("closed_schedule: %v", err)
+		}
+	}
+	if c.MonthEnd != "" {
+		cal.monthEnd, err = parseSchedule(c.MonthEnd)
+		if err != nil {
+			return nil, fmt.Errorf("month_end: %v", err)
+		}
+	}
+	return cal, nil
+}
+
+// closed returns why the clinic is closed on the day of t, or "" if it is
+// open.
+func (c *calendar) closed(t time.Time) string {
+	if c.closedWeekdays[t.Weekday()] {
+		return tr("closed weekday")
+	}
+	if c.closedDates[t.Format("2006-01-02")] || c.closedDates[t.Format("01-02")] {
+		return tr("closing day")
+	}
+	if c.holidays {
+		if name := japaneseHoliday(t); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// lastBusinessDay reports whether the day of t is the last day of its
+// month the clinic is open.
+func (c *calendar) lastBusinessDay(t time.Time) bool {
+	if c.closed(t) != "" {
+		return false
+	}
+	for d := t.AddDate(0, 0, 1); d.Month() == t.Month(); d = d.AddDate(0, 0, 1) {
+		if c.closed(d) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// isMonthEnd reports whether the month-end backup is due at t.
+func (c *calendar) isMonthEnd(t time.Time) bool {
+	return c.monthEnd != nil && c.monthEnd.Match(t) && c.lastBusinessDay(t)
+}
+
+func monthEndLabel(t time.Time) string {
+	return "month-end-" + t.Format("2006-01")
+}
+
+// calendarSchedule fires the regular backups of a profile with a calendar.
+type calendarSchedule struct {
+	cal      *calendar
+	schedule *Schedule
+}
+
+func (s *calendarSchedule) Match(t time.Time) bool {
+	if s.cal.isMonthEnd(t) {
+		return false
+	}
+	if s.cal.closed(t) != "" {
+		return s.cal.closedSchedule != nil && s.cal.closedSchedule.Match(t)
+	}
+	return s.schedule.Match(t)
+}
+
+// monthEndSchedule fires the month-end backup of a profile.
+type monthEndSchedule struct {
+	cal *calendar
+}
+
+func (s *monthEndSchedule) Match(t time.Time) bool {
+	return s.cal.isMonthEnd(t)
+}
+
+// calendarCommand prints the coming days as the calendars of the selected
+// profiles see them, to check the configuration.
+func calendarCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("calendar", flag.ExitOnError)
+	from := flags.String("from", "", "first day to print, e.g. 2020-12-01 (default today)")
+	days := flags.Int("days", 31, "number of days to print")
+	flags.Parse(args)
+	start := time.Now()
+	if *from != "" {
+		var err error
+		start, err = time.ParseInLocation("2006-01-02", *from, time.Local)
+		if err != nil {
+			return fmt.Errorf("-from: %v", err)
+		}
+	}
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.Local)
+	for _, p := range profiles {
+		if p.Calendar == nil {
+			fmt.Fprintf(stdout, tr("%s: no calendar configured\n"), p.Name)
+			continue
+		}
+		cal, err := newCalendar(p.Calendar)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s:\n", p.Name)
+		for i := 0; i < *days; i++ {
+			d := start.AddDate(0, 0, i)
+			status := tr("open")
+			if reason := cal.closed(d); reason != "" {
+				status = trf("closed (%s)", reason)
+			}
+			if cal.monthEnd != nil && cal.lastBusinessDay(d) {
+				status += tr(", month-end backup ") + monthEndLabel(d)
+			}
+			fmt.Fprintf(stdout, "  %s (%s)  %s\n", d.Format("2006-01-02"), tr(d.Format("Mon")), status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewCalendarErrors(t *testing.T) {
+	for _, c := range []*CalendarConfig{
+		{ClosedWeekdays: []string{"sunday", "xyz"}},
+		{ClosedDates: []string{"2020-13-01"}},
+		{ClosedDates: []string{"12/30"}},
+		{ClosedSchedule: "0 12 * *"},
+		{MonthEnd: "0 25 * * *"},
+	} {
+		if _, err := newCalendar(c); err == nil {
+			t.Errorf("newCalendar(%+v) succeeded", c)
+		}
+	}
+}
+
+// testCalendar is a clinic closed on Sundays, Thursdays and holidays, from
+// December 29 to 31, and on August 14, 2020.
+func testCalendar(t *testing.T) *calendar {
+	t.Helper()
+	cal, err := newCalendar(&CalendarConfig{
+		Holidays:       true,
+		ClosedWeekdays: []string{"Sunday", "thu"},
+		ClosedDates:    []string{"12-29", "12-30", "12-31", "2020-08-14"},
+		ClosedSchedule: "0 12 * * *",
+		MonthEnd:       "0 19 * * *",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cal
+}
+
+func TestCalendarClosed(t *testing.T) {
+	cal := testCalendar(t)
+	for _, tc := range []struct {
+		date   string
+		closed bool
+	}{
+		{"2020-08-13", true},
+		{"2020-08-14", true},
+		{"2021-08-13", false},
+		{"2020-08-16", true},
+		{"2020-08-17", false},
+		{"2020-12-29", true},
+		{"2021-12-29", true},
+		{"2020-12-28", false},
+		{"2020-02-24", true},
+		{"2020-10-12", false},
+	} {
+		day, err := time.ParseInLocation("2006-01-02", tc.date, jst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cal.closed(day); (got != "") != tc.closed {
+			t.Errorf("closed(%s) = %q, want closed %v", tc.date, got, tc.closed)
+		}
+	}
+}
+
+func mustParseSchedule(t *testing.T, spec string) *Schedule {
+	t.Helper()
+	s, err := parseSchedule(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCalendarMonthEnd(t *testing.T) {
+	cal := testCalendar(t)
+	regular := &calendarSchedule{cal: cal, schedule: mustParseSchedule(t, "0 19 * * *")}
+	monthEnd := &monthEndSchedule{cal: cal}
+	for _, tc := range []struct {
+		time     string
+		last     bool
+		regular  bool
+		monthEnd bool
+	}{
+		// Closed from Tuesday December 29 to Thursday December 31.
+		{"2020-12-28 19:00", true, false, true},
+		{"2020-12-28 18:00", true, false, false},
+		{"2020-12-29 19:00", false, false, false},
+		{"2020-12-29 12:00", false, true, false},
+		{"2020-12-31 12:00", false, true, false},
+		// Leap years.
+		{"2020-02-29 19:00", true, false, true},
+		{"2020-02-28 19:00", false, true, false},
+		{"2021-02-27 19:00", true, false, true},
+		{"2021-02-28 19:00", false, false, false},
+		// Open on the last day.
+		{"2020-10-31 19:00", true, false, true},
+		{"2020-10-30 19:00", false, true, false},
+		// April 29, 2020 is 昭和の日, and April 30 a Thursday.
+		{"2020-04-29 19:00", false, false, false},
+		{"2020-04-28 19:00", true, false, true},
+	} {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", tc.time, jst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cal.lastBusinessDay(tm); got != tc.last {
+			t.Errorf("lastBusinessDay(%s) = %v", tc.time, got)
+		}
+		if got := regular.Match(tm); got != tc.regular {
+			t.Errorf("regular backup at %s = %v", tc.time, got)
+		}
+		if got := monthEnd.Match(tm); got != tc.monthEnd {
+			t.Errorf("month-end backup at %s = %v", tc.time, got)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CatalogEntry records one completed backup.
+type CatalogEntry struct {
+	RunID   string `json:"run_id"`
+	Profile string `json:"profile"`
+	// Kind is empty for database dumps, "grants" for the accounts and
+	// grants stored along with a dump, "binlog" for the binary logs
+	// following a dump, named Name, and "put" for artifacts stored with
+	// the put command under Name.
+	Kind          string    `json:"kind,omitempty"`
+	Name          string    `json:"name,omitempty"`
+	Time          time.Time `json:"time"`
+	BackupFile    string    `json:"backup_file"`
+	EncryptedFile string    `json:"encrypted_file"`
+	S3Bucket      string    `json:"s3_bucket"`
+	S3Key         string    `json:"s3_key"`
+	// Target is the storage the object is in, such as
+	// sftp://backup@nas/backups, if it is not S3; see storage.go.
+	Target string `json:"target,omitempty"`
+	// ObjectName is the key the object would have without opaque_names,
+	// if it is stored under an opaque name.
+	ObjectName string `json:"object_name,omitempty"`
+	// Size and SHA256 are of the plain SQL dump or artifact.
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256"`
+	EncryptedSize int64  `json:"encrypted_size"`
+	// EncryptedSHA256 is of the encrypted file as uploaded.
+	EncryptedSHA256 string `json:"encrypted_sha256,omitempty"`
+	// Label and Note are given with backup -label and -note, to mark a
+	// deliberate snapshot such as one taken before an upgrade.
+	Label string `json:"label,omitempty"`
+	Note  string `json:"note,omitempty"`
+	// Trigger tells how the run was started, e.g. schedule or
+	// pre-upgrade.
+	Trigger string `json:"trigger,omitempty"`
+	// CryptoMode is fips if the backup was made in FIPS mode, and
+	// standard otherwise.
+	CryptoMode string `json:"crypto_mode,omitempty"`
+	// KeyFingerprint identifies the key the backup was encrypted with;
+	// see keyFingerprint.
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+	// Compression is the compressor of the content, zlib if empty; see
+	// compressor.go.
+	Compression string `json:"compression,omitempty"`
+	// Instance is the installation which made the backup; see
+	// instanceID.
+	Instance string `json:"instance,omitempty"`
+	// Binlog is the position of the source server at the time of the
+	// dump, if binlog_coordinates is set.
+	Binlog *BinlogCoordinates `json:"binlog,omitempty"`
+	// Verifications lists the checks done on the stored backup.
+	Verifications []*Verification `json:"verifications,omitempty"`
+	// Hold, if set, exempts the backup from pruning.
+	Hold *Hold `json:"hold,omitempty"`
+}
+
+// isDump reports whether the entry is a database dump, which can be
+// restored and verified.
+func (e *CatalogEntry) isDump() bool {
+	return e.Kind == ""
+}
+
+// Catalog is the list of completed backups kept in the state directory,
+// or with catalog_s3 in S3.
+type Catalog struct {
+	path   string
+	remote *s3Catalog
+	mu     sync.Mutex
+}
+
+var catalog *Catalog
+
+func newCatalog(path string) *Catalog {
+	return &Catalog{path: path}
+}
+
+// read returns the content of the catalog, nil if there is none yet, and
+// its version, which write checks.
+func (c *Catalog) read() ([]byte, string, error) {
+	if c.remote != nil {
+		return c.remote.read()
+	}
+	src, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	return src, "", err
+}
+
+// write stores src as the content of the catalog, or returns
+// errCatalogChanged if it is no longer of the version read.
+func (c *Catalog) write(src []byte, version string) error {
+	if c.remote != nil {
+		return c.remote.write(src, version)
+	}
+	return writeFileAtomic(c.path, src, 0600)
+}
+
+func (c *Catalog) name() string {
+	if c.remote != nil {
+		return "s3://" + c.remote.bucket + "/" + c.remote.key
+	}
+	return c.path
+}
+
+func (c *Catalog) load() ([]*CatalogEntry, string, error) {
+	src, version, err := c.read()
+	if err != nil || src == nil {
+		return nil, version, err
+	}
+	src, err = openMetadata(src)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", c.name(), err)
+	}
+	var entries []*CatalogEntry
+	err = json.Unmarshal(src, &entries)
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, version, nil
+}
+
+func (c *Catalog) save(entries []*CatalogEntry, version string) error {
+	src, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	src, err = sealMetadata(src)
+	if err != nil {
+		return err
+	}
+	return c.write(src, version)
+}
+
+// Entries returns all recorded backups, oldest first.
+func (c *Catalog) Entries() ([]*CatalogEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, _, err := c.load()
+	return entries, err
+}
+
+// Changes to the catalog read, modify and write the whole file, so two
+// processes changing it at once, such as the daemon and a hold given by
+// hand, or runs on several hosts sharing state_dir on a network drive,
+// would lose the entries of one of them. They are made under a lock file
+// next to the catalog, created exclusively, which the file systems of
+// network drives honor too. The holder touches the lock while it holds it,
+// and a lock left by a process killed while holding it is taken over once
+// it has not been touched for catalogLockStale. The lock is taken over by
+// renaming it aside and checking that what was renamed is the stale lock,
+// so that of two processes taking over at once, one does not remove the
+// lock the other has just made. The lock file does not reach hosts which
+// share only the bucket; a catalog of catalog_s3 is written with
+// conditional requests instead.
+
+// catalogLockWait is how long a change waits for the lock held by another
+// process.
+const catalogLockWait = 2 * time.Minute
+
+// catalogLockStale is the age after which a lock is taken to be left
+// over. A held lock is touched every catalogLockStale/4.
+const catalogLockStale = 10 * time.Minute
+
+// lockFile takes the lock of the catalog file, returning the function
+// releasing it.
+func (c *Catalog) lockFile() (func(), error) {
+	path := c.path + ".lock"
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s %d %s %s\n", host, os.Getpid(), time.Now().Format(time.RFC3339), newRunID())
+	deadline := time.Now().Add(catalogLockWait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = f.WriteString(owner)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return holdLockFile(path, owner), nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		held, rerr := ioutil.ReadFile(path)
+		info, serr := os.Stat(path)
+		if rerr == nil && serr == nil && time.Since(info.ModTime()) > catalogLockStale {
+			if takeOverLockFile(path, string(held)) {
+				fmt.Fprintf(stderr, tr("removed stale catalog lock %s (%s)\n"), path, strings.TrimSpace(string(held)))
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			held, _ := ioutil.ReadFile(path)
+			return nil, fmt.Errorf("catalog is locked by %s (%s)", strings.TrimSpace(string(held)), path)
+		}
+		time.Sleep(time.Duration(50+rand.Intn(100)) * time.Millisecond)
+	}
+}
+
+// holdLockFile touches the lock at path, made by owner, until the
+// returned function is called, or the process is interrupted, which
+// removes it if it is still owner's.
+func holdLockFile(path string, owner string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(catalogLockStale / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				os.Chtimes(path, now, now)
+			}
+		}
+	}()
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			held, err := ioutil.ReadFile(path)
+			if err == nil && string(held) == owner {
+				os.Remove(path)
+			}
+		})
+	}
+	remove := onInterrupt(release)
+	return func() {
+		remove()
+		release()
+	}
+}
+
+// takeOverLockFile removes the stale lock at path holding held, reporting
+// whether it did. The lock is renamed aside first; if what was renamed is
+// not the stale lock but one made since by another process, it is put
+// back. If that fails, as a third process has made a lock meanwhile, the
+// lock renamed aside is left where it is rather than removed, as its
+// owner may still be writing the catalog.
+func takeOverLockFile(path string, held string) bool {
+	aside := path + "." + newRunID()
+	if os.Rename(path, aside) != nil {
+		return false
+	}
+	moved, err := ioutil.ReadFile(aside)
+	if err == nil && string(moved) == held {
+		os.Remove(aside)
+		return true
+	}
+	if os.Link(aside, path) == nil {
+		os.Remove(aside)
+	}
+	return false
+}
+
+// Add records a completed backup.
+func (c *Catalog) Add(entry *CatalogEntry) error {
+	return c.Update(func(entries []*CatalogEntry) ([]*CatalogEntry, error) {
+		return append(entries, entry), nil
+	})
+}
+
+// View calls f with the entries while holding the lock of the catalog, so
+// that no change is made meanwhile by the processes sharing state_dir.
+func (c *Catalog) View(f func(entries []*CatalogEntry) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	unlock, err := c.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, _, err := c.load()
+	if err != nil {
+		return err
+	}
+	return f(entries)
+}
+
+// Update lets f modify the entries and saves them if f succeeds. If
+// another host changes a catalog of catalog_s3 meanwhile, f is called
+// again on the entries it wrote.
+func (c *Catalog) Update(f func(entries []*CatalogEntry) ([]*CatalogEntry, error)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	unlock, err := c.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for attempt := 1; ; attempt++ {
+		entries, version, err := c.load()
+		if err != nil {
+			return err
+		}
+		entries, err = f(entries)
+		if err != nil {
+			return err
+		}
+		err = c.save(entries, version)
+		if err != errCatalogChanged {
+			return err
+		}
+		if attempt == catalogWriteAttempts {
+			return fmt.Errorf("%s: %v %d times", c.name(), err, attempt)
+		}
+		time.Sleep(time.Duration(50+rand.Intn(100)*attempt) * time.Millisecond)
+	}
+}
+
+// reseal rewrites the catalog encrypted, or plain if decrypt is set, if
+// it exists.
+func (c *Catalog) reseal(decrypt bool) error {
+	if c.remote == nil {
+		return resealFile(c.path, decrypt)
+	}
+	for attempt := 1; ; attempt++ {
+		src, version, err := c.read()
+		if err != nil || src == nil {
+			return err
+		}
+		src, err = openMetadata(src)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.name(), err)
+		}
+		if !decrypt {
+			src, err = sealMetadata(src)
+			if err != nil {
+				return err
+			}
+		}
+		err = c.write(src, version)
+		if err != errCatalogChanged || attempt == catalogWriteAttempts {
+			return err
+		}
+	}
+}
+
+// writeFileAtomic writes to a temporary file first and renames it, so that
+// a crash never leaves a truncated file behind. The temporary file has a
+// name of its own, so that two processes writing at once do not write
+// into the same one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// CatalogS3Config keeps the catalog as one object in S3 instead of in the
+// state directory, so that the hosts of a multi-host setup, such as a
+// controller and the standby taking over from it, share it. Each change
+// is written only if the object is still the one read, with If-Match on
+// its ETag, or If-None-Match: * if there was none; a change losing the
+// race is made again on what the other host wrote.
+type CatalogS3Config struct {
+	Region     string `yaml:"region"`
+	Bucket     string `yaml:"bucket"`
+	Key        string `yaml:"key"`
+	RoleARN    string `yaml:"role_arn"`
+	ExternalID string `yaml:"external_id"`
+}
+
+func (c *CatalogS3Config) validate() error {
+	if c.Region == "" || c.Bucket == "" || c.Key == "" {
+		return fmt.Errorf("catalog_s3: region, bucket and key are required")
+	}
+	return nil
+}
+
+// errCatalogChanged is returned by writes of the catalog which another
+// process has changed since it was read.
+var errCatalogChanged = errors.New("catalog changed since it was read")
+
+// catalogWriteAttempts is how many times a change is made before giving
+// up on a catalog which keeps changing under it.
+const catalogWriteAttempts = 10
+
+// s3Catalog is the catalog object of catalog_s3.
+type s3Catalog struct {
+	sess   *session.Session
+	bucket string
+	key    string
+}
+
+func newS3Catalog(c *CatalogS3Config) (*s3Catalog, error) {
+	sess, err := newAWSSession(c.Region, "", c.RoleARN, c.ExternalID, "catalog")
+	if err != nil {
+		return nil, fmt.Errorf("catalog_s3: cannot create AWS session: %v", err)
+	}
+	return &s3Catalog{sess: sess, bucket: c.Bucket, key: c.Key}, nil
+}
+
+// read returns the content of the catalog object and its ETag, or nil and
+// "" if there is none yet.
+func (r *s3Catalog) read() ([]byte, string, error) {
+	out, err := s3.New(r.sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+	})
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot read catalog s3://%s/%s: %v", r.bucket, r.key, err)
+	}
+	defer out.Body.Close()
+	src, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot read catalog s3://%s/%s: %v", r.bucket, r.key, err)
+	}
+	return src, aws.StringValue(out.ETag), nil
+}
+
+// write stores src as the catalog object if it is still the one with the
+// ETag etag, or still absent if etag is "", and returns errCatalogChanged
+// otherwise.
+func (r *s3Catalog) write(src []byte, etag string) error {
+	_, err := s3.New(r.sess).PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+		Bucket:      aws.String(r.bucket),
+		Key:         aws.String(r.key),
+		Body:        bytes.NewReader(src),
+		ContentType: aws.String("application/octet-stream"),
+	}, func(req *request.Request) {
+		if etag == "" {
+			req.HTTPRequest.Header.Set("If-None-Match", "*")
+		} else {
+			req.HTTPRequest.Header.Set("If-Match", etag)
+		}
+	})
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		// S3 answers 409 to a conditional write racing another one.
+		switch rerr.StatusCode() {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return errCatalogChanged
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write catalog s3://%s/%s: %v", r.bucket, r.key, err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestCatalogLockFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	c := newCatalog(filepath.Join(dir, "catalog.json"))
+	path := c.path + ".lock"
+	stale := time.Now().Add(-2 * catalogLockStale)
+
+	// A stale lock is taken over.
+	err := ioutil.WriteFile(path, []byte("other 1 2019-12-31T15:04:00Z x\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, stale, stale)
+	unlock, err := c.lockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A lock which is not the stale one read is put back.
+	if takeOverLockFile(path, "other 1 2019-12-31T15:04:00Z x\n") {
+		t.Error("took over a lock made since the stale one")
+	}
+	if held, err := ioutil.ReadFile(path); err != nil || string(held) != string(mine) {
+		t.Errorf("lock after a failed takeover: %q, %v", held, err)
+	}
+
+	unlock()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock left after unlocking: %v", err)
+	}
+
+	// The lock of another process is not removed by unlocking.
+	unlock, err = c.lockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte("other\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if held, err := ioutil.ReadFile(path); err != nil || string(held) != "other\n" {
+		t.Errorf("lock of another process: %q, %v", held, err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("files left: %d", len(files))
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "state.json")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := writeFileAtomic(path, []byte(fmt.Sprintf("writer %d\n", i)), 0600); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("files left: %d", len(files))
+	}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var i int
+	if _, err := fmt.Sscanf(string(src), "writer %d\n", &i); err != nil {
+		t.Errorf("content: %q", src)
+	}
+}
+
+// fakeS3 serves objects from memory, honoring If-Match and If-None-Match
+// on PUT as S3 does.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func etagOf(src []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(src))
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[r.URL.Path]
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		w.Header().Set("ETag", etagOf(obj))
+		w.Write(obj)
+	case http.MethodPut:
+		if m := r.Header.Get("If-Match"); m != "" && (!ok || m != etagOf(obj)) ||
+			r.Header.Get("If-None-Match") == "*" && ok {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, "<Error><Code>PreconditionFailed</Code></Error>")
+			return
+		}
+		src, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Path] = src
+		w.Header().Set("ETag", etagOf(src))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCatalogS3(t *testing.T) {
+	srv := httptest.NewServer(&fakeS3{objects: make(map[string][]byte)})
+	defer srv.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("ap-northeast-1"),
+		Endpoint:         aws.String(srv.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two hosts share the catalog object but not their state directories.
+	var hosts []*Catalog
+	for i := 0; i < 2; i++ {
+		dir, cleanup := tempDir(t)
+		defer cleanup()
+		c := newCatalog(filepath.Join(dir, "catalog.json"))
+		c.remote = &s3Catalog{sess: sess, bucket: "backups", key: "catalog.json"}
+		hosts = append(hosts, c)
+	}
+	a, b := hosts[0], hosts[1]
+	entry := func(id string) *CatalogEntry {
+		return &CatalogEntry{RunID: id, Profile: "myclinic"}
+	}
+	if err := a.Add(entry("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// b adds an entry after a has read the catalog; a writes again on
+	// what b wrote rather than losing it.
+	calls := 0
+	err = a.Update(func(entries []*CatalogEntry) ([]*CatalogEntry, error) {
+		calls++
+		if calls == 1 {
+			if err := b.Add(entry("2")); err != nil {
+				return nil, err
+			}
+		}
+		return append(entries, entry("3")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("update made %d times, want 2", calls)
+	}
+	entries, err := b.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.RunID)
+	}
+	if fmt.Sprint(ids) != "[1 2 3]" {
+		t.Errorf("entries %v, want [1 2 3]", ids)
+	}
+
+	// A first write fails if another host has made the catalog since.
+	c := &s3Catalog{sess: sess, bucket: "backups", key: "other.json"}
+	if err := c.write([]byte("[]"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write([]byte("[]"), ""); err != errCatalogChanged {
+		t.Errorf("second creation: %v", err)
+	}
+}
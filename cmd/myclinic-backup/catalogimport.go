@@ -0,0 +1,236 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Backups taken before the catalog existed, by hand, or on a machine whose
+// state directory was lost are not in the catalog, so retention, restore
+// and the reports pass them by. catalog import finds them by their names,
+// dump-YYYYMMDDHHMM.sql (also compressed) in backup_dir,
+// dump-YYYYMMDDHHMM-sql.cf or encrypted_name in encrypted_dir and under the
+// prefix in the bucket, and records one entry per time taken, with the
+// checksums the files and the object metadata give. A plain dump is
+// recorded only along with its encrypted backup. Backups the catalog
+// already knows are left alone, so importing again is harmless.
+
+// importedBackup is a backup found by catalog import, by the time taken.
+type importedBackup struct {
+	entry *CatalogEntry
+	// plainGzip is set if the plain dump is compressed.
+	plainGzip bool
+}
+
+// knownBackups indexes what the catalog records of the profile.
+type knownBackups struct {
+	times map[time.Time]bool
+	paths map[string]bool
+}
+
+func newKnownBackups(entries []*CatalogEntry, p *Profile) *knownBackups {
+	k := &knownBackups{times: make(map[time.Time]bool), paths: make(map[string]bool)}
+	for _, e := range entries {
+		if e.Profile != p.Name || !e.isDump() {
+			continue
+		}
+		k.times[e.Time.Truncate(time.Minute).UTC()] = true
+		for _, path := range []string{e.BackupFile, e.EncryptedFile, entryLocation(e)} {
+			k.paths[path] = true
+		}
+	}
+	return k
+}
+
+func (k *knownBackups) has(t time.Time, path string) bool {
+	return k.times[t.UTC()] || k.paths[path]
+}
+
+// findImports looks for the backups of the profile which the catalog does
+// not record, locally and, unless localOnly, in the bucket.
+func findImports(p *Profile, known *knownBackups, localOnly bool) ([]*CatalogEntry, error) {
+	found := make(map[time.Time]*importedBackup)
+	backup := func(t time.Time) *importedBackup {
+		b := found[t.UTC()]
+		if b == nil {
+			b = &importedBackup{entry: &CatalogEntry{RunID: newRunID(), Profile: p.Name, Time: t,
+				Trigger: triggerImport}}
+			found[t.UTC()] = b
+		}
+		return b
+	}
+	dumps, err := listPlainDumps(p.BackupDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dumps {
+		path := strings.TrimSuffix(d.path, ".gz")
+		if known.has(d.time, path) {
+			continue
+		}
+		b := backup(d.time)
+		if b.entry.BackupFile != "" && !b.plainGzip {
+			// Both are there; the uncompressed one is checked.
+			continue
+		}
+		b.entry.BackupFile = path
+		b.plainGzip = path != d.path
+	}
+	err = filepath.Walk(p.EncryptedDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != p.EncryptedDir && (info.Name() == workDirName || info.Name() == kindPut) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		t, ok := p.encryptedBackupTime(info.Name())
+		if !ok || known.has(t, path) {
+			return nil
+		}
+		e := backup(t).entry
+		e.EncryptedFile = path
+		e.EncryptedSHA256, e.EncryptedSize, err = hashFile(path)
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !localOnly && p.hasStorage() {
+		l, err := listRemote(p, dateRange{})
+		if err != nil {
+			return nil, err
+		}
+		var svc *s3.S3
+		if p.usesS3API() {
+			sess, err := newS3Session(p)
+			if err != nil {
+				return nil, fmt.Errorf("cannot create AWS session: %v", err)
+			}
+			svc = s3.New(sess)
+		}
+		for _, o := range l.backups {
+			if known.has(o.Time, entryLocation(o)) {
+				continue
+			}
+			e := backup(o.Time).entry
+			e.S3Bucket, e.S3Key, e.Target = o.S3Bucket, o.S3Key, o.Target
+			if e.EncryptedFile == "" {
+				e.EncryptedSize = o.EncryptedSize
+			}
+			if svc == nil {
+				// Only S3 keeps metadata with the objects.
+				continue
+			}
+			head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(o.S3Bucket), Key: aws.String(o.S3Key)})
+			if err != nil {
+				return nil, fmt.Errorf("cannot read s3://%s/%s: %v", o.S3Bucket, o.S3Key, err)
+			}
+			for k, v := range head.Metadata {
+				switch strings.ToLower(k) {
+				case sha256MetadataKey:
+					if e.EncryptedSHA256 == "" {
+						e.EncryptedSHA256 = aws.StringValue(v)
+					}
+				case cryptoModeMetadataKey:
+					e.CryptoMode = aws.StringValue(v)
+				case compressionMetadataKey:
+					e.Compression = aws.StringValue(v)
+				case instanceMetadataKey:
+					e.Instance = aws.StringValue(v)
+				}
+			}
+		}
+	}
+	var entries []*CatalogEntry
+	for _, b := range found {
+		e := b.entry
+		if e.EncryptedFile == "" && e.S3Key == "" {
+			continue
+		}
+		if e.BackupFile != "" {
+			if b.plainGzip {
+				e.SHA256, err = gunzipSHA256(e.BackupFile + ".gz")
+			} else {
+				e.SHA256, e.Size, err = hashFile(e.BackupFile)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, nil
+}
+
+// importLocation tells where an imported backup was found.
+func importLocation(e *CatalogEntry) string {
+	var where []string
+	for _, path := range []string{e.BackupFile, e.EncryptedFile} {
+		if path != "" {
+			where = append(where, path)
+		}
+	}
+	if e.S3Key != "" {
+		where = append(where, entryLocation(e))
+	}
+	return strings.Join(where, ", ")
+}
+
+// catalogCommand maintains the catalog. Its only subcommand, import,
+// records the backups of the selected profiles which the catalog does not
+// know of.
+func catalogCommand(config *Config, profiles []*Profile, args []string) error {
+	usage := fmt.Errorf("usage: catalog import [-local]")
+	if len(args) == 0 || args[0] != "import" {
+		return usage
+	}
+	flags := flag.NewFlagSet("catalog import", flag.ExitOnError)
+	localOnly := flags.Bool("local", false, "looks only in the local directories, not in the buckets")
+	flags.Parse(args[1:])
+	if flags.NArg() > 0 {
+		return usage
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return err
+	}
+	var imports []*CatalogEntry
+	for _, p := range profiles {
+		found, err := findImports(p, newKnownBackups(entries, p), *localOnly)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p.Name, err)
+		}
+		imports = append(imports, found...)
+	}
+	if len(imports) == 0 {
+		fmt.Fprintf(stdout, tr("no backups missing from the catalog\n"))
+		return nil
+	}
+	format := tr("imported %s %s: %s\n")
+	if *dryRun {
+		format = tr("would import %s %s: %s\n")
+	} else {
+		err = catalog.Update(func(entries []*CatalogEntry) ([]*CatalogEntry, error) {
+			return append(entries, imports...), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range imports {
+		fmt.Fprintf(stdout, format, e.Profile, e.Time.Format("2006-01-02 15:04"), importLocation(e))
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Backups are named and cataloged by the time of the machine, so a clinic
+// PC whose clock has reset, such as after its CMOS battery died, takes
+// backups "from 2010" which sort as the oldest and are pruned first.
+// Before a new run, the clock is therefore compared with the Date S3
+// sends with every response, even one refusing the request, and with the
+// newest backup of the profile in the catalog, which the clock must not be
+// behind. What is done when it is off by more than max_clock_skew is up
+// to clock_check:
+//
+//	warn    logs a warning (default)
+//	adjust  also names and catalogs the backup by the time of S3
+//	fail    fails the run
+//	off     does not check
+//
+// Unless the run fails, plain dumps are not pruned by a clock found off,
+// whose idea of their age cannot be trusted. If S3 cannot be reached the
+// catalog alone is checked.
+
+// Values of clock_check.
+const (
+	clockWarn   = "warn"
+	clockAdjust = "adjust"
+	clockFail   = "fail"
+	clockOff    = "off"
+)
+
+// defaultMaxClockSkew is max_clock_skew if not set; S3 itself refuses
+// requests 15 minutes off.
+const defaultMaxClockSkew = 5 * time.Minute
+
+func validateClockCheck(mode string) error {
+	switch mode {
+	case "", clockWarn, clockAdjust, clockFail, clockOff:
+		return nil
+	}
+	return fmt.Errorf("clock_check must be %s, %s, %s or %s: %s", clockWarn, clockAdjust, clockFail, clockOff, mode)
+}
+
+func (c *Config) maxClockSkew() time.Duration {
+	if c.MaxClockSkew > 0 {
+		return c.MaxClockSkew
+	}
+	return defaultMaxClockSkew
+}
+
+// s3ClockSkew returns how far S3 is ahead of the local clock, which the
+// Date header tells to the second.
+func s3ClockSkew(p *Profile) (time.Duration, error) {
+	sess, err := newS3Session(p)
+	if err != nil {
+		return 0, err
+	}
+	req, _ := s3.New(sess).HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(p.S3Bucket)})
+	sent := time.Now()
+	// Write-only credentials, or a clock S3 finds too skewed, get an
+	// error, but with a Date all the same.
+	req.Send()
+	received := time.Now()
+	var header string
+	if req.HTTPResponse != nil {
+		header = req.HTTPResponse.Header.Get("Date")
+	}
+	if header == "" && req.Error != nil {
+		return 0, req.Error
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return 0, fmt.Errorf("no Date in response of S3")
+	}
+	local := sent.Add(received.Sub(sent) / 2)
+	return date.Sub(local), nil
+}
+
+// checkClock compares the clock with S3 and the catalog before a new run
+// of the profile at now, and returns the time to name the run by. It fails
+// only with clock_check fail; otherwise a clock found off is reported and
+// makes the run keep its plain dumps.
+func (r *backupRun) checkClock(now time.Time) (time.Time, error) {
+	mode := r.config.ClockCheck
+	if mode == clockOff || *dryRun {
+		return now, nil
+	}
+	maxSkew := r.config.maxClockSkew()
+	// Other targets give no time to compare with, leaving the catalog.
+	var skew time.Duration
+	var err error
+	if r.profile.usesS3API() {
+		skew, err = s3ClockSkew(r.profile)
+	}
+	if err != nil {
+		r.logf("cannot read the time of S3 to check the clock: %v\n", err)
+		skew = 0
+	}
+	var problem string
+	if skew > maxSkew || skew < -maxSkew {
+		problem = trf("the clock is %s off the time of S3", roundSkew(skew))
+	} else if last, err := lastSuccess(r.profile); err == nil && last.Sub(now.Add(skew)) > maxSkew {
+		problem = trf("the clock is behind the newest backup, taken %s", last.Format("2006-01-02 15:04"))
+	}
+	if problem == "" {
+		return now, nil
+	}
+	if mode == clockFail {
+		return now, fmt.Errorf("%s; fix the clock or set clock_check", problem)
+	}
+	r.clockOff = true
+	if mode == clockAdjust && (skew > maxSkew || skew < -maxSkew) {
+		now = now.Add(skew)
+		fmt.Fprintf(stderr, r.prefix+tr("warning: %s; the backup is named by the time of S3, %s, and plain dumps are not pruned\n"), problem,
+			now.Format("2006-01-02 15:04"))
+		return now, nil
+	}
+	fmt.Fprintf(stderr, r.prefix+tr("warning: %s; plain dumps are not pruned until it is fixed\n"), problem)
+	return now, nil
+}
+
+func roundSkew(d time.Duration) time.Duration {
+	if d > time.Minute || d < -time.Minute {
+		return d.Round(time.Minute)
+	}
+	return d.Round(time.Second)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(config *Config, profiles []*Profile, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"backup", "backs up selected profiles once (default)", backupCommand},
+		{"daemon", "backs up profiles according to their schedules", daemonCommand},
+		{"serve", "serves an authenticated HTTP API for backups and restores", serveCommand},
+		{"agent", "serves encrypted dumps of the profiles to a controller", agentCommand},
+		{"controller", "collects backups from the agents of the configured sites", controllerCommand},
+		{"pre-upgrade", "takes a labeled backup and verifies it, failing if the upgrade must not proceed", preUpgradeCommand},
+		{"summary", "prints the weekly summary for the clinic staff, or with -send sends it to the notifiers", summaryCommand},
+		{"calendar", "prints the coming days as the calendars of the profiles see them", calendarCommand},
+		{"compliance", "reports whether the backups meet the 3-2-1 rule, retention and verification requirements", complianceCommand},
+		{"check", "reports profiles whose last successful backup is older than max_age", checkCommand},
+		{"objectives", "reports the recovery point and recovery time of the profiles against rpo and rto", objectivesCommand},
+		{"put", "encrypts a file or stdin and uploads it as a named artifact", putCommand},
+		{"tui", "browses the backups and restores, verifies or prunes them from menus", tuiCommand},
+		{"restore", "streams a backup, the latest by default, from S3 or the local copy into the database", restoreCommand},
+		{"history", "prints the past runs, e.g. history -failed -since 30d, also as CSV or JSON", historyCommand},
+		{"hold", "exempts backups from pruning, with S3 legal hold where the bucket allows, or lists those held", holdCommand},
+		{"release", "lifts the hold on backups", releaseCommand},
+		{"list", "lists the backups of the catalog, or with -local and -remote those on disk and in the buckets", listCommand},
+		{"fetch", "downloads a backup, also by s3:// URL from another bucket, optionally decrypted", fetchCommand},
+		{"seed-replica", "restores the latest backup onto a replica and prints how to start replication", seedReplicaCommand},
+		{"standby", "restores the newest backup in the bucket into the standby server", standbyCommand},
+		{"verify", "downloads the latest backup, decrypts it and checks it against the checksum taken at backup time", verifyCommand},
+		{"spot-check", "downloads the latest backup and compares its checksum with the catalog", spotCheckCommand},
+		{"drill", "restores the latest backup into a temporary database and reports", drillCommand},
+		{"ship-binlogs", "ships the binary logs written since the latest backup, for profiles with binlog", shipBinlogsCommand},
+		{"schema-check", "compares the tables of the latest backup with the live database", schemaCheckCommand},
+		{"audit-verify", "checks that the audit log has not been tampered with", auditVerifyCommand},
+		{"export-key", "writes the key of a profile as a printable, passphrase-protected escrow bundle", exportKeyCommand},
+		{"import-key", "writes the key of an escrow bundle to a key file", importKeyCommand},
+		{"split-key", "splits the key of a profile into shares, a threshold of which recover it", splitKeyCommand},
+		{"combine-key", "recovers a key from its shares and writes it to a key file", combineKeyCommand},
+		{"migrate-layout", "moves existing backups and their catalog entries to the current naming, prefix and bucket", migrateLayoutCommand},
+		{"catalog", "with import, records backups made by older versions or by hand which the catalog lacks", catalogCommand},
+		{"gc", "removes leftovers of interrupted runs and handles backups missing from the catalog or without an encrypted copy", gcCommand},
+		{"prune", "deletes the backups, locally and in S3, which the retention policy expires", pruneCommand},
+		{"encrypt-metadata", "rewrites the catalog, history, audit log and states encrypted with metadata_key_file, or with -decrypt plain", encryptMetadataCommand},
+		{"compress-plain", "compresses old uncompressed plain dumps in place", compressPlainCommand},
+		{"reconcile-inventory", "compares an S3 Inventory report with the catalog", reconcileInventoryCommand},
+		{"bench", "measures dump, compression, encryption and upload throughput and recommends settings", benchCommand},
+		{"axcrypt-check", "finds the AxCrypt program and checks that its version is supported", axcryptCheckCommand},
+		{"iam-policy", "prints IAM policies limiting each profile to its S3 prefix", iamPolicyCommand},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func backupCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	toStdout := flags.Bool("stdout", false, "writes the dump to stdout instead of files and S3")
+	compress := flags.Bool("compress", false, "with -stdout, gzip compresses the dump")
+	encrypt := flags.Bool("encrypt", false, "with -stdout, encrypts the dump in crypt-file format")
+	label := flags.String("label", "", "label recorded with the backup, e.g. pre-upgrade-2.3; see keep_labeled")
+	note := flags.String("note", "", "note recorded with the backup, e.g. \"before insurance master update\"")
+	trigger := flags.String("trigger", triggerManual, "why the backup is taken, recorded for audits: "+strings.Join(statedTriggers, ", "))
+	flags.Parse(args)
+	err := validateLabel(*label)
+	if err != nil {
+		return err
+	}
+	err = validateTrigger(*trigger)
+	if err != nil {
+		return err
+	}
+	applyResourceLimits(config)
+	if *toStdout {
+		if *label != "" || *note != "" {
+			return fmt.Errorf("-label and -note are not recorded with -stdout")
+		}
+		return backupToStdout(config, profiles, *compress, *encrypt, *trigger)
+	}
+	lim := newLimiter(config.Workers)
+	results := runProfiles(config, profiles, lim, runOptions{
+		now:       time.Now(),
+		trigger:   *trigger,
+		label:     *label,
+		note:      *note,
+		labelled:  len(profiles) > 1,
+		transfers: newLimiter(config.TransferWorkers),
+	})
+	printResults(results)
+	if !allSucceeded(results) {
+		return fmt.Errorf("backup failed")
+	}
+	return nil
+}
+
+func daemonCommand(config *Config, profiles []*Profile, args []string) error {
+	applyResourceLimits(config)
+	return daemon(config, profiles)
+}
+
+func iamPolicyCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("iam-policy", flag.ExitOnError)
+	expireDays := flags.Int("expire-days", 0, "for write_only profiles, days after which the lifecycle rule deletes backups")
+	objectLock := flags.Bool("object-lock", false, "the buckets have Object Lock enabled, allowing the legal holds of hold")
+	versioned := flags.Bool("versioned", false, "the buckets have versioning enabled")
+	flags.Parse(args)
+	features := bucketFeatures{objectLock: *objectLock, versioned: *versioned}
+	for _, p := range profiles {
+		if p.WriteOnly {
+			writer, reader, lifecycle, err := writeOnlyPolicies(p, *expireDays)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "# %s: the backup server (write_only)\n%s\n", p.Name, writer)
+			fmt.Fprintf(stdout, "# %s: restores and pruning, not on the backup server\n%s\n", p.Name, reader)
+			fmt.Fprintf(stdout, "# %s: lifecycle rule (aws s3api put-bucket-lifecycle-configuration)\n%s\n", p.Name, lifecycle)
+			continue
+		}
+		policy, err := iamPolicy(p, features)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "# %s\n%s\n", p.Name, policy)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ComplianceConfig states the requirements the compliance command checks
+// besides the 3-2-1 rule itself: three copies of the data, on two kinds of
+// media, one of them off-site.
+type ComplianceConfig struct {
+	// RetentionDays is how long backups must be kept, e.g. 1825 for five
+	// years (0 does not check retention).
+	RetentionDays int `yaml:"retention_days"`
+	// VerifyWithinDays is how recently a backup must have been verified or
+	// restored in a drill (default 31).
+	VerifyWithinDays int `yaml:"verify_within_days"`
+}
+
+// complianceCheck is one line of the report.
+type complianceCheck struct {
+	name   string
+	pass   bool
+	detail string
+}
+
+// complianceReport collects the checks of the compliance command.
+type complianceReport struct {
+	failed int
+}
+
+func (r *complianceReport) print(checks []*complianceCheck) {
+	for _, c := range checks {
+		status := "PASS"
+		if !c.pass {
+			status = "FAIL"
+			r.failed++
+		}
+		fmt.Fprintf(stdout, "  %s  %-14s %s\n", status, tr(c.name), c.detail)
+	}
+}
+
+// complianceChecks evaluates the profile. Unless catalogOnly, the copies
+// in S3 are listed rather than taken from the catalog, so that the report
+// shows what is actually stored.
+func complianceChecks(config *Config, p *Profile, req ComplianceConfig, catalogOnly bool, now time.Time) ([]*complianceCheck, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var latest, first *CatalogEntry
+	var lastVerified *Verification
+	for _, e := range entries {
+		if e.Profile != p.Name || !e.isDump() {
+			continue
+		}
+		if latest == nil || e.Time.After(latest.Time) {
+			latest = e
+		}
+		if first == nil || e.Time.Before(first.Time) {
+			first = e
+		}
+		for _, v := range e.Verifications {
+			if v.OK && (lastVerified == nil || v.Time.After(lastVerified.Time)) {
+				lastVerified = v
+			}
+		}
+	}
+	var stored []*CatalogEntry
+	if p.hasStorage() {
+		if catalogOnly {
+			for _, e := range entries {
+				if e.Profile == p.Name && e.isDump() && e.S3Key != "" {
+					stored = append(stored, e)
+				}
+			}
+		} else {
+			l, err := listRemote(p, dateRange{})
+			if err != nil {
+				return nil, err
+			}
+			stored = l.backups
+		}
+	}
+	var newestStored, oldestStored *CatalogEntry
+	for _, e := range stored {
+		if newestStored == nil || e.Time.After(newestStored.Time) {
+			newestStored = e
+		}
+		if oldestStored == nil || e.Time.Before(oldestStored.Time) {
+			oldestStored = e
+		}
+	}
+
+	// Copies and media: the data itself, the dump on this machine, the
+	// backup in S3 and a standby server restored from it.
+	copies := []string{tr("original")}
+	media := []string{tr("local disk")}
+	if latest != nil && (fileExists(latest.BackupFile) || fileExists(latest.EncryptedFile)) {
+		copies = append(copies, tr("local dump"))
+	}
+	offsite := &complianceCheck{name: "off-site", detail: tr("no backup in S3")}
+	if newestStored != nil {
+		copies = append(copies, "S3")
+		media = append(media, tr("cloud storage"))
+		age := now.Sub(newestStored.Time)
+		offsite.detail = trf("%s, taken %s", entryLocation(newestStored),
+			newestStored.Time.Local().Format("2006-01-02 15:04"))
+		// An off-site copy which has stopped being refreshed protects
+		// only the past.
+		offsite.pass = p.MaxAge == 0 || age <= p.MaxAge
+		if !offsite.pass {
+			offsite.detail += trf(" (older than max_age %s)", p.MaxAge)
+		}
+	}
+	if p.Standby != nil {
+		st, err := loadStandbyState(standbyStatePath(config.StateDir, p.Name))
+		if err == nil && !st.Restored.IsZero() && st.Error == "" {
+			copies = append(copies, trf("standby (%s)", st.Restored.Local().Format("2006-01-02")))
+			media = append(media, tr("standby server"))
+		}
+	}
+	checks := []*complianceCheck{
+		{name: "copies", pass: len(copies) >= 3, detail: fmt.Sprintf("%d (%s)", len(copies), strings.Join(copies, ", "))},
+		{name: "media", pass: len(media) >= 2, detail: fmt.Sprintf("%d (%s)", len(media), strings.Join(media, ", "))},
+		offsite,
+	}
+
+	if req.RetentionDays > 0 {
+		c := &complianceCheck{name: "retention", detail: tr("no backup in S3")}
+		if oldestStored != nil {
+			days := int(now.Sub(oldestStored.Time).Hours() / 24)
+			switch {
+			case days >= req.RetentionDays:
+				c.pass = true
+				c.detail = trf("oldest backup %s, %d days old (%d required)",
+					oldestStored.Time.Local().Format("2006-01-02"), days, req.RetentionDays)
+			case first != nil && !oldestStored.Time.After(first.Time):
+				// Backups have not been taken for that long yet, and
+				// none has been deleted.
+				c.pass = true
+				c.detail = trf("all backups kept since the first, %s (%d of %d days)",
+					first.Time.Local().Format("2006-01-02"), days, req.RetentionDays)
+			default:
+				c.detail = trf("oldest backup %s is %d days old, %d required",
+					oldestStored.Time.Local().Format("2006-01-02"), days, req.RetentionDays)
+			}
+		}
+		checks = append(checks, c)
+	}
+
+	c := &complianceCheck{name: "verification", detail: tr("never verified")}
+	if lastVerified != nil {
+		days := int(now.Sub(lastVerified.Time).Hours() / 24)
+		c.pass = days <= req.VerifyWithinDays
+		c.detail = trf("last %s %s (%d days ago, within %d required)", lastVerified.Kind,
+			lastVerified.Time.Local().Format("2006-01-02"), days, req.VerifyWithinDays)
+	}
+	checks = append(checks, c)
+	return checks, nil
+}
+
+// complianceCommand reports whether the selected profiles meet the 3-2-1
+// rule, the retention requirement and the verification recency, for the
+// clinic's annual security review. It fails if any check fails.
+func complianceCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("compliance", flag.ExitOnError)
+	retention := flags.Int("retention-days", 0, "overrides compliance.retention_days")
+	verifyWithin := flags.Int("verify-within-days", 0, "overrides compliance.verify_within_days")
+	catalogOnly := flags.Bool("catalog-only", false, "trusts the catalog instead of listing the buckets")
+	flags.Parse(args)
+	var req ComplianceConfig
+	if config.Compliance != nil {
+		req = *config.Compliance
+	}
+	if *retention > 0 {
+		req.RetentionDays = *retention
+	}
+	if *verifyWithin > 0 {
+		req.VerifyWithinDays = *verifyWithin
+	}
+	if req.VerifyWithinDays == 0 {
+		req.VerifyWithinDays = 31
+	}
+	if !*catalogOnly {
+		err := useReaderCredentials(profiles)
+		if err != nil {
+			return fmt.Errorf("%v, or use -catalog-only", err)
+		}
+	}
+	now := time.Now()
+	host, _ := os.Hostname()
+	fmt.Fprintf(stdout, tr("Backup compliance report, %s, %s\n"), now.Format("2006-01-02 15:04"), host)
+	retentionReq := tr("not required")
+	if req.RetentionDays > 0 {
+		retentionReq = trf("%d days", req.RetentionDays)
+	}
+	fmt.Fprintf(stdout, tr("Requirements: 3 copies on 2 kinds of media, 1 off-site; retention %s; verified within %d days\n"),
+		retentionReq, req.VerifyWithinDays)
+	r := &complianceReport{}
+	for _, p := range profiles {
+		fmt.Fprintf(stdout, tr("\nProfile %s\n"), p.Name)
+		checks, err := complianceChecks(config, p, req, *catalogOnly, now)
+		if err != nil {
+			checks = []*complianceCheck{{name: "evaluation", detail: err.Error()}}
+		}
+		r.print(checks)
+	}
+	fmt.Fprintf(stdout, tr("\nAudit log\n"))
+	records, err := auditLog.records()
+	audit := &complianceCheck{name: "integrity", pass: err == nil, detail: trf("%d records, chain intact", len(records))}
+	if err != nil {
+		audit.detail = err.Error()
+	}
+	r.print([]*complianceCheck{audit})
+	if r.failed > 0 {
+		fmt.Fprintf(stdout, tr("\nResult: FAIL (%d checks failed)\n"), r.failed)
+		return fmt.Errorf("%d compliance checks failed", r.failed)
+	}
+	fmt.Fprintf(stdout, tr("\nResult: PASS\n"))
+	return nil
+}
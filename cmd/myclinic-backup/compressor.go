@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The content of encrypted backups is compressed before encryption by the
+// compressor of the compression setting:
+//
+//	zlib     crypt-file's own compression (default)
+//	gzip     gzip, which pigz and other tools also read and write
+//	zstd     the zstd command, using compress_threads threads (all if 0)
+//	command  compression_command, such as "pigz -p 8" or "xz -T0"
+//
+// zlib and gzip compress each backup on one thread; compress_threads caps
+// how many of the backups compressed at once compress at the same time.
+// compression_level applies to the first three. Whatever a backup was
+// compressed with, restores tell it from the first bytes of its content:
+// zlib and gzip are read by the tool itself, zstd, xz and bzip2 data by
+// their commands, and anything else by decompression_command. The
+// compressor is also recorded in the catalog and the metadata of uploads.
+
+// Compressor compresses the content of encrypted backups.
+type Compressor interface {
+	// Name is recorded with the backup.
+	Name() string
+	// NewWriter returns a writer compressing what is written to it into w.
+	// Close flushes the compressed data but does not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// compress compresses plain at once.
+func compress(c Compressor, plain []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(plain)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Values of compression.
+const (
+	compressionZlib    = "zlib"
+	compressionGzip    = "gzip"
+	compressionZstd    = "zstd"
+	compressionCommand = "command"
+	// compressionMetadataKey records the compressor with every uploaded
+	// object.
+	compressionMetadataKey = "compression"
+)
+
+// threadLimit lets at most as many of the in-process compressors sharing
+// it compress at once as it has room for; a nil threadLimit does not
+// limit.
+type threadLimit chan struct{}
+
+func newThreadLimit(threads int) threadLimit {
+	if threads <= 0 {
+		return nil
+	}
+	return make(threadLimit, threads)
+}
+
+// limit returns w compressing only while it holds a thread of l.
+func (l threadLimit) limit(w io.WriteCloser, err error) (io.WriteCloser, error) {
+	if l == nil || err != nil {
+		return w, err
+	}
+	return &limitedWriter{w: w, threads: l}, nil
+}
+
+type limitedWriter struct {
+	w       io.WriteCloser
+	threads threadLimit
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.threads <- struct{}{}
+	defer func() { <-w.threads }()
+	return w.w.Write(p)
+}
+
+// Close compresses what is buffered, which also takes a thread.
+func (w *limitedWriter) Close() error {
+	w.threads <- struct{}{}
+	defer func() { <-w.threads }()
+	return w.w.Close()
+}
+
+type zlibCompressor struct {
+	level   int
+	threads threadLimit
+}
+
+func (c zlibCompressor) Name() string {
+	return compressionZlib
+}
+
+func (c zlibCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return c.threads.limit(zlib.NewWriterLevel(w, c.level))
+}
+
+type gzipCompressor struct {
+	level   int
+	threads threadLimit
+}
+
+func (c gzipCompressor) Name() string {
+	return compressionGzip
+}
+
+func (c gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return c.threads.limit(gzip.NewWriterLevel(w, c.level))
+}
+
+// commandCompressor pipes the content through an external command.
+type commandCompressor struct {
+	name string
+	args []string
+}
+
+func (c commandCompressor) Name() string {
+	return c.name
+}
+
+func (c commandCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	cw := &commandWriter{cmd: exec.Command(c.args[0], c.args[1:]...)}
+	cw.cmd.Stdout = w
+	cw.cmd.Stderr = &cw.stderr
+	in, err := cw.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	cw.in = in
+	err = cw.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("cannot compress with %s: %v", c.args[0], err)
+	}
+	return cw, nil
+}
+
+// commandWriter writes to a compression command.
+type commandWriter struct {
+	cmd    *exec.Cmd
+	in     io.WriteCloser
+	stderr bytes.Buffer
+}
+
+func (w *commandWriter) Write(p []byte) (int, error) {
+	n, err := w.in.Write(p)
+	if err != nil {
+		// The command has most likely failed; Close tells why.
+		if cerr := w.Close(); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
+
+// Close waits for the command to write the rest of its output and exit.
+func (w *commandWriter) Close() error {
+	if w.cmd.ProcessState != nil {
+		return nil
+	}
+	w.in.Close()
+	err := w.cmd.Wait()
+	if err != nil {
+		return commandError(w.cmd.Args[0], err, &w.stderr)
+	}
+	return nil
+}
+
+func commandError(name string, err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%s: %v: %s", name, err, msg)
+	}
+	return fmt.Errorf("%s: %v", name, err)
+}
+
+// zstdArgs returns the zstd command at the level, using threads threads
+// (0 for all).
+func zstdArgs(level int, threads int) []string {
+	args := []string{"zstd", "-q", "-c", "-T" + strconv.Itoa(threads)}
+	if level > 0 {
+		args = append(args, "-"+strconv.Itoa(level))
+	}
+	return args
+}
+
+// newCompressor returns the compressor of the compression settings.
+func (c *Config) newCompressor() (Compressor, error) {
+	if c.Compression != compressionCommand && c.CompressionCommand != "" {
+		return nil, fmt.Errorf("compression_command needs compression: %s", compressionCommand)
+	}
+	level := zlib.DefaultCompression
+	if c.CompressionLevel > 0 {
+		level = c.CompressionLevel
+	}
+	switch c.Compression {
+	case "", compressionZlib:
+		return zlibCompressor{level, newThreadLimit(c.CompressThreads)}, nil
+	case compressionGzip:
+		return gzipCompressor{level, newThreadLimit(c.CompressThreads)}, nil
+	case compressionZstd:
+		return commandCompressor{compressionZstd, zstdArgs(c.CompressionLevel, c.CompressThreads)}, nil
+	case compressionCommand:
+		args := strings.Fields(c.CompressionCommand)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("compression: %s needs compression_command", compressionCommand)
+		}
+		return commandCompressor{args[0], args}, nil
+	}
+	return nil, fmt.Errorf("compression must be %s, %s, %s or %s: %s", compressionZlib, compressionGzip, compressionZstd,
+		compressionCommand, c.Compression)
+}
+
+// decompressionCommand is decompression_command, split into arguments.
+var decompressionCommand []string
+
+// Magic numbers of the compressed formats read by their commands.
+var decompressionCommands = []struct {
+	magic []byte
+	args  []string
+}{
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, []string{"zstd", "-q", "-d", "-c"}},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, []string{"xz", "-d", "-c"}},
+	{[]byte("BZh"), []string{"bzip2", "-d", "-c"}},
+}
+
+// decompressReader returns a reader of the decompressed content read from
+// r, telling the compression from its first bytes.
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(head) >= 2 && head[0] == 0x1f && head[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	for _, d := range decompressionCommands {
+		if bytes.HasPrefix(head, d.magic) {
+			return startDecompression(d.args, br)
+		}
+	}
+	if len(head) >= 2 && head[0]&0x0f == 8 && (int(head[0])<<8|int(head[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	if len(decompressionCommand) > 0 {
+		return startDecompression(decompressionCommand, br)
+	}
+	return nil, fmt.Errorf("unknown compression of backup content; set decompression_command")
+}
+
+// commandReader reads the output of a decompression command.
+type commandReader struct {
+	cmd    *exec.Cmd
+	out    io.ReadCloser
+	stderr bytes.Buffer
+	done   bool
+}
+
+func startDecompression(args []string, in io.Reader) (io.ReadCloser, error) {
+	r := &commandReader{cmd: exec.Command(args[0], args[1:]...)}
+	r.cmd.Stdin = in
+	r.cmd.Stderr = &r.stderr
+	out, err := r.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	r.out = out
+	err = r.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress with %s: %v", args[0], err)
+	}
+	return r, nil
+}
+
+// Read returns io.EOF only once the command has exited successfully.
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.out.Read(p)
+	if err == io.EOF && !r.done {
+		r.done = true
+		werr := r.cmd.Wait()
+		if werr != nil {
+			return n, commandError(r.cmd.Args[0], werr, &r.stderr)
+		}
+	}
+	return n, err
+}
+
+func (r *commandReader) Close() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	r.out.Close()
+	r.cmd.Process.Kill()
+	r.cmd.Wait()
+	return nil
+}
+
+// compressedExt returns the extension of content compressed as recorded
+// in the catalog.
+func compressedExt(compression string) string {
+	switch compression {
+	case "", compressionZlib:
+		return ".zlib"
+	case compressionGzip:
+		return ".gz"
+	case compressionZstd:
+		return ".zst"
+	}
+	return ".compressed"
+}
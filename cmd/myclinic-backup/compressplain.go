@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// gzipFile compresses src into src.gz and returns the SHA-256 of the
+// uncompressed content.
+func gzipFile(src string, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(io.MultiWriter(gz, h), in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// gunzipSHA256 returns the SHA-256 of the uncompressed content of path.
+func gunzipSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, gz)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// compressPlainDump replaces a plain dump by its gzip compressed version,
+// removing the original only after the compressed file is verified.
+func compressPlainDump(path string) (int64, error) {
+	gzPath := path + ".gz"
+	sum, err := gzipFile(path, gzPath)
+	if err != nil {
+		return 0, err
+	}
+	check, err := gunzipSHA256(gzPath)
+	if err != nil || check != sum {
+		os.Remove(gzPath)
+		return 0, fmt.Errorf("verification of %s failed: %v", gzPath, err)
+	}
+	before, err := fileSize(path)
+	if err != nil {
+		return 0, err
+	}
+	after, err := fileSize(gzPath)
+	if err != nil {
+		return 0, err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return 0, err
+	}
+	return before - after, nil
+}
+
+// compressPlainCommand compresses uncompressed plain dumps left by earlier
+// versions of this tool.
+func compressPlainCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("compress-plain", flag.ExitOnError)
+	days := flags.Int("days", 1, "compresses dumps older than this many days")
+	flags.Parse(args)
+	limit := time.Now().AddDate(0, 0, -*days)
+	var saved int64
+	count := 0
+	for _, p := range profiles {
+		err := filepath.Walk(p.BackupDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if path != p.BackupDir && info.Name() == workDirName {
+					// Dumps being taken.
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			t, ok := plainDumpTime(info.Name())
+			if !ok || filepath.Ext(path) != ".sql" || !t.Before(limit) {
+				return nil
+			}
+			if *dryRun {
+				fmt.Fprintf(stdout, tr("would compress %s\n"), path)
+				return nil
+			}
+			n, err := compressPlainDump(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, tr("compressed %s (saved %d bytes)\n"), path, n)
+			saved += n
+			count++
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, tr("%d files compressed, %d bytes saved\n"), count, saved)
+	return nil
+}
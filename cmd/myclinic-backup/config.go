@@ -0,0 +1,844 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const defaultDatabase = "myclinic"
+
+// Config is the content of the configuration file given by -config.
+type Config struct {
+	// Workers is the maximum number of profiles dumped at the same time.
+	Workers int `yaml:"workers"`
+	// TransferWorkers is the maximum number of dumps encrypted and
+	// uploaded at the same time (default workers). A profile being
+	// uploaded does not hold one of the workers, which go on dumping the
+	// next profiles.
+	TransferWorkers int `yaml:"transfer_workers"`
+	// StateDir holds the catalog and logs.
+	StateDir string `yaml:"state_dir"`
+	// LowPriority runs the dump and compression at lowered CPU and I/O
+	// priority.
+	LowPriority bool `yaml:"low_priority"`
+	// CompressThreads caps the CPU threads used for compression (0 means
+	// no limit).
+	CompressThreads int `yaml:"compress_threads"`
+	// Compression is the compressor of encrypted backups: zlib (default),
+	// gzip, zstd or command, which runs CompressionCommand; see
+	// compressor.go. DecompressionCommand reads what that writes if
+	// restores cannot tell it.
+	Compression          string `yaml:"compression"`
+	CompressionCommand   string `yaml:"compression_command"`
+	DecompressionCommand string `yaml:"decompression_command"`
+	// CompressionLevel is the level of encrypted backups, from 1
+	// (fastest) to 9 (smallest), or to 19 with zstd; 0 means the default
+	// of the compressor (6 for zlib and gzip).
+	CompressionLevel int `yaml:"compression_level"`
+	// UploadPartSize (such as 16MB) and UploadConcurrency tune multipart
+	// uploads (defaults 5MB and 5). The bench command recommends values.
+	UploadPartSize    string `yaml:"upload_part_size"`
+	UploadConcurrency int    `yaml:"upload_concurrency"`
+	// DownloadConcurrency is how many parts of a backup restores and
+	// fetches download at once (default 1, one stream).
+	DownloadConcurrency int `yaml:"download_concurrency"`
+	// DeleteConcurrency and DeleteRate pace the deletions of prune; see
+	// prune.go.
+	DeleteConcurrency int     `yaml:"delete_concurrency"`
+	DeleteRate        float64 `yaml:"delete_rate"`
+	// CatalogS3 keeps the catalog in S3, shared by several hosts, instead
+	// of in state_dir; see catalog_s3.go.
+	CatalogS3 *CatalogS3Config `yaml:"catalog_s3"`
+	// AuditS3 optionally mirrors the audit log to write-once storage.
+	AuditS3 *AuditS3Config `yaml:"audit_s3"`
+	// FIPS restricts cryptography to approved algorithms; see fipsMode.
+	FIPS bool `yaml:"fips"`
+	// WorkDir holds the work directories of runs (default .work in the
+	// backup_dir of each profile); see workBase.
+	WorkDir string `yaml:"work_dir"`
+	// MetadataKeyFile, if set, encrypts the catalog and the other
+	// metadata in the state directory with the key; see metadataKey.
+	MetadataKeyFile string `yaml:"metadata_key_file"`
+	// InstanceID names this installation in the catalog, in the metadata
+	// of uploads and, with s3_key_instance, in S3 keys (default the host
+	// name); see identity.go.
+	InstanceID string `yaml:"instance_id"`
+	// ClockCheck is what a run does when the clock is off by more than
+	// MaxClockSkew (default 5m): warn (default), adjust, fail or off; see
+	// clock.go.
+	ClockCheck   string        `yaml:"clock_check"`
+	MaxClockSkew time.Duration `yaml:"max_clock_skew"`
+	// Templates replace the texts of notifications and reports; see
+	// templates.go.
+	Templates *TemplatesConfig `yaml:"templates"`
+	// Tracing sends each backup run as an OpenTelemetry trace; see
+	// tracing.go.
+	Tracing *TracingConfig `yaml:"tracing"`
+	// HTTPListen is the address of the monitoring endpoint served in
+	// daemon mode (disabled if empty).
+	HTTPListen string `yaml:"http_listen"`
+	// SMTP is the mail server for reports.
+	SMTP *SMTPConfig `yaml:"smtp"`
+	// Agent serves dumps of the profiles to a controller. It is served
+	// over TLS only, as its token and dumps cross the network.
+	Agent *ServerConfig `yaml:"agent"`
+	// API is the server of the serve command. It is served over TLS
+	// unless it listens only on a loopback address.
+	API *ServerConfig `yaml:"api"`
+	// Language is the language of messages and reports, en or ja (default
+	// from the locale).
+	Language string `yaml:"language"`
+	// Dashboard is the web UI served in daemon mode. Browsers sign in
+	// with the token. It is served over TLS unless it listens only on a
+	// loopback address.
+	Dashboard *ServerConfig `yaml:"dashboard"`
+	// Compliance states the requirements the compliance command checks.
+	Compliance *ComplianceConfig `yaml:"compliance"`
+	// Controller collects backups from the agents of other sites.
+	Controller *ControllerConfig `yaml:"controller"`
+	Profiles   []*Profile        `yaml:"profiles"`
+	// warnings are found by validate and printed by runCommand, once the
+	// language and the output are set up.
+	warnings []configWarning
+}
+
+// configWarning is a problem of the configuration not bad enough to
+// refuse it: a message format, in English, and its arguments.
+type configWarning struct {
+	format string
+	args   []interface{}
+}
+
+// Profile describes the backup of one database, or of files if its type is
+// files. Fields left empty fall back to the corresponding environment
+// variable.
+type Profile struct {
+	Name string `yaml:"name"`
+	// Type is "mysql" (the default) or "files".
+	Type     string       `yaml:"type"`
+	Files    *FilesConfig `yaml:"files"`
+	Database string       `yaml:"database"`
+	// Databases, used instead of database, are dumped together in one
+	// consistent snapshot.
+	Databases []string `yaml:"databases"`
+	DBUser    string   `yaml:"db_user"`
+	DBPass    string   `yaml:"db_pass"`
+	// DockerContainer is the name or ID of the container in which the
+	// MySQL client tools are run with docker exec.
+	DockerContainer string `yaml:"docker_container"`
+	// Kubernetes runs the MySQL client tools with kubectl exec in the
+	// database pod.
+	Kubernetes *KubernetesConfig `yaml:"kubernetes"`
+	// SSH runs the MySQL client tools on the database host over SSH.
+	SSH *SSHConfig `yaml:"ssh"`
+	// DBUserFile and DBPassFile read the credentials from files, such as
+	// mounted Kubernetes secrets, when db_user and db_pass are not set.
+	DBUserFile string `yaml:"db_user_file"`
+	DBPassFile string `yaml:"db_pass_file"`
+	// DBDefaultsFile is a MySQL option file, such as the .my.cnf of a
+	// user, and DBLoginPath a login path stored with mysql_config_editor,
+	// which the client programs read the credentials from instead, so that
+	// db_user and db_pass are not needed. The file is on the machine or in
+	// the container the programs run in. Profiles using kubernetes or ssh
+	// must use them, as db_pass would be passed in the process list.
+	DBDefaultsFile string `yaml:"db_defaults_file"`
+	DBLoginPath    string `yaml:"db_login_path"`
+	// DBSocket connects through a Unix socket, e.g. one shared with the
+	// database container when running as a sidecar.
+	DBSocket string `yaml:"db_socket"`
+	// DBHost is the MySQL server as host or host:port (default local).
+	DBHost       string `yaml:"db_host"`
+	BackupDir    string `yaml:"backup_dir"`
+	EncryptedDir string `yaml:"encrypted_dir"`
+	KeyFile      string `yaml:"key_file"`
+	S3Region     string `yaml:"s3_region"`
+	S3Bucket     string `yaml:"s3_bucket"`
+	S3Prefix     string `yaml:"s3_prefix"`
+	S3RoleARN    string `yaml:"s3_role_arn"`
+	S3ExternalID string `yaml:"s3_external_id"`
+	// AWSProfile is a named profile of the AWS shared credentials file
+	// (default the standard credential chain).
+	AWSProfile string `yaml:"aws_profile"`
+	Schedule   string `yaml:"schedule"`
+	// Calendar adjusts the schedule to the days the clinic is closed.
+	Calendar *CalendarConfig `yaml:"calendar"`
+	Notify   NotifyConfig    `yaml:"notify"`
+	// Verify schedules verification of random older backups in daemon mode.
+	Verify *VerifyConfig `yaml:"verify"`
+	// SpotCheck schedules spot checks of the latest backup in daemon mode.
+	SpotCheck *SpotCheckConfig `yaml:"spot_check"`
+	// Drill schedules restore drills in daemon mode.
+	Drill *DrillConfig `yaml:"drill"`
+	// Standby keeps a standby server restored from the bucket in daemon
+	// mode.
+	Standby *StandbyConfig `yaml:"standby"`
+	// Binlog ships the binary logs following each dump, for restores to a
+	// point in time.
+	Binlog *BinlogConfig `yaml:"binlog"`
+	// MaxAge is how old the last successful backup may become before it is
+	// reported as overdue (0 disables the check).
+	MaxAge time.Duration `yaml:"max_age"`
+	// RPO is the recovery point objective: how old the newest restorable
+	// backup in S3 may become (0 sets none).
+	RPO time.Duration `yaml:"rpo"`
+	// RTO is the recovery time objective: how long restoring the latest
+	// backup may take, as measured by restore drills (0 sets none).
+	RTO time.Duration `yaml:"rto"`
+	// PlainRetention is the number of days plain SQL dumps are kept on
+	// disk; older ones are deleted on every run (0 keeps them forever).
+	PlainRetention int `yaml:"plain_retention"`
+	// PlainKeepLast keeps the newest plain dumps whatever their age; set
+	// alone, it deletes the others.
+	PlainKeepLast int `yaml:"plain_keep_last"`
+	// PlainKeepMonthly keeps the newest plain dump of each of the latest
+	// months having any.
+	PlainKeepMonthly int `yaml:"plain_keep_monthly"`
+	// KeepLabeled exempts the plain dumps of backups taken with -label
+	// from plain_retention, so that deliberate snapshots stay on disk.
+	KeepLabeled bool `yaml:"keep_labeled"`
+	// DedupPlain stores a plain dump identical to the previous one as a
+	// link to it; see placePlainDump.
+	DedupPlain bool `yaml:"dedup_plain"`
+	// WriteOnly declares that the credentials of the profile can only add
+	// backups; see writeonly.go.
+	WriteOnly bool `yaml:"write_only"`
+	// EncryptedName is the file name of encrypted backups, in which
+	// {stamp} is replaced by the time of the backup (e.g.
+	// "dump-{stamp}.sql.cf"). The default is "dump-{stamp}-sql.cf".
+	EncryptedName string `yaml:"encrypted_name"`
+	// S3KeyInstance puts the instance ID under s3_prefix in the keys of
+	// backups, keeping those of machines sharing the prefix apart.
+	S3KeyInstance bool `yaml:"s3_key_instance"`
+	// OpaqueNames stores the objects of the profile under names derived
+	// with HMAC, recording the true names in an encrypted manifest; see
+	// opaque.go.
+	OpaqueNames bool `yaml:"opaque_names"`
+	// KeyFingerprint pins the fingerprint of the key in KeyFile, which
+	// runs otherwise compare with that of the newest backup; see
+	// keycheck.go.
+	KeyFingerprint string `yaml:"key_fingerprint"`
+	// BinlogCoordinates records the binary log position (and GTID set) of
+	// each dump, so that a replica can be seeded from it. The account
+	// needs the RELOAD and REPLICATION CLIENT privileges.
+	BinlogCoordinates bool `yaml:"binlog_coordinates"`
+	// DumpOptions are further options of mysqldump, such as --routines
+	// or --ignore-table=myclinic.session.
+	DumpOptions []string `yaml:"dump_options"`
+	// Grants also stores the accounts and grants of the server as a
+	// separate artifact with every backup.
+	Grants bool `yaml:"grants"`
+	// Stream uploads dumps as they are made, without writing them to disk
+	// first; see stream.go.
+	Stream bool `yaml:"stream"`
+	// StreamKeep tells which local copies streamed backups write: both
+	// (default), plain, encrypted or none.
+	StreamKeep string `yaml:"stream_keep"`
+	// RestoreSnapshot backs the databases up before every restore into
+	// them; see restoresnapshot.go.
+	RestoreSnapshot bool `yaml:"restore_snapshot"`
+	// Retention expires encrypted backups, locally and in the bucket; see
+	// prune.go.
+	Retention *RetentionConfig `yaml:"retention"`
+	// Target is where encrypted backups are uploaded: s3 (default), gcs,
+	// sftp or file; see storage.go. gcs uses s3_bucket, and the HMAC key
+	// of aws_profile.
+	Target string `yaml:"target"`
+	// SFTP is the server of target sftp.
+	SFTP *SFTPConfig `yaml:"sftp"`
+	// TargetDir is the directory, such as a NAS mount, of target file.
+	TargetDir string `yaml:"target_dir"`
+	// AfterRestore are checks run after a restore; see restorecheck.go.
+	AfterRestore []*RestoreCheck `yaml:"after_restore"`
+	// writer keeps the credentials of a write_only profile switched to
+	// the reader's by useReaderCredentials; uploads still use them.
+	writer *writerCredentials
+}
+
+func readConfig(path string) (*Config, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	err = yaml.UnmarshalStrict(src, &config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(config.Profiles) == 0 && config.Controller == nil {
+		return nil, fmt.Errorf("%s: no profiles defined", path)
+	}
+	return &config, nil
+}
+
+// envConfig is used when no configuration file is given; it has a single
+// profile taken entirely from the environment.
+func envConfig() *Config {
+	return &Config{
+		Profiles: []*Profile{&Profile{Name: "default"}},
+	}
+}
+
+func loadConfig(path string) (*Config, error) {
+	var config *Config
+	if path == "" {
+		path = defaultConfigFile()
+	}
+	if path == "" {
+		config = envConfig()
+	} else {
+		c, err := readConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		config = c
+	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.TransferWorkers <= 0 {
+		config.TransferWorkers = config.Workers
+	}
+	if *lowPriorityFlag {
+		config.LowPriority = true
+	}
+	override(&config.HTTPListen, *listenFlag)
+	if *compressThreadsFlag > 0 {
+		config.CompressThreads = *compressThreadsFlag
+	}
+	stateDir, err := resolveStateDir(config.StateDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine state directory: %v", err)
+	}
+	config.StateDir = stateDir
+	dbPass, err := readPassSource(*dbPassSourceFlag)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range config.Profiles {
+		p.applyFlags(dbPass)
+		err = p.applySecretFiles()
+		if err != nil {
+			return nil, err
+		}
+		err = p.applyEnv()
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+	}
+	config.applyLocalPaths()
+	config.registerSecrets()
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	err = config.applyTransferSettings()
+	if err != nil {
+		return nil, err
+	}
+	config.applyFIPS()
+	return config, nil
+}
+
+// applyLocalPaths makes the local paths of the configuration fit for long
+// paths; see localPath.
+func (c *Config) applyLocalPaths() {
+	c.StateDir = localPath(c.StateDir)
+	c.WorkDir = localPath(c.WorkDir)
+	for _, p := range c.Profiles {
+		for _, path := range []*string{&p.BackupDir, &p.EncryptedDir, &p.KeyFile, &p.TargetDir} {
+			*path = localPath(*path)
+		}
+		if p.Files != nil {
+			for i := range p.Files.Paths {
+				p.Files.Paths[i] = localPath(p.Files.Paths[i])
+			}
+		}
+	}
+}
+
+func override(value *string, flagValue string) {
+	if flagValue != "" {
+		*value = flagValue
+	}
+}
+
+func (p *Profile) applyFlags(dbPass string) {
+	if *plainRetentionFlag > 0 {
+		p.PlainRetention = *plainRetentionFlag
+	}
+	override(&p.DBUser, *dbUserFlag)
+	override(&p.DBPass, dbPass)
+	override(&p.Database, *databaseFlag)
+	override(&p.BackupDir, *backupDirFlag)
+	override(&p.EncryptedDir, *encryptedDirFlag)
+	override(&p.KeyFile, *keyFileFlag)
+	override(&p.S3Region, *regionFlag)
+	override(&p.S3Bucket, *bucketFlag)
+}
+
+// readPassSource reads a password from the source given by -db-pass-source,
+// which keeps the password itself off the command line.
+func readPassSource(source string) (string, error) {
+	switch {
+	case source == "":
+		return "", nil
+	case source == "stdin":
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		value := os.Getenv(name)
+		if value == "" {
+			return "", fmt.Errorf("cannot get env var %s", name)
+		}
+		return value, nil
+	case strings.HasPrefix(source, "file:"):
+		c, err := ioutil.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(c)), nil
+	default:
+		return "", fmt.Errorf("invalid password source: %s", source)
+	}
+}
+
+func fallback(value *string, envVar string) {
+	if *value == "" {
+		*value = os.Getenv(envVar)
+	}
+}
+
+// readSecretFile reads a secret such as a mounted Kubernetes secret, which
+// often ends with a newline.
+func readSecretFile(path string) (string, error) {
+	c, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSpace(string(c))
+	secrets.add(s)
+	return s, nil
+}
+
+func (p *Profile) applySecretFiles() error {
+	files := []struct {
+		value *string
+		path  string
+	}{
+		{&p.DBUser, p.DBUserFile},
+		{&p.DBPass, p.DBPassFile},
+	}
+	for _, f := range files {
+		if *f.value != "" || f.path == "" {
+			continue
+		}
+		s, err := readSecretFile(f.path)
+		if err != nil {
+			return fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+		*f.value = s
+	}
+	return nil
+}
+
+func (p *Profile) applyEnv() error {
+	if p.Database == "" && len(p.Databases) == 0 {
+		p.Database = defaultDatabase
+	}
+	fallback(&p.DBUser, mysqlUserEnvVar)
+	fallback(&p.DBPass, mysqlPassEnvVar)
+	fallback(&p.BackupDir, backupDirEnvVar)
+	fallback(&p.EncryptedDir, encryptedBackupDirEnvVar)
+	fallback(&p.KeyFile, encryptionKey)
+	fallback(&p.S3Region, s3BackupRegionEnvVar)
+	fallback(&p.S3Bucket, s3BackupBucketEnvVar)
+	fallback(&p.Target, targetEnvVar)
+	switch p.Target {
+	case targetFile:
+		fallback(&p.TargetDir, targetDirEnvVar)
+	case targetSFTP:
+		if p.SFTP == nil {
+			var err error
+			p.SFTP, err = sftpEnv()
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Profile) validate() error {
+	required := []struct {
+		value  string
+		field  string
+		envVar string
+	}{
+		{p.BackupDir, "backup_dir", backupDirEnvVar},
+		{p.EncryptedDir, "encrypted_dir", encryptedBackupDirEnvVar},
+		{p.KeyFile, "key_file", encryptionKey},
+	}
+	switch p.target() {
+	case targetS3:
+		required = append(required, []struct {
+			value  string
+			field  string
+			envVar string
+		}{
+			{p.S3Region, "s3_region", s3BackupRegionEnvVar},
+			{p.S3Bucket, "s3_bucket", s3BackupBucketEnvVar},
+		}...)
+	case targetGCS:
+		required = append(required, struct {
+			value  string
+			field  string
+			envVar string
+		}{p.S3Bucket, "s3_bucket", s3BackupBucketEnvVar})
+	case targetFile:
+		required = append(required, struct {
+			value  string
+			field  string
+			envVar string
+		}{p.TargetDir, "target_dir", targetDirEnvVar})
+	}
+	// Simulated dumps do not connect to the database.
+	if !p.isFiles() && !*simulateFlag && !p.usesOptionFiles() && p.Kubernetes == nil && p.SSH == nil {
+		required = append(required, []struct {
+			value  string
+			field  string
+			envVar string
+		}{
+			{p.DBUser, "db_user", mysqlUserEnvVar},
+			{p.DBPass, "db_pass", mysqlPassEnvVar},
+		}...)
+	}
+	for _, r := range required {
+		if r.value == "" {
+			return fmt.Errorf("profile %s: %s is not set (nor env var %s)",
+				p.Name, r.field, r.envVar)
+		}
+	}
+	switch p.Type {
+	case "", profileMysql:
+		if p.Files != nil {
+			return fmt.Errorf("profile %s: files is only for profiles of type files", p.Name)
+		}
+		if len(p.Databases) > 0 {
+			err := p.validateDatabases()
+			if err != nil {
+				return fmt.Errorf("profile %s: %v", p.Name, err)
+			}
+		}
+		remotes := 0
+		for _, set := range []bool{p.DockerContainer != "", p.Kubernetes != nil, p.SSH != nil} {
+			if set {
+				remotes++
+			}
+		}
+		if remotes > 1 {
+			return fmt.Errorf("profile %s: only one of docker_container, kubernetes and ssh can be used", p.Name)
+		}
+		if p.SSH != nil {
+			err := p.SSH.validate()
+			if err != nil {
+				return fmt.Errorf("profile %s: %v", p.Name, err)
+			}
+		}
+		if p.Kubernetes != nil && p.Kubernetes.Pod == "" {
+			return fmt.Errorf("profile %s: kubernetes: pod is not set", p.Name)
+		}
+		// kubectl exec and ssh cannot pass MYSQL_PWD, and a password on
+		// the command line shows in the process lists of both ends.
+		if (p.Kubernetes != nil || p.SSH != nil) && (p.DBPass != "" || !p.usesOptionFiles()) {
+			return fmt.Errorf("profile %s: with kubernetes or ssh, the password must be in db_defaults_file or db_login_path on the database host, not in db_pass", p.Name)
+		}
+		for _, o := range p.DumpOptions {
+			// Anything else would be taken for a database or table to dump.
+			if !strings.HasPrefix(o, "-") {
+				return fmt.Errorf("profile %s: dump_options: not an option: %s", p.Name, o)
+			}
+		}
+	case profileFiles:
+		if p.Files == nil {
+			return fmt.Errorf("profile %s: files is not set", p.Name)
+		}
+		err := p.Files.validate()
+		if err != nil {
+			return fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+		if p.Drill != nil || p.Standby != nil {
+			return fmt.Errorf("profile %s: restore drills and standby need a database", p.Name)
+		}
+		if p.Grants || p.BinlogCoordinates || len(p.DumpOptions) > 0 || p.usesOptionFiles() || p.DockerContainer != "" ||
+			p.Kubernetes != nil || p.SSH != nil {
+			return fmt.Errorf("profile %s: grants, binlog_coordinates, dump_options, db_defaults_file, db_login_path, docker_container, kubernetes and ssh need a database", p.Name)
+		}
+	default:
+		return fmt.Errorf("profile %s: unknown type: %s", p.Name, p.Type)
+	}
+	if p.Schedule != "" {
+		_, err := parseSchedule(p.Schedule)
+		if err != nil {
+			return fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+	}
+	if p.WriteOnly && (p.Verify != nil || p.SpotCheck != nil || p.Drill != nil || p.Standby != nil) {
+		return fmt.Errorf("profile %s: verify, spot_check, drill and standby read backups, which write_only credentials cannot", p.Name)
+	}
+	if p.Calendar != nil {
+		if p.Schedule == "" {
+			return fmt.Errorf("profile %s: calendar needs a schedule", p.Name)
+		}
+		_, err := newCalendar(p.Calendar)
+		if err != nil {
+			return fmt.Errorf("profile %s: calendar: %v", p.Name, err)
+		}
+	}
+	if p.EncryptedName != "" {
+		err := validateNameTemplate(p.EncryptedName)
+		if err != nil {
+			return fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+	}
+	if p.Retention != nil {
+		if err := p.Retention.validate(p); err != nil {
+			return fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+	}
+	if err := p.validateStream(); err != nil {
+		return fmt.Errorf("profile %s: %v", p.Name, err)
+	}
+	if err := p.validateTarget(); err != nil {
+		return fmt.Errorf("profile %s: %v", p.Name, err)
+	}
+	if err := p.validateArtifactPaths(); err != nil {
+		return fmt.Errorf("profile %s: %v", p.Name, err)
+	}
+	for i, c := range p.AfterRestore {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("profile %s: after_restore %d: %v", p.Name, i+1, err)
+		}
+	}
+	if err := validateKeyFingerprint(p.KeyFingerprint); err != nil {
+		return fmt.Errorf("profile %s: %v", p.Name, err)
+	}
+	err := p.Notify.validate()
+	if err != nil {
+		return fmt.Errorf("profile %s: notify: %v", p.Name, err)
+	}
+	if p.Verify != nil {
+		_, err := parseSchedule(p.Verify.Schedule)
+		if err != nil {
+			return fmt.Errorf("profile %s: verify: %v", p.Name, err)
+		}
+	}
+	if p.SpotCheck != nil {
+		_, err := parseSchedule(p.SpotCheck.Schedule)
+		if err != nil {
+			return fmt.Errorf("profile %s: spot_check: %v", p.Name, err)
+		}
+	}
+	if p.Drill != nil {
+		_, err := parseSchedule(p.Drill.Schedule)
+		if err != nil {
+			return fmt.Errorf("profile %s: drill: %v", p.Name, err)
+		}
+	}
+	if p.Standby != nil {
+		_, err := parseSchedule(p.Standby.Schedule)
+		if err != nil {
+			return fmt.Errorf("profile %s: standby: %v", p.Name, err)
+		}
+		if p.Standby.Database == "" {
+			return fmt.Errorf("profile %s: standby: database is required", p.Name)
+		}
+		for _, db := range p.databases() {
+			if p.Standby.Database == db {
+				return fmt.Errorf("profile %s: standby: database %s is backed up by the profile; the standby must be restored into another database", p.Name, db)
+			}
+		}
+	}
+	if p.Binlog != nil {
+		if err := p.validateBinlog(); err != nil {
+			return fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// databases returns the databases backed up by the profile.
+func (p *Profile) databases() []string {
+	if len(p.Databases) > 0 {
+		return p.Databases
+	}
+	return []string{p.Database}
+}
+
+// isMultiDatabase reports whether the dump holds several databases. Such a
+// dump names its databases itself, so it cannot be loaded into another
+// database.
+func (p *Profile) isMultiDatabase() bool {
+	return len(p.Databases) > 1
+}
+
+func (p *Profile) validateDatabases() error {
+	if p.Database != "" {
+		return fmt.Errorf("database and databases cannot be used together")
+	}
+	seen := make(map[string]bool)
+	for _, db := range p.Databases {
+		if db == "" || seen[db] {
+			return fmt.Errorf("databases must be distinct and not empty")
+		}
+		seen[db] = true
+	}
+	if p.isMultiDatabase() && p.Drill != nil {
+		return fmt.Errorf("restore drills need a single database")
+	}
+	if p.isMultiDatabase() && p.Verify != nil && p.Verify.Deep {
+		return fmt.Errorf("deep verification needs a single database")
+	}
+	if p.isMultiDatabase() && p.Standby != nil {
+		return fmt.Errorf("standby needs a single database")
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	err := validateInstanceID(c.InstanceID)
+	if err != nil {
+		return err
+	}
+	err = validateClockCheck(c.ClockCheck)
+	if err != nil {
+		return err
+	}
+	if c.Templates != nil {
+		err = c.Templates.load()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Tracing != nil {
+		err = c.Tracing.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.CatalogS3 != nil {
+		err := c.CatalogS3.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.AuditS3 != nil {
+		err := c.AuditS3.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.SMTP != nil {
+		err := c.SMTP.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Agent != nil {
+		err := c.Agent.validate("agent")
+		if err != nil {
+			return err
+		}
+		if c.Agent.CertFile == "" {
+			return fmt.Errorf("agent: cert_file and key_file are required, so that the token is not sent in clear text")
+		}
+	}
+	if c.API != nil {
+		err := c.API.validate("api")
+		if err != nil {
+			return err
+		}
+		if c.API.CertFile == "" && !c.API.loopback() {
+			return fmt.Errorf("api: cert_file and key_file are required unless listen is a loopback address, so that the token is not sent in clear text")
+		}
+	}
+	if c.Language != "" && !validLanguage(c.Language) {
+		return fmt.Errorf("invalid language: %s", c.Language)
+	}
+	if c.Dashboard != nil {
+		err := c.Dashboard.validate("dashboard")
+		if err != nil {
+			return err
+		}
+		if c.Dashboard.CertFile == "" && !c.Dashboard.loopback() {
+			return fmt.Errorf("dashboard: cert_file and key_file are required unless listen is a loopback address, so that the token is not sent in clear text")
+		}
+	}
+	if c.Controller != nil {
+		err := c.Controller.validate()
+		if err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	dirs := make(map[string]string)
+	for _, p := range c.Profiles {
+		if p.Name == "" {
+			return fmt.Errorf("profile without name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate profile name: %s", p.Name)
+		}
+		names[p.Name] = true
+		err := p.validate()
+		if err != nil {
+			return err
+		}
+		if p.Notify.mails() && c.SMTP == nil {
+			return fmt.Errorf("profile %s: email notifications need smtp to be configured", p.Name)
+		}
+		if p.Drill != nil && len(p.Drill.EmailTo) > 0 && c.SMTP == nil {
+			return fmt.Errorf("profile %s: drill reports need smtp to be configured", p.Name)
+		}
+		for _, dir := range []string{p.BackupDir, p.EncryptedDir} {
+			dir = filepath.Clean(dir)
+			if other, ok := dirs[dir]; ok && other != p.Name {
+				return fmt.Errorf("profiles %s and %s share directory %s",
+					other, p.Name, dir)
+			}
+			dirs[dir] = p.Name
+		}
+	}
+	c.warnings, err = validateIsolation(c.Profiles)
+	return err
+}
+
+func (c *Config) selectProfiles(names []string) ([]*Profile, error) {
+	if len(names) == 0 {
+		return c.Profiles, nil
+	}
+	var selected []*Profile
+	for _, name := range names {
+		found := false
+		for _, p := range c.Profiles {
+			if p.Name == name {
+				selected = append(selected, p)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown profile: %s", name)
+		}
+	}
+	return selected, nil
+}
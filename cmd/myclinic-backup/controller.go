@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ControllerConfig makes the controller command collect backups from the
+// agents of many sites and store them centrally.
+type ControllerConfig struct {
+	// StoreDir keeps the collected backups, by site and month.
+	StoreDir string `yaml:"store_dir"`
+	// Collected backups are also uploaded to S3 if S3Bucket is set.
+	S3Region  string        `yaml:"s3_region"`
+	S3Bucket  string        `yaml:"s3_bucket"`
+	S3Prefix  string        `yaml:"s3_prefix"`
+	S3RoleARN string        `yaml:"s3_role_arn"`
+	Sites     []*SiteConfig `yaml:"sites"`
+}
+
+// SiteConfig is one clinic whose agent the controller collects from.
+type SiteConfig struct {
+	Name string `yaml:"name"`
+	// URL is the base URL of the agent, e.g. https://clinic-a:9130. It
+	// must be https, which the agent requires.
+	URL       string `yaml:"url"`
+	Profile   string `yaml:"profile"`
+	TokenFile string `yaml:"token_file"`
+	// CAFile is the certificate authority of the agent's certificate.
+	CAFile   string       `yaml:"ca_file"`
+	Schedule string       `yaml:"schedule"`
+	Notify   NotifyConfig `yaml:"notify"`
+}
+
+func (c *ControllerConfig) validate() error {
+	if c.StoreDir == "" {
+		return fmt.Errorf("controller: store_dir is not set")
+	}
+	if c.S3Bucket != "" && c.S3Region == "" {
+		return fmt.Errorf("controller: s3_region is not set")
+	}
+	names := make(map[string]bool)
+	for _, s := range c.Sites {
+		if s.Name == "" || strings.ContainsAny(s.Name, `/\`) {
+			return fmt.Errorf("controller: invalid site name: %q", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("controller: duplicate site name: %s", s.Name)
+		}
+		names[s.Name] = true
+		if s.URL == "" || s.Profile == "" || s.TokenFile == "" {
+			return fmt.Errorf("controller: site %s: url, profile and token_file are required", s.Name)
+		}
+		if u, err := url.Parse(s.URL); err != nil || u.Scheme != "https" {
+			return fmt.Errorf("controller: site %s: url must be https: %s", s.Name, s.URL)
+		}
+		_, err := parseSchedule(s.Schedule)
+		if err != nil {
+			return fmt.Errorf("controller: site %s: %v", s.Name, err)
+		}
+		err = s.Notify.validate()
+		if err != nil {
+			return fmt.Errorf("controller: site %s: notify: %v", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// collect fetches a backup from the agent of the site, stores it and
+// records it in the catalog under the site name.
+func (c *ControllerConfig) collect(s *SiteConfig, trigger string) (*CatalogEntry, error) {
+	token, err := readSecretFile(s.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := agentClient(s.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(s.URL, "/")+"/v1/dump?profile="+
+		url.QueryEscape(s.Profile), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("agent responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	work, err := createWorkDir(filepath.Join(c.StoreDir, workDirName, s.Name), newRunID())
+	if err != nil {
+		return nil, fmt.Errorf("cannot create work directory: %v", err)
+	}
+	defer removeWorkDir(work)
+	tmp := filepath.Join(work, "dump.cf")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	encSize, err := io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("transfer failed: %v", err)
+	}
+	// The agent streams the dump and sends its metadata after it.
+	if msg := resp.Trailer.Get(headerError); msg != "" {
+		return nil, fmt.Errorf("dump failed on the agent: %s", msg)
+	}
+	if resp.Trailer.Get(headerSHA256) == "" {
+		return nil, fmt.Errorf("agent did not complete the dump")
+	}
+	t, err := time.Parse(time.RFC3339, resp.Trailer.Get(headerTime))
+	if err != nil {
+		return nil, fmt.Errorf("agent sent invalid time: %v", err)
+	}
+	size, _ := strconv.ParseInt(resp.Trailer.Get(headerSize), 10, 64)
+	// The size and SHA-256 of the plain dump are the agent's word: the
+	// controller holds no key to decrypt the dump with, so it records them
+	// as sent and vouches only for the SHA-256 of the encrypted file.
+	// Verifying the backup where the key is checks the SHA-256 against the
+	// decrypted dump.
+	entry := &CatalogEntry{
+		RunID:         resp.Trailer.Get(headerRunID),
+		Profile:       s.Name,
+		Time:          t,
+		Size:          size,
+		SHA256:        resp.Trailer.Get(headerSHA256),
+		EncryptedSize: encSize,
+		Trigger:       trigger,
+		Instance:      instanceID,
+	}
+	entry.EncryptedFile = filepath.Join(c.StoreDir, s.Name, dirPart(t),
+		s.Name+"-"+t.Format("200601021504")+".cf")
+	err = moveIntoPlace(tmp, entry.EncryptedFile)
+	if err != nil {
+		return nil, err
+	}
+	entry.EncryptedSHA256 = hex.EncodeToString(h.Sum(nil))
+	fmt.Fprintf(stdout, tr("[%s] stored %s (sha256 of encrypted file %s)\n"), s.Name, entry.EncryptedFile,
+		entry.EncryptedSHA256)
+	if c.S3Bucket != "" {
+		entry.S3Bucket = c.S3Bucket
+		entry.S3Key = createS3Key(normalizePrefix(c.S3Prefix)+s.Name, entry.EncryptedFile)
+		sess, err := newAWSSession(c.S3Region, "", c.S3RoleARN, "", "controller")
+		if err != nil {
+			return nil, fmt.Errorf("cannot create AWS session: %v", err)
+		}
+		err = uploadToS3(sess, c.S3Bucket, entry.S3Key, entry.EncryptedFile, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload to S3: %v", err)
+		}
+		fmt.Fprintf(stdout, tr("[%s] uploaded to s3://%s/%s\n"), s.Name, c.S3Bucket, entry.S3Key)
+	}
+	return entry, catalog.Add(entry)
+}
+
+func (c *ControllerConfig) collectAndReport(s *SiteConfig, trigger string) error {
+	started := time.Now()
+	entry, err := c.collect(s, trigger)
+	result := &ProfileResult{Profile: s.Name, Trigger: trigger, Success: err == nil, Started: started, Finished: time.Now()}
+	if entry != nil {
+		result.RunID = entry.RunID
+		result.EncryptedFile = entry.EncryptedFile
+		result.S3Key = entry.S3Key
+	}
+	if err != nil {
+		result.Error = redactError(err)
+		fmt.Fprintf(stderr, tr("[%s] collection failed: %v\n"), s.Name, err)
+	}
+	if nerr := notify(s.Notify, backupEvent(result)); nerr != nil {
+		fmt.Fprintf(stderr, tr("[%s] notification failed: %v\n"), s.Name, nerr)
+	}
+	return err
+}
+
+// controllerCommand collects from the sites on their schedules, or with
+// -once from every site right away.
+func controllerCommand(config *Config, profiles []*Profile, args []string) error {
+	c := config.Controller
+	if c == nil {
+		return fmt.Errorf("controller is not configured")
+	}
+	flags := flag.NewFlagSet("controller", flag.ExitOnError)
+	once := flags.Bool("once", false, "collects from every site once and exits")
+	flags.Parse(args)
+	if *once {
+		failed := 0
+		for _, s := range c.Sites {
+			if c.collectAndReport(s, triggerManual) != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("collection failed for %d site(s)", failed)
+		}
+		return nil
+	}
+	lim := newLimiter(config.Workers)
+	var jobs []*scheduledJob
+	for _, s := range c.Sites {
+		s := s
+		schedule, _ := parseSchedule(s.Schedule)
+		jobs = append(jobs, &scheduledJob{
+			name:     "collection from " + s.Name,
+			schedule: schedule,
+			run: func(now time.Time) {
+				lim.do(func() {
+					c.collectAndReport(s, triggerSchedule)
+				})
+			},
+		})
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("no sites configured")
+	}
+	runJobs(jobs)
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// scheduledJob is something the daemon runs whenever its schedule fires.
+type scheduledJob struct {
+	name     string
+	schedule jobSchedule
+	run      func(now time.Time)
+}
+
+// jobSchedule tells when a job runs: a *Schedule, or a schedule adjusted
+// by a calendar.
+type jobSchedule interface {
+	// Match reports whether the job runs at the minute containing t.
+	Match(t time.Time) bool
+}
+
+func profileJobs(config *Config, p *Profile, lim limiter, transfers limiter) ([]*scheduledJob, error) {
+	var jobs []*scheduledJob
+	if p.Schedule != "" {
+		s, err := parseSchedule(p.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		var schedule jobSchedule = s
+		if p.Calendar != nil {
+			cal, err := newCalendar(p.Calendar)
+			if err != nil {
+				return nil, err
+			}
+			schedule = &calendarSchedule{cal: cal, schedule: s}
+			if cal.monthEnd != nil {
+				jobs = append(jobs, &scheduledJob{
+					name:     "month-end backup of " + p.Name,
+					schedule: &monthEndSchedule{cal: cal},
+					run: func(now time.Time) {
+						runProfiles(config, []*Profile{p}, lim, runOptions{
+							now:       now,
+							trigger:   triggerSchedule,
+							label:     monthEndLabel(now),
+							labelled:  true,
+							transfers: transfers,
+						})
+					},
+				})
+			}
+		}
+		jobs = append(jobs, &scheduledJob{
+			name:     "backup of " + p.Name,
+			schedule: schedule,
+			run: func(now time.Time) {
+				runProfiles(config, []*Profile{p}, lim, runOptions{
+					now:       now,
+					trigger:   triggerSchedule,
+					labelled:  true,
+					transfers: transfers,
+				})
+			},
+		})
+	}
+	if p.Verify != nil {
+		s, err := parseSchedule(p.Verify.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &scheduledJob{
+			name:     "verification of " + p.Name,
+			schedule: s,
+			run: func(now time.Time) {
+				lim.do(func() {
+					verifyRandomBackup(p, "["+p.Name+"] ")
+				})
+			},
+		})
+	}
+	if p.SpotCheck != nil {
+		s, err := parseSchedule(p.SpotCheck.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &scheduledJob{
+			name:     "spot check of " + p.Name,
+			schedule: s,
+			run: func(now time.Time) {
+				lim.do(func() {
+					runSpotCheck(p, "["+p.Name+"] ")
+				})
+			},
+		})
+	}
+	if p.Drill != nil {
+		s, err := parseSchedule(p.Drill.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &scheduledJob{
+			name:     "restore drill of " + p.Name,
+			schedule: s,
+			run: func(now time.Time) {
+				lim.do(func() {
+					runDrill(config, p)
+				})
+			},
+		})
+	}
+	if p.Notify.WeeklySummary != "" {
+		s, err := parseSchedule(p.Notify.WeeklySummary)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &scheduledJob{
+			name:     "weekly summary of " + p.Name,
+			schedule: s,
+			run: func(now time.Time) {
+				sendWeeklySummary(p, now)
+			},
+		})
+	}
+	if p.Standby != nil {
+		s, err := parseSchedule(p.Standby.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &scheduledJob{
+			name:     "standby restore of " + p.Name,
+			schedule: s,
+			run: func(now time.Time) {
+				lim.do(func() {
+					runStandby(config, p, "["+p.Name+"] ")
+				})
+			},
+		})
+	}
+	if p.Binlog != nil && p.Binlog.Schedule != "" {
+		s, err := parseSchedule(p.Binlog.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &scheduledJob{
+			name:     "binary log shipping of " + p.Name,
+			schedule: s,
+			run: func(now time.Time) {
+				prefix := "[" + p.Name + "] "
+				var err error
+				lim.do(func() {
+					_, err = shipBinlogs(config, p, prefix)
+				})
+				if err != nil {
+					fmt.Fprintf(stderr, tr("%sshipping binary logs: %v\n"), prefix, err)
+					return
+				}
+				// The backup waits for a slot of lim itself.
+				err = rebaseChain(config, p, prefix, runOptions{
+					now:       now,
+					labelled:  true,
+					dumps:     lim,
+					transfers: transfers,
+				})
+				if err != nil {
+					fmt.Fprintf(stderr, tr("%sstarting a new chain of binary logs: %v\n"), prefix, err)
+				}
+			},
+		})
+	}
+	return jobs, nil
+}
+
+var everyMinute, _ = parseSchedule("* * * * *")
+
+// daemon runs the scheduled jobs of the profiles.
+func daemon(config *Config, profiles []*Profile) error {
+	rand.Seed(time.Now().UnixNano())
+	lim := newLimiter(config.Workers)
+	transfers := newLimiter(config.TransferWorkers)
+	var jobs []*scheduledJob
+	for _, p := range profiles {
+		pj, err := profileJobs(config, p, lim, transfers)
+		if err != nil {
+			return err
+		}
+		if len(pj) == 0 {
+			fmt.Fprintf(stderr, tr("profile %s has no schedule; skipped\n"), p.Name)
+		}
+		jobs = append(jobs, pj...)
+	}
+	w := newWatchdog(func(p *Profile, now time.Time) (*Event, error) {
+		return overdueEvent(p, p.MaxAge, now)
+	})
+	objectives := newWatchdog(objectivesEvent)
+	for _, p := range profiles {
+		p := p
+		if p.MaxAge > 0 {
+			jobs = append(jobs, &scheduledJob{
+				name:     "watchdog of " + p.Name,
+				schedule: everyMinute,
+				run: func(now time.Time) {
+					w.check(p, now)
+				},
+			})
+		}
+		if p.RPO > 0 || p.RTO > 0 {
+			jobs = append(jobs, &scheduledJob{
+				name:     "recovery objectives of " + p.Name,
+				schedule: everyMinute,
+				run: func(now time.Time) {
+					objectives.check(p, now)
+				},
+			})
+		}
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("no profile has a schedule")
+	}
+	if config.HTTPListen != "" {
+		go func() {
+			err := serveStatus(config.HTTPListen, profiles)
+			fmt.Fprintf(stderr, tr("monitoring endpoint stopped: %v\n"), err)
+		}()
+	}
+	if config.Dashboard != nil {
+		go func() {
+			err := serveDashboard(config, profiles)
+			fmt.Fprintf(stderr, tr("dashboard stopped: %v\n"), err)
+		}()
+	}
+	runJobs(jobs)
+	return nil
+}
+
+// runJobs runs the jobs whenever their schedules fire, forever. A job is
+// not started again while its previous run is still in progress.
+func runJobs(jobs []*scheduledJob) {
+	var mu sync.Mutex
+	running := make(map[*scheduledJob]bool)
+	for {
+		now := time.Now().Truncate(time.Minute)
+		for _, job := range jobs {
+			if !job.schedule.Match(now) {
+				continue
+			}
+			mu.Lock()
+			busy := running[job]
+			running[job] = true
+			mu.Unlock()
+			if busy {
+				fmt.Fprintf(stderr, tr("previous %s still in progress; skipped\n"), job.name)
+				continue
+			}
+			go func(job *scheduledJob) {
+				job.run(now)
+				mu.Lock()
+				delete(running, job)
+				mu.Unlock()
+			}(job)
+		}
+		time.Sleep(time.Until(now.Add(time.Minute)))
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dashboardCookie holds the session of a signed in browser, a random ID
+// rather than the token, which the cookie would otherwise keep.
+const dashboardCookie = "myclinic_backup_session"
+
+// dashboardSessionTime is how long a browser stays signed in.
+const dashboardSessionTime = 12 * time.Hour
+
+// dashboardBackups is how many backups of each profile the dashboard
+// lists.
+const dashboardBackups = 20
+
+var dashboardFuncs = template.FuncMap{
+	"tr":    tr,
+	"lang":  func() string { return language },
+	"bytes": formatBytes,
+	"time": func(t time.Time) string {
+		return t.Local().Format("2006-01-02 15:04")
+	},
+	"lastVerification": func(e *CatalogEntry) *Verification {
+		if len(e.Verifications) == 0 {
+			return nil
+		}
+		return e.Verifications[len(e.Verifications)-1]
+	},
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(dashboardFuncs).Parse(`<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+<meta charset="utf-8">
+<title>myclinic-backup</title>
+{{if .Running}}<meta http-equiv="refresh" content="10">{{end}}
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #f0f0f0; }
+.ok { color: #080; }
+.bad { color: #c00; font-weight: bold; }
+.message { background: #ffd; border: 1px solid #cc8; padding: 0.5em; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>{{tr "Backups"}}</h1>
+{{with .Message}}<p class="message">{{.}}</p>{{end}}
+{{range .Profiles}}
+<h2>{{.Status.Profile}}</h2>
+<p>
+{{if .Status.Time}}{{tr "Last backup:"}} {{time .Status.Time}}{{else}}{{tr "No backup yet."}}{{end}}
+{{if .Status.Overdue}}<span class="bad">{{tr "The last backup is too old. Please check the backup or contact support."}}</span>{{end}}
+</p>
+<p>
+<form method="post" action="backup"><input type="hidden" name="profile" value="{{.Status.Profile}}"><button>{{tr "Back up now"}}</button></form>
+{{if .Prunable}}<form method="post" action="prune" onsubmit="return confirm('{{printf (tr "Delete plain dumps %s?") .Retention}}')"><input type="hidden" name="profile" value="{{.Status.Profile}}"><button>{{tr "Delete old plain dumps"}}</button></form>{{end}}
+</p>
+{{if .Backups}}
+<table>
+<tr><th>{{tr "Time"}}</th><th>{{tr "Size"}}</th><th>{{tr "Stored size"}}</th><th>{{tr "Verified"}}</th><th></th></tr>
+{{range .Backups}}
+<tr>
+<td>{{time .Time}}</td>
+<td>{{bytes .Size}}</td>
+<td>{{bytes .EncryptedSize}}</td>
+<td>{{with lastVerification .}}{{if .OK}}<span class="ok">{{tr "OK"}}</span>{{else}}<span class="bad">{{tr "failed"}}</span>{{end}} ({{time .Time}}){{else}}{{tr "not yet"}}{{end}}</td>
+<td>
+{{if .S3Key}}
+<form method="post" action="verify"><input type="hidden" name="profile" value="{{.Profile}}"><input type="hidden" name="run_id" value="{{.RunID}}"><button>{{tr "Verify"}}</button></form>
+{{if $.Restorable .Profile}}
+<form method="post" action="restore" onsubmit="return confirm('{{printf (tr "Restore the backup of %s? The database will be overwritten.") (time .Time)}}')"><input type="hidden" name="profile" value="{{.Profile}}"><input type="hidden" name="run_id" value="{{.RunID}}"><input name="target_db" placeholder="{{tr "database"}}" size="12" required><button>{{tr "Restore"}}</button></form>
+{{end}}
+{{else}}{{tr "not uploaded"}}{{end}}
+</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+{{if .Operations}}
+<h2>{{tr "Recent operations"}}</h2>
+<table>
+<tr><th>{{tr "Started"}}</th><th>{{tr "Operation"}}</th><th>{{tr "Profile"}}</th><th>{{tr "Status"}}</th><th>{{tr "Details"}}</th></tr>
+{{range .Operations}}
+<tr>
+<td>{{time .Started}}</td>
+<td>{{tr .Kind}}</td>
+<td>{{.Profile}}</td>
+<td>{{if eq .Status "failed"}}<span class="bad">{{tr "failed"}}</span>{{else if eq .Status "succeeded"}}<span class="ok">{{tr "succeeded"}}</span>{{else}}{{tr .Status}}{{end}}</td>
+<td>{{if .Error}}{{.Error}}{{else}}{{.Progress}}{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+var dashboardLoginTemplate = template.Must(template.New("login").Funcs(dashboardFuncs).Parse(`<!DOCTYPE html>
+<html lang="{{lang}}">
+<head><meta charset="utf-8"><title>myclinic-backup</title></head>
+<body style="font-family: sans-serif; margin: 2em">
+<h1>{{tr "Backups"}}</h1>
+{{if .}}<p style="color: #c00">{{tr "The token is not correct."}}</p>{{end}}
+<form method="post" action="login">
+<label>{{tr "Token"}} <input type="password" name="token" autofocus></label>
+<button>{{tr "Sign in"}}</button>
+</form>
+</body>
+</html>
+`))
+
+type dashboardProfile struct {
+	Status    *profileStatus
+	Backups   []*CatalogEntry
+	Prunable  bool
+	Retention string
+}
+
+type dashboardPage struct {
+	Message    string
+	Profiles   []*dashboardProfile
+	Operations []*Operation
+	Running    bool
+	profiles   []*Profile
+}
+
+// Restorable reports whether backups of the profile can be restored from
+// the dashboard.
+func (d *dashboardPage) Restorable(name string) bool {
+	p := findProfile(d.profiles, name)
+	return p != nil && !p.isFiles() && !p.isMultiDatabase()
+}
+
+// dashboard is the web UI served by the daemon for checking and running
+// backups from a browser. It starts operations like the API does.
+type dashboard struct {
+	api   *apiServer
+	token string
+	mu    sync.Mutex
+	// sessions are the expiry times of the signed in sessions by their
+	// IDs.
+	sessions map[string]time.Time
+}
+
+func (d *dashboard) page(message string) (*dashboardPage, error) {
+	statuses, err := profileStatuses(d.api.profiles, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	page := &dashboardPage{Message: message, Operations: d.api.ops.list(), profiles: d.api.profiles}
+	for i, p := range d.api.profiles {
+		dp := &dashboardProfile{
+			Status:    statuses[i],
+			Prunable:  p.prunesPlainDumps(),
+			Retention: p.describeRetention(),
+		}
+		for _, e := range entries {
+			if e.Profile == p.Name && e.isDump() {
+				dp.Backups = append(dp.Backups, e)
+			}
+		}
+		sort.Slice(dp.Backups, func(i, j int) bool { return dp.Backups[i].Time.After(dp.Backups[j].Time) })
+		if len(dp.Backups) > dashboardBackups {
+			dp.Backups = dp.Backups[:dashboardBackups]
+		}
+		page.Profiles = append(page.Profiles, dp)
+	}
+	for _, op := range page.Operations {
+		if op.Status == statusRunning {
+			page.Running = true
+		}
+	}
+	return page, nil
+}
+
+// startPrune deletes the plain dumps of the profile which its retention
+// rules delete, as is otherwise done after each backup.
+func (d *dashboard) startPrune(p *Profile, req *apiRequest) (*Operation, error) {
+	if !p.prunesPlainDumps() {
+		return nil, &apiError{http.StatusBadRequest, fmt.Errorf("neither plain_retention nor plain_keep_last is set for profile %s", p.Name)}
+	}
+	op, err := d.api.ops.start(operationPrune, p.Name, func(log io.Writer) (interface{}, error) {
+		removed, err := p.expirePlainDumps(time.Now(), "")
+		for _, path := range removed {
+			fmt.Fprintf(log, "removed expired plain dump %s\n", path)
+		}
+		return removed, err
+	})
+	if err != nil {
+		return nil, &apiError{http.StatusConflict, err}
+	}
+	return op, nil
+}
+
+func (d *dashboard) signedIn(r *http.Request) bool {
+	c, err := r.Cookie(dashboardCookie)
+	if err != nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	expires, ok := d.sessions[c.Value]
+	if ok && time.Now().After(expires) {
+		delete(d.sessions, c.Value)
+		return false
+	}
+	return ok
+}
+
+// newSession starts a session and returns its ID.
+func (d *dashboard) newSession() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for s, expires := range d.sessions {
+		if now.After(expires) {
+			delete(d.sessions, s)
+		}
+	}
+	d.sessions[id] = now.Add(dashboardSessionTime)
+	return id, nil
+}
+
+func (d *dashboard) login(w http.ResponseWriter, r *http.Request) {
+	failed := false
+	if r.Method == http.MethodPost {
+		given := r.PostFormValue("token")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(d.token)) == 1 {
+			id, err := d.newSession()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     dashboardCookie,
+				Value:    id,
+				Path:     "/",
+				MaxAge:   int(dashboardSessionTime / time.Second),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(w, r, "./", http.StatusSeeOther)
+			return
+		}
+		failed = true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	dashboardLoginTemplate.Execute(w, failed)
+}
+
+// action serves a button of the dashboard, returning to the page with the
+// outcome.
+func (d *dashboard) action(start func(p *Profile, req *apiRequest) (*Operation, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		req := &apiRequest{
+			Profile:  r.PostFormValue("profile"),
+			RunID:    r.PostFormValue("run_id"),
+			TargetDB: r.PostFormValue("target_db"),
+			Deep:     r.PostFormValue("deep") != "",
+		}
+		var message string
+		p := findProfile(d.api.profiles, req.Profile)
+		if p == nil {
+			message = "unknown profile: " + req.Profile
+		} else if op, err := start(p, req); err != nil {
+			message = redactError(err)
+		} else {
+			message = trf("%s of %s started", tr(op.Kind), p.Name)
+		}
+		http.Redirect(w, r, "./?message="+url.QueryEscape(message), http.StatusSeeOther)
+	}
+}
+
+func (d *dashboard) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		page, err := d.page(r.URL.Query().Get("message"))
+		if err != nil {
+			http.Error(w, redactError(err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = dashboardTemplate.Execute(w, page)
+		if err != nil {
+			fmt.Fprintf(stderr, tr("dashboard: %v\n"), err)
+		}
+	})
+	mux.HandleFunc("/backup", d.action(func(p *Profile, req *apiRequest) (*Operation, error) {
+		return d.api.startBackup(p, triggerDashboard, "", "")
+	}))
+	mux.HandleFunc("/restore", d.action(d.api.startRestore))
+	mux.HandleFunc("/verify", d.action(d.api.startVerify))
+	mux.HandleFunc("/prune", d.action(d.startPrune))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			d.login(w, r)
+			return
+		}
+		if !d.signedIn(r) {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveDashboard serves the dashboard until it fails.
+func serveDashboard(config *Config, profiles []*Profile) error {
+	token, err := readSecretFile(config.Dashboard.TokenFile)
+	if err != nil {
+		return err
+	}
+	d := &dashboard{
+		api:      &apiServer{config: config, profiles: profiles, ops: newOperations()},
+		token:    token,
+		sessions: make(map[string]time.Time),
+	}
+	return config.Dashboard.listen(d.handler())
+}
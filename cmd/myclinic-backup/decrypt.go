@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io/ioutil"
+)
+
+// decryptBackup reverses compressAndEncrypt: the data starts with the
+// crypt-file header ("CF", version, 12 byte nonce) followed by the AES-GCM
+// sealed, compressed content.
+func decryptBackup(key []byte, data []byte) ([]byte, error) {
+	if len(data) < 3 || data[0] != 'C' || data[1] != 'F' {
+		return nil, fmt.Errorf("not crypt-file data")
+	}
+	if data[2] != 1 {
+		return nil, fmt.Errorf("unsupported crypt-file version: %d", data[2])
+	}
+	if len(data) < 15 {
+		return nil, fmt.Errorf("truncated crypt-file data")
+	}
+	nonce, sealed := data[3:15], data[15:]
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed (wrong key or corrupted data): %v", err)
+	}
+	r, err := decompressReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// With dedup_plain, a plain dump identical to the previous one, as happens
+// on weekends and holidays when nothing is entered, is stored as a hard
+// link to it, or where hard links fail as a reflink sharing its blocks,
+// instead of as another full copy. mysqldump is then told to leave out the
+// date it otherwise writes at the end, which would make every dump differ.
+
+// previousPlainDump returns the newest plain dump of the profile of the
+// same kind as name, or "" if there is none.
+func (p *Profile) previousPlainDump(name string) (string, error) {
+	dumps, err := listPlainDumps(p.BackupDir)
+	if err != nil {
+		return "", err
+	}
+	for _, d := range dumps {
+		if filepath.Ext(d.path) == filepath.Ext(name) && filepath.Base(d.path) != filepath.Base(name) {
+			return d.path, nil
+		}
+	}
+	return "", nil
+}
+
+// sameContent reports whether the files a and b hold the same bytes.
+func sameContent(a string, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	ia, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	ib, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if ia.Size() != ib.Size() {
+		return false, nil
+	}
+	bufA := make([]byte, 1<<20)
+	bufB := make([]byte, 1<<20)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// linkDuplicate puts at dst a file sharing the storage of src, a hard
+// link or else a reflink, and returns how, or "" if neither is supported.
+func linkDuplicate(src string, dst string) (string, error) {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return "", err
+	}
+	if os.Link(src, dst) == nil {
+		return "hard link", nil
+	}
+	if reflink(src, dst) == nil {
+		return "reflink", nil
+	}
+	return "", nil
+}
+
+// placePlainDump moves the complete dump tmp to final, as a link to the
+// previous dump if dedup_plain is set and they are identical, and returns
+// the previous dump and how it was linked, or "" if it was moved.
+func (p *Profile) placePlainDump(tmp string, final string) (string, string, error) {
+	if p.DedupPlain {
+		previous, err := p.previousPlainDump(final)
+		if err != nil {
+			return "", "", err
+		}
+		if previous != "" {
+			same, err := sameContent(tmp, previous)
+			if err != nil {
+				return "", "", err
+			}
+			if same {
+				how, err := linkDuplicate(previous, final)
+				if err != nil {
+					return "", "", err
+				}
+				if how != "" {
+					return previous, how, os.Remove(tmp)
+				}
+			}
+		}
+	}
+	return "", "", moveIntoPlace(tmp, final)
+}
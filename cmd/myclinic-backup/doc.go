@@ -0,0 +1,19 @@
+// Command myclinic-backup backs up the MySQL database of myclinic,
+// encrypted with crypt-file, to S3 and other storage, and restores it.
+//
+// It is built with the Go that go.mod states, 1.13, and without cgo, so
+// that it builds for the Windows machines of the clinics as for Linux, and
+// it depends on the AWS SDK, crypt-file and yaml.v2 only. Where more was
+// asked for, the standard library does instead:
+//
+//   - The agent and the controller speak HTTPS with a bearer token rather
+//     than gRPC, which grpc-go would need a newer Go for. A dump is a single
+//     stream of bytes, which HTTP carries with its metadata in trailers.
+//   - The control API of the serve command streams the progress of a run
+//     as a chunked response of JSON lines rather than as a gRPC stream,
+//     which would also need generated stubs kept in step with a protoc
+//     the clinics' build machines lack. Package client reads it.
+//   - The history of runs is a file of JSON lines rather than a SQLite
+//     database, which would take cgo or a newer Go. The history command
+//     does the querying and the CSV and JSON export.
+package main
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Restores and fetches read a backup as a stream, which with a single GET
+// is as fast as one connection to S3 goes. With download_concurrency above
+// 1 a large object is instead read in parts of downloadPartSize by that
+// many ranged GETs at once, and the parts are passed on in order, so that
+// decryption and loading still see one stream. Memory is bounded by the
+// parts in flight.
+
+// downloadPartSize is the size of the ranges downloaded concurrently.
+const downloadPartSize = 8 << 20
+
+// downloadAttempts is how many times reading a part is tried, the SDK
+// retrying failed requests but not a body cut short.
+const downloadAttempts = 3
+
+// openS3ObjectParallel opens the object for reading in parts by
+// concurrency GETs. The first part is streamed while the others are
+// downloaded; all are requested with the ETag of the first, so that an
+// object replaced meanwhile fails rather than mixes.
+func openS3ObjectParallel(sess *session.Session, bucket string, key string, concurrency int) (io.ReadCloser, int64, error) {
+	svc := s3.New(sess)
+	first, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", downloadPartSize-1)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	size, ok := contentRangeSize(aws.StringValue(first.ContentRange))
+	if !ok {
+		// Not ranged, so the whole object.
+		return first.Body, aws.Int64Value(first.ContentLength), nil
+	}
+	if size <= downloadPartSize {
+		return first.Body, size, nil
+	}
+	ctx, cancel := context.WithCancel(aws.BackgroundContext())
+	r := &parallelReader{
+		current: first.Body,
+		first:   first.Body,
+		cancel:  cancel,
+		slots:   make(chan struct{}, concurrency),
+	}
+	parts := int((size + downloadPartSize - 1) / downloadPartSize)
+	for i := 1; i < parts; i++ {
+		r.parts = append(r.parts, make(chan partResult, 1))
+	}
+	go r.download(ctx, svc, &s3.GetObjectInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		IfMatch: first.ETag,
+	}, size)
+	return r, size, nil
+}
+
+// contentRangeSize returns the total size in a Content-Range header such
+// as "bytes 0-8388607/123456789".
+func contentRangeSize(header string) (int64, bool) {
+	i := strings.LastIndex(header, "/")
+	if i < 0 {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(header[i+1:], 10, 64)
+	return size, err == nil
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+// parallelReader reads the first part from its response and the others
+// from the results of the downloads, in order.
+type parallelReader struct {
+	current io.Reader
+	first   io.ReadCloser
+	// parts are the results of parts 1 and later.
+	parts  []chan partResult
+	next   int
+	cancel context.CancelFunc
+	// slots bound the parts downloaded and not yet read.
+	slots     chan struct{}
+	closeOnce sync.Once
+}
+
+// download fetches the parts in order, at most cap(slots) ahead of the
+// reader.
+func (r *parallelReader) download(ctx context.Context, svc *s3.S3, input *s3.GetObjectInput, size int64) {
+	for i, result := range r.parts {
+		select {
+		case r.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		start := int64(i+1) * downloadPartSize
+		end := start + downloadPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		go func(result chan partResult, start int64, end int64) {
+			in := *input
+			in.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end))
+			var p partResult
+			for attempt := 0; attempt < downloadAttempts; attempt++ {
+				p = downloadPart(ctx, svc, &in, end-start+1)
+				if p.err == nil || ctx.Err() != nil {
+					break
+				}
+			}
+			result <- p
+		}(result, start, end)
+	}
+}
+
+func downloadPart(ctx context.Context, svc *s3.S3, input *s3.GetObjectInput, size int64) partResult {
+	out, err := svc.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return partResult{err: err}
+	}
+	defer out.Body.Close()
+	data, err := ioutil.ReadAll(out.Body)
+	if err == nil && int64(len(data)) != size {
+		err = fmt.Errorf("part of %d bytes received, expected %d", len(data), size)
+	}
+	return partResult{data: data, err: err}
+}
+
+func (r *parallelReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.current.Read(b)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if r.next >= len(r.parts) {
+			return 0, io.EOF
+		}
+		p := <-r.parts[r.next]
+		if r.next > 0 {
+			// The part before is read; its slot goes to the next.
+			<-r.slots
+		}
+		r.next++
+		if p.err != nil {
+			return 0, fmt.Errorf("download failed: %v", p.err)
+		}
+		r.current = bytes.NewReader(p.data)
+	}
+}
+
+func (r *parallelReader) Close() error {
+	r.closeOnce.Do(r.cancel)
+	return r.first.Close()
+}
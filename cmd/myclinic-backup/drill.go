@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DrillConfig schedules restore drills: the latest backup is restored into
+// a temporary database and a pass/fail report is mailed.
+type DrillConfig struct {
+	Schedule string   `yaml:"schedule"`
+	EmailTo  []string `yaml:"email_to"`
+}
+
+// drillReport is the outcome of a restore drill.
+type drillReport struct {
+	Profile    string
+	Started    time.Time
+	Entry      *CatalogEntry
+	ChecksumOK bool
+	Database   string
+	// RestoreTime is how long the backup took to download, decrypt and
+	// load, which are streamed into one another.
+	RestoreTime time.Duration
+	Tables      string
+	// Drift compares the tables restored with the live database.
+	Drift *schemaDrift
+	// Checks are the query checks of after_restore.
+	Checks []*RestoreCheckResult
+	Err    error
+}
+
+func (d *drillReport) passed() bool {
+	return d.Err == nil
+}
+
+func (d *drillReport) status() string {
+	if d.passed() {
+		return tr("PASS")
+	}
+	return tr("FAIL")
+}
+
+func (d *drillReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, tr("Restore drill: %s\n\n"), d.status())
+	fmt.Fprintf(&b, tr("Profile: %s\n"), d.Profile)
+	fmt.Fprintf(&b, tr("Started: %s\n"), d.Started.Format("2006-01-02 15:04:05"))
+	if d.Entry != nil {
+		fmt.Fprintf(&b, tr("Backup: %s (taken %s)\n"), entryLocation(d.Entry),
+			d.Entry.Time.Format("2006-01-02 15:04"))
+	}
+	if d.ChecksumOK {
+		fmt.Fprintf(&b, tr("Checksum: OK\n"))
+	}
+	if d.Database != "" && d.RestoreTime > 0 {
+		fmt.Fprintf(&b, tr("Restored into temporary database %s in %s (%s tables)\n"),
+			d.Database, d.RestoreTime.Round(time.Second), d.Tables)
+	}
+	if d.Drift != nil && d.Drift.drifted() {
+		fmt.Fprintf(&b, tr("Schema: %d tables differ from live database %s; see schema-check\n"),
+			len(d.Drift.OnlyBackup)+len(d.Drift.OnlyLive)+len(d.Drift.Differ), d.Drift.Database)
+	} else if d.Drift != nil {
+		fmt.Fprintf(&b, tr("Schema: same as live database %s\n"), d.Drift.Database)
+	}
+	printRestoreChecks(&b, d.Checks)
+	if d.Err != nil {
+		fmt.Fprintf(&b, tr("Error: %v\n"), redactError(d.Err))
+	}
+	return b.String()
+}
+
+func latestUploaded(p *Profile) (*CatalogEntry, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var latest *CatalogEntry
+	for _, e := range catalogBackups(entries, p, dateRange{}) {
+		if e.S3Key != "" {
+			latest = e
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no uploaded backup of profile %s in catalog", p.Name)
+	}
+	return latest, nil
+}
+
+// restoreDrill restores the latest backup into a temporary database which
+// is dropped afterwards.
+func restoreDrill(p *Profile) *drillReport {
+	d := &drillReport{Profile: p.Name, Started: time.Now()}
+	d.Err = d.run(p)
+	return d
+}
+
+func (d *drillReport) run(p *Profile) error {
+	e, err := latestUploaded(p)
+	if err != nil {
+		return err
+	}
+	d.Entry = e
+	d.Database = fmt.Sprintf("%s_drill_%d", p.databases()[0], time.Now().Unix())
+	err = mysqlExecute(p, "CREATE DATABASE "+quoteIdent(d.Database))
+	if err != nil {
+		return err
+	}
+	defer mysqlExecute(p, "DROP DATABASE "+quoteIdent(d.Database))
+	start := time.Now()
+	err = readBackup(p, e, func(plain io.Reader) error {
+		return mysqlLoad(p, d.Database, plain)
+	})
+	if err != nil {
+		return err
+	}
+	d.ChecksumOK = true
+	d.RestoreTime = time.Since(start)
+	d.Tables, err = mysqlQuery(p, "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = "+
+		quoteString(d.Database))
+	if err != nil {
+		return err
+	}
+	if d.Tables == "0" {
+		return fmt.Errorf("restored database has no tables")
+	}
+	d.Drift, err = drillDrift(p, d.Database)
+	if err != nil {
+		return err
+	}
+	d.Checks = runRestoreChecks(p, d.Database, true)
+	return restoreChecksFailed(d.Checks)
+}
+
+// drillDrift compares the tables restored into the temporary database with
+// the live database of the profile.
+func drillDrift(p *Profile, database string) (*schemaDrift, error) {
+	restored, err := liveSchema(p, database)
+	if err != nil {
+		return nil, err
+	}
+	live, err := liveSchema(p, p.databases()[0])
+	if err != nil {
+		return nil, err
+	}
+	return compareSchemas(p.databases()[0], restored, live), nil
+}
+
+// runDrill performs a drill, records it in the catalog and mails the report.
+func runDrill(config *Config, p *Profile) *drillReport {
+	d := restoreDrill(p)
+	fmt.Fprint(stdout, d.String())
+	if d.Entry != nil {
+		v := &Verification{Time: d.Started, Kind: "drill", Deep: true, OK: d.passed()}
+		if d.Err != nil {
+			v.Error = redactError(d.Err)
+		} else {
+			v.RecoveryTime = d.RestoreTime
+		}
+		err := recordVerification(d.Entry, v)
+		if err != nil {
+			fmt.Fprintf(stderr, tr("cannot record drill: %v\n"), err)
+		}
+	}
+	if p.Drill != nil && len(p.Drill.EmailTo) > 0 {
+		subject := trf("[myclinic-backup] restore drill %s: %s", d.status(), p.Name)
+		err := sendMail(config.SMTP, p.Drill.EmailTo, subject, renderText(templateDrillReport, d, d.String()))
+		if err != nil {
+			fmt.Fprintf(stderr, tr("cannot mail drill report: %v\n"), err)
+		}
+	}
+	return d
+}
+
+func drillCommand(config *Config, profiles []*Profile, args []string) error {
+	failed := 0
+	for _, p := range profiles {
+		if !runDrill(config, p).passed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d restore drill(s) failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPConfig is the mail server used to send reports.
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+func (s *SMTPConfig) validate() error {
+	if s.Host == "" || s.From == "" {
+		return fmt.Errorf("smtp: host and from are required")
+	}
+	if s.Port == 0 {
+		s.Port = 587
+	}
+	return nil
+}
+
+// sendMail sends a plain text mail. The message is encoded in UTF-8 so that
+// Japanese text can be sent as is.
+func sendMail(s *SMTPConfig, to []string, subject string, body string) error {
+	return sendMailHTML(s, to, subject, body, "")
+}
+
+// sendMailHTML sends a mail with an HTML version of the body besides the
+// plain text, if html is not empty.
+func sendMailHTML(s *SMTPConfig, to []string, subject string, body string, html string) error {
+	if s == nil {
+		return fmt.Errorf("smtp is not configured")
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	if html == "" {
+		fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n")
+		fmt.Fprintf(&msg, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+		msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	} else {
+		var parts bytes.Buffer
+		w := multipart.NewWriter(&parts)
+		for _, part := range []struct{ contentType, content string }{
+			{"text/plain", body},
+			{"text/html", html},
+		} {
+			pw, err := w.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {part.contentType + "; charset=UTF-8"},
+				"Content-Transfer-Encoding": {"8bit"},
+			})
+			if err != nil {
+				return err
+			}
+			pw.Write([]byte(strings.Replace(part.content, "\n", "\r\n", -1)))
+		}
+		w.Close()
+		fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", w.Boundary())
+		msg.Write(parts.Bytes())
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	addr := s.Host + ":" + strconv.Itoa(s.Port)
+	return smtp.SendMail(addr, auth, s.From, to, []byte(msg.String()))
+}
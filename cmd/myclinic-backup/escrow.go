@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backups are only as good as the key they can be decrypted with, and the
+// key file is one file on one clinic PC. export-key writes the key of a
+// profile as an escrow bundle, protected by a passphrase, short enough to
+// print and keep in a safe or with the clinic's lawyer; import-key turns a
+// bundle, typed back in if need be, into a key file again. The key is
+// encrypted with AES-256-GCM under a key derived from the passphrase with
+// PBKDF2-HMAC-SHA256, and every line of the bundle carries a checksum, so
+// that a mistyped line is found before the passphrase is blamed. Exports
+// are recorded in the catalog, and export-key -status tells when the key
+// of each profile was last escrowed and whether the key has changed since.
+
+// kindEscrow marks catalog entries recording an export of the key.
+const kindEscrow = "escrow"
+
+// escrowIterations is the PBKDF2 iteration count of new bundles.
+const escrowIterations = 600000
+
+// minPassphrase is the shortest passphrase accepted for a bundle.
+const minPassphrase = 12
+
+const (
+	escrowTitle   = "KEY"
+	escrowKDF     = "pbkdf2-sha256"
+	escrowSaltLen = 16
+	// escrowNonceLen is the standard nonce size of AES-GCM.
+	escrowNonceLen = 12
+	// armorLine is the number of base64 characters on a line of data.
+	armorLine = 32
+)
+
+// pbkdf2 derives a key of keyLen bytes from the passphrase, as RFC 8018
+// with HMAC-SHA256.
+func pbkdf2(passphrase []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, passphrase)
+	var out []byte
+	for block := uint32(1); len(out) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
+func escrowAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2([]byte(passphrase), salt, iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// lineChecksum is the checksum of a numbered line of a bundle.
+func lineChecksum(n int, data string) string {
+	sum := sha256.Sum256([]byte(strconv.Itoa(n) + ":" + data))
+	return hex.EncodeToString(sum[:2])
+}
+
+// sealEscrowKey encrypts the key under the passphrase, returning the data
+// of a bundle: the salt, the nonce and the sealed key.
+func sealEscrowKey(key []byte, passphrase string, salt []byte, nonce []byte, iterations int) ([]byte, error) {
+	aead, err := escrowAEAD(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) != escrowSaltLen || len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid salt or nonce")
+	}
+	data := append(append([]byte(nil), salt...), nonce...)
+	return aead.Seal(data, nonce, key, nil), nil
+}
+
+// writeEscrowBundle writes the key of the profile as a bundle.
+func writeEscrowBundle(w io.Writer, p *Profile, key []byte, passphrase string, now time.Time) error {
+	salt := make([]byte, escrowSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, escrowNonceLen)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	data, err := sealEscrowKey(key, passphrase, salt, nonce, escrowIterations)
+	if err != nil {
+		return err
+	}
+	writeArmored(w, escrowTitle, []string{
+		"Profile: " + p.Name,
+		"Fingerprint: " + keyFingerprint(key),
+		"Exported: " + now.Format("2006-01-02 15:04 -0700"),
+		fmt.Sprintf("KDF: %s %d", escrowKDF, escrowIterations),
+	}, data)
+	return nil
+}
+
+// writeArmored writes data as printable text titled title: headers,
+// then the data in numbered, checksummed lines of base64.
+func writeArmored(w io.Writer, title string, headers []string, data []byte) {
+	fmt.Fprintf(w, "-----BEGIN MYCLINIC-BACKUP %s-----\n", title)
+	for _, h := range headers {
+		fmt.Fprintln(w, h)
+	}
+	fmt.Fprintln(w)
+	text := base64.StdEncoding.EncodeToString(data)
+	for n := 1; len(text) > 0; n++ {
+		line := text
+		if len(line) > armorLine {
+			line = line[:armorLine]
+		}
+		text = text[len(line):]
+		fmt.Fprintf(w, "%02d %s %s\n", n, line, lineChecksum(n, line))
+	}
+	fmt.Fprintf(w, "-----END MYCLINIC-BACKUP %s-----\n", title)
+}
+
+// readArmored reads what writeArmored wrote, checking the checksum of
+// every line, and returns the headers and the data.
+func readArmored(r io.Reader, title string) (map[string]string, []byte, error) {
+	begin := "-----BEGIN MYCLINIC-BACKUP " + title + "-----"
+	end := "-----END MYCLINIC-BACKUP " + title + "-----"
+	headers := make(map[string]string)
+	var text strings.Builder
+	in, done := false, false
+	n := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == begin:
+			in = true
+		case !in || done || line == "":
+		case line == end:
+			done = true
+		case strings.Contains(line, ":"):
+			i := strings.Index(line, ":")
+			headers[line[:i]] = strings.TrimSpace(line[i+1:])
+		default:
+			n++
+			f := strings.Fields(line)
+			if len(f) != 3 || f[0] != fmt.Sprintf("%02d", n) {
+				return nil, nil, fmt.Errorf("line %02d is missing or out of order", n)
+			}
+			if lineChecksum(n, f[1]) != strings.ToLower(f[2]) {
+				return nil, nil, fmt.Errorf("line %02d is mistyped: its checksum does not match", n)
+			}
+			text.WriteString(f[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if !done || n == 0 {
+		return nil, nil, fmt.Errorf("not complete: the %s and %s lines and the numbered lines between them are needed", begin, end)
+	}
+	data, err := base64.StdEncoding.DecodeString(text.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return headers, data, nil
+}
+
+// escrowBundle is a bundle as read back.
+type escrowBundle struct {
+	fingerprint string
+	iterations  int
+	data        []byte
+}
+
+// readEscrowBundle parses a bundle.
+func readEscrowBundle(r io.Reader) (*escrowBundle, error) {
+	headers, data, err := readArmored(r, escrowTitle)
+	if err != nil {
+		return nil, fmt.Errorf("key bundle: %v", err)
+	}
+	b := &escrowBundle{fingerprint: headers["Fingerprint"], data: data}
+	f := strings.Fields(headers["KDF"])
+	if len(f) != 2 || f[0] != escrowKDF {
+		return nil, fmt.Errorf("key bundle: unsupported KDF: %s", headers["KDF"])
+	}
+	b.iterations, err = strconv.Atoi(f[1])
+	if err != nil || b.iterations < 1 {
+		return nil, fmt.Errorf("key bundle: invalid KDF: %s", headers["KDF"])
+	}
+	return b, nil
+}
+
+// open decrypts the key of the bundle.
+func (b *escrowBundle) open(passphrase string) ([]byte, error) {
+	if len(b.data) < escrowSaltLen {
+		return nil, fmt.Errorf("invalid key bundle")
+	}
+	aead, err := escrowAEAD(passphrase, b.data[:escrowSaltLen], b.iterations)
+	if err != nil {
+		return nil, err
+	}
+	rest := b.data[escrowSaltLen:]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid key bundle")
+	}
+	key, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase")
+	}
+	if b.fingerprint != "" && keyFingerprint(key) != b.fingerprint {
+		return nil, fmt.Errorf("the key does not match the fingerprint of the bundle, %s", b.fingerprint)
+	}
+	return key, nil
+}
+
+// lastEscrow returns the newest record of an export of the key of the
+// profile, or nil.
+func lastEscrow(entries []*CatalogEntry, p *Profile) *CatalogEntry {
+	var last *CatalogEntry
+	for _, e := range entries {
+		if e.Profile == p.Name && e.Kind == kindEscrow && (last == nil || e.Time.After(last.Time)) {
+			last = e
+		}
+	}
+	return last
+}
+
+// exportKeyCommand writes the key of a profile as an escrow bundle, or
+// with -status reports the escrow of every profile.
+func exportKeyCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("export-key", flag.ExitOnError)
+	output := flags.String("o", "-", "file to write the bundle to, or - for stdout")
+	passSource := flags.String("passphrase-source", "stdin", "where to read the passphrase: env:NAME, file:PATH, or stdin")
+	status := flags.Bool("status", false, "reports when the key of each profile was last exported")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: export-key [-o FILE] [-passphrase-source SOURCE] | export-key -status")
+	}
+	if *status {
+		return escrowStatus(profiles)
+	}
+	p, err := singleProfile(profiles)
+	if err != nil {
+		return err
+	}
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	if *dryRun {
+		fmt.Fprintf(stdout, tr("would export the key of %s (fingerprint %s)\n"), p.Name, keyFingerprint(key))
+		return nil
+	}
+	if *passSource == "stdin" {
+		fmt.Fprintf(stderr, tr("passphrase for the key bundle (at least %d characters): "), minPassphrase)
+	}
+	passphrase, err := readPassSource(*passSource)
+	if err != nil {
+		return err
+	}
+	if len([]rune(passphrase)) < minPassphrase {
+		return fmt.Errorf("the passphrase must be at least %d characters", minPassphrase)
+	}
+	now := time.Now()
+	out := os.Stdout
+	if *output != "-" {
+		out, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeEscrowBundle(out, p, key, passphrase, now)
+	if out != os.Stdout {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = catalog.Add(&CatalogEntry{RunID: newRunID(), Profile: p.Name, Kind: kindEscrow, Time: now,
+		KeyFingerprint: keyFingerprint(key), Trigger: triggerManual, Instance: instanceID})
+	if err != nil {
+		return fmt.Errorf("cannot record the export in catalog: %v", err)
+	}
+	fmt.Fprintf(stderr, tr("key of %s exported; keep the bundle and the passphrase in separate safe places\n"), p.Name)
+	return nil
+}
+
+func escrowStatus(profiles []*Profile) error {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		last := lastEscrow(entries, p)
+		if last == nil {
+			fmt.Fprintf(stdout, tr("%s: key never exported\n"), p.Name)
+			continue
+		}
+		key, err := readEncryptionKey(p.KeyFile)
+		if err != nil {
+			return fmt.Errorf("%s: cannot read encryption key: %v", p.Name, err)
+		}
+		if last.KeyFingerprint != keyFingerprint(key) {
+			fmt.Fprintf(stdout, tr("%s: key changed since it was last exported on %s; export it again\n"), p.Name,
+				last.Time.Local().Format("2006-01-02"))
+			continue
+		}
+		fmt.Fprintf(stdout, tr("%s: key exported on %s (fingerprint %s)\n"), p.Name,
+			last.Time.Local().Format("2006-01-02"), last.KeyFingerprint)
+	}
+	return nil
+}
+
+// importKeyCommand writes the key of an escrow bundle to a key file.
+func importKeyCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("import-key", flag.ExitOnError)
+	output := flags.String("o", "", "key file to write (default the key_file of the profile)")
+	passSource := flags.String("passphrase-source", "stdin", "where to read the passphrase: env:NAME, file:PATH, or stdin")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import-key [-o KEYFILE] [-passphrase-source SOURCE] BUNDLE (or - for stdin)")
+	}
+	dest := *output
+	if dest == "" {
+		p, err := singleProfile(profiles)
+		if err != nil {
+			return fmt.Errorf("%v, or give the key file with -o", err)
+		}
+		dest = p.KeyFile
+	}
+	var src []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		if *passSource == "stdin" {
+			return fmt.Errorf("the bundle and the passphrase cannot both be read from stdin")
+		}
+		src, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		src, err = ioutil.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	bundle, err := readEscrowBundle(strings.NewReader(string(src)))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s exists; move it away or give another file with -o", dest)
+	}
+	if *passSource == "stdin" {
+		fmt.Fprint(stderr, tr("passphrase of the key bundle: "))
+	}
+	passphrase, err := readPassSource(*passSource)
+	if err != nil {
+		return err
+	}
+	key, err := bundle.open(passphrase)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(dest, key)
+}
+
+// writeKeyFile writes a recovered key to a key file, in the hex format of
+// key_file.
+func writeKeyFile(dest string, key []byte) error {
+	if *dryRun {
+		fmt.Fprintf(stdout, tr("would write the key (fingerprint %s) to %s\n"), keyFingerprint(key), dest)
+		return nil
+	}
+	err := writeFileAtomic(dest, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, tr("key (fingerprint %s) written to %s\n"), keyFingerprint(key), dest)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The test vectors of PBKDF2-HMAC-SHA256 published in RFC 7914, section 11.
+func TestPBKDF2(t *testing.T) {
+	for _, tc := range []struct {
+		passphrase string
+		salt       string
+		iterations int
+		want       string
+	}{
+		{"passwd", "salt", 1,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+				"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000,
+			"4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+				"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	} {
+		got := hex.EncodeToString(pbkdf2([]byte(tc.passphrase), []byte(tc.salt), tc.iterations, 64))
+		if got != tc.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", tc.passphrase, tc.salt, tc.iterations, got, tc.want)
+		}
+	}
+	// Shorter keys are a prefix of the first block.
+	got := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 20))
+	if got != "55ac046e56e3089fec1691c22544b605f9418521" {
+		t.Errorf("pbkdf2 of 20 bytes = %s", got)
+	}
+}
+
+// escrowKey, escrowSalt and escrowNonce are counting bytes, so that the
+// sealed key below can be reproduced.
+var (
+	escrowKey   = countingBytes(0x00, 32)
+	escrowSalt  = countingBytes(0x00, escrowSaltLen)
+	escrowNonce = countingBytes(0xa0, escrowNonceLen)
+)
+
+func countingBytes(first byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = first + byte(i)
+	}
+	return b
+}
+
+const escrowPassphrase = "correct horse battery"
+
+// escrowSealed is escrowKey sealed under escrowPassphrase with 1000
+// iterations: the salt, the nonce, and the key encrypted with AES-256-GCM
+// under 02169e67...cffdf08d, the key derived by PBKDF2-HMAC-SHA256.
+const escrowSealed = "000102030405060708090a0b0c0d0e0f" + "a0a1a2a3a4a5a6a7a8a9aaab" +
+	"69ce3550b40d47e86f002fdeb48e5b754f21666f57e7b64f760336d20347fc2d" +
+	"c163af38541b09d671752ec4cf13507c"
+
+// escrowBundleText is escrowSealed as export-key writes it.
+const escrowBundleText = `-----BEGIN MYCLINIC-BACKUP KEY-----
+Profile: clinic
+Fingerprint: f2bdd842e8811b88
+Exported: 2024-01-02 15:04 +0900
+KDF: pbkdf2-sha256 1000
+
+01 AAECAwQFBgcICQoLDA0OD6ChoqOkpaan 76ae
+02 qKmqq2nONVC0DUfobwAv3rSOW3VPIWZv 5f28
+03 V+e2T3YDNtIDR/wtwWOvOFQbCdZxdS7E a194
+04 zxNQfA== ede3
+-----END MYCLINIC-BACKUP KEY-----
+`
+
+func TestEscrowKnownAnswer(t *testing.T) {
+	derived := hex.EncodeToString(pbkdf2([]byte(escrowPassphrase), escrowSalt, 1000, 32))
+	if derived != "02169e674d80c0fc7292e8610c8f17be140df062af9aa33ea85eaabecffdf08d" {
+		t.Errorf("derived key = %s", derived)
+	}
+	data, err := sealEscrowKey(escrowKey, escrowPassphrase, escrowSalt, escrowNonce, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(data); got != escrowSealed {
+		t.Errorf("sealed key = %s, want %s", got, escrowSealed)
+	}
+
+	var w bytes.Buffer
+	writeArmored(&w, escrowTitle, []string{
+		"Profile: clinic",
+		"Fingerprint: " + keyFingerprint(escrowKey),
+		"Exported: 2024-01-02 15:04 +0900",
+		"KDF: pbkdf2-sha256 1000",
+	}, data)
+	if w.String() != escrowBundleText {
+		t.Errorf("bundle:\n%s\nwant:\n%s", w.String(), escrowBundleText)
+	}
+
+	b, err := readEscrowBundle(strings.NewReader(escrowBundleText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := b.open(escrowPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, escrowKey) {
+		t.Errorf("opened key = %x", key)
+	}
+	if _, err := b.open("correct horse battery!"); err == nil {
+		t.Error("opened with a wrong passphrase")
+	}
+}
+
+func TestEscrowBundleMistyped(t *testing.T) {
+	for _, tc := range []struct {
+		old, new string
+		err      string
+	}{
+		{"V+e2T3YD", "V+e2T3YE", "line 03 is mistyped"},
+		{"02 qKmqq2", "03 qKmqq2", "line 02 is missing or out of order"},
+		{"-----END MYCLINIC-BACKUP KEY-----\n", "", "not complete"},
+		{"pbkdf2-sha256 1000", "scrypt 1000", "unsupported KDF"},
+	} {
+		_, err := readEscrowBundle(strings.NewReader(strings.Replace(escrowBundleText, tc.old, tc.new, 1)))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q for %q: got %v, want an error with %q", tc.new, tc.old, err, tc.err)
+		}
+	}
+}
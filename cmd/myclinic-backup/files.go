@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Profile types.
+const (
+	profileMysql = "mysql"
+	profileFiles = "files"
+)
+
+// FilesConfig lists what a profile of type files backs up.
+type FilesConfig struct {
+	Paths []string `yaml:"paths"`
+	// Include, if not empty, limits the files archived to those matching
+	// one of the patterns. Exclude skips matching files and directories.
+	// Patterns are matched against the base name and against the path
+	// relative to the configured path, using filepath.Match.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	// FollowSymlinks archives what symbolic links point to instead of the
+	// links themselves.
+	FollowSymlinks bool `yaml:"follow_symlinks"`
+}
+
+func (p *Profile) isFiles() bool {
+	return p.Type == profileFiles
+}
+
+func (f *FilesConfig) validate() error {
+	if len(f.Paths) == 0 {
+		return fmt.Errorf("files: paths is empty")
+	}
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("files: invalid pattern %s", pattern)
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(rel)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveName is the name of path inside the archive: the absolute path
+// without volume and leading separator, so that extraction recreates the
+// tree under the target directory.
+func archiveName(path string) string {
+	path = strings.TrimPrefix(path, filepath.VolumeName(path))
+	return strings.TrimLeft(filepath.ToSlash(path), "/")
+}
+
+type archiver struct {
+	config *FilesConfig
+	tw     *tar.Writer
+	// visited holds the directories entered, to stop symlink loops.
+	visited map[string]bool
+}
+
+func (a *archiver) add(path string, rel string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 && a.config.FollowSymlinks {
+		info, err = os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(stderr, tr("skipping broken link %s\n"), path)
+			return nil
+		}
+	}
+	if rel != "." && matchAny(a.config.Exclude, rel) {
+		return nil
+	}
+	if info.IsDir() {
+		return a.addDir(path, rel, info)
+	}
+	if info.Mode().IsRegular() && rel != "." && len(a.config.Include) > 0 && !matchAny(a.config.Include, rel) {
+		return nil
+	}
+	return a.addEntry(path, info)
+}
+
+func (a *archiver) addDir(path string, rel string, info os.FileInfo) error {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	if a.visited[real] {
+		return nil
+	}
+	a.visited[real] = true
+	err = a.addEntry(path, info)
+	if err != nil {
+		return err
+	}
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = a.add(filepath.Join(path, name), filepath.Join(rel, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *archiver) addEntry(path string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = archiveName(path)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	err = a.tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(a.tw, f, info.Size())
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// writeArchive writes a tar archive of the configured paths to w.
+func writeArchive(config *FilesConfig, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	a := &archiver{config: config, tw: tw, visited: make(map[string]bool)}
+	for _, path := range config.Paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		err = a.add(abs, ".")
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func archiveFiles(archiveFile string, config *FilesConfig) error {
+	err := os.MkdirAll(filepath.Dir(archiveFile), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(archiveFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeArchive(config, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// createArchiveFilePath is the counterpart of createBackupFilePath for
+// profiles of type files.
+func createArchiveFilePath(dir string, t time.Time) string {
+	return filepath.Join(dir, dirPart(t), "files-"+t.Format("200601021504")+".tar")
+}
+
+// checkArchive reads the archive through, failing if it is malformed.
+func checkArchive(r io.Reader) (int, error) {
+	tr := tar.NewReader(r)
+	n := 0
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		_, err = io.Copy(ioutil.Discard, tr)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// extractArchive extracts the archive read from r under dir. Entries are
+// not written through symbolic links, so that a link in the archive cannot
+// have a later entry written outside dir.
+func extractArchive(r io.Reader, dir string) (int, error) {
+	tr := tar.NewReader(r)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || name == ".." ||
+			strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return n, fmt.Errorf("unsafe path in archive: %s", hdr.Name)
+		}
+		link, err := throughSymlink(dir, name)
+		if err != nil {
+			return n, err
+		}
+		if link {
+			return n, fmt.Errorf("path in archive through a symbolic link: %s", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.FileMode(hdr.Mode).Perm()|0700)
+		case tar.TypeSymlink:
+			err = os.MkdirAll(filepath.Dir(target), 0700)
+			if err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+		case tar.TypeReg:
+			err = extractFile(tr, target, os.FileMode(hdr.Mode).Perm(), hdr.ModTime)
+		default:
+			fmt.Fprint(stderr, trf("skipping %s of unsupported type\n", hdr.Name))
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// throughSymlink reports whether name under dir, or a directory on the way
+// to it, is a symbolic link.
+func throughSymlink(dir, name string) (bool, error) {
+	path := dir
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		path = filepath.Join(path, part)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func extractFile(r io.Reader, path string, perm os.FileMode, modTime time.Time) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
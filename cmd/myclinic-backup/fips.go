@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	cflib "github.com/hangilc/crypt-file/lib"
+)
+
+// fipsMode restricts the cryptography of the program to algorithms
+// approved by FIPS 140: backups are encrypted with AES-256-GCM only,
+// checksums are SHA-256, and TLS, both served and to AWS and the
+// notification services, is TLS 1.2 with ECDHE key exchange over P-256 or
+// P-384 and AES-GCM. MD5, which S3 uses for ETags and Content-MD5, is no
+// longer computed; the SHA-256 checksums stand in for it.
+//
+// Backups are sealed and opened by the AES-GCM of crypto/cipher rather
+// than by the streaming implementation of internal/cfstream, which builds
+// GCM from CTR mode and a GHASH of its own. crypto/cipher seals a message
+// at once, so the compressed backup is held in memory while it is
+// encrypted or decrypted, and none of it is read before it is
+// authenticated.
+//
+// The mode selects algorithms; it does not make the Go standard library a
+// validated module. Policies requiring one need a validated build of the
+// toolchain, such as a BoringCrypto one, built with the fips tag so that
+// the mode cannot be turned off.
+var fipsMode bool
+
+// fipsBuild is set in builds with the fips tag.
+var fipsBuild bool
+
+// Values of the crypto-mode metadata of uploaded objects and of the
+// catalog.
+const (
+	cryptoModeStandard = "standard"
+	cryptoModeFIPS     = "fips"
+	// cryptoModeMetadataKey records the mode with every uploaded object.
+	cryptoModeMetadataKey = "crypto-mode"
+)
+
+func cryptoMode() string {
+	if fipsMode {
+		return cryptoModeFIPS
+	}
+	return cryptoModeStandard
+}
+
+// applyFIPS turns the mode on if configured or built in.
+func (c *Config) applyFIPS() {
+	if !c.FIPS && !fipsBuild {
+		return
+	}
+	fipsMode = true
+	notifyClient.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: fipsTLSConfig(),
+	}
+}
+
+// fipsTLSConfig returns the TLS settings of the mode. TLS 1.3 is left out
+// because its cipher suites cannot be restricted.
+func fipsTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	}
+}
+
+// readEncryptionKey reads the key file of a profile. In FIPS mode the key
+// must be 256 bits, since the format itself accepts AES-128 and AES-192
+// keys as well.
+func readEncryptionKey(path string) ([]byte, error) {
+	key, err := cflib.ReadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if fipsMode && len(key) != 32 {
+		return nil, fmt.Errorf("%s holds a %d-bit key; FIPS mode requires AES-256 (64 hex digits)", path, len(key)*8)
+	}
+	return key, nil
+}
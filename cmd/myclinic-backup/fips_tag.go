@@ -0,0 +1,8 @@
+//go:build fips
+// +build fips
+
+package main
+
+func init() {
+	fipsBuild = true
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Years of crashed runs, hand-made copies and interrupted maintenance
+// leave debris in backup_dir and encrypted_dir. gc finds
+//
+//   - work directories and .tmp files left by runs killed outright,
+//   - plain dumps compressed only halfway, with both the .sql and the .gz,
+//   - encrypted files which the catalog does not record, such as grants
+//     left without their dump, and
+//   - plain dumps without an encrypted backup, locally or in S3,
+//
+// and cleans them up. Leftovers are removed and halfway compressions
+// finished. Unrecorded encrypted files are imported into the catalog as
+// catalog import does by default, or removed with -encrypted delete; plain
+// dumps without an encrypted backup may be the only copy and are removed
+// only with -plain delete. Anything younger than a day is left alone, as a
+// run may still be writing or recording it.
+
+// gcPolicies are the values of -encrypted and -plain.
+var gcPolicies = map[string]bool{"keep": true, "import": true, "delete": true}
+
+// gcReport counts what gc found and did.
+type gcReport struct {
+	found   int
+	cleaned int
+}
+
+func (r *gcReport) printf(done bool, format string, args ...interface{}) {
+	r.found++
+	if done {
+		r.cleaned++
+	}
+	fmt.Fprintf(stdout, tr(format), args...)
+}
+
+// gcOld reports whether the file is old enough for gc to touch.
+func gcOld(info os.FileInfo, now time.Time) bool {
+	return now.Sub(info.ModTime()) > maxResumeAge
+}
+
+// gcLeftovers removes the stale work directories of the profile and the
+// .tmp files in its directories.
+func gcLeftovers(config *Config, p *Profile, now time.Time, r *gcReport) error {
+	base := config.workBase(p)
+	infos, err := readDirIfExists(base)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.IsDir() || !gcOld(info, now) {
+			continue
+		}
+		dir := filepath.Join(base, info.Name())
+		if *dryRun {
+			r.printf(false, "would remove work directory %s\n", dir)
+			continue
+		}
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+		r.printf(true, "removed work directory %s\n", dir)
+	}
+	for _, root := range []string{p.BackupDir, p.EncryptedDir} {
+		err = walkIfExists(root, func(path string, info os.FileInfo) error {
+			if info.IsDir() && info.Name() == workDirName {
+				return filepath.SkipDir
+			}
+			if info.IsDir() || filepath.Ext(path) != ".tmp" || !gcOld(info, now) {
+				return nil
+			}
+			if *dryRun {
+				r.printf(false, "would remove %s\n", path)
+				return nil
+			}
+			err := os.Remove(path)
+			if err == nil {
+				r.printf(true, "removed %s\n", path)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gcHalfCompressed finishes compressions of plain dumps interrupted after
+// the .gz was written: the .sql is removed if the .gz holds the same
+// content, and the .gz otherwise.
+func gcHalfCompressed(p *Profile, now time.Time, r *gcReport) error {
+	dumps, err := listPlainDumps(p.BackupDir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dumps {
+		if filepath.Ext(d.path) != ".gz" {
+			continue
+		}
+		plain := strings.TrimSuffix(d.path, ".gz")
+		info, err := os.Stat(plain)
+		if err != nil || !gcOld(info, now) {
+			continue
+		}
+		if *dryRun {
+			r.printf(false, "would finish compressing %s\n", plain)
+			continue
+		}
+		sum, _, err := hashFile(plain)
+		if err != nil {
+			return err
+		}
+		gzSum, err := gunzipSHA256(d.path)
+		if err == nil && gzSum == sum {
+			err = os.Remove(plain)
+			if err != nil {
+				return err
+			}
+			r.printf(true, "finished compressing %s\n", plain)
+			continue
+		}
+		err = os.Remove(d.path)
+		if err != nil {
+			return err
+		}
+		r.printf(true, "removed %s, which does not match %s\n", d.path, plain)
+	}
+	return nil
+}
+
+// gcUnrecorded handles the encrypted files of the profile which the
+// catalog does not record, by policy.
+func gcUnrecorded(p *Profile, entries []*CatalogEntry, policy string, now time.Time, r *gcReport) error {
+	recorded := make(map[string]bool)
+	for _, e := range entries {
+		if e.Profile == p.Name {
+			recorded[e.EncryptedFile] = true
+		}
+	}
+	importable := make(map[string]*CatalogEntry)
+	if policy == "import" {
+		found, err := findImports(p, newKnownBackups(entries, p), true)
+		if err != nil {
+			return err
+		}
+		for _, e := range found {
+			importable[e.EncryptedFile] = e
+		}
+	}
+	var imports []*CatalogEntry
+	err := walkIfExists(p.EncryptedDir, func(path string, info os.FileInfo) error {
+		if info.IsDir() && info.Name() == workDirName {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || filepath.Ext(path) != ".cf" || recorded[path] || !gcOld(info, now) {
+			return nil
+		}
+		switch {
+		case policy == "delete" && *dryRun:
+			r.printf(false, "would remove %s, which is not in the catalog\n", path)
+		case policy == "delete":
+			err := removeMovedFile(path)
+			if err != nil {
+				return err
+			}
+			r.printf(true, "removed %s, which is not in the catalog\n", path)
+		case policy == "import" && importable[path] != nil:
+			imports = append(imports, importable[path])
+			if *dryRun {
+				r.printf(false, "would import %s into the catalog\n", path)
+			} else {
+				r.printf(true, "imported %s into the catalog\n", path)
+			}
+		default:
+			r.printf(false, "%s is not in the catalog\n", path)
+		}
+		return nil
+	})
+	if err != nil || len(imports) == 0 || *dryRun {
+		return err
+	}
+	return catalog.Update(func(entries []*CatalogEntry) ([]*CatalogEntry, error) {
+		return append(entries, imports...), nil
+	})
+}
+
+// gcUnencrypted handles the plain dumps of the profile which have no
+// encrypted backup, neither in encrypted_dir nor recorded as uploaded, by
+// policy.
+func gcUnencrypted(p *Profile, entries []*CatalogEntry, policy string, now time.Time, r *gcReport) error {
+	encrypted := make(map[time.Time]bool)
+	for _, e := range entries {
+		if e.Profile != p.Name || !e.isDump() {
+			continue
+		}
+		if _, err := os.Stat(e.EncryptedFile); e.S3Key != "" || err == nil {
+			encrypted[e.Time.Truncate(time.Minute).UTC()] = true
+		}
+	}
+	dumps, err := listPlainDumps(p.BackupDir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dumps {
+		if encrypted[d.time.UTC()] || now.Sub(d.time) < maxResumeAge {
+			continue
+		}
+		if _, err := os.Stat(p.encryptedFilePath(d.time)); err == nil {
+			continue
+		}
+		switch {
+		case policy == "delete" && *dryRun:
+			r.printf(false, "would remove %s, which has no encrypted backup\n", d.path)
+		case policy == "delete":
+			err = removeMovedFile(d.path)
+			if err != nil {
+				return err
+			}
+			r.printf(true, "removed %s, which has no encrypted backup\n", d.path)
+		default:
+			r.printf(false, "%s has no encrypted backup\n", d.path)
+		}
+	}
+	return nil
+}
+
+// readDirIfExists lists dir, which may not exist.
+func readDirIfExists(dir string) ([]os.FileInfo, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+// walkIfExists walks root, which may not exist.
+func walkIfExists(root string, fn func(path string, info os.FileInfo) error) error {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// gcCommand cleans up the debris in the directories of the selected
+// profiles.
+func gcCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	encrypted := flags.String("encrypted", "import", "what to do with encrypted files not in the catalog: keep, import or delete")
+	plain := flags.String("plain", "keep", "what to do with plain dumps without an encrypted backup: keep or delete")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: gc [-encrypted keep|import|delete] [-plain keep|delete]")
+	}
+	if !gcPolicies[*encrypted] {
+		return fmt.Errorf("-encrypted must be keep, import or delete: %s", *encrypted)
+	}
+	if !gcPolicies[*plain] || *plain == "import" {
+		return fmt.Errorf("-plain must be keep or delete: %s", *plain)
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	r := &gcReport{}
+	for _, p := range profiles {
+		err = gcLeftovers(config, p, now, r)
+		if err == nil {
+			err = gcHalfCompressed(p, now, r)
+		}
+		if err == nil {
+			err = gcUnrecorded(p, entries, *encrypted, now, r)
+		}
+		if err == nil {
+			err = gcUnencrypted(p, entries, *plain, now, r)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", p.Name, err)
+		}
+	}
+	if r.found == 0 {
+		fmt.Fprintf(stdout, tr("nothing to clean up\n"))
+	} else if !*dryRun {
+		fmt.Fprintf(stdout, tr("%d found, %d cleaned up\n"), r.found, r.cleaned)
+	}
+	return nil
+}
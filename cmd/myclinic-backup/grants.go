@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const kindGrants = "grants"
+
+// dumpGrants returns SQL statements recreating the accounts of the server
+// and their privileges. The data dump does not include them, and without
+// them the application cannot log in to a rebuilt server. Accounts internal
+// to MySQL (mysql.sys and the like) are left out.
+func dumpGrants(p *Profile) (string, error) {
+	out, err := mysqlQuery(p, "SELECT user, host FROM mysql.user ORDER BY user, host")
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- accounts and grants dumped by %s at %s\n", appName,
+		time.Now().Format("2006-01-02 15:04:05"))
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "mysql.") {
+			continue
+		}
+		account := quoteString(fields[0]) + "@" + quoteString(fields[1])
+		fmt.Fprintf(&b, "\n-- %s\n", account)
+		// SHOW CREATE USER is missing before MySQL 5.7.6, where SHOW
+		// GRANTS includes the password hash instead.
+		create, err := mysqlQueryRaw(p, "SHOW CREATE USER "+account)
+		if err == nil {
+			create = strings.Replace(create, "CREATE USER ", "CREATE USER IF NOT EXISTS ", 1)
+			fmt.Fprintf(&b, "%s;\n", create)
+		}
+		grants, err := mysqlQueryRaw(p, "SHOW GRANTS FOR "+account)
+		if err != nil {
+			return "", err
+		}
+		for _, g := range strings.Split(grants, "\n") {
+			fmt.Fprintf(&b, "%s;\n", g)
+		}
+	}
+	b.WriteString("\nFLUSH PRIVILEGES;\n")
+	return b.String(), nil
+}
+
+func (p *Profile) grantsFilePath(t time.Time) string {
+	return filepath.Join(p.EncryptedDir, dirPart(t), "grants-"+t.Format("200601021504")+"-sql.cf")
+}
+
+// backupGrants stores the accounts and grants as a separate encrypted
+// artifact. They contain password hashes, so no plain copy is written.
+func (r *backupRun) backupGrants() error {
+	p := r.profile
+	st := r.state
+	sql, err := dumpGrants(p)
+	if err != nil {
+		return fmt.Errorf("cannot dump grants: %v", err)
+	}
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	enc, err := compressAndEncrypt(key, []byte(sql))
+	if err != nil {
+		return fmt.Errorf("encryption of grants failed: %v", err)
+	}
+	path := p.grantsFilePath(st.Time)
+	tmp := r.workFile(path)
+	err = ioutil.WriteFile(tmp, enc, 0600)
+	if err == nil {
+		err = moveIntoPlace(tmp, path)
+	}
+	if err != nil {
+		return err
+	}
+	s3Key, err := p.objectKey(createS3Key(p.s3KeyPrefix(), path))
+	if err != nil {
+		return err
+	}
+	storage, err := p.storage()
+	if err != nil {
+		return err
+	}
+	err = storage.Put(s3Key, path)
+	if err != nil {
+		return fmt.Errorf("failed to upload grants to %s: %v", p.targetName(), err)
+	}
+	r.artifacts = append(r.artifacts, path, p.storedLocation(s3Key))
+	r.logf("grants uploaded to %s\n", s3Key)
+	sum := sha256.Sum256([]byte(sql))
+	encSum := sha256.Sum256(enc)
+	entry := &CatalogEntry{
+		RunID:           st.RunID,
+		Profile:         p.Name,
+		Kind:            kindGrants,
+		Time:            st.Time,
+		EncryptedFile:   path,
+		S3Bucket:        p.storageBucket(),
+		S3Key:           s3Key,
+		Target:          p.targetURL(),
+		ObjectName:      p.objectName(path),
+		Size:            int64(len(sql)),
+		SHA256:          hex.EncodeToString(sum[:]),
+		EncryptedSize:   int64(len(enc)),
+		EncryptedSHA256: hex.EncodeToString(encSum[:]),
+		Trigger:         r.trigger,
+		CryptoMode:      cryptoMode(),
+		KeyFingerprint:  r.keyFingerprint,
+		Compression:     transfer.compressor.Name(),
+		Instance:        instanceID,
+	}
+	return catalog.Add(entry)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of runs in the history besides the kinds of verifications.
+const (
+	historyBackup = "backup"
+	historyPut    = "put"
+	historyStdout = "stdout"
+	historyAgent  = "agent"
+)
+
+// HistoryRecord is one run in the history: a backup of whatever kind, or a
+// verification or drill of a stored backup.
+type HistoryRecord struct {
+	RunID    string    `json:"run_id"`
+	Profile  string    `json:"profile"`
+	Kind     string    `json:"kind"`
+	Trigger  string    `json:"trigger,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+	// Size is the stored size of the backup, if known.
+	Size  int64  `json:"size,omitempty"`
+	S3Key string `json:"s3_key,omitempty"`
+	Label string `json:"label,omitempty"`
+}
+
+// History keeps the metadata of every run, one JSON object per line, so
+// that questions about past runs are answered by the history command
+// rather than by reading the logs. Unlike the catalog it also holds
+// failures, and it is never rewritten.
+type History struct {
+	mu   sync.Mutex
+	path string
+}
+
+var history *History
+
+func newHistory(path string) *History {
+	return &History{path: path}
+}
+
+func (c *Config) historyPath() string {
+	return filepath.Join(c.StateDir, "history.jsonl")
+}
+
+// Append adds the record at the end of the history.
+func (h *History) Append(r *HistoryRecord) error {
+	line, err := json.Marshal(r)
+	if err == nil {
+		line, err = sealLine(line)
+	}
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err = os.MkdirAll(filepath.Dir(h.path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Records returns the records in the order appended. A line cut short by
+// a crash is skipped; a line which cannot be decrypted is an error.
+func (h *History) Records() ([]*HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*HistoryRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line, err := openLine(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", h.path, err)
+		}
+		var r HistoryRecord
+		if json.Unmarshal(line, &r) == nil {
+			records = append(records, &r)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// recordHistory appends the record, reporting rather than returning a
+// failure, which must not fail the run itself.
+func recordHistory(r *HistoryRecord) {
+	if history == nil || *dryRun {
+		return
+	}
+	err := history.Append(r)
+	if err != nil {
+		fmt.Fprintf(stderr, tr("history: %v\n"), err)
+	}
+}
+
+// parseSince parses a time such as 30d, 12h or 2020-06-01 for -since.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, _, err := parseDateOrMonth(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("-since: invalid %s (30d, 12h or 2020-06-01)", s)
+	}
+	return t, nil
+}
+
+// historyCommand prints the runs of the selected profiles from the
+// history, oldest first.
+func historyCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	failed := flags.Bool("failed", false, "prints only failed runs")
+	since := flags.String("since", "", "prints runs started since, e.g. 30d, 12h or 2020-06-01")
+	kind := flags.String("kind", "", "prints only runs of a kind: backup, put, stdout, agent, verify or drill")
+	format := flags.String("format", "text", "output format: text, csv or json")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: history [-failed] [-since 30d] [-kind KIND] [-format text|csv|json]")
+	}
+	var from time.Time
+	if *since != "" {
+		var err error
+		from, err = parseSince(*since, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	selected := make(map[string]bool)
+	for _, p := range profiles {
+		selected[p.Name] = true
+	}
+	all, err := history.Records()
+	if err != nil {
+		return err
+	}
+	var records []*HistoryRecord
+	for _, r := range all {
+		if selected[r.Profile] && (!*failed || !r.Success) && (*kind == "" || r.Kind == *kind) && !r.Started.Before(from) {
+			records = append(records, r)
+		}
+	}
+	switch *format {
+	case "json":
+		if records == nil {
+			records = []*HistoryRecord{}
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case "csv":
+		w := csv.NewWriter(stdout)
+		w.Write([]string{"run_id", "profile", "kind", "trigger", "started", "finished", "success", "error", "size", "s3_key", "label"})
+		for _, r := range records {
+			w.Write([]string{r.RunID, r.Profile, r.Kind, r.Trigger, r.Started.Format(time.RFC3339), r.Finished.Format(time.RFC3339),
+				strconv.FormatBool(r.Success), r.Error, strconv.FormatInt(r.Size, 10), r.S3Key, r.Label})
+		}
+		w.Flush()
+		return w.Error()
+	case "text":
+	default:
+		return fmt.Errorf("-format must be text, csv or json")
+	}
+	if len(records) == 0 {
+		fmt.Fprintf(stdout, tr("no runs\n"))
+	}
+	for _, r := range records {
+		outcome := "ok"
+		detail := r.S3Key
+		if !r.Success {
+			outcome = "FAILED"
+			detail = strings.Replace(r.Error, "\n", " ", -1)
+		}
+		size := ""
+		if r.Size > 0 {
+			size = formatBytes(r.Size)
+		}
+		fmt.Fprintf(stdout, "%s  %-12s %-7s %-11s %-6s %8s %10s  %s\n", r.Started.Local().Format("2006-01-02 15:04"),
+			r.Profile, r.Kind, r.Trigger, outcome, r.Finished.Sub(r.Started).Round(time.Second), size, detail)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Hold marks a backup which must be kept, such as one relevant to a
+// dispute over a patient record, whatever the retention rules say. It is
+// recorded in the catalog, and where the bucket has Object Lock enabled
+// S3 legal hold is also placed on the object, so that no one can delete it
+// there until the hold is released.
+type Hold struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Reason string    `json:"reason,omitempty"`
+	// S3 is set if the object carries an S3 legal hold.
+	S3 bool `json:"s3,omitempty"`
+}
+
+// selectHeldEntries returns the entries of the catalog which the arguments
+// of hold or release name: run IDs, taking in every entry of the run, or
+// s3:// URLs of single objects, of the selected profiles.
+func selectHeldEntries(entries []*CatalogEntry, profiles []*Profile, args []string) ([]*CatalogEntry, error) {
+	selected := make(map[string]bool)
+	for _, p := range profiles {
+		selected[p.Name] = true
+	}
+	var matched []*CatalogEntry
+	for _, arg := range args {
+		var bucket, key string
+		if strings.HasPrefix(arg, "s3://") {
+			var err error
+			bucket, key, err = parseS3URL(arg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		found := false
+		for _, e := range entries {
+			if !selected[e.Profile] {
+				continue
+			}
+			if (key != "" && e.S3Bucket == bucket && e.S3Key == key) || (key == "" && e.RunID == arg) {
+				matched = append(matched, e)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no backup %s of the selected profiles in catalog", arg)
+		}
+	}
+	return matched, nil
+}
+
+// objectLockEnabled reports whether Object Lock is enabled on the bucket,
+// which S3 legal hold needs.
+func objectLockEnabled(svc *s3.S3, bucket string) (bool, error) {
+	out, err := svc.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{Bucket: aws.String(bucket)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ObjectLockConfigurationNotFoundError" {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return out.ObjectLockConfiguration != nil &&
+		aws.StringValue(out.ObjectLockConfiguration.ObjectLockEnabled) == s3.ObjectLockEnabledEnabled, nil
+}
+
+// setLegalHold places or lifts the S3 legal hold on the object of the
+// entry.
+func setLegalHold(svc *s3.S3, e *CatalogEntry, on bool) error {
+	status := s3.ObjectLockLegalHoldStatusOff
+	if on {
+		status = s3.ObjectLockLegalHoldStatusOn
+	}
+	_, err := svc.PutObjectLegalHoldWithContext(aws.BackgroundContext(), &s3.PutObjectLegalHoldInput{
+		Bucket:    aws.String(e.S3Bucket),
+		Key:       aws.String(e.S3Key),
+		LegalHold: &s3.ObjectLockLegalHold{Status: aws.String(status)},
+	}, withoutMD5)
+	if err != nil {
+		return fmt.Errorf("cannot set legal hold on s3://%s/%s: %v", e.S3Bucket, e.S3Key, err)
+	}
+	return nil
+}
+
+// withoutMD5 replaces the Content-MD5 the SDK puts on requests which S3
+// requires a checksum of with a SHA-256 checksum in FIPS mode.
+func withoutMD5(r *request.Request) {
+	if !fipsMode {
+		return
+	}
+	r.Handlers.Build.PushBack(func(r *request.Request) {
+		if r.Error != nil || r.Body == nil {
+			return
+		}
+		h := sha256.New()
+		_, err := io.Copy(h, r.Body)
+		if err == nil {
+			_, err = r.Body.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			r.Error = err
+			return
+		}
+		r.HTTPRequest.Header.Del("Content-Md5")
+		r.HTTPRequest.Header.Set(checksumSHA256Header, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		r.HTTPRequest.Header.Set(checksumAlgorithmHeader, "SHA256")
+	})
+}
+
+// applyLegalHolds places or lifts the S3 legal hold on the uploaded
+// entries whose buckets have Object Lock enabled, setting Hold.S3 of those
+// placed. Entries in other buckets, or not stored in S3, are held in the
+// catalog only.
+func applyLegalHolds(profiles []*Profile, entries []*CatalogEntry, on bool) error {
+	byName := make(map[string]*Profile)
+	for _, p := range profiles {
+		byName[p.Name] = p
+	}
+	enabled := make(map[string]bool)
+	for _, e := range entries {
+		p := byName[e.Profile]
+		if e.S3Key == "" || e.Target != "" || p == nil || (!on && (e.Hold == nil || !e.Hold.S3)) {
+			continue
+		}
+		sess, err := newS3Session(p)
+		if err != nil {
+			return err
+		}
+		svc := s3.New(sess)
+		lock, checked := enabled[e.S3Bucket]
+		if !checked {
+			lock, err = objectLockEnabled(svc, e.S3Bucket)
+			if err != nil {
+				return fmt.Errorf("cannot read the Object Lock configuration of bucket %s: %v", e.S3Bucket, err)
+			}
+			enabled[e.S3Bucket] = lock
+			if !lock && on {
+				fmt.Fprintf(stdout, tr("bucket %s does not have Object Lock enabled; holding in the catalog only\n"), e.S3Bucket)
+			}
+		}
+		if !lock {
+			continue
+		}
+		err = setLegalHold(svc, e, on)
+		if err != nil {
+			return err
+		}
+		if on {
+			e.Hold.S3 = true
+		}
+	}
+	return nil
+}
+
+// updateHolds sets the holds of the entries named by args to hold, or
+// releases them if hold is nil, in S3 and in the catalog, and audits the
+// change.
+func updateHolds(profiles []*Profile, args []string, hold *Hold) error {
+	command := "hold"
+	if hold == nil {
+		command = "release"
+	}
+	rec := &AuditRecord{
+		RunID:   newRunID(),
+		Time:    time.Now(),
+		Trigger: triggerManual,
+		User:    currentUser(),
+		Command: commandLine(),
+		Stages:  []string{command},
+		Outcome: "success",
+	}
+	rec.Host, _ = os.Hostname()
+	// The legal holds are placed in S3 before the catalog is locked, so
+	// that slow requests do not keep other processes from changing it.
+	var changed []*CatalogEntry
+	entries, err := catalog.Entries()
+	if err == nil {
+		var matched []*CatalogEntry
+		matched, err = selectHeldEntries(entries, profiles, args)
+		for _, e := range matched {
+			if hold != nil {
+				if e.Hold != nil {
+					continue
+				}
+				h := *hold
+				e.Hold = &h
+			} else if e.Hold == nil {
+				continue
+			}
+			changed = append(changed, e)
+		}
+	}
+	if err == nil {
+		err = applyLegalHolds(profiles, changed, hold != nil)
+	}
+	if err == nil && len(changed) > 0 {
+		holds := make(map[string]*Hold)
+		for _, e := range changed {
+			if hold != nil {
+				holds[e.catalogID()] = e.Hold
+			} else {
+				holds[e.catalogID()] = nil
+			}
+		}
+		// prune deletes under the lock, so an entry still in the catalog
+		// here is held before prune looks at it again.
+		err = catalog.Update(func(entries []*CatalogEntry) ([]*CatalogEntry, error) {
+			found := 0
+			for _, e := range entries {
+				if h, ok := holds[e.catalogID()]; ok {
+					e.Hold = h
+					found++
+				}
+			}
+			if found < len(holds) {
+				return nil, fmt.Errorf("some of the backups were deleted meanwhile; run %s again", command)
+			}
+			return entries, nil
+		})
+	}
+	for _, e := range changed {
+		rec.Profile = e.Profile
+		rec.Artifacts = append(rec.Artifacts, entryLocation(e))
+	}
+	if err != nil {
+		rec.Outcome = "failure"
+		rec.Error = redactError(err)
+	}
+	if len(changed) > 0 || err != nil {
+		if aerr := auditLog.Append(rec); aerr != nil {
+			fmt.Fprintf(stderr, tr("audit log: %v\n"), aerr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range changed {
+		if hold != nil {
+			fmt.Fprintf(stdout, tr("held %s\n"), entryLocation(e))
+		} else {
+			fmt.Fprintf(stdout, tr("released %s\n"), entryLocation(e))
+		}
+	}
+	if len(changed) == 0 {
+		fmt.Fprintf(stdout, tr("nothing to change\n"))
+	}
+	return nil
+}
+
+// entryLocation names the backup of the entry: its S3 URL, or its local
+// file if it is not uploaded.
+func entryLocation(e *CatalogEntry) string {
+	if e.S3Key != "" && e.Target != "" {
+		return e.Target + "/" + e.S3Key
+	}
+	if e.S3Key != "" {
+		return fmt.Sprintf("s3://%s/%s", e.S3Bucket, e.S3Key)
+	}
+	return e.EncryptedFile
+}
+
+// holdCommand exempts backups from pruning, or lists those held.
+func holdCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("hold", flag.ExitOnError)
+	reason := flags.String("reason", "", "why the backups are held, e.g. the case they are kept for")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return listHolds(profiles)
+	}
+	if *reason == "" {
+		return fmt.Errorf("usage: hold -reason REASON RUN-ID|s3://bucket/key...")
+	}
+	if *dryRun {
+		fmt.Fprintf(stdout, tr("would hold %s\n"), strings.Join(flags.Args(), ", "))
+		return nil
+	}
+	return updateHolds(profiles, flags.Args(), &Hold{Time: time.Now(), User: currentUser(), Reason: *reason})
+}
+
+// releaseCommand lifts holds, leaving the backups to the retention rules
+// again.
+func releaseCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("release", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: release RUN-ID|s3://bucket/key...")
+	}
+	if *dryRun {
+		fmt.Fprintf(stdout, tr("would release %s\n"), strings.Join(flags.Args(), ", "))
+		return nil
+	}
+	return updateHolds(profiles, flags.Args(), nil)
+}
+
+func listHolds(profiles []*Profile) error {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return err
+	}
+	selected := make(map[string]bool)
+	for _, p := range profiles {
+		selected[p.Name] = true
+	}
+	n := 0
+	for _, e := range entries {
+		if !selected[e.Profile] || e.Hold == nil {
+			continue
+		}
+		s3hold := ""
+		if e.Hold.S3 {
+			s3hold = tr("  (S3 legal hold)")
+		}
+		fmt.Fprintf(stdout, "%-12s %s  %s%s\n", e.Profile, e.RunID, entryLocation(e), s3hold)
+		fmt.Fprintf(stdout, tr("    held %s by %s: %s\n"), e.Hold.Time.Local().Format("2006-01-02 15:04"), e.Hold.User, e.Hold.Reason)
+		n++
+	}
+	if n == 0 {
+		fmt.Fprintf(stdout, tr("no backups are held\n"))
+	}
+	return nil
+}
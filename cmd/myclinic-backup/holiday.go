@@ -0,0 +1,117 @@
+package main
+
+import "time"
+
+// japaneseHoliday returns the name of the national holiday of Japan on the
+// date, or "". It follows the law as in force from 2020, with the moved
+// holidays of the 2020 and 2021 Olympics, and adds the substitute holidays
+// and the citizens' holidays the law derives from the others. The
+// equinoxes are the usual approximation, which holds from 1980 to 2099;
+// the Cabinet Office announces them a year ahead.
+func japaneseHoliday(t time.Time) string {
+	y, m, d := t.Date()
+	if name := baseHoliday(y, m, d); name != "" {
+		return name
+	}
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	// A holiday on a Sunday moves to the next day which is not a holiday.
+	for prev := day.AddDate(0, 0, -1); ; prev = prev.AddDate(0, 0, -1) {
+		py, pm, pd := prev.Date()
+		if baseHoliday(py, pm, pd) == "" {
+			break
+		}
+		if prev.Weekday() == time.Sunday {
+			return "振替休日"
+		}
+	}
+	// A day between two holidays is a holiday too.
+	prev, next := day.AddDate(0, 0, -1), day.AddDate(0, 0, 1)
+	if day.Weekday() != time.Sunday && baseHoliday(prev.Date()) != "" && baseHoliday(next.Date()) != "" {
+		return "国民の休日"
+	}
+	return ""
+}
+
+// baseHoliday returns the holiday fixed by its own rule on the date.
+func baseHoliday(y int, m time.Month, d int) string {
+	switch m {
+	case time.January:
+		switch d {
+		case 1:
+			return "元日"
+		case nthMonday(y, m, 2):
+			return "成人の日"
+		}
+	case time.February:
+		switch {
+		case d == 11:
+			return "建国記念の日"
+		case d == 23 && y >= 2020:
+			return "天皇誕生日"
+		}
+	case time.March:
+		if d == equinox(y, 20.8431) {
+			return "春分の日"
+		}
+	case time.April:
+		if d == 29 {
+			return "昭和の日"
+		}
+	case time.May:
+		switch d {
+		case 3:
+			return "憲法記念日"
+		case 4:
+			return "みどりの日"
+		case 5:
+			return "こどもの日"
+		}
+	case time.July:
+		switch {
+		case y == 2020 && d == 23, y == 2021 && d == 22, y != 2020 && y != 2021 && d == nthMonday(y, m, 3):
+			return "海の日"
+		case y == 2020 && d == 24, y == 2021 && d == 23:
+			return "スポーツの日"
+		}
+	case time.August:
+		switch {
+		case y == 2020 && d == 10, y == 2021 && d == 8, y != 2020 && y != 2021 && d == 11:
+			return "山の日"
+		}
+	case time.September:
+		switch d {
+		case nthMonday(y, m, 3):
+			return "敬老の日"
+		case equinox(y, 23.2488):
+			return "秋分の日"
+		}
+	case time.October:
+		if y != 2020 && y != 2021 && d == nthMonday(y, m, 2) {
+			return "スポーツの日"
+		}
+	case time.November:
+		switch d {
+		case 3:
+			return "文化の日"
+		case 23:
+			return "勤労感謝の日"
+		}
+	case time.December:
+		if d == 23 && y <= 2018 {
+			return "天皇誕生日"
+		}
+	}
+	return ""
+}
+
+// nthMonday returns the day of the nth Monday of the month.
+func nthMonday(y int, m time.Month, n int) int {
+	first := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC).Weekday()
+	return 1 + (int(time.Monday)-int(first)+7)%7 + 7*(n-1)
+}
+
+// equinox returns the day of the vernal (base 20.8431) or autumnal (base
+// 23.2488) equinox in Japan.
+func equinox(y int, base float64) int {
+	return int(base+0.242194*float64(y-1980)) - (y-1980)/4
+}
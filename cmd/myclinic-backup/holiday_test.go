@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var jst = time.FixedZone("JST", 9*60*60)
+
+func TestJapaneseHoliday(t *testing.T) {
+	for _, tc := range []struct {
+		date string
+		want string
+	}{
+		{"2020-01-01", "元日"},
+		{"2020-01-13", "成人の日"},
+		{"2020-02-11", "建国記念の日"},
+		// February 23, 2020 was a Sunday.
+		{"2020-02-23", "天皇誕生日"},
+		{"2020-02-24", "振替休日"},
+		{"2020-03-20", "春分の日"},
+		{"2020-04-29", "昭和の日"},
+		// May 3, 2020 was a Sunday, and the substitute holiday is the first
+		// day after it which is not a holiday.
+		{"2020-05-03", "憲法記念日"},
+		{"2020-05-04", "みどりの日"},
+		{"2020-05-05", "こどもの日"},
+		{"2020-05-06", "振替休日"},
+		{"2020-05-07", ""},
+		// The holidays moved for the Olympics.
+		{"2020-07-20", ""},
+		{"2020-07-23", "海の日"},
+		{"2020-07-24", "スポーツの日"},
+		{"2020-08-10", "山の日"},
+		{"2020-08-11", ""},
+		{"2020-10-12", ""},
+		{"2021-07-19", ""},
+		{"2021-07-22", "海の日"},
+		{"2021-07-23", "スポーツの日"},
+		{"2021-08-08", "山の日"},
+		{"2021-08-09", "振替休日"},
+		{"2021-10-11", ""},
+		{"2022-07-18", "海の日"},
+		{"2022-08-11", "山の日"},
+		{"2022-10-10", "スポーツの日"},
+		{"2020-09-21", "敬老の日"},
+		{"2020-09-22", "秋分の日"},
+		{"2020-11-03", "文化の日"},
+		{"2020-11-23", "勤労感謝の日"},
+		{"2023-03-21", "春分の日"},
+		{"2023-09-23", "秋分の日"},
+		// Sunday holidays in February and September 2024.
+		{"2024-02-12", "振替休日"},
+		{"2024-09-16", "敬老の日"},
+		{"2024-09-22", "秋分の日"},
+		{"2024-09-23", "振替休日"},
+		// May 4, 2025 was a Sunday.
+		{"2025-05-06", "振替休日"},
+		// September 22, 2026 is between 敬老の日 and 秋分の日.
+		{"2026-09-21", "敬老の日"},
+		{"2026-09-22", "国民の休日"},
+		{"2026-09-23", "秋分の日"},
+		// The Emperor's Birthday moved with the era.
+		{"2018-12-23", "天皇誕生日"},
+		{"2018-12-24", "振替休日"},
+		{"2019-12-23", ""},
+		{"2020-12-31", ""},
+	} {
+		// The date is that of the time in its own location.
+		day, err := time.ParseInLocation("2006-01-02", tc.date, jst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tm := range []time.Time{day, day.Add(24*time.Hour - time.Minute)} {
+			if got := japaneseHoliday(tm); got != tc.want {
+				t.Errorf("japaneseHoliday(%v) = %q, want %q", tm, got, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// profileStatus is the freshness of the backups of a profile.
+type profileStatus struct {
+	Profile    string     `json:"profile"`
+	Time       *time.Time `json:"time,omitempty"`
+	AgeSeconds int64      `json:"age_seconds,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	S3Key      string     `json:"s3_key,omitempty"`
+	Overdue    bool       `json:"overdue"`
+	// RecoveryPointSeconds is the age of the newest restorable backup in
+	// S3, and RecoveryTimeSeconds the recovery time of the latest drill.
+	RecoveryPointSeconds int64 `json:"recovery_point_seconds,omitempty"`
+	RecoveryTimeSeconds  int64 `json:"recovery_time_seconds,omitempty"`
+	ObjectivesBreached   bool  `json:"objectives_breached"`
+}
+
+func latestEntry(entries []*CatalogEntry, profile string) *CatalogEntry {
+	var latest *CatalogEntry
+	for _, e := range entries {
+		if e.Profile == profile && e.isDump() && (latest == nil || e.Time.After(latest.Time)) {
+			latest = e
+		}
+	}
+	return latest
+}
+
+func profileStatuses(profiles []*Profile, now time.Time) ([]*profileStatus, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []*profileStatus
+	for _, p := range profiles {
+		s := &profileStatus{Profile: p.Name}
+		e := latestEntry(entries, p.Name)
+		if e != nil {
+			s.Time = &e.Time
+			s.AgeSeconds = int64(now.Sub(e.Time).Seconds())
+			s.Size = e.Size
+			s.S3Key = e.S3Key
+		}
+		s.Overdue = p.MaxAge > 0 && (e == nil || now.Sub(e.Time) > p.MaxAge)
+		o := checkObjectives(entries, p, now)
+		if o.Point != nil {
+			s.RecoveryPointSeconds = int64(o.recoveryPoint(now).Seconds())
+		}
+		if o.Drill != nil {
+			s.RecoveryTimeSeconds = int64(o.Drill.RecoveryTime.Seconds())
+		}
+		s.ObjectivesBreached = len(o.breaches) > 0
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+func writeMetrics(w http.ResponseWriter, statuses []*profileStatus) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP myclinic_backup_last_success_timestamp_seconds Time of the last successful backup.\n")
+	fmt.Fprintf(w, "# TYPE myclinic_backup_last_success_timestamp_seconds gauge\n")
+	for _, s := range statuses {
+		if s.Time != nil {
+			fmt.Fprintf(w, "myclinic_backup_last_success_timestamp_seconds{profile=%q} %d\n", s.Profile, s.Time.Unix())
+		}
+	}
+	fmt.Fprintf(w, "# HELP myclinic_backup_last_size_bytes Size of the last successful plain dump.\n")
+	fmt.Fprintf(w, "# TYPE myclinic_backup_last_size_bytes gauge\n")
+	for _, s := range statuses {
+		if s.Time != nil {
+			fmt.Fprintf(w, "myclinic_backup_last_size_bytes{profile=%q} %d\n", s.Profile, s.Size)
+		}
+	}
+	fmt.Fprintf(w, "# HELP myclinic_backup_overdue Whether the last successful backup is older than max_age.\n")
+	fmt.Fprintf(w, "# TYPE myclinic_backup_overdue gauge\n")
+	for _, s := range statuses {
+		overdue := 0
+		if s.Overdue {
+			overdue = 1
+		}
+		fmt.Fprintf(w, "myclinic_backup_overdue{profile=%q} %d\n", s.Profile, overdue)
+	}
+	fmt.Fprintf(w, "# HELP myclinic_backup_recovery_point_seconds Age of the newest backup restorable from S3.\n")
+	fmt.Fprintf(w, "# TYPE myclinic_backup_recovery_point_seconds gauge\n")
+	for _, s := range statuses {
+		if s.RecoveryPointSeconds > 0 {
+			fmt.Fprintf(w, "myclinic_backup_recovery_point_seconds{profile=%q} %d\n", s.Profile, s.RecoveryPointSeconds)
+		}
+	}
+	fmt.Fprintf(w, "# HELP myclinic_backup_recovery_time_seconds Time the latest restore drill took to recover the backup.\n")
+	fmt.Fprintf(w, "# TYPE myclinic_backup_recovery_time_seconds gauge\n")
+	for _, s := range statuses {
+		if s.RecoveryTimeSeconds > 0 {
+			fmt.Fprintf(w, "myclinic_backup_recovery_time_seconds{profile=%q} %d\n", s.Profile, s.RecoveryTimeSeconds)
+		}
+	}
+	fmt.Fprintf(w, "# HELP myclinic_backup_objectives_breached Whether rpo or rto is breached.\n")
+	fmt.Fprintf(w, "# TYPE myclinic_backup_objectives_breached gauge\n")
+	for _, s := range statuses {
+		breached := 0
+		if s.ObjectivesBreached {
+			breached = 1
+		}
+		fmt.Fprintf(w, "myclinic_backup_objectives_breached{profile=%q} %d\n", s.Profile, breached)
+	}
+}
+
+// serveStatus serves the freshness of backups for HTTP based monitoring.
+func serveStatus(addr string, profiles []*Profile) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok\n")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := profileStatuses(profiles, time.Now())
+		if err != nil {
+			http.Error(w, redactError(err), http.StatusInternalServerError)
+			return
+		}
+		writeMetrics(w, statuses)
+	})
+	mux.HandleFunc("/last-backup", func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := profileStatuses(profiles, time.Now())
+		if err != nil {
+			http.Error(w, redactError(err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	})
+	server := &http.Server{Addr: addr, Handler: mux}
+	defer onInterrupt(func() { server.Close() })()
+	return server.ListenAndServe()
+}
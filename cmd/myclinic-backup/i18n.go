@@ -0,0 +1,670 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Languages messages can be shown in.
+const (
+	languageEnglish  = "en"
+	languageJapanese = "ja"
+)
+
+// language is the language of messages, reports and prompts. It is chosen
+// by -lang, the language field of the config file, or the locale, in that
+// order.
+var language = languageEnglish
+
+var langFlag = flag.String("lang", "", "language of messages: en or ja (default from the locale)")
+
+// detectLanguage returns the language of the locale set in the environment.
+func detectLanguage() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		if strings.HasPrefix(v, "ja") {
+			return languageJapanese
+		}
+		return languageEnglish
+	}
+	return languageEnglish
+}
+
+func validLanguage(lang string) bool {
+	return lang == languageEnglish || lang == languageJapanese
+}
+
+// setLanguage chooses the language once the config file is read; before
+// that only -lang and the locale are known.
+func setLanguage(configured string) error {
+	switch {
+	case *langFlag != "":
+		if !validLanguage(*langFlag) {
+			return fmt.Errorf("invalid language: %s", *langFlag)
+		}
+		language = *langFlag
+	case configured != "":
+		if !validLanguage(configured) {
+			return fmt.Errorf("invalid language: %s", configured)
+		}
+		language = configured
+	default:
+		language = detectLanguage()
+	}
+	return nil
+}
+
+// tr returns the translation of the English message s, which may be a
+// format, or s itself if there is none.
+func tr(s string) string {
+	if language != languageJapanese {
+		return s
+	}
+	if t, ok := messagesJa[s]; ok {
+		return t
+	}
+	return s
+}
+
+// trf formats the translation of format.
+func trf(format string, args ...interface{}) string {
+	return fmt.Sprintf(tr(format), args...)
+}
+
+// errorHint explains an error whose message contains pattern, for the
+// operator who is not a sysadmin.
+type errorHint struct {
+	pattern string
+	en      string
+	ja      string
+}
+
+var errorHints = []errorHint{
+	{"Access denied for user",
+		"the database user or password is wrong; check db_user and db_pass",
+		"データベースのユーザー名またはパスワードが正しくありません。db_user と db_pass を確認してください"},
+	{"Can't connect to",
+		"the database server is not running or cannot be reached",
+		"データベースサーバーが起動していないか、接続できません"},
+	{"executable file not found",
+		"a required program is not installed or not in PATH",
+		"必要なプログラムがインストールされていないか、PATH にありません"},
+	{"NoCredentialProviders",
+		"no AWS credentials were found; check the credentials file or environment variables",
+		"AWS の認証情報が見つかりません。認証情報ファイルまたは環境変数を確認してください"},
+	{"AccessDenied",
+		"AWS refused access; check the IAM policy of the backup user (see the iam-policy command)",
+		"AWS へのアクセスが拒否されました。バックアップ用ユーザーの IAM ポリシーを確認してください（iam-policy コマンドを参照）"},
+	{"NoSuchBucket",
+		"the S3 bucket does not exist; check s3_bucket and s3_region",
+		"S3 バケットが存在しません。s3_bucket と s3_region を確認してください"},
+	{"no such host",
+		"the network is unavailable or the name cannot be resolved",
+		"ネットワークに接続できないか、ホスト名を解決できません"},
+	{"message authentication failed",
+		"the backup cannot be decrypted: the key is wrong or the file is damaged",
+		"バックアップを復号できません。鍵が違うか、ファイルが壊れています"},
+	{"(-inject-failure)",
+		"the failure was forced by -inject-failure for a rehearsal",
+		"-inject-failure により訓練として発生させた障害です"},
+	{"no space left on device",
+		"the disk is full; delete old plain dumps or free space",
+		"ディスクがいっぱいです。古い平文ダンプを削除するなどして空き容量を確保してください"},
+}
+
+// explainError returns an explanation of err in the current language, or
+// "" if there is none.
+func explainError(err error) string {
+	msg := err.Error()
+	for _, h := range errorHints {
+		if strings.Contains(msg, h.pattern) {
+			if language == languageJapanese {
+				return h.ja
+			}
+			return h.en
+		}
+	}
+	return ""
+}
+
+// printError prints err with its explanation, if any.
+func printError(prefix string, err error) {
+	fmt.Fprintf(stderr, "%s%v\n", prefix, err)
+	if hint := explainError(err); hint != "" {
+		fmt.Fprintf(stderr, "%s%s%s\n", prefix, tr("hint: "), hint)
+	}
+}
+
+// messagesJa are the Japanese translations, keyed by the English message.
+var messagesJa = map[string]string{
+	// Usage.
+	"Usage: %s [options] [command] [args]\n": "使い方: %s [オプション] [コマンド] [引数]\n",
+	"[commands]\n":                           "[コマンド]\n",
+	"[options]\n":                            "[オプション]\n",
+	"unknown command: %s\n":                  "不明なコマンドです: %s\n",
+	"hint: ":                                 "ヒント: ",
+	"backs up selected profiles once (default)":                                                                       "選択したプロファイルを一度バックアップします（既定）",
+	"backs up profiles according to their schedules":                                                                  "スケジュールに従ってバックアップします",
+	"serves an authenticated HTTP API for backups and restores":                                                       "バックアップと復元のための認証付き HTTP API を提供します",
+	"serves encrypted dumps of the profiles to a controller":                                                          "暗号化したダンプをコントローラーに提供します",
+	"collects backups from the agents of the configured sites":                                                        "各拠点のエージェントからバックアップを収集します",
+	"prints the weekly summary for the clinic staff, or with -send sends it to the notifiers":                         "医院スタッフ向けの週次まとめを表示し、-send で通知先に送ります",
+	"prints the coming days as the calendars of the profiles see them":                                                "プロファイルのカレンダーから見た今後の日々を表示します",
+	"reports whether the backups meet the 3-2-1 rule, retention and verification requirements":                        "バックアップが 3-2-1 ルール、保存期間、検証の要件を満たしているか報告します",
+	"prints the past runs, e.g. history -failed -since 30d, also as CSV or JSON":                                      "過去の実行を表示します（例: history -failed -since 30d）。CSV や JSON でも出力できます",
+	"exempts backups from pruning, with S3 legal hold where the bucket allows, or lists those held":                   "バックアップを削除の対象から外します（バケットが許せば S3 のリーガルホールドも設定）。引数なしで保留中のものを一覧します",
+	"lifts the hold on backups":                                                                                       "バックアップの保留を解除します",
+	"rewrites the catalog, history, audit log and states encrypted with metadata_key_file, or with -decrypt plain":    "カタログ、履歴、監査ログ、状態を metadata_key_file で暗号化して（-decrypt では平文で）書き直します",
+	"reports the recovery point and recovery time of the profiles against rpo and rto":                                "プロファイルの復旧時点と復旧時間を rpo・rto と照らして報告します",
+	"writes the key of a profile as a printable, passphrase-protected escrow bundle":                                  "プロファイルの鍵を、パスフレーズで保護した印刷可能な預託用バンドルとして書き出します",
+	"writes the key of an escrow bundle to a key file":                                                                "預託用バンドルの鍵を鍵ファイルに書き出します",
+	"splits the key of a profile into shares, a threshold of which recover it":                                        "プロファイルの鍵を、一定数集まれば復元できる分割鍵に分けます",
+	"recovers a key from its shares and writes it to a key file":                                                      "分割鍵から鍵を復元し、鍵ファイルに書き出します",
+	"moves existing backups and their catalog entries to the current naming, prefix and bucket":                       "既存のバックアップとカタログの記録を、現在の名前・プレフィックス・バケットに移します",
+	"with import, records backups made by older versions or by hand which the catalog lacks":                          "import で、旧版や手作業で作られカタログにないバックアップを記録します",
+	"removes leftovers of interrupted runs and handles backups missing from the catalog or without an encrypted copy": "中断した実行の残骸を削除し、カタログにないバックアップや暗号化されていないダンプを処理します",
+	"deletes the backups, locally and in S3, which the retention policy expires":                                      "保持ポリシーで期限切れとなったバックアップをローカルと S3 から削除します",
+	"reports profiles whose last successful backup is older than max_age":                                             "最後に成功したバックアップが max_age より古いプロファイルを報告します",
+	"encrypts a file or stdin and uploads it as a named artifact":                                                     "ファイルまたは標準入力を暗号化し、名前を付けてアップロードします",
+	"browses the backups and restores, verifies or prunes them from menus":                                            "メニューからバックアップを閲覧し、復元・検証・整理します",
+	"streams a backup, the latest by default, from S3 or the local copy into the database":                            "S3 またはローカルのバックアップ（既定は最新）をデータベースに復元します",
+	"restores the latest backup onto a replica and prints how to start replication":                                   "最新のバックアップをレプリカに復元し、レプリケーションの開始方法を表示します",
+	"restores the newest backup in the bucket into the standby server":                                                "バケット内の最新のバックアップをスタンバイサーバーに復元します",
+	"downloads the latest backup, decrypts it and checks it against the checksum taken at backup time":                "最新のバックアップをダウンロード・復号し、バックアップ時のチェックサムと照合します",
+	"downloads the latest backup and compares its checksum with the catalog":                                          "最新のバックアップをダウンロードし、チェックサムをカタログと照合します",
+	"restores the latest backup into a temporary database and reports":                                                "最新のバックアップを一時データベースに復元して結果を報告します",
+	"compares the tables of the latest backup with the live database":                                                 "最新のバックアップのテーブルを稼働中のデータベースと比較します",
+	"ships the binary logs written since the latest backup, for profiles with binlog":                                 "binlog を設定したプロファイルについて、最新のバックアップ以降のバイナリログを転送します",
+	"checks that the audit log has not been tampered with":                                                            "監査ログが改ざんされていないことを確認します",
+	"compresses old uncompressed plain dumps in place":                                                                "圧縮されていない古い平文ダンプを圧縮します",
+	"measures dump, compression, encryption and upload throughput and recommends settings":                            "ダンプ・圧縮・暗号化・アップロードの速度を測定し、設定を推奨します",
+	"benchmark with %s of synthetic data\n":                                                                           "%s の合成データで測定します\n",
+	"  dump (disk write): %s\n":                                                                                       "  ダンプ（ディスク書き込み）: %s\n",
+	"  dump (mysqldump of %s): %s\n":                                                                                  "  ダンプ（%s の mysqldump）: %s\n",
+	"  compression level %d: %s, %.0f%% of the original size\n":                                                       "  圧縮レベル %d: %s、元のサイズの %.0f%%\n",
+	"  encryption: %s\n":                       "  暗号化: %s\n",
+	"  upload, part size %s, %d at once: %s\n": "  アップロード（パートサイズ %s、同時 %d）: %s\n",
+	"recommended settings for dumps of %s and a backup window of %s (estimated %s):\n": "%s のダンプを %s 以内にバックアップするための推奨設定（見込み %s）:\n",
+	"warning: even at the fastest setting the backup takes longer than the window\n":   "警告: 最も速い設定でもバックアップが時間内に終わりません\n",
+	"compares an S3 Inventory report with the catalog":                                 "S3 インベントリレポートとカタログを照合します",
+	"finds the AxCrypt program and checks that its version is supported":               "AxCrypt のプログラムを探し、対応するバージョンか確認します",
+	"prints IAM policies limiting each profile to its S3 prefix":                       "各プロファイルを S3 プレフィックスに制限する IAM ポリシーを表示します",
+
+	// Backup runs.
+	"resuming run %s started at %s\n":              "%[2]s に開始した実行 %[1]s を再開します\n",
+	"abandoning unfinished run %s started at %s\n": "%[2]s に開始した未完了の実行 %[1]s を破棄します\n",
+	"%s already done; skipped\n":                   "%s は完了済みのため省略します\n",
+	"files archived to %s\n":                       "ファイルを %s にアーカイブしました\n",
+	"database backed up to %s\n":                   "データベースを %s にバックアップしました\n",
+	"simulated database dump written to %s\n":      "模擬ダンプを %s に書き出しました\n",
+	"encrypted file: %s\n":                         "暗号化ファイル: %s\n",
+	"region: %s\n":                                 "リージョン: %s\n",
+	"S3 key: %s\n":                                 "S3 キー: %s\n",
+	"removed expired plain dump %s\n":              "期限切れの平文ダンプ %s を削除しました\n",
+	"grants uploaded to %s\n":                      "権限情報を %s にアップロードしました\n",
+	"ok":                                           "成功",
+	"FAILED: ":                                     "失敗: ",
+	"notification failed: %v\n":                    "通知に失敗しました: %v\n",
+
+	// Notifications.
+	"backup of %s succeeded":                                   "%s のバックアップに成功しました",
+	"backup of %s failed: %s":                                  "%s のバックアップに失敗しました: %s",
+	"backup of %s overdue: no successful backup recorded":      "%s のバックアップが遅れています: 成功したバックアップの記録がありません",
+	"backup of %s overdue: last success %s (%s ago, limit %s)": "%s のバックアップが遅れています: 最後の成功は %s（%s 前、上限 %s）",
+	"standby restore of %s failed: %s":                         "%s のスタンバイへの復元に失敗しました: %s",
+	"standby of %s is current":                                 "%s のスタンバイは最新です",
+	"%s: no max_age configured\n":                              "%s: max_age が設定されていません\n",
+	"%s: OK\n":                                                 "%s: 正常\n",
+
+	// Restore.
+	"restoring %s (taken %s) into %s\n":      "%s（%s 取得）を %s に復元しています\n",
+	"restored into %s\n":                     "%s に復元しました\n",
+	"would extract %s (taken %s) under %s\n": "%s（%s 取得）を %s に展開します（実行はしません）\n",
+	"%d entries extracted\n":                 "%d 件を展開しました\n",
+	"extracting %s (taken %s) under %s\n":    "%s（%s 取得）を %s に展開しています\n",
+	"%s: %s of %s (%d%%)":                    "%s: %s / %s (%d%%)",
+	", about %s left":                        "、残り約 %s",
+	"%d tables done, now %s, about %d rows":  "%d 表完了、現在 %s、約 %d 行",
+	"%d tables, about %d rows":               "%d 表、約 %d 行",
+	"restoring":                              "復元中",
+	"downloading":                            "ダウンロード中",
+	"downloads a backup, also by s3:// URL from another bucket, optionally decrypted": "バックアップをダウンロードします。別のバケットの s3:// URL も指定でき、復号もできます",
+	"would fetch %s to %s\n": "%s を %s にダウンロードします（実行しません）\n",
+	"fetched %s to %s\n":     "%s を %s にダウンロードしました\n",
+	"reading backup":         "バックアップを読み込み中",
+
+	// Authenticating backups before they are loaded.
+	"authenticating the backup before loading it\n": "読み込む前にバックアップを認証しています\n",
+
+	// Point-in-time restore.
+	"replaying %d binary log(s) up to %s\n":                                                "%d 個のバイナリログを %s まで適用しています\n",
+	"warning: the binary logs were last shipped %s; changes after that are not restored\n": "警告: バイナリログの最終転送は %s です。それ以降の変更は復元されません\n",
+
+	// Re-basing chains of binary logs.
+	"the backup taken %s is older than max_days of %d":                    "%s のバックアップが max_days（%d 日）より古くなりました",
+	"%d binary logs follow the backup taken %s, more than max_logs of %d": "%d 個のバイナリログが %s のバックアップに続いており、max_logs（%d）を超えました",
+	"%s; taking a full backup to start a new chain\n":                     "%s。新しいチェーンを始めるためフルバックアップを取ります\n",
+
+	// pre-upgrade.
+	"takes a labeled backup and verifies it, failing if the upgrade must not proceed": "ラベル付きのバックアップを取得して検証します。失敗した場合はアップグレードを進めてはいけません",
+	"\nPRE-UPGRADE BACKUP FAILED. Do not proceed with the upgrade.\n":                 "\nアップグレード前のバックアップに失敗しました。アップグレードを進めないでください。\n",
+	"pre-upgrade backup %s is uploaded and verified; the upgrade may proceed\n":       "アップグレード前のバックアップ %s はアップロード・検証済みです。アップグレードを進めてかまいません\n",
+
+	// History.
+	"no runs\n": "実行記録はありません\n",
+
+	// Compliance.
+	"original":                 "原本",
+	"local disk":               "ローカルディスク",
+	"local dump":               "ローカルのダンプ",
+	"cloud storage":            "クラウドストレージ",
+	"standby server":           "スタンバイサーバー",
+	"standby (%s)":             "スタンバイ（%s）",
+	"no backup in S3":          "S3 にバックアップがありません",
+	"%s, taken %s":             "%s、%s 取得",
+	" (older than max_age %s)": "（max_age %s より古い）",
+	"copies":                   "コピー数",
+	"media":                    "媒体",
+	"off-site":                 "遠隔地保管",
+	"retention":                "保存期間",
+	"verification":             "検証",
+	"evaluation":               "評価",
+	"integrity":                "完全性",
+	"oldest backup %s, %d days old (%d required)":          "最古のバックアップ %s、%d 日前（%d 日必要）",
+	"all backups kept since the first, %s (%d of %d days)": "最初の %s 以降すべて保存（%d / %d 日）",
+	"oldest backup %s is %d days old, %d required":         "最古のバックアップ %s は %d 日前で、%d 日必要です",
+	"never verified": "検証されていません",
+	"last %s %s (%d days ago, within %d required)": "最終 %s %s（%d 日前、%d 日以内が必要）",
+	"Backup compliance report, %s, %s\n":           "バックアップ適合性報告、%s、%s\n",
+	"not required":                                 "要件なし",
+	"%d days":                                      "%d 日",
+	"Requirements: 3 copies on 2 kinds of media, 1 off-site; retention %s; verified within %d days\n": "要件: 2 種類の媒体に 3 コピー、うち 1 つは遠隔地。保存期間 %s。%d 日以内に検証\n",
+	"\nProfile %s\n":                      "\nプロファイル %s\n",
+	"\nAudit log\n":                       "\n監査ログ\n",
+	"%d records, chain intact":            "%d 件、チェーンは正常",
+	"\nResult: FAIL (%d checks failed)\n": "\n結果: 不合格（%d 項目が不合格）\n",
+	"\nResult: PASS\n":                    "\n結果: 合格\n",
+
+	// Calendar.
+	"closed weekday":               "定休日",
+	"closing day":                  "休診日",
+	"%s: no calendar configured\n": "%s: カレンダーが設定されていません\n",
+	"open":                         "診療日",
+	"closed (%s)":                  "休み（%s）",
+	", month-end backup ":          "、月末バックアップ ",
+
+	// SMS.
+
+	// Hold.
+	"bucket %s does not have Object Lock enabled; holding in the catalog only\n": "バケット %s はオブジェクトロックが有効でないため、カタログでのみ保留します\n",
+	"held %s\n":               "%s を保留しました\n",
+	"released %s\n":           "%s の保留を解除しました\n",
+	"nothing to change\n":     "変更するものはありません\n",
+	"would hold %s\n":         "%s を保留します（実行しません）\n",
+	"would release %s\n":      "%s の保留を解除します（実行しません）\n",
+	"  (S3 legal hold)":       "  （S3 リーガルホールド）",
+	"    held %s by %s: %s\n": "    %s に %s が保留: %s\n",
+	"no backups are held\n":   "保留中のバックアップはありません\n",
+	"[held]":                  "[保留]",
+
+	// Metadata encryption.
+	"metadata in %s is stored plain; remove metadata_key_file to keep it so\n": "%s のメタデータを平文にしました。このままにするには metadata_key_file を削除してください\n",
+	"metadata in %s is encrypted\n":                                            "%s のメタデータは暗号化されています\n",
+
+	// Deduplication.
+	"dump is identical to %s; stored as a %s\n": "ダンプは %s と同一のため、%s として保存しました\n",
+	"hard link": "ハードリンク",
+	"reflink":   "reflink",
+
+	// Work directories.
+	"%v: work directories removed; exiting\n": "%v: 作業ディレクトリを削除して終了します\n",
+
+	// Recovery objectives.
+	"RPO: no restorable backup in S3":                       "RPO: S3 に復元可能なバックアップがありません",
+	"RPO: newest restorable backup is %s old, objective %s": "RPO: 最新の復元可能なバックアップは %s 前のもので、目標は %s です",
+	"RTO: not measured by any restore drill":                "RTO: 復元訓練で計測されていません",
+	"RTO: restore drill of %s took %s, objective %s":        "RTO: %s の復元訓練は %s かかり、目標は %s です",
+	"recovery objectives of %s breached: %s":                "%s の復旧目標を満たしていません: %s",
+	"%s (backup of %s)":                                     "%s（%s のバックアップ）",
+	"  recovery point: %s, objective %s\n":                  "  復旧時点: %s、目標 %s\n",
+	"none":                                                  "なし",
+	"not set":                                               "未設定",
+	"not measured":                                          "未計測",
+	"%s (drill of %s)":                                      "%s（%s の訓練）",
+	"  recovery time: %s, objective %s\n":                   "  復旧時間: %s、目標 %s\n",
+	"  BREACHED %s\n":                                       "  未達 %s\n",
+
+	// Clock check.
+	"cannot read the time of S3 to check the clock: %v\n":                                      "時計を確認するための S3 の時刻を取得できません: %v\n",
+	"the clock is %s off the time of S3":                                                       "時計が S3 の時刻から %s ずれています",
+	"the clock is behind the newest backup, taken %s":                                          "時計が最新のバックアップ（%s）より遅れています",
+	"warning: %s; the backup is named by the time of S3, %s, and plain dumps are not pruned\n": "警告: %s。バックアップは S3 の時刻 %s で名付け、平文ダンプは削除しません\n",
+	"warning: %s; plain dumps are not pruned until it is fixed\n":                              "警告: %s。直るまで平文ダンプは削除しません\n",
+	"plain dumps not pruned while the clock is off\n":                                          "時計がずれているため平文ダンプを削除しませんでした\n",
+
+	// Notification pipeline.
+	"backup of %s succeeded again after %d failures": "%s のバックアップは %d 回の失敗の後、再び成功しました",
+	"backup of %s failed %d times in a row: %s":      "%s のバックアップが %d 回続けて失敗しました: %s",
+	"Time: %s\n":     "日時: %s\n",
+	"Severity: %s\n": "重要度: %s\n",
+	"info":           "情報",
+	"warning":        "警告",
+	"critical":       "重大",
+
+	// Key escrow.
+	"would export the key of %s (fingerprint %s)\n":                                    "%s の鍵（フィンガープリント %s）を書き出します\n",
+	"passphrase for the key bundle (at least %d characters): ":                         "鍵バンドルのパスフレーズ（%d 文字以上）: ",
+	"key of %s exported; keep the bundle and the passphrase in separate safe places\n": "%s の鍵を書き出しました。バンドルとパスフレーズは別々の安全な場所に保管してください\n",
+	"%s: key never exported\n":                                                         "%s: 鍵は一度も書き出されていません\n",
+	"%s: key changed since it was last exported on %s; export it again\n":              "%s: %s に書き出した後で鍵が変わっています。もう一度書き出してください\n",
+	"%s: key exported on %s (fingerprint %s)\n":                                        "%s: 鍵は %s に書き出し済みです（フィンガープリント %s）\n",
+	"passphrase of the key bundle: ":                                                   "鍵バンドルのパスフレーズ: ",
+	"would write the key (fingerprint %s) to %s\n":                                     "鍵（フィンガープリント %s）を %s に書き出します\n",
+	"key (fingerprint %s) written to %s\n":                                             "鍵（フィンガープリント %s）を %s に書き出しました\n",
+
+	"would split the key of %s (fingerprint %s) into %d shares, %d of which recover it\n": "%s の鍵（フィンガープリント %s）を %d 個の分割鍵に分けます。%d 個で復元できます\n",
+	"share %d written to %s\n": "分割鍵 %d を %s に書き出しました\n",
+	"hand each share to its holder and delete the files; any %d of them recover the key\n": "各分割鍵を保管者に渡し、ファイルは削除してください。どれか %d 個で鍵を復元できます\n",
+
+	// Layout migration.
+	"%s has an S3 legal hold and is not moved; release it first\n": "%s には S3 のリーガルホールドがあるため移動しません。先に解除してください\n",
+	"would move %s\n    %s\n":                                      "%s を移動します\n    %s\n",
+	"moved %s\n    %s\n":                                           "%s を移動しました\n    %s\n",
+	"all backups are already in place\n":                           "すべてのバックアップは既に所定の場所にあります\n",
+
+	// Catalog import.
+	"no backups missing from the catalog\n": "カタログに漏れているバックアップはありません\n",
+	"imported %s %s: %s\n":                  "%s %s を取り込みました: %s\n",
+	"would import %s %s: %s\n":              "%s %s を取り込みます: %s\n",
+
+	// Deleting expired backups.
+	"deleted %d of %d backups\n": "%d / %d 件のバックアップを削除しました\n",
+
+	// Garbage collection.
+	"would remove work directory %s\n":                 "作業ディレクトリ %s を削除します\n",
+	"removed work directory %s\n":                      "作業ディレクトリ %s を削除しました\n",
+	"would remove %s\n":                                "%s を削除します\n",
+	"would finish compressing %s\n":                    "%s の圧縮を完了させます\n",
+	"finished compressing %s\n":                        "%s の圧縮を完了させました\n",
+	"removed %s, which does not match %s\n":            "%s は %s と一致しないため削除しました\n",
+	"would remove %s, which is not in the catalog\n":   "カタログにない %s を削除します\n",
+	"removed %s, which is not in the catalog\n":        "カタログにない %s を削除しました\n",
+	"would import %s into the catalog\n":               "%s をカタログに取り込みます\n",
+	"imported %s into the catalog\n":                   "%s をカタログに取り込みました\n",
+	"%s is not in the catalog\n":                       "%s はカタログにありません\n",
+	"would remove %s, which has no encrypted backup\n": "暗号化したバックアップのない %s を削除します\n",
+	"removed %s, which has no encrypted backup\n":      "暗号化したバックアップのない %s を削除しました\n",
+	"%s has no encrypted backup\n":                     "%s には暗号化したバックアップがありません\n",
+	"nothing to clean up\n":                            "片付けるものはありません\n",
+	"%d found, %d cleaned up\n":                        "%d 件見つかり、%d 件を片付けました\n",
+
+	// Streamed backups.
+	"streaming backup to s3://%s/%s\n":   "s3://%s/%s へ直接バックアップしています\n",
+	"streamed %s (%s encrypted) to S3\n": "%s（暗号化後 %s）を S3 へ送りました\n",
+
+	// Restore snapshots.
+	"no snapshot taken: profile %s does not back up %s\n":                 "プロファイル %s は %s をバックアップしないため、スナップショットは取りません\n",
+	"backing up the current state as %s before restoring\n":               "復元の前に現在の状態を %s としてバックアップします\n",
+	"to undo the restore: myclinic-backup -profile %s restore -date %s\n": "復元を取り消すには: myclinic-backup -profile %s restore -date %s\n",
+
+	// Pruning.
+	"the newest %d":                "最新 %d 件",
+	"%d daily":                     "日ごと %d 件",
+	"%d weekly":                    "週ごと %d 件",
+	"%d monthly":                   "月ごと %d 件",
+	"%d yearly":                    "年ごと %d 件",
+	"%s: keeping %s\n":             "%s: %s を保持します\n",
+	"would delete %s (taken %s)\n": "%s（%s 作成）を削除します\n",
+	"kept %d backups held since they expired\n":   "期限切れの後に保持指定された %d 件のバックアップを残しました\n",
+	"%s: no expired backups\n":                    "%s: 期限切れのバックアップはありません\n",
+	"pruned %d expired backups\n":                 "期限切れのバックアップ %d 件を削除しました\n",
+	"backups not pruned while the clock is off\n": "時計がずれているためバックアップを削除しませんでした\n",
+
+	// Restore picker.
+	"Backups of %s, newest first:\n":                  "%s のバックアップ（新しい順）:\n",
+	"↑↓ to move, Enter to choose, q to cancel\r\n":    "↑↓ で移動、Enter で選択、q で中止\r\n",
+	"Number of the backup to restore (q to cancel): ": "復元するバックアップの番号（q で中止）: ",
+	"Enter a number from 1 to %d.\n":                  "1 から %d までの番号を入力してください。\n",
+	"chosen: %s\n":                                    "選択: %s\n",
+	"Restore the backup taken %s into %s?":            "%s 取得のバックアップを %s に復元しますか？",
+	"restore canceled\n":                              "復元を中止しました\n",
+
+	// Weekdays.
+	"Sun": "日",
+	"Mon": "月",
+	"Tue": "火",
+	"Wed": "水",
+	"Thu": "木",
+	"Fri": "金",
+	"Sat": "土",
+
+	// List.
+	"lists the backups of the catalog, or with -local and -remote those on disk and in the buckets": "カタログのバックアップ、-local と -remote ではディスク上とバケット内のバックアップを一覧表示します",
+	"%s  %5d backups  %10s\n":      "%s  %5d 件  %10s\n",
+	"total    %5d backups  %10s\n": "合計     %5d 件  %10s\n",
+	"no backups\n":                 "バックアップはありません\n",
+	"(not uploaded)":               "(未アップロード)",
+	"encrypted":                    "暗号化",
+	"plain":                        "平文",
+	"other objects under the prefixes: %d, %s\n": "プレフィックス下のその他のオブジェクト: %d 件、%s\n",
+
+	// Restore drill report.
+	"PASS":                    "合格",
+	"FAIL":                    "不合格",
+	"Checks after restore:\n": "復元後の確認:\n",
+	"Schema: %d tables differ from live database %s; see schema-check\n": "スキーマ: %d 個のテーブルが稼働中のデータベース %s と異なります（schema-check を参照）\n",
+	"Schema: same as live database %s\n":                                 "スキーマ: 稼働中のデータベース %s と同じです\n",
+	"[myclinic-backup] restore drill %s: %s":                             "[myclinic-backup] 復元訓練 %s: %s",
+	"Restore drill: %s\n\n":                                              "復元訓練: %s\n\n",
+	"Profile: %s\n":                                                      "プロファイル: %s\n",
+	"Duration: %s\n":                                                     "所要時間: %s\n",
+	"Size: %s\n":                                                         "サイズ: %s\n",
+	"Key: %s\n":                                                          "キー: %s\n",
+	"Started: %s\n":                                                      "開始: %s\n",
+	"Backup: %s (taken %s)\n":                                            "バックアップ: %s（%s 取得）\n",
+	"Checksum: OK\n":                                                     "チェックサム: 正常\n",
+	"Restored into temporary database %s in %s (%s tables)\n": "一時データベース %s に %s で復元しました（テーブル数 %s）\n",
+	"Error: %v\n": "エラー: %v\n",
+
+	// tui.
+	"\n=== Backups":          "\n=== バックアップ",
+	" taken %s":              "（%s 取得分）",
+	"  no backups\n":         "  バックアップはありません\n",
+	"  (not uploaded)":       "  (未アップロード)",
+	"  started by:     %s\n": "  開始契機:       %s\n",
+	"  crypto mode:    %s\n": "  暗号モード:     %s\n",
+	"  label:          %s\n": "  ラベル:         %s\n",
+	"  note:           %s\n": "  メモ:           %s\n",
+	"not verified":           "未検証",
+	"verified ":              "検証済み ",
+	"VERIFICATION FAILED ":   "検証失敗 ",
+	"\n  page %d of %d\n":    "\n  %d / %d ページ\n",
+	"\n  NUMBER  details and actions of a backup\n":                                                "\n  番号    バックアップの詳細と操作\n",
+	"  d DATE  show backups taken on a date, e.g. d 2020-06-01 or d 2020-06 (d alone shows all)\n": "  d 日付  その日付のバックアップを表示（例: d 2020-06-01、d 2020-06。d のみで全件）\n",
+	"  n, p    next or previous page\n":                                                            "  n, p    次・前のページ\n",
+	"  prune   delete plain dumps by the retention rules\n":                                        "  prune   保持ルールに従って平文ダンプを削除\n",
+	"  q       quit\n\n":                  "  q       終了\n\n",
+	"\n=== Backup of %s taken %s ===\n\n": "\n=== %s のバックアップ（%s 取得） ===\n\n",
+	"  run id:         %s\n":              "  実行 ID:        %s\n",
+	"  size:           %s\n":              "  サイズ:         %s\n",
+	"  encrypted size: %s\n":              "  暗号化後:       %s\n",
+	"  stored at:      %s\n":              "  保存先:         %s\n",
+	"  local file:     %s\n":              "  ローカル:       %s\n",
+	"FAILED: %s":                          "失敗: %s",
+	"\n  The backup was not uploaded, so it cannot be restored or verified from here.\n":                                      "\n  このバックアップはアップロードされていないため、ここから復元・検証できません。\n",
+	"\n  r  restore this backup\n  v  verify this backup\n  V  verify by loading it into a temporary database\n  b  back\n\n": "\n  r  このバックアップを復元\n  v  このバックアップを検証\n  V  一時データベースに読み込んで検証\n  b  戻る\n\n",
+	"unknown choice: %s\n":                                      "不明な選択です: %s\n",
+	"\nPress Enter to go back.":                                 "\nEnter キーで戻ります。",
+	" Type yes to continue: ":                                   "続けるには yes と入力してください: ",
+	"cancelled\n":                                               "中止しました\n",
+	"Directory to extract into: ":                               "展開先のディレクトリ: ",
+	"Files of the backup taken %s will be written under %s.":    "%s 取得のバックアップのファイルを %s の下に書き込みます。",
+	"The databases %s will be replaced by the backup taken %s.": "データベース %s を %s 取得のバックアップで置き換えます。",
+	"Database to restore into [%s]: ":                           "復元先のデータベース [%s]: ",
+	"The database %s will be replaced by the backup taken %s.":  "データベース %s を %s 取得のバックアップで置き換えます。",
+	"\nRESTORE FAILED: %v\n":                                    "\n復元に失敗しました: %v\n",
+	"\nrestored\n":                                              "\n復元しました\n",
+	"verifying %s\n":                                            "%s を検証しています\n",
+	"\nVERIFICATION FAILED: %v\n":                               "\n検証に失敗しました: %v\n",
+	"\nthe backup is intact\n":                                  "\nバックアップは正常です\n",
+	"%s: neither plain_retention nor plain_keep_last is set; nothing to delete\n": "%s: plain_retention も plain_keep_last も設定されていないため、削除するものはありません\n",
+	"Plain dumps of %s %s will be deleted from %s.":                               "%[3]s から %[1]s の平文ダンプ（%[2]s）を削除します。",
+	"older than %d days":                             "%d 日より古いもの",
+	"beyond the newest":                              "新しいもの以外",
+	", keeping the newest %d":                        "、最新の %d 件を除く",
+	", keeping one for each of the latest %d months": "、ダンプのある直近 %d か月の各月 1 件を除く",
+	"removed %s\n":                                   "%s を削除しました\n",
+	"%s: %d plain dump(s) deleted\n":                 "%s: 平文ダンプを %d 件削除しました\n",
+
+	// Dashboard.
+	"Backups":        "バックアップ",
+	"Last backup:":   "最新のバックアップ:",
+	"No backup yet.": "まだバックアップがありません。",
+	"The last backup is too old. Please check the backup or contact support.": "最新のバックアップが古すぎます。バックアップを確認するか、サポートに連絡してください。",
+	"Back up now":            "今すぐバックアップ",
+	"Delete old plain dumps": "古い平文ダンプを削除",
+	"Delete plain dumps %s?": "平文ダンプ（%s）を削除しますか？",
+	"Time":                   "日時",
+	"Size":                   "サイズ",
+	"Stored size":            "保存サイズ",
+	"Verified":               "検証",
+	"OK":                     "正常",
+	"failed":                 "失敗",
+	"not yet":                "未実施",
+	"Verify":                 "検証",
+	"Restore":                "復元",
+	"database":               "データベース",
+	"Restore the backup of %s? The database will be overwritten.": "%s のバックアップを復元しますか？データベースは上書きされます。",
+	"not uploaded":              "未アップロード",
+	"Recent operations":         "最近の操作",
+	"Started":                   "開始",
+	"Operation":                 "操作",
+	"Profile":                   "プロファイル",
+	"Status":                    "状態",
+	"Details":                   "詳細",
+	"succeeded":                 "成功",
+	"running":                   "実行中",
+	"Token":                     "トークン",
+	"Sign in":                   "サインイン",
+	"The token is not correct.": "トークンが正しくありません。",
+	"%s of %s started":          "%[2]s の %[1]s を開始しました",
+	"backup":                    "バックアップ",
+	"restore":                   "復元",
+	"verify":                    "検証",
+	"prune":                     "整理",
+
+	// Agent and controller.
+	"[%s] dump requested by %s\n":                    "[%s] %s からダンプを要求されました\n",
+	"[%s] dump failed: %v\n":                         "[%s] ダンプに失敗しました: %v\n",
+	"agent listening on %s\n":                        "エージェントが %s で待ち受けています\n",
+	"[%s] stored %s (sha256 of encrypted file %s)\n": "[%s] %s に保存しました（暗号化ファイルの sha256 %s）\n",
+	"[%s] uploaded to s3://%s/%s\n":                  "[%s] s3://%s/%s にアップロードしました\n",
+	"[%s] collection failed: %v\n":                   "[%s] 収集に失敗しました: %v\n",
+	"[%s] notification failed: %v\n":                 "[%s] 通知に失敗しました: %v\n",
+
+	// API.
+	"[%s] restoring %s into %s (requested through API)\n": "[%s] %s を %s に復元しています（API からの要求）\n",
+	"[%s] cannot record verification: %v\n":               "[%s] 検証結果を記録できません: %v\n",
+	"API listening on %s\n":                               "API が %s で待ち受けています\n",
+
+	// Logs and records.
+	"audit log: %v\n":                                          "監査ログ: %v\n",
+	"%saudit log: %v\n":                                        "%s監査ログ: %v\n",
+	"[%s] audit log: %v\n":                                     "[%s] 監査ログ: %v\n",
+	"audit log OK: %d records\n":                               "監査ログは正常です: %d 件\n",
+	"history: %v\n":                                            "履歴: %v\n",
+	"warning: cannot open log file: %v\n":                      "警告: ログファイルを開けません: %v\n",
+	"warning: injecting failures: %s\n":                        "警告: 障害を注入しています: %s\n",
+	"removed stale catalog lock %s (%s)\n":                     "古いカタログのロック %s を削除しました（%s）\n",
+	"cannot send trace: %v\n":                                  "トレースを送信できません: %v\n",
+	"template %s: %v; the built-in text is used\n":             "テンプレート %s: %v。組み込みの文面を使います\n",
+	"template email_html: %v; the mail is sent as text only\n": "テンプレート email_html: %v。メールはテキストのみで送ります\n",
+
+	// Backup runs, continued.
+	"stored as: %s\n":                                               "保存先: %s\n",
+	"streaming backup to %s: %s/%s\n":                               "%s にバックアップを転送しています: %s/%s\n",
+	"%scannot remove expired plain dumps: %v\n":                     "%s期限切れの平文ダンプを削除できません: %v\n",
+	"%sno binlog coordinates in dump; is binary logging enabled?\n": "%sダンプにバイナリログの位置がありません。バイナリログは有効ですか？\n",
+	"%scannot remove work directory: %v\n":                          "%s作業ディレクトリを削除できません: %v\n",
+	"warning: cannot lower process priority: %v\n":                  "警告: プロセスの優先度を下げられません: %v\n",
+	"%scannot prune expired backups: %v\n":                          "%s期限切れのバックアップを削除できません: %v\n",
+	"skipping broken link %s\n":                                     "壊れたリンク %s を飛ばします\n",
+	"skipping %s of unsupported type\n":                             "対応していない種類の %s を飛ばします\n",
+	"dumped %s in %s\n":                                             "%s を %s でダンプしました\n",
+
+	// Binary logs.
+	"%swarning: the chain following the backup taken %s is not complete: %v\n": "%s警告: %s に作成したバックアップに続くチェーンが完全ではありません: %v\n",
+	"%sshipped binary log %s\n":                   "%sバイナリログ %s を転送しました\n",
+	"%sshipping binary logs: %v\n":                "%sバイナリログの転送: %v\n",
+	"%s%d binary log(s) shipped\n":                "%sバイナリログを %d 件転送しました\n",
+	"%sstarting a new chain of binary logs: %v\n": "%sバイナリログの新しいチェーンの開始: %v\n",
+
+	// Daemon.
+	"profile %s has no schedule; skipped\n":            "プロファイル %s にはスケジュールがないため省略します\n",
+	"monitoring endpoint stopped: %v\n":                "監視用エンドポイントが停止しました: %v\n",
+	"dashboard stopped: %v\n":                          "ダッシュボードが停止しました: %v\n",
+	"previous %s still in progress; skipped\n":         "前回の %s がまだ実行中のため省略します\n",
+	"dashboard: %v\n":                                  "ダッシュボード: %v\n",
+	"[%s] %s notification dropped by rate_limit: %s\n": "[%s] rate_limit により %s の通知を送りませんでした: %s\n",
+	"%s: notification failed: %v\n":                    "%s: 通知に失敗しました: %v\n",
+	"[%s] watchdog: %v\n":                              "[%s] 監視: %v\n",
+	"[%s] weekly summary: %v\n":                        "[%s] 週次まとめ: %v\n",
+
+	// Verification.
+	"%sverification: %v\n":                            "%s検証: %v\n",
+	"%sverification: no backup old enough\n":          "%s検証: 十分に古いバックアップがありません\n",
+	"%sverification of %s FAILED: %v\n":               "%s%s の検証に失敗しました: %v\n",
+	"%sverification of %s OK\n":                       "%s%s の検証は正常です\n",
+	"%scannot record verification: %v\n":              "%s検証結果を記録できません: %v\n",
+	"cannot record verification: %v\n":                "検証結果を記録できません: %v\n",
+	"cannot record drill: %v\n":                       "復元訓練の結果を記録できません: %v\n",
+	"cannot mail drill report: %v\n":                  "復元訓練の報告をメールで送れません: %v\n",
+	"%sspot check: %v\n":                              "%s抜き取り検査: %v\n",
+	"%sspot check of %s FAILED: %v\n":                 "%s%s の抜き取り検査に失敗しました: %v\n",
+	"%sspot check of %s OK\n":                         "%s%s の抜き取り検査は正常です\n",
+	"%scannot record spot check: %v\n":                "%s抜き取り検査の結果を記録できません: %v\n",
+	"inventory of %s (%s): %d objects, %d problems\n": "%s のインベントリ（%s）: オブジェクト %d 件、問題 %d 件\n",
+
+	// Schema check and restore preview.
+	"Database %s: does not exist\n":                           "データベース %s: 存在しません\n",
+	"Database %s: %d tables as in backup\n":                   "データベース %s: バックアップと同じテーブル %d 個\n",
+	"  only in backup: %s\n":                                  "  バックアップにのみあり: %s\n",
+	"  only in live database: %s\n":                           "  稼働中のデータベースにのみあり: %s\n",
+	"  differs: %s\n":                                         "  相違あり: %s\n",
+	"%sschema check: %v\n":                                    "%sスキーマの確認: %v\n",
+	"%sBackup: %s (taken %s)\n":                               "%sバックアップ: %s（%s 作成）\n",
+	"Backup: %s\n":                                            "バックアップ: %s\n",
+	"Taken: %s\n":                                             "作成日時: %s\n",
+	"Size: %s (encrypted %s)\n":                               "サイズ: %s（暗号化後 %s）\n",
+	"Target database: %s (does not exist; will be created)\n": "復元先データベース: %s（存在しないため作成します）\n",
+	"Target database: %s (exists, %d tables)\n":               "復元先データベース: %s（存在します。テーブル %d 個）\n",
+	"Tables to overwrite (same schema)":                       "上書きするテーブル（スキーマ同一）",
+	"Tables to overwrite (schema differs from live)":          "上書きするテーブル（稼働中とスキーマが異なる）",
+	"Live tables not in backup (left as is)":                  "バックアップにない稼働中のテーブル（そのまま残す）",
+
+	// Replicas and standbys.
+	"the backup sets gtid_purged; gtid_executed of the replica must be empty (RESET MASTER)\n": "バックアップは gtid_purged を設定します。レプリカの gtid_executed は空でなければなりません（RESET MASTER）\n",
+	"would restore %s (taken %s) into %s\n":                                                    "%s（%s 作成）を %s に復元します\n",
+	"run on the replica to start replication:\n":                                               "レプリケーションを開始するにはレプリカで次を実行してください:\n",
+	"%srestoring %s (taken %s) into standby\n":                                                 "%s%s（%s 作成）をスタンバイに復元しています\n",
+	"%scannot save standby state: %v\n":                                                        "%sスタンバイの状態を保存できません: %v\n",
+	"%snotification failed: %v\n":                                                              "%s通知に失敗しました: %v\n",
+	"%s: no standby configured\n":                                                              "%s: スタンバイが設定されていません\n",
+
+	// Put and plain dumps.
+	"would store %s as %s and upload it to %s\n": "%s を %s として保存し、%s にアップロードします\n",
+	"stored %s (%s) as %s\n":                     "%s（%s）を %s として保存しました\n",
+	"would compress %s\n":                        "%s を圧縮します\n",
+	"compressed %s (saved %d bytes)\n":           "%s を圧縮しました（%d バイト削減）\n",
+	"%d files compressed, %d bytes saved\n":      "%d 個のファイルを圧縮し、%d バイト削減しました\n",
+	"warning: cannot delete s3://%s/%s: %v\n":    "警告: s3://%s/%s を削除できません: %v\n",
+	"%s (version %s)\n":                          "%s（バージョン %s）\n",
+
+	// Configuration.
+	"warning: profile %s shares bucket %s but has no s3_role_arn; its credentials are not scoped to its prefix\n": "警告: プロファイル %s はバケット %s を共有していますが s3_role_arn がありません。認証情報がプレフィックスに限定されません\n",
+}
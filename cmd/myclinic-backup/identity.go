@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Two clinic machines configured alike, such as an old PC left running
+// next to its replacement, upload backups under the same keys and record
+// them alike, and which machine took which cannot be told afterwards.
+// Every upload therefore carries the host and the instance it came from
+// as S3 metadata, and every catalog entry the instance. With
+// s3_key_instance the instance is also part of the keys of the profile,
+// under its s3_prefix, so that the backups of the machines are kept apart
+// rather than overwriting each other. The instance is instance_id if set,
+// and the host name otherwise.
+
+// instanceID names this installation; see Config.instanceID.
+var instanceID string
+
+// S3 metadata recording the origin of every uploaded object.
+const (
+	hostMetadataKey     = "host"
+	instanceMetadataKey = "instance"
+)
+
+// instanceIDPattern is what instance IDs may consist of, being part of S3
+// keys.
+var instanceIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var unsafeKeyChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// instanceID returns instance_id, or the host name made fit for S3 keys.
+// A name with characters beyond ASCII, such as a Japanese one Windows
+// allows, loses them, so a hash of the name is appended to keep hosts named
+// 受付 and 診察室 apart.
+func (c *Config) instanceID() string {
+	if c.InstanceID != "" {
+		return c.InstanceID
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "unknown"
+	}
+	id := strings.Trim(unsafeKeyChars.ReplaceAllString(strings.ToLower(host), "-"), "-._")
+	if !isASCII(host) {
+		sum := sha256.Sum256([]byte(host))
+		id = strings.TrimPrefix(id+"-"+hex.EncodeToString(sum[:4]), "-")
+	}
+	if id == "" {
+		return "unknown"
+	}
+	return id
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func validateInstanceID(id string) error {
+	if id != "" && !instanceIDPattern.MatchString(id) {
+		return fmt.Errorf("instance_id may contain only letters, digits, '.', '_' and '-': %s", id)
+	}
+	return nil
+}
+
+// s3KeyPrefix returns the prefix of the keys of the backups of the
+// profile, which includes the instance with s3_key_instance.
+func (p *Profile) s3KeyPrefix() string {
+	if !p.S3KeyInstance {
+		return p.S3Prefix
+	}
+	return normalizePrefix(p.S3Prefix) + instanceID
+}
+
+// hostMetadata returns the host name for S3 metadata, which is sent as
+// HTTP headers: a name in Japanese, as Windows allows, is MIME encoded.
+func hostMetadata() string {
+	host, _ := os.Hostname()
+	return mime.QEncoding.Encode("utf-8", host)
+}
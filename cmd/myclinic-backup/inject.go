@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Failures -inject-failure can force. The first three fail the backup
+// stage of the same name; network fails every request to AWS as if the
+// connection could not be made, while notifications still go out.
+const (
+	failureDump    = stageDump
+	failureEncrypt = stageEncrypt
+	failureUpload  = stageUpload
+	failureNetwork = "network"
+)
+
+var knownFailures = []string{failureDump, failureEncrypt, failureUpload, failureNetwork}
+
+// hiddenFlags are left out of the usage. They are for rehearsing recovery,
+// not for everyday use.
+var hiddenFlags = map[string]bool{
+	"inject-failure": true,
+}
+
+// printFlags prints the defaults of the flags which are not hidden, as
+// flag.PrintDefaults does.
+func printFlags(out io.Writer) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		fs.Var(f.Value, f.Name, f.Usage)
+		fs.Lookup(f.Name).DefValue = f.DefValue
+	})
+	fs.PrintDefaults()
+}
+
+// injectedFailures holds the failures given by -inject-failure.
+var injectedFailures = map[string]bool{}
+
+// parseInjectedFailures sets injectedFailures from a comma separated list.
+func parseInjectedFailures(s string) error {
+	for _, f := range splitList(s) {
+		known := false
+		for _, k := range knownFailures {
+			if f == k {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("-inject-failure: unknown failure %s (one of %s)",
+				f, strings.Join(knownFailures, ", "))
+		}
+		injectedFailures[f] = true
+	}
+	return nil
+}
+
+func injectedFailureList() string {
+	var list []string
+	for f := range injectedFailures {
+		list = append(list, f)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// injectedStageFailure returns the error forced on stage, or nil.
+func injectedStageFailure(stage string) error {
+	if !injectedFailures[stage] {
+		return nil
+	}
+	return fmt.Errorf("%s failed: injected failure (-inject-failure)", stage)
+}
+
+// failingDial fails every connection as an unreachable network does.
+func failingDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: network,
+		Err: errors.New("injected network failure (-inject-failure)")}
+}
+
+// awsHTTPClient returns the HTTP client for AWS sessions: nil for the
+// default one, one which cannot connect if network failures are
+// injected, or one restricted to the TLS settings of FIPS mode.
+func awsHTTPClient() *http.Client {
+	if !injectedFailures[failureNetwork] && !fipsMode {
+		return nil
+	}
+	// The SDK requires an *http.Transport, to which it may add a CA
+	// bundle.
+	t := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if injectedFailures[failureNetwork] {
+		t.DialContext = failingDial
+	}
+	if fipsMode {
+		t.TLSClientConfig = fipsTLSConfig()
+	}
+	return &http.Client{Transport: t}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// When the process is interrupted or terminated, runCommand stops waiting
+// for the command and returns, after running the cleanups registered with
+// onInterrupt, which release the catalog lock and close the listeners, and
+// removing the work directories of the runs going on. Its deferred
+// flushes of the output then run before main exits with 1. A second
+// signal kills the process outright.
+
+// interrupted is closed once the process is interrupted, after
+// interruptSignal is set.
+var interrupted = make(chan struct{})
+
+var interruptSignal os.Signal
+
+// errInterrupted is returned by runUntilInterrupted when the process is
+// interrupted before the command ends.
+var errInterrupted = errors.New("interrupted")
+
+// interruptCleanups are the functions run when the process is
+// interrupted, by the key onInterrupt returned them for.
+var interruptCleanups = struct {
+	sync.Mutex
+	next  int
+	funcs map[int]func()
+}{funcs: make(map[int]func())}
+
+// notifyInterrupt closes interrupted on the first SIGINT or SIGTERM.
+func notifyInterrupt() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	done := interrupted
+	go func() {
+		interruptSignal = <-c
+		signal.Stop(c)
+		close(done)
+	}()
+}
+
+// onInterrupt registers f to run if the process is interrupted, until the
+// returned function is called.
+func onInterrupt(f func()) (remove func()) {
+	interruptCleanups.Lock()
+	defer interruptCleanups.Unlock()
+	key := interruptCleanups.next
+	interruptCleanups.next++
+	interruptCleanups.funcs[key] = f
+	return func() {
+		interruptCleanups.Lock()
+		delete(interruptCleanups.funcs, key)
+		interruptCleanups.Unlock()
+	}
+}
+
+// runUntilInterrupted returns what run returns or, if the process is
+// interrupted first, cleans up and returns errInterrupted. run is left
+// running then, to end with the process.
+func runUntilInterrupted(run func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- run()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-interrupted:
+	}
+	interruptCleanups.Lock()
+	funcs := interruptCleanups.funcs
+	interruptCleanups.funcs = make(map[int]func())
+	interruptCleanups.Unlock()
+	for _, f := range funcs {
+		f()
+	}
+	removeWorkDirs()
+	fmt.Fprintf(stderr, tr("%v: work directories removed; exiting\n"), interruptSignal)
+	return errInterrupted
+}
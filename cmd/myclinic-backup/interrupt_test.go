@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// An interrupted command is left running while the catalog lock it holds
+// is released, its listener closed and its work directory removed.
+func TestRunUntilInterrupted(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	savedInterrupted, savedErr := interrupted, stderr
+	defer func() { interrupted, interruptSignal, stderr = savedInterrupted, nil, savedErr }()
+	interrupted = make(chan struct{})
+	var errOut bytes.Buffer
+	stderr = &errOut
+
+	c := newCatalog(filepath.Join(dir, "catalog.json"))
+	lock := c.path + ".lock"
+	server := &ServerConfig{Listen: "127.0.0.1:0"}
+	served := make(chan error, 1)
+	var work string
+	started, finish := make(chan struct{}), make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- runUntilInterrupted(func() error {
+			unlock, err := c.lockFile()
+			if err != nil {
+				t.Error(err)
+			}
+			defer unlock()
+			work, err = createWorkDir(filepath.Join(dir, "work"), newRunID())
+			if err != nil {
+				t.Error(err)
+			}
+			go func() {
+				served <- server.listen(http.NotFoundHandler())
+			}()
+			close(started)
+			<-finish
+			return nil
+		})
+	}()
+	<-started
+	if _, err := os.Stat(lock); err != nil {
+		t.Fatal(err)
+	}
+	// The listener registers its cleanup as it starts, after the lock.
+	for n := 0; n < 2; {
+		time.Sleep(10 * time.Millisecond)
+		interruptCleanups.Lock()
+		n = len(interruptCleanups.funcs)
+		interruptCleanups.Unlock()
+	}
+	interruptSignal = syscall.SIGTERM
+	close(interrupted)
+	if err := <-result; err != errInterrupted {
+		t.Fatalf("got %v, want errInterrupted", err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("catalog lock left: %v", err)
+	}
+	if _, err := os.Stat(work); !os.IsNotExist(err) {
+		t.Errorf("work directory left: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("listener ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("listener not closed")
+	}
+	if !strings.Contains(errOut.String(), "terminated") {
+		t.Errorf("output %q does not name the signal", errOut.String())
+	}
+	// The command releasing the lock itself afterwards is harmless.
+	close(finish)
+}
+
+func TestRunUntilInterruptedReturns(t *testing.T) {
+	savedInterrupted := interrupted
+	defer func() { interrupted = savedInterrupted }()
+	interrupted = make(chan struct{})
+	if err := runUntilInterrupted(func() error { return os.ErrNotExist }); err != os.ErrNotExist {
+		t.Errorf("got %v, want the error of the command", err)
+	}
+}
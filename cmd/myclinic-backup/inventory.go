@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// inventoryManifest is the manifest.json written by S3 Inventory.
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	CreationTimestamp string `json:"creationTimestamp"`
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+func (m *inventoryManifest) created() time.Time {
+	ms, err := strconv.ParseInt(m.CreationTimestamp, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// parseS3URL splits s3://bucket/key into bucket and key.
+func parseS3URL(s string) (string, string, error) {
+	if !strings.HasPrefix(s, "s3://") {
+		return "", "", fmt.Errorf("not an s3:// URL: %s", s)
+	}
+	rest := strings.TrimPrefix(s, "s3://")
+	i := strings.Index(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", fmt.Errorf("invalid S3 URL: %s", s)
+	}
+	return rest[:i], rest[i+1:], nil
+}
+
+func readLocation(sess *session.Session, location string) ([]byte, error) {
+	if strings.HasPrefix(location, "s3://") {
+		bucket, key, err := parseS3URL(location)
+		if err != nil {
+			return nil, err
+		}
+		return downloadFromS3(sess, bucket, key)
+	}
+	return ioutil.ReadFile(location)
+}
+
+// readInventory returns the sizes of the objects listed in the inventory,
+// keyed by object key.
+func readInventory(sess *session.Session, manifestLocation string) (*inventoryManifest, map[string]int64, error) {
+	src, err := readLocation(sess, manifestLocation)
+	if err != nil {
+		return nil, nil, err
+	}
+	var m inventoryManifest
+	err = json.Unmarshal(src, &m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid inventory manifest: %v", err)
+	}
+	if m.FileFormat != "CSV" {
+		return nil, nil, fmt.Errorf("unsupported inventory format: %s (only CSV is supported)", m.FileFormat)
+	}
+	columns := make(map[string]int)
+	for i, c := range strings.Split(m.FileSchema, ",") {
+		columns[strings.TrimSpace(c)] = i
+	}
+	keyCol, ok1 := columns["Key"]
+	sizeCol, ok2 := columns["Size"]
+	if !ok1 || !ok2 {
+		return nil, nil, fmt.Errorf("inventory schema lacks Key or Size: %s", m.FileSchema)
+	}
+	dest := strings.TrimPrefix(m.DestinationBucket, "arn:aws:s3:::")
+	objects := make(map[string]int64)
+	for _, f := range m.Files {
+		data, err := readLocation(sess, "s3://"+dest+"/"+f.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", f.Key, err)
+		}
+		err = readInventoryCSV(data, keyCol, sizeCol, objects)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", f.Key, err)
+		}
+	}
+	return &m, objects, nil
+}
+
+func readInventoryCSV(data []byte, keyCol, sizeCol int, objects map[string]int64) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	r := csv.NewReader(gz)
+	r.FieldsPerRecord = -1
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if keyCol >= len(rec) || sizeCol >= len(rec) {
+			continue
+		}
+		// Keys in inventory reports are URL encoded.
+		key, err := url.QueryUnescape(rec[keyCol])
+		if err != nil {
+			key = rec[keyCol]
+		}
+		size, _ := strconv.ParseInt(rec[sizeCol], 10, 64)
+		objects[key] = size
+	}
+}
+
+// reconcileInventoryCommand compares an S3 Inventory report with the
+// catalog, which is much cheaper than listing a large bucket.
+func reconcileInventoryCommand(config *Config, profiles []*Profile, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: reconcile-inventory MANIFEST (s3://bucket/.../manifest.json or local path)")
+	}
+	sess, err := newS3Session(profiles[0])
+	if err != nil {
+		return err
+	}
+	m, objects, err := readInventory(sess, args[0])
+	if err != nil {
+		return err
+	}
+	created := m.created()
+	entries, err := catalog.Entries()
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, p := range profiles {
+		if p.S3Bucket != m.SourceBucket {
+			continue
+		}
+		prefix := normalizePrefix(p.S3Prefix)
+		known := make(map[string]bool)
+		for _, e := range entries {
+			if e.Profile != p.Name || e.S3Key == "" {
+				continue
+			}
+			known[e.S3Key] = true
+			if !created.IsZero() && e.Time.After(created) {
+				continue
+			}
+			size, ok := objects[e.S3Key]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing from bucket: %s", p.Name, e.S3Key))
+			} else if e.EncryptedSize != 0 && size != e.EncryptedSize {
+				problems = append(problems, fmt.Sprintf("%s: size mismatch: %s (catalog %d, bucket %d)",
+					p.Name, e.S3Key, e.EncryptedSize, size))
+			}
+		}
+		for key := range objects {
+			_, isBackup := p.encryptedBackupTime(path.Base(key))
+			if strings.HasPrefix(key, prefix) && isBackup && !known[key] {
+				problems = append(problems, fmt.Sprintf("%s: not in catalog: %s", p.Name, key))
+			}
+		}
+	}
+	sort.Strings(problems)
+	for _, line := range problems {
+		fmt.Fprintln(stdout, line)
+	}
+	fmt.Fprintf(stdout, tr("inventory of %s (%s): %d objects, %d problems\n"),
+		m.SourceBucket, created.Format("2006-01-02 15:04"), len(objects), len(problems))
+	if len(problems) > 0 {
+		return fmt.Errorf("inventory does not match catalog")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// A key file mixed up with that of another profile or clinic, or replaced
+// when a machine was set up again, goes unnoticed: backups go on being
+// taken, encrypted with a key that is not the one kept safe for restores.
+// Every backup therefore records the fingerprint of its key in the
+// catalog, and before a run the fingerprint of the key file is compared
+// with key_fingerprint if set, or else with that of the newest backup of
+// the profile. A key that changed fails the run. A key rotated on purpose
+// is acknowledged by setting key_fingerprint to the fingerprint of the new
+// key, which the error tells.
+
+// keyFingerprintPattern is what key_fingerprint looks like.
+var keyFingerprintPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// keyFingerprint identifies the key without revealing it.
+func keyFingerprint(key []byte) string {
+	h := sha256.New()
+	h.Write([]byte("myclinic-backup key fingerprint\x00"))
+	h.Write(key)
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func validateKeyFingerprint(fp string) error {
+	if fp != "" && !keyFingerprintPattern.MatchString(fp) {
+		return fmt.Errorf("key_fingerprint must be 16 lowercase hex digits: %s", fp)
+	}
+	return nil
+}
+
+// recordedKeyFingerprint returns the key fingerprint of the newest
+// uploaded backup of the profile which has one, and when it was taken.
+func recordedKeyFingerprint(p *Profile) (string, time.Time, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var latest *CatalogEntry
+	for _, e := range entries {
+		if e.Profile == p.Name && e.S3Key != "" && e.KeyFingerprint != "" && (latest == nil || e.Time.After(latest.Time)) {
+			latest = e
+		}
+	}
+	if latest == nil {
+		return "", time.Time{}, nil
+	}
+	return latest.KeyFingerprint, latest.Time, nil
+}
+
+// checkKeyFingerprint checks the key read from the key file of the profile
+// against key_fingerprint or the newest backup, and returns its
+// fingerprint.
+func (p *Profile) checkKeyFingerprint(key []byte) (string, error) {
+	fp := keyFingerprint(key)
+	if p.KeyFingerprint != "" {
+		if fp != p.KeyFingerprint {
+			return fp, fmt.Errorf("the key in %s has fingerprint %s, not %s as key_fingerprint says; check that it is the right key file",
+				p.KeyFile, fp, p.KeyFingerprint)
+		}
+		return fp, nil
+	}
+	recorded, t, err := recordedKeyFingerprint(p)
+	if err != nil {
+		return fp, err
+	}
+	if recorded != "" && recorded != fp {
+		return fp, fmt.Errorf("the key in %s has fingerprint %s, but the backup taken %s was encrypted with key %s; "+
+			"if the key was changed on purpose, set key_fingerprint: %s", p.KeyFile, fp, t.Format("2006-01-02 15:04"), recorded, fp)
+	}
+	return fp, nil
+}
+
+// checkKey reads the key of the profile before a run and checks that it
+// has not changed.
+func (r *backupRun) checkKey() error {
+	key, err := readEncryptionKey(r.profile.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	r.keyFingerprint, err = r.profile.checkKeyFingerprint(key)
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fingerprint a run records is checked by the next: the same key file
+// is accepted and another rejected, unless key_fingerprint names it.
+func TestCheckKeyRoundTrip(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer withCatalog(dir)()
+	right, wrong := testKeyFile(t, dir, 1), testKeyFile(t, dir, 2)
+	check := func(keyFile string, pin string) (string, error) {
+		r := &backupRun{profile: &Profile{Name: "myclinic", KeyFile: keyFile, KeyFingerprint: pin}}
+		err := r.checkKey()
+		return r.keyFingerprint, err
+	}
+
+	// The first backup has nothing to be checked against.
+	fp, err := check(right, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validateKeyFingerprint(fp) != nil {
+		t.Errorf("fingerprint %q does not look like key_fingerprint", fp)
+	}
+	taken := time.Date(2020, 1, 10, 3, 0, 0, 0, time.Local)
+	add := func(profile string, s3Key string, fp string, at time.Time) {
+		t.Helper()
+		err := catalog.Add(&CatalogEntry{RunID: newRunID(), Profile: profile, Time: at, S3Key: s3Key, KeyFingerprint: fp})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("myclinic", "backup.cf", fp, taken)
+	wrongFP, err := check(wrong, "")
+	if err == nil {
+		t.Fatal("a changed key was accepted")
+	}
+	// Neither backups not uploaded nor those of other profiles count.
+	add("myclinic", "", wrongFP, taken.Add(time.Hour))
+	add("other", "other.cf", wrongFP, taken.Add(time.Hour))
+
+	if got, err := check(right, ""); err != nil || got != fp {
+		t.Errorf("right key: %s, %v", got, err)
+	}
+	_, err = check(wrong, "")
+	if err == nil || !strings.Contains(err.Error(), "key_fingerprint: "+wrongFP) {
+		t.Errorf("wrong key: got %v, want an error telling how to acknowledge it", err)
+	}
+
+	// A rotated key is acknowledged with key_fingerprint, which then
+	// rejects the old key.
+	if _, err := check(wrong, wrongFP); err != nil {
+		t.Errorf("pinned key: %v", err)
+	}
+	if _, err := check(right, wrongFP); err == nil {
+		t.Error("key not pinned was accepted")
+	}
+	// Once a backup is taken with the new key, it is the one checked.
+	add("myclinic", "rotated.cf", wrongFP, taken.Add(2*time.Hour))
+	if _, err := check(wrong, ""); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+	if _, err := check(right, ""); err == nil {
+		t.Error("old key accepted after the rotation")
+	}
+}
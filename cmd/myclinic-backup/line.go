@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// LineConfig sends the summaries of events to LINE, which clinic staff
+// read far more readily than mail. Messages are pushed by the clinic's
+// LINE Official Account through the Messaging API to a user or a group;
+// LINE Notify, which needed no account, was discontinued in March 2025.
+type LineConfig struct {
+	// ChannelTokenFile holds the channel access token of the account.
+	ChannelTokenFile string `yaml:"channel_token_file"`
+	// To is the ID of the user or group the messages go to.
+	To string `yaml:"to"`
+	// FailuresOnly leaves out the events of things that went well, except
+	// the weekly summary, which is sent only if configured.
+	FailuresOnly bool `yaml:"failures_only"`
+}
+
+func (l *LineConfig) validate() error {
+	if l.ChannelTokenFile == "" || l.To == "" {
+		return fmt.Errorf("line: channel_token_file and to are required")
+	}
+	return nil
+}
+
+var lineEndpoint = "https://api.line.me/v2/bot/message/push"
+
+// lineMaxText is the longest text a LINE message may have.
+const lineMaxText = 5000
+
+// lineMessage is the text of the message for the event.
+func lineMessage(event *Event) string {
+	mark := "✅"
+	if !event.Success {
+		mark = "⚠️"
+	}
+	text := renderText(templateLine, event,
+		fmt.Sprintf("%s %s\n%s", mark, event.Summary, event.Time.Local().Format("2006-01-02 15:04")))
+	if r := []rune(text); len(r) > lineMaxText {
+		text = string(r[:lineMaxText-1]) + "…"
+	}
+	return text
+}
+
+// send pushes the summary of the event.
+func (l *LineConfig) send(event *Event) error {
+	if l.FailuresOnly && event.Success && event.Kind != eventSummary && event.Recovered == 0 {
+		return nil
+	}
+	token, err := readSecretFile(l.ChannelTokenFile)
+	if err != nil {
+		return fmt.Errorf("line: %v", err)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"to": l.To,
+		"messages": []map[string]string{
+			{"type": "text", "text": lineMessage(event)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, lineEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("line: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("line responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
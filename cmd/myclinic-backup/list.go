@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dateRange selects backups by the time they were taken. A zero bound is
+// open; until is exclusive.
+type dateRange struct {
+	since time.Time
+	until time.Time
+}
+
+func (r dateRange) contains(t time.Time) bool {
+	return (r.since.IsZero() || !t.Before(r.since)) && (r.until.IsZero() || t.Before(r.until))
+}
+
+// parseDateRange parses dates such as 2020-06-01, or months such as
+// 2020-06, in local time. Both bounds are inclusive: an until of 2020-06
+// takes in the whole of June.
+func parseDateRange(since string, until string) (dateRange, error) {
+	var r dateRange
+	var err error
+	if since != "" {
+		r.since, _, err = parseDateOrMonth(since)
+		if err != nil {
+			return r, fmt.Errorf("-since: %v", err)
+		}
+	}
+	if until != "" {
+		t, month, err := parseDateOrMonth(until)
+		if err != nil {
+			return r, fmt.Errorf("-until: %v", err)
+		}
+		if month {
+			r.until = t.AddDate(0, 1, 0)
+		} else {
+			r.until = t.AddDate(0, 0, 1)
+		}
+	}
+	if !r.since.IsZero() && !r.until.IsZero() && !r.since.Before(r.until) {
+		return r, fmt.Errorf("-since must not be after -until")
+	}
+	return r, nil
+}
+
+// parseDateOrMonth returns the start of the date or month s, and whether
+// it is a month.
+func parseDateOrMonth(s string) (time.Time, bool, error) {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err == nil {
+		return t, false, nil
+	}
+	t, err = time.ParseInLocation("2006-01", s, time.Local)
+	if err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid date %s (2020-06-01 or 2020-06)", s)
+}
+
+// remoteListing is what a profile has under its prefix in the bucket.
+type remoteListing struct {
+	// backups are the encrypted dumps, recognized by their names, in the
+	// order taken.
+	backups []*CatalogEntry
+	// otherCount and otherSize are of the remaining objects, such as
+	// grants and put artifacts.
+	otherCount int
+	otherSize  int64
+}
+
+// listRemote lists the prefix of the profile in its bucket, or other
+// target, keeping the backups taken within r. The bucket itself is read
+// rather than the catalog, so that backups made on other machines are
+// included. Listing of S3 goes page by page, 1000 objects at a time,
+// through the whole prefix.
+func listRemote(p *Profile, r dateRange) (*remoteListing, error) {
+	storage, err := p.storage()
+	if err != nil {
+		return nil, err
+	}
+	backupTime := func(key string) (time.Time, bool) {
+		return p.encryptedBackupTime(path.Base(key))
+	}
+	if p.OpaqueNames {
+		// Backups are known by the manifest rather than their names.
+		entries, err := p.readManifest(storage.(*s3Storage).sess)
+		if err != nil {
+			return nil, err
+		}
+		dumps := make(map[string]time.Time)
+		for _, e := range entries {
+			if e.isDump() {
+				dumps[e.S3Key] = e.Time
+			}
+		}
+		backupTime = func(key string) (time.Time, bool) {
+			t, ok := dumps[key]
+			return t, ok
+		}
+	}
+	prefix := normalizePrefix(p.S3Prefix)
+	objects, err := storage.List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list %s: %v", p.storedLocation(prefix), err)
+	}
+	l := &remoteListing{}
+	for _, obj := range objects {
+		t, ok := backupTime(obj.Key)
+		if !ok {
+			l.otherCount++
+			l.otherSize += obj.Size
+			continue
+		}
+		if !r.contains(t) {
+			continue
+		}
+		l.backups = append(l.backups, &CatalogEntry{
+			Profile:       p.Name,
+			Time:          t,
+			S3Bucket:      p.storageBucket(),
+			S3Key:         obj.Key,
+			Target:        p.targetURL(),
+			EncryptedSize: obj.Size,
+		})
+	}
+	sort.SliceStable(l.backups, func(i, j int) bool {
+		return l.backups[i].Time.Before(l.backups[j].Time)
+	})
+	return l, nil
+}
+
+// backupCopy is a copy of a backup as list finds it: recorded in the
+// catalog, on the local disk or in the storage of the profile.
+type backupCopy struct {
+	*CatalogEntry
+	// encrypted is unset for plain dumps and file archives.
+	encrypted bool
+	location  string
+}
+
+func (c *backupCopy) size() int64 {
+	if c.encrypted {
+		return c.EncryptedSize
+	}
+	return c.Size
+}
+
+func (c *backupCopy) status() string {
+	if c.encrypted {
+		return tr("encrypted")
+	}
+	return tr("plain")
+}
+
+// catalogBackups returns the dumps of the profile in the catalog taken
+// within r, oldest first. It is the inventory list, restore and prune
+// take the recorded backups from.
+func catalogBackups(entries []*CatalogEntry, p *Profile, r dateRange) []*CatalogEntry {
+	var dumps []*CatalogEntry
+	for _, e := range entries {
+		if e.Profile == p.Name && e.isDump() && r.contains(e.Time) {
+			dumps = append(dumps, e)
+		}
+	}
+	sort.SliceStable(dumps, func(i, j int) bool { return dumps[i].Time.Before(dumps[j].Time) })
+	return dumps
+}
+
+// localBackups returns the plain dumps in backup_dir and the encrypted
+// backups in encrypted_dir of the profile taken within r, as found on disk
+// whether or not the catalog records them.
+func localBackups(p *Profile, r dateRange) ([]*backupCopy, error) {
+	var copies []*backupCopy
+	dumps, err := listPlainDumps(p.BackupDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dumps {
+		if !r.contains(d.time) {
+			continue
+		}
+		size, err := fileSize(d.path)
+		if err != nil {
+			return nil, err
+		}
+		e := &CatalogEntry{Profile: p.Name, Time: d.time, BackupFile: d.path, Size: size}
+		copies = append(copies, &backupCopy{CatalogEntry: e, location: d.path})
+	}
+	err = walkIfExists(p.EncryptedDir, func(path string, info os.FileInfo) error {
+		if info.IsDir() {
+			if path != p.EncryptedDir && (info.Name() == workDirName || info.Name() == kindPut) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		t, ok := p.encryptedBackupTime(info.Name())
+		if !ok || !r.contains(t) {
+			return nil
+		}
+		e := &CatalogEntry{Profile: p.Name, Time: t, EncryptedFile: path, EncryptedSize: info.Size()}
+		copies = append(copies, &backupCopy{CatalogEntry: e, encrypted: true, location: path})
+		return nil
+	})
+	return copies, err
+}
+
+// monthTotal is the number and stored size of the backups of a month.
+type monthTotal struct {
+	month string
+	count int
+	size  int64
+}
+
+// monthlyTotals sums the sizes of the copies by the local month they were
+// taken in, oldest month first.
+func monthlyTotals(copies []*backupCopy) []*monthTotal {
+	var totals []*monthTotal
+	byMonth := make(map[string]*monthTotal)
+	for _, c := range copies {
+		month := c.Time.Local().Format("2006-01")
+		t := byMonth[month]
+		if t == nil {
+			t = &monthTotal{month: month}
+			byMonth[month] = t
+			totals = append(totals, t)
+		}
+		t.count++
+		t.size += c.size()
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].month < totals[j].month })
+	return totals
+}
+
+func printMonthlyTotals(copies []*backupCopy) {
+	var count int
+	var size int64
+	for _, t := range monthlyTotals(copies) {
+		fmt.Fprintf(stdout, tr("%s  %5d backups  %10s\n"), t.month, t.count, formatBytes(t.size))
+		count += t.count
+		size += t.size
+	}
+	fmt.Fprintf(stdout, tr("total    %5d backups  %10s\n"), count, formatBytes(size))
+}
+
+// labelSummary returns the label, hold and note of a backup to append to a
+// line describing it, or "".
+func labelSummary(e *CatalogEntry) string {
+	s := ""
+	if e.Label != "" {
+		s += "  [" + e.Label + "]"
+	}
+	if e.Hold != nil {
+		s += "  " + tr("[held]")
+	}
+	if e.Note != "" {
+		s += "  " + e.Note
+	}
+	return s
+}
+
+// listedBackup is a copy of a backup as list -json prints it.
+type listedBackup struct {
+	Profile   string    `json:"profile"`
+	Time      time.Time `json:"time"`
+	Size      int64     `json:"size"`
+	Encrypted bool      `json:"encrypted"`
+	Location  string    `json:"location"`
+	Trigger   string    `json:"trigger,omitempty"`
+	Label     string    `json:"label,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	Held      bool      `json:"held,omitempty"`
+}
+
+func printListJSON(copies []*backupCopy) error {
+	list := []*listedBackup{}
+	for _, c := range copies {
+		list = append(list, &listedBackup{
+			Profile:   c.Profile,
+			Time:      c.Time,
+			Size:      c.size(),
+			Encrypted: c.encrypted,
+			Location:  c.location,
+			Trigger:   c.Trigger,
+			Label:     c.Label,
+			Note:      c.Note,
+			Held:      c.Hold != nil,
+		})
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(list)
+}
+
+// listCommand lists the backups of the selected profiles from the catalog,
+// or with -local and -remote as found on the local disk and in the
+// buckets.
+func listCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	local := flags.Bool("local", false, "lists the plain and encrypted backups on the local disk instead of the catalog")
+	remote := flags.Bool("remote", false, "lists the backups in the S3 buckets instead of the catalog")
+	since := flags.String("since", "", "lists backups taken on or after a date, e.g. 2020-06-01 or 2020-06")
+	until := flags.String("until", "", "lists backups taken on or before a date, e.g. 2020-06-30 or 2020-06")
+	month := flags.String("month", "", "lists backups taken in a month, e.g. 2020-06")
+	totals := flags.Bool("totals", false, "prints the number and stored size of the backups of each month instead of each backup")
+	trigger := flags.String("trigger", "", "lists only backups started this way, e.g. pre-upgrade or schedule")
+	asJSON := flags.Bool("json", false, "prints the backups as JSON")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: list [-local] [-remote] [-since DATE] [-until DATE] [-month MONTH] [-trigger TRIGGER] [-totals] [-json]")
+	}
+	if *month != "" {
+		if *since != "" || *until != "" {
+			return fmt.Errorf("-month cannot be given with -since or -until")
+		}
+		if _, isMonth, err := parseDateOrMonth(*month); err != nil || !isMonth {
+			return fmt.Errorf("-month must be a month such as 2020-06: %s", *month)
+		}
+		*since, *until = *month, *month
+	}
+	if *totals && *asJSON {
+		return fmt.Errorf("-totals cannot be given with -json")
+	}
+	r, err := parseDateRange(*since, *until)
+	if err != nil {
+		return err
+	}
+	all, err := catalog.Entries()
+	if err != nil {
+		return err
+	}
+	// Copies known to the catalog get what it records about them.
+	known := make(map[string]*CatalogEntry)
+	for _, e := range all {
+		if !e.isDump() {
+			continue
+		}
+		for _, location := range []string{e.BackupFile, e.EncryptedFile} {
+			if location != "" {
+				known[filepath.Clean(location)] = e
+			}
+		}
+		if e.S3Key != "" {
+			known[entryLocation(e)] = e
+		}
+	}
+	annotate := func(c *backupCopy) {
+		// A compressed plain dump is recorded under its name before.
+		if k := known[strings.TrimSuffix(c.location, ".gz")]; k != nil {
+			c.RunID, c.Label, c.Note, c.Trigger, c.Hold = k.RunID, k.Label, k.Note, k.Trigger, k.Hold
+		}
+	}
+	var copies []*backupCopy
+	var otherCount int
+	var otherSize int64
+	if *local {
+		for _, p := range profiles {
+			found, err := localBackups(p, r)
+			if err != nil {
+				return err
+			}
+			for _, c := range found {
+				annotate(c)
+				copies = append(copies, c)
+			}
+		}
+	}
+	if *remote {
+		err = useReaderCredentials(profiles)
+		if err != nil {
+			return err
+		}
+		for _, p := range profiles {
+			if !p.hasStorage() {
+				continue
+			}
+			l, err := listRemote(p, r)
+			if err != nil {
+				return err
+			}
+			for _, e := range l.backups {
+				c := &backupCopy{CatalogEntry: e, encrypted: true, location: entryLocation(e)}
+				annotate(c)
+				copies = append(copies, c)
+			}
+			otherCount += l.otherCount
+			otherSize += l.otherSize
+		}
+	}
+	if !*local && !*remote {
+		for _, p := range profiles {
+			for _, e := range catalogBackups(all, p, r) {
+				location := tr("(not uploaded)")
+				if e.S3Key != "" {
+					location = entryLocation(e)
+				}
+				copies = append(copies, &backupCopy{CatalogEntry: e, encrypted: true, location: location})
+			}
+		}
+	}
+	if *trigger != "" {
+		var matched []*backupCopy
+		for _, c := range copies {
+			if c.Trigger == *trigger {
+				matched = append(matched, c)
+			}
+		}
+		copies = matched
+	}
+	sort.SliceStable(copies, func(i, j int) bool {
+		return copies[i].Time.Before(copies[j].Time)
+	})
+	if *asJSON {
+		return printListJSON(copies)
+	}
+	if *totals {
+		printMonthlyTotals(copies)
+	} else {
+		if len(copies) == 0 {
+			fmt.Fprintf(stdout, tr("no backups\n"))
+		}
+		for _, c := range copies {
+			trigger := c.Trigger
+			if trigger == "" {
+				trigger = "-"
+			}
+			fmt.Fprintf(stdout, "%-12s %s  %-11s %10s  %-9s  %s%s\n", c.Profile, c.Time.Local().Format("2006-01-02 15:04"),
+				trigger, formatBytes(c.size()), c.status(), c.location, labelSummary(c.CatalogEntry))
+		}
+	}
+	if otherCount > 0 {
+		fmt.Fprintf(stdout, tr("other objects under the prefixes: %d, %s\n"), otherCount, formatBytes(otherSize))
+	}
+	return nil
+}
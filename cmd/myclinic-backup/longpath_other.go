@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// localPath returns path unchanged; see longpath_windows.go.
+func localPath(path string) string {
+	return path
+}
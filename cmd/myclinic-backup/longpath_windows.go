@@ -0,0 +1,18 @@
+package main
+
+import "path/filepath"
+
+// localPath returns path made absolute. The os package lifts the limit of
+// 260 characters of Windows paths, by prefixing them with \\?\, only for
+// absolute paths, which backups deep in a folder with a long Japanese
+// name easily exceed.
+func localPath(path string) string {
+	if path == "" {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
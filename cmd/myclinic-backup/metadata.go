@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// With metadata_key_file set, the metadata the tool keeps about backups,
+// which tells table names, sizes and the times of runs, is encrypted like
+// the backups themselves: the catalog and the run and standby states as
+// whole files, the history and the audit log line by line, since they are
+// appended to, and the audit records mirrored to S3. Files written before
+// are still read, and encrypt-metadata rewrites them encrypted, or with
+// -decrypt plain again.
+
+// metadataKey is the key of metadata_key_file, or nil if metadata is
+// stored plain.
+var metadataKey []byte
+
+// loadMetadataKey reads the key of metadata_key_file, which is in the
+// format of the key_file of profiles.
+func (c *Config) loadMetadataKey() error {
+	if c.MetadataKeyFile == "" {
+		return nil
+	}
+	key, err := readEncryptionKey(c.MetadataKeyFile)
+	if err != nil {
+		return fmt.Errorf("metadata_key_file: %v", err)
+	}
+	metadataKey = key
+	return nil
+}
+
+// sealMetadata returns the JSON src encrypted, if metadata is.
+func sealMetadata(src []byte) ([]byte, error) {
+	if metadataKey == nil {
+		return src, nil
+	}
+	return compressAndEncrypt(metadataKey, src)
+}
+
+// openMetadata returns the JSON of src as written by sealMetadata, with or
+// without encryption.
+func openMetadata(src []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(src)
+	if len(trimmed) == 0 || trimmed[0] == '{' || trimmed[0] == '[' || string(trimmed) == "null" {
+		return src, nil
+	}
+	if metadataKey == nil {
+		return nil, fmt.Errorf("metadata is encrypted; metadata_key_file is needed to read it")
+	}
+	return decryptBackup(metadataKey, src)
+}
+
+// sealLine returns a JSON line encrypted and base64 encoded, so that it
+// stays one line, if metadata is encrypted.
+func sealLine(line []byte) ([]byte, error) {
+	sealed, err := sealMetadata(line)
+	if err != nil || metadataKey == nil {
+		return sealed, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openLine returns the JSON of a line written by sealLine.
+func openLine(line []byte) ([]byte, error) {
+	if len(line) == 0 || line[0] == '{' {
+		return line, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	return openMetadata(sealed)
+}
+
+// resealFile rewrites a file of metadata encrypted, or plain if decrypt is
+// set, if it exists.
+func resealFile(path string, decrypt bool) error {
+	src, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	src, err = openMetadata(src)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if !decrypt {
+		src, err = sealMetadata(src)
+		if err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path, src, 0600)
+}
+
+// resealLines rewrites a file of metadata lines like resealFile. The
+// lines themselves are unchanged, so that the hash chain of the audit log
+// holds.
+func resealLines(path string, decrypt bool) error {
+	src, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	scanner.Buffer(nil, 1024*1024)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line, err := openLine(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if !decrypt {
+			line, err = sealLine(line)
+			if err != nil {
+				return err
+			}
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, out.Bytes(), 0600)
+}
+
+// encryptMetadataCommand rewrites the metadata written before
+// metadata_key_file was set encrypted, or with -decrypt all of it plain,
+// before metadata_key_file is removed.
+func encryptMetadataCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("encrypt-metadata", flag.ExitOnError)
+	decrypt := flags.Bool("decrypt", false, "rewrites the metadata plain")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: encrypt-metadata [-decrypt]")
+	}
+	if *dryRun {
+		return fmt.Errorf("encrypt-metadata cannot be run with -dry-run")
+	}
+	if metadataKey == nil {
+		return fmt.Errorf("metadata_key_file is not set")
+	}
+	catalog.mu.Lock()
+	unlock, err := catalog.lockFile()
+	if err == nil {
+		err = catalog.reseal(*decrypt)
+		unlock()
+	}
+	catalog.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	history.mu.Lock()
+	err = resealLines(history.path, *decrypt)
+	history.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	auditLog.mu.Lock()
+	err = resealLines(auditLog.path, *decrypt)
+	auditLog.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, p := range config.Profiles {
+		for _, path := range []string{runStatePath(config.StateDir, p.Name), standbyStatePath(config.StateDir, p.Name)} {
+			err = resealFile(path, *decrypt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if *decrypt {
+		fmt.Fprintf(stdout, tr("metadata in %s is stored plain; remove metadata_key_file to keep it so\n"), config.StateDir)
+	} else {
+		fmt.Fprintf(stdout, tr("metadata in %s is encrypted\n"), config.StateDir)
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// When encrypted_name, s3_prefix, s3_key_instance, opaque_names or the
+// bucket of a profile change, the backups taken before keep their old
+// names. Restores still find them through the catalog, but list -remote,
+// the manifest and anyone browsing the bucket see two layouts.
+// migrate-layout moves them to where the profile would store them now.
+// Local files are renamed, or across file systems copied, verified and
+// removed; S3 objects are copied, checked against the size and SHA-256 of
+// the original, and only then deleted. Each catalog entry is rewritten as
+// soon as its backup has moved, so an interrupted migration is finished by
+// running it again. The old bucket must be reachable with the credentials
+// and region of the profile.
+
+// maxCopySize is the largest object CopyObject copies in one request.
+const maxCopySize = 5 << 30
+
+// layoutMove is where a backup of the catalog moves.
+type layoutMove struct {
+	entry         *CatalogEntry
+	backupFile    string
+	encryptedFile string
+	s3Bucket      string
+	s3Key         string
+	objectName    string
+}
+
+// plannedMove returns where the backup of the entry belongs under the
+// current settings of the profile, or nil if it is already there or the
+// entry is not of a stored backup.
+func plannedMove(p *Profile, e *CatalogEntry) (*layoutMove, error) {
+	m := &layoutMove{entry: e, backupFile: e.BackupFile, s3Bucket: e.S3Bucket}
+	var name string
+	switch e.Kind {
+	case "":
+		m.encryptedFile = p.encryptedFilePath(e.Time)
+		if e.BackupFile != "" {
+			m.backupFile = p.backupFilePath(e.Time)
+		}
+		name = createS3Key(p.s3KeyPrefix(), m.encryptedFile)
+	case kindGrants:
+		m.encryptedFile = p.grantsFilePath(e.Time)
+		name = createS3Key(p.s3KeyPrefix(), m.encryptedFile)
+	case kindPut:
+		m.encryptedFile = putFilePath(p, e.Name, e.Time)
+		name = putObjectName(p, m.encryptedFile)
+	default:
+		return nil, nil
+	}
+	// Objects are moved within S3 only; elsewhere they stay where they
+	// are, under their old keys.
+	m.s3Key = e.S3Key
+	if e.S3Key != "" && e.Target == "" && p.target() == targetS3 {
+		var err error
+		m.s3Bucket = p.S3Bucket
+		m.s3Key, err = p.objectKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if p.OpaqueNames {
+			m.objectName = name
+		}
+	}
+	if m.backupFile == e.BackupFile && m.encryptedFile == e.EncryptedFile &&
+		m.s3Bucket == e.S3Bucket && m.s3Key == e.S3Key {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// relocateFile moves the file src to dst, and reports whether dst holds it
+// now. A src which no longer exists, pruned or moved by an interrupted
+// migration, is left alone.
+func relocateFile(src string, dst string) (bool, error) {
+	if src == dst {
+		return false, nil
+	}
+	sum, _, err := hashFile(src)
+	if os.IsNotExist(err) {
+		_, err = os.Stat(dst)
+		return err == nil, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if existing, _, err := hashFile(dst); err == nil {
+		if existing != sum {
+			return false, fmt.Errorf("%s exists and differs from %s", dst, src)
+		}
+		return true, removeMovedFile(src)
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return false, err
+	}
+	if os.Rename(src, dst) == nil {
+		os.Remove(filepath.Dir(src))
+		return true, nil
+	}
+	tmp := dst + ".tmp"
+	_, err = copyFile(tmp, src)
+	if err == nil {
+		var copied string
+		copied, _, err = hashFile(tmp)
+		if err == nil && copied != sum {
+			err = fmt.Errorf("copy of %s to %s does not match the original", src, dst)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, removeMovedFile(src)
+}
+
+// removeMovedFile removes a file which has been moved, and its directory
+// if that is left empty.
+func removeMovedFile(path string) error {
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+	os.Remove(filepath.Dir(path))
+	return nil
+}
+
+// moveObject copies the object of the entry to the bucket and key of the
+// move, checks the copy and deletes the original unless keepOld is set.
+func moveObject(svc *s3.S3, m *layoutMove, keepOld bool) error {
+	e := m.entry
+	old := fmt.Sprintf("s3://%s/%s", e.S3Bucket, e.S3Key)
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(e.S3Bucket), Key: aws.String(e.S3Key)})
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", old, err)
+	}
+	size := aws.Int64Value(head.ContentLength)
+	if size > maxCopySize {
+		return fmt.Errorf("%s is larger than 5 GB, which S3 cannot copy in one request; move it by hand", old)
+	}
+	_, err = svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(m.s3Bucket),
+		Key:               aws.String(m.s3Key),
+		CopySource:        aws.String((&url.URL{Path: e.S3Bucket + "/" + e.S3Key}).EscapedPath()),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+		StorageClass:      head.StorageClass,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot copy %s to s3://%s/%s: %v", old, m.s3Bucket, m.s3Key, err)
+	}
+	copied, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(m.s3Bucket), Key: aws.String(m.s3Key)})
+	if err != nil {
+		return fmt.Errorf("cannot check the copy of %s: %v", old, err)
+	}
+	if aws.Int64Value(copied.ContentLength) != size || metadataSHA256(copied) != metadataSHA256(head) {
+		return fmt.Errorf("the copy of %s at s3://%s/%s does not match the original", old, m.s3Bucket, m.s3Key)
+	}
+	if keepOld {
+		return nil
+	}
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(e.S3Bucket), Key: aws.String(e.S3Key)})
+	if err != nil {
+		return fmt.Errorf("cannot delete %s after copying it: %v", old, err)
+	}
+	return nil
+}
+
+// metadataSHA256 returns the SHA-256 stored with the object by
+// uploadToS3, or "".
+func metadataSHA256(head *s3.HeadObjectOutput) string {
+	for k, v := range head.Metadata {
+		if strings.EqualFold(k, sha256MetadataKey) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
+
+// migrate moves the backup of the entry and rewrites the entry in the
+// catalog.
+func (m *layoutMove) migrate(svc *s3.S3, keepOld bool) error {
+	e := m.entry
+	moved, err := relocateFile(e.EncryptedFile, m.encryptedFile)
+	if err != nil {
+		return err
+	}
+	encryptedFile := e.EncryptedFile
+	if moved {
+		encryptedFile = m.encryptedFile
+	}
+	backupFile := e.BackupFile
+	if m.backupFile != e.BackupFile {
+		// The plain dump may have been compressed since.
+		moved, err := relocateFile(e.BackupFile, m.backupFile)
+		if err != nil {
+			return err
+		}
+		gz, err := relocateFile(e.BackupFile+".gz", m.backupFile+".gz")
+		if err != nil {
+			return err
+		}
+		if moved || gz {
+			backupFile = m.backupFile
+		}
+	}
+	if m.s3Bucket != e.S3Bucket || m.s3Key != e.S3Key {
+		err = moveObject(svc, m, keepOld)
+		if err != nil {
+			return err
+		}
+	}
+	return catalog.Update(func(entries []*CatalogEntry) ([]*CatalogEntry, error) {
+		for _, c := range entries {
+			if c.Profile == e.Profile && c.RunID == e.RunID && c.Kind == e.Kind && c.Name == e.Name &&
+				c.EncryptedFile == e.EncryptedFile && c.S3Key == e.S3Key {
+				c.BackupFile = backupFile
+				c.EncryptedFile = encryptedFile
+				c.S3Bucket = m.s3Bucket
+				c.S3Key = m.s3Key
+				c.ObjectName = m.objectName
+			}
+		}
+		return entries, nil
+	})
+}
+
+// describe tells what moves, for the dry run and the report.
+func (m *layoutMove) describe() string {
+	e := m.entry
+	var parts []string
+	if m.encryptedFile != e.EncryptedFile {
+		parts = append(parts, e.EncryptedFile+" -> "+m.encryptedFile)
+	}
+	if m.backupFile != e.BackupFile {
+		parts = append(parts, e.BackupFile+" -> "+m.backupFile)
+	}
+	if m.s3Bucket != e.S3Bucket || m.s3Key != e.S3Key {
+		parts = append(parts, fmt.Sprintf("s3://%s/%s -> s3://%s/%s", e.S3Bucket, e.S3Key, m.s3Bucket, m.s3Key))
+	}
+	return strings.Join(parts, "\n    ")
+}
+
+// migrateLayoutCommand moves the backups of the selected profiles to the
+// current naming and storage settings.
+func migrateLayoutCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	keepOld := flags.Bool("keep-old", false, "keeps the S3 objects under their old keys after copying them")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: migrate-layout [-keep-old]")
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return err
+	}
+	rec := &AuditRecord{
+		RunID:   newRunID(),
+		Time:    time.Now(),
+		Trigger: triggerManual,
+		User:    currentUser(),
+		Command: commandLine(),
+		Stages:  []string{"migrate-layout"},
+		Outcome: "success",
+	}
+	rec.Host, _ = os.Hostname()
+	planned, total := 0, 0
+	for _, p := range profiles {
+		var moves []*layoutMove
+		for _, e := range entries {
+			if e.Profile != p.Name {
+				continue
+			}
+			m, err := plannedMove(p, e)
+			if err != nil {
+				return err
+			}
+			if m == nil {
+				continue
+			}
+			if e.Hold != nil && e.Hold.S3 && (m.s3Bucket != e.S3Bucket || m.s3Key != e.S3Key) {
+				fmt.Fprintf(stdout, tr("%s has an S3 legal hold and is not moved; release it first\n"), entryLocation(e))
+				continue
+			}
+			moves = append(moves, m)
+		}
+		planned += len(moves)
+		if len(moves) == 0 {
+			continue
+		}
+		if *dryRun {
+			for _, m := range moves {
+				fmt.Fprintf(stdout, tr("would move %s\n    %s\n"), m.entry.RunID, m.describe())
+			}
+			continue
+		}
+		sess, err := newS3Session(p)
+		if err != nil {
+			return fmt.Errorf("cannot create AWS session: %v", err)
+		}
+		svc := s3.New(sess)
+		for _, m := range moves {
+			err = m.migrate(svc, *keepOld)
+			if err != nil {
+				break
+			}
+			rec.Profile = p.Name
+			rec.Artifacts = append(rec.Artifacts, m.describe())
+			fmt.Fprintf(stdout, tr("moved %s\n    %s\n"), m.entry.RunID, m.describe())
+			total++
+		}
+		if err == nil && p.OpaqueNames && p.S3Bucket != "" {
+			err = p.updateManifest()
+			if err != nil {
+				err = fmt.Errorf("cannot update manifest: %v", err)
+			}
+		}
+		if err != nil {
+			rec.Outcome = "failure"
+			rec.Error = redactError(err)
+			if aerr := auditLog.Append(rec); aerr != nil {
+				fmt.Fprintf(stderr, tr("audit log: %v\n"), aerr)
+			}
+			return err
+		}
+	}
+	if total > 0 {
+		if aerr := auditLog.Append(rec); aerr != nil {
+			fmt.Fprintf(stderr, tr("audit log: %v\n"), aerr)
+		}
+	}
+	if planned == 0 {
+		fmt.Fprintf(stdout, tr("all backups are already in place\n"))
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -8,13 +10,14 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	cflib "github.com/hangilc/crypt-file/lib"
 )
 
 const (
@@ -36,37 +39,119 @@ MYCLINIC_BACKUP_ENCRYPTED_DIR -- directory to store encrypted SQL backup file
 MYCLINIC_BACKUP_ENCRYPTION_KEY -- path to encryption key file
 MYCLINIC_BACKUP_S3_REGION -- S3 region
 MYCLINIC_BACKUP_S3_BUCKET -- S3 bucket
+MYCLINIC_BACKUP_TARGET -- where to upload: s3 (default), gcs, sftp or file
+MYCLINIC_BACKUP_TARGET_DIR -- directory of target file, or on the SFTP server
+MYCLINIC_BACKUP_SFTP_HOST -- SFTP server of target sftp, as [user@]host[:port]
+MYCLINIC_BACKUP_CONFIG -- configuration file used when -config is not given
+MYCLINIC_BACKUP_STATE_DIR -- directory to keep catalog and logs
 `)
+	fmt.Print(precedenceNote)
 }
 
+const precedenceNote = `
+Settings are taken from, in order of precedence:
+  1. command line options (applied to every profile)
+  2. profile fields in the -config file
+  3. environment variables
+`
+
 var dryRun = flag.Bool("dry-run", false, "does not actually run commands")
 var printEnv = flag.Bool("env", false, "prints relevant env vars")
+var configFile = flag.String("config", "", "configuration file defining backup profiles")
+var profileNames = flag.String("profile", "", "comma separated names of profiles to run (default all)")
+var stateDirFlag = flag.String("state-dir", "", "directory to keep catalog and logs")
+var lowPriorityFlag = flag.Bool("low-priority", false, "runs dump and compression at lowered priority")
+var listenFlag = flag.String("listen", "", "address for the monitoring endpoint in daemon mode (e.g. 127.0.0.1:9120)")
+var plainRetentionFlag = flag.Int("plain-retention", 0, "days to keep plain SQL dumps on disk")
+var noResume = flag.Bool("no-resume", false, "starts a new run even if an earlier run was interrupted")
+var compressThreadsFlag = flag.Int("compress-threads", 0, "maximum CPU threads used for compression")
+var k8sFlag = flag.Bool("k8s", false, "runs as a Kubernetes CronJob: logs to stdout only and exits with 2 on errors retrying cannot fix")
+var simulateFlag = flag.Bool("simulate", false, "backs up generated dumps of the myclinic schema instead of the database, for testing without patient data")
+var simulateSizeFlag = flag.String("simulate-size", "10MB", "size of the dumps generated by -simulate")
+var injectFailureFlag = flag.String("inject-failure", "", "comma separated failures to force for rehearsing recovery: dump, encrypt, upload, network")
+
+var dbUserFlag = flag.String("db-user", "", "database user")
+var dbPassSourceFlag = flag.String("db-pass-source", "",
+	"where to read database password: env:NAME, file:PATH, or stdin")
+var databaseFlag = flag.String("database", "", "database to back up (default myclinic)")
+var backupDirFlag = flag.String("backup-dir", "", "directory to store plain SQL backup file")
+var encryptedDirFlag = flag.String("encrypted-dir", "", "directory to store encrypted SQL backup file")
+var keyFileFlag = flag.String("key-file", "", "path to encryption key file")
+var regionFlag = flag.String("region", "", "S3 region")
+var bucketFlag = flag.String("bucket", "", "S3 bucket")
+
+func init() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		setLanguage("")
+		fmt.Fprintf(out, tr("Usage: %s [options] [command] [args]\n"), os.Args[0])
+		fmt.Fprintf(out, tr("[commands]\n"))
+		for _, c := range commands {
+			fmt.Fprintf(out, "  %s -- %s\n", c.name, tr(c.summary))
+		}
+		fmt.Fprintf(out, tr("[options]\n"))
+		printFlags(out)
+		fmt.Fprintf(out, "%s", precedenceNote)
+	}
+}
 
-func uploadToS3(region string, bucket string, key string, filename string) error {
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	}))
+// uploadToS3 uploads the file, in parts if it is larger than the part
+// size, with its SHA-256, and checks that the stored object matches the
+// file. Write-only credentials cannot read the object back, and rely on
+// the checks S3 makes of each request.
+// opts are applied to every request of the upload as well.
+func uploadToS3(sess *session.Session, bucket string, key string, filename string, writeOnly bool, opts ...request.Option) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	uploader := s3manager.NewUploader(sess)
-	_, err = uploader.Upload(&s3manager.UploadInput{
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	partSize, err := uploadPartSize(info.Size())
+	if err != nil {
+		return err
+	}
+	sums, err := computeUploadChecksums(file, info.Size(), partSize)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	uploader := newUploader(sess, partSize)
+	out, err := uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 		Body:   file,
-	})
-	return err
+		Metadata: map[string]*string{
+			sha256MetadataKey:      aws.String(hex.EncodeToString(sums.sha256)),
+			cryptoModeMetadataKey:  aws.String(cryptoMode()),
+			compressionMetadataKey: aws.String(transfer.compressor.Name()),
+			hostMetadataKey:        aws.String(hostMetadata()),
+			instanceMetadataKey:    aws.String(instanceID),
+		},
+	}, s3manager.WithUploaderRequestOptions(append([]request.Option{sums.withChecksums}, opts...)...))
+	if err != nil || writeOnly {
+		return err
+	}
+	return sums.check(s3.New(sess), bucket, key, out.VersionID)
 }
 
-func getenv(name string) string {
-	value := os.Getenv(name)
-	if value == "" {
-		fmt.Fprintf(os.Stderr, "cannot get env var %s", name)
-		os.Exit(1)
+func downloadFromS3(sess *session.Session, bucket string, key string) ([]byte, error) {
+	buf := aws.NewWriteAtBuffer(nil)
+	downloader := s3manager.NewDownloader(sess)
+	_, err := downloader.Download(buf, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
 	}
-	return value
+	return buf.Bytes(), nil
 }
 
 func dirPart(dateTime time.Time) string {
@@ -77,33 +162,48 @@ func filePart(dateTime time.Time) string {
 	return "dump-" + dateTime.Format("200601021504") + ".sql"
 }
 
-func encryptedBackupResult(src string) string {
-	reg := regexp.MustCompile(`(.+)(\.(\w+))$`)
-	return reg.ReplaceAllString(src, "$1-$3.cf")
+func createBackupFilePath(dir string, dateTime time.Time) string {
+	return filepath.Join(dir, dirPart(dateTime), filePart(dateTime))
 }
 
-func createBackupFilePath(dir string, dateTime time.Time) string {
-	p := dir + "/" + dirPart(dateTime) + "/" + filePart(dateTime)
-	p = filepath.ToSlash(p)
-	return filepath.Clean(p)
+// mysqldumpArgs returns the arguments for a consistent dump of databases:
+// InnoDB tables are read in a single transaction, so the dump is a snapshot
+// of one point in time without locking the tables. Several databases are
+// dumped by one invocation to share that snapshot. options follow, so that
+// they can override these.
+func mysqldumpArgs(options []string, databases ...string) []string {
+	args := append([]string{"--default-character-set=utf8", "--single-transaction"}, options...)
+	if len(databases) > 1 {
+		args = append(args, "--databases")
+	}
+	return append(args, databases...)
 }
 
-func dumpMysql(backupFile string) error {
+// dumpMysql writes the output of the mysqldump command cmd, which may run
+// mysqldump on another machine or in a container, to backupFile.
+func dumpMysql(backupFile string, cmd *exec.Cmd, lowPriority bool) error {
 	dir := filepath.Dir(backupFile)
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		return err
 	}
-	user := getenv(mysqlUserEnvVar)
-	pass := getenv(mysqlPassEnvVar)
-	cmd := exec.Command("mysqldump", "-u", user, "-p"+pass,
-		"--default-character-set=utf8", "myclinic", "--result-file="+backupFile)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	out, err := os.OpenFile(backupFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if lowPriority {
+		cmd = lowPriorityCommand(cmd)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = stderr
 	err = cmd.Run()
+	cerr := out.Close()
 	if err != nil {
 		return err
 	}
+	if cerr != nil {
+		return cerr
+	}
 	exitCode := cmd.ProcessState.ExitCode()
 	if exitCode != 0 {
 		return fmt.Errorf("mysqldump failed with exit code: %d", exitCode)
@@ -125,9 +225,19 @@ func copyFile(dst, src string) (int64, error) {
 	return io.Copy(fout, fin)
 }
 
+// invokeAxCrypt encrypts src with AxCrypt. prog may be empty to find the
+// program automatically.
 func invokeAxCrypt(prog string, password string, src string) error {
+	prog, err := locateAxCrypt(prog)
+	if err != nil {
+		return err
+	}
+	_, err = checkAxCrypt(prog)
+	if err != nil {
+		return err
+	}
 	cmd := exec.Command(prog, "-b", "2", "-e", "-k", password, "-z", src)
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		return err
 	}
@@ -138,78 +248,185 @@ func invokeAxCrypt(prog string, password string, src string) error {
 	return nil
 }
 
-func encryptBackupFile(dstPath string, key []byte, srcPath string) error {
-	fmt.Printf("dstPath %s\n", dstPath)
-	dir := filepath.Dir(dstPath)
-	fmt.Printf("dst dir %s\n", dir)
-	err := os.MkdirAll(dir, 0755)
+// encryptBackupFile compresses and encrypts the file, tracing each step
+// within sp. The file is streamed, never read into memory whole.
+func encryptBackupFile(dstPath string, key []byte, srcPath string, sp *span) error {
+	err := os.MkdirAll(filepath.Dir(dstPath), 0755)
 	if err != nil {
 		return err
 	}
-	in, err := ioutil.ReadFile(srcPath)
+	in, err := os.Open(srcPath)
 	if err != nil {
 		return err
 	}
-	enc, err := cflib.CompressAndEncrypt(key, in)
-	err = ioutil.WriteFile(dstPath, enc, 0600)
-	return nil
+	defer in.Close()
+	out, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// Compression and encryption run together, so one span covers both.
+	csp := sp.child("compress")
+	csp.set("compress.algorithm", transfer.compressor.Name())
+	csp.set("crypto.mode", cryptoMode())
+	bw := bufio.NewWriterSize(out, 1<<20)
+	enc := &countingWriter{w: bw, hash: ioutil.Discard}
+	w, err := newEncryptWriter(key, enc)
+	var n int64
+	if err == nil {
+		n, err = io.Copy(w, in)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	csp.set("compress.input_bytes", n)
+	csp.set("compress.output_bytes", enc.n)
+	csp.finish(err)
+	return err
 }
 
-func createS3Key(encryptedFile string) string {
+func createS3Key(prefix string, encryptedFile string) string {
 	dir, base := filepath.Split(encryptedFile)
 	_, dirbase := filepath.Split(filepath.Clean(dir + "."))
-	return dirbase + "/" + base
+	key := dirbase + "/" + base
+	if prefix != "" {
+		key = strings.TrimSuffix(prefix, "/") + "/" + key
+	}
+	return key
 }
 
-func getEncryptionKey() ([]byte, error) {
-	keyPath := os.Getenv(encryptionKey)
-	if keyPath == "" {
-		return nil, fmt.Errorf("Cannot get key path from $%s", encryptionKey)
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
 	}
-	return cflib.ReadKeyFile(keyPath)
+	return list
 }
 
 func main() {
 	flag.Parse()
+	err := setLanguage("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	err = parseInjectedFailures(*injectFailureFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
 	if *printEnv {
 		printEnvReference()
 		return
 	}
-	now := time.Now()
-	backupDir := getenv(backupDirEnvVar)
-	backupFile := createBackupFilePath(backupDir, now)
-	if !*dryRun {
-		err := dumpMysql(backupFile)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "mysql backup failed: %v\n", err)
-			os.Exit(1)
-		}
+	name := "backup"
+	var args []string
+	if flag.NArg() > 0 {
+		name = flag.Arg(0)
+		args = flag.Args()[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, tr("unknown command: %s\n"), name)
+		flag.Usage()
+		os.Exit(2)
 	}
-	fmt.Printf("database backed up to %s\n", backupFile)
-	encryptedBackupDir := getenv(encryptedBackupDirEnvVar)
-	encSrc := createBackupFilePath(encryptedBackupDir, now)
-	encryptedFile := encryptedBackupResult(encSrc)
-	if !*dryRun {
-		key, err := getEncryptionKey()
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(configErrorExit())
+	}
+	err = setLanguage(config.Language)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(configErrorExit())
+	}
+	os.Exit(runCommand(cmd, config, args))
+}
+
+// configErrorExit is the exit code for errors in the configuration. A
+// Kubernetes Job is retried after failures, which is pointless for these,
+// so with -k8s they get an exit code the Job's podFailurePolicy can match.
+func configErrorExit() int {
+	if *k8sFlag {
+		return 2
+	}
+	return 1
+}
+
+func runCommand(cmd *command, config *Config, args []string) int {
+	// In a pod the output is collected from stdout and stderr, and the
+	// state directory may not be persistent.
+	if !*k8sFlag {
+		logFile, err := openLog(config.logDir())
 		if err != nil {
-			panic(err)
+			fmt.Fprintf(stderr, tr("warning: cannot open log file: %v\n"), err)
+		} else {
+			defer logFile.Close()
 		}
-		err = encryptBackupFile(encryptedFile, key, backupFile)
+	}
+	out, errOut := newRedactingWriter(stdout), newRedactingWriter(stderr)
+	defer out.Flush()
+	defer errOut.Flush()
+	stdout, stderr = out, errOut
+	if len(injectedFailures) > 0 {
+		fmt.Fprintf(stderr, tr("warning: injecting failures: %s\n"), injectedFailureList())
+	}
+	for _, w := range config.warnings {
+		fmt.Fprintf(stderr, tr(w.format), w.args...)
+	}
+	notifyInterrupt()
+	instanceID = config.instanceID()
+	notifySMTP = config.SMTP
+	messageTemplates = config.Templates
+	tracing = config.Tracing
+	if err := config.loadMetadataKey(); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return configErrorExit()
+	}
+	catalog = newCatalog(config.catalogPath())
+	if config.CatalogS3 != nil {
+		remote, err := newS3Catalog(config.CatalogS3)
 		if err != nil {
-			panic(err)
+			fmt.Fprintf(stderr, "%v\n", err)
+			return configErrorExit()
 		}
+		catalog.remote = remote
+	}
+	auditLog = newAuditLog(config.auditLogPath())
+	history = newHistory(config.historyPath())
+	if config.AuditS3 != nil {
+		auditLog.mirror = config.AuditS3.upload
+	}
+	profiles, err := config.selectProfiles(splitList(*profileNames))
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return configErrorExit()
 	}
-	fmt.Printf("encrypted file: %s\n", encryptedFile)
-	region := getenv(s3BackupRegionEnvVar)
-	fmt.Printf("region: %s\n", region)
-	bucket := getenv(s3BackupBucketEnvVar)
-	key := createS3Key(encryptedFile)
-	fmt.Printf("S3 key: %s\n", key)
-	if !*dryRun {
-		err := uploadToS3(region, bucket, key, encryptedFile)
+	if readsBackups(cmd.name, args) {
+		err = useReaderCredentials(profiles)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to upload to S3: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(stderr, "%v\n", err)
+			return configErrorExit()
 		}
 	}
+	err = runUntilInterrupted(func() error {
+		return cmd.run(config, profiles, args)
+	})
+	if err == errInterrupted {
+		return 1
+	}
+	if err != nil {
+		printError("", err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// hostArgs returns the client arguments connecting to db_host, which is a
+// host name optionally followed by :port.
+func (p *Profile) hostArgs() []string {
+	if p.DBSocket != "" {
+		return []string{"--socket=" + p.DBSocket}
+	}
+	if p.DBHost == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(p.DBHost)
+	if err != nil {
+		return []string{"--host=" + p.DBHost}
+	}
+	return []string{"--host=" + host, "--port=" + port}
+}
+
+// KubernetesConfig locates the database pod.
+type KubernetesConfig struct {
+	Namespace string `yaml:"namespace"`
+	// Pod is a pod name or anything kubectl exec accepts in its place,
+	// such as statefulset/mysql.
+	Pod       string `yaml:"pod"`
+	Container string `yaml:"container"`
+}
+
+// SSHConfig is the database host on which the MySQL client tools are run
+// over SSH. Only key authentication is used, and the host key must already
+// be known.
+type SSHConfig struct {
+	Host string `yaml:"host"`
+	User string `yaml:"user"`
+	Port int    `yaml:"port"`
+	// IdentityFile is the private key (default that of ssh).
+	IdentityFile string `yaml:"identity_file"`
+	// KnownHostsFile holds the host key (default ~/.ssh/known_hosts).
+	KnownHostsFile string `yaml:"known_hosts_file"`
+}
+
+func (s *SSHConfig) validate() error {
+	if s.Host == "" {
+		return fmt.Errorf("ssh: host is not set")
+	}
+	return nil
+}
+
+// shellQuote quotes s for the remote shell which ssh passes the command to.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func (s *SSHConfig) command(program string, args ...string) *exec.Cmd {
+	sargs := []string{"-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes"}
+	if s.KnownHostsFile != "" {
+		sargs = append(sargs, "-o", "UserKnownHostsFile="+s.KnownHostsFile)
+	}
+	if s.IdentityFile != "" {
+		sargs = append(sargs, "-o", "IdentitiesOnly=yes", "-i", s.IdentityFile)
+	}
+	if s.Port != 0 {
+		sargs = append(sargs, "-p", strconv.Itoa(s.Port))
+	}
+	dest := s.Host
+	if s.User != "" {
+		dest = s.User + "@" + s.Host
+	}
+	remote := []string{program}
+	for _, a := range args {
+		remote = append(remote, shellQuote(a))
+	}
+	sargs = append(sargs, dest, "--", strings.Join(remote, " "))
+	return exec.Command("ssh", sargs...)
+}
+
+// clientCommand runs a MySQL client program, either on this machine or,
+// if docker_container or kubernetes is set, inside the database container
+// so that no client tools need to be installed here, or on the database
+// host over SSH.
+func (p *Profile) clientCommand(program string, args ...string) *exec.Cmd {
+	if p.SSH != nil {
+		return p.SSH.command(program, args...)
+	}
+	if p.DockerContainer != "" {
+		// With -e and no value, docker passes MYSQL_PWD on from its own
+		// environment if set there by credentialCommand.
+		return exec.Command("docker", append([]string{"exec", "-i", "-e", mysqlPwdEnvVar, p.DockerContainer,
+			program}, args...)...)
+	}
+	if k := p.Kubernetes; k != nil {
+		kargs := []string{"exec", "-i"}
+		if k.Namespace != "" {
+			kargs = append(kargs, "--namespace="+k.Namespace)
+		}
+		kargs = append(kargs, k.Pod)
+		if k.Container != "" {
+			kargs = append(kargs, "--container="+k.Container)
+		}
+		kargs = append(kargs, "--", program)
+		return exec.Command("kubectl", append(kargs, args...)...)
+	}
+	return exec.Command(program, args...)
+}
+
+// usesOptionFiles reports whether the credentials may come from MySQL
+// option files rather than db_user and db_pass.
+func (p *Profile) usesOptionFiles() bool {
+	return p.DBDefaultsFile != "" || p.DBLoginPath != ""
+}
+
+// optionFileArgs returns the arguments reading db_defaults_file and
+// db_login_path, which the client programs accept only before any other.
+func (p *Profile) optionFileArgs() []string {
+	var args []string
+	if p.DBDefaultsFile != "" {
+		args = append(args, "--defaults-extra-file="+p.DBDefaultsFile)
+	}
+	if p.DBLoginPath != "" {
+		args = append(args, "--login-path="+p.DBLoginPath)
+	}
+	return args
+}
+
+// mysqlPwdEnvVar is read by the MySQL client programs for the password.
+const mysqlPwdEnvVar = "MYSQL_PWD"
+
+// credentialCommand runs a MySQL client program as db_user. The password
+// is passed in the environment so that it does not show in the process
+// list. kubectl exec and ssh cannot pass the environment, so profiles
+// using them have the password in option files instead; see validate.
+func (p *Profile) credentialCommand(program string, args ...string) *exec.Cmd {
+	args = append(p.hostArgs(), args...)
+	if p.DBUser != "" {
+		args = append([]string{"-u", p.DBUser}, args...)
+	}
+	if p.DBPass == "" {
+		// The password is in the option files.
+		return p.clientCommand(program, append(p.optionFileArgs(), args...)...)
+	}
+	cmd := p.clientCommand(program, append(p.optionFileArgs(), args...)...)
+	cmd.Env = append(os.Environ(), mysqlPwdEnvVar+"="+p.DBPass)
+	return cmd
+}
+
+// mysqldumpCommand returns the command dumping the profile to stdout.
+func (p *Profile) mysqldumpCommand() *exec.Cmd {
+	var args []string
+	if p.BinlogCoordinates {
+		args = append(args, "--master-data=2")
+	}
+	if p.DedupPlain {
+		args = append(args, "--skip-dump-date")
+	}
+	return p.credentialCommand("mysqldump", append(args, mysqldumpArgs(p.DumpOptions, p.databases()...)...)...)
+}
+
+// mysqlCommand runs the mysql client with the credentials of the profile.
+func mysqlCommand(p *Profile, args ...string) *exec.Cmd {
+	return p.credentialCommand("mysql", append([]string{"--default-character-set=utf8"}, args...)...)
+}
+
+func runMysql(cmd *exec.Cmd) error {
+	var errOut strings.Builder
+	cmd.Stderr = &errOut
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("mysql failed: %w: %s", err, redact(strings.TrimSpace(errOut.String())))
+	}
+	return nil
+}
+
+// mysqlExecute runs SQL statements with the mysql client.
+func mysqlExecute(p *Profile, sql string) error {
+	return runMysql(mysqlCommand(p, "--execute="+sql))
+}
+
+// mysqlQuery runs a query and returns its output without column names.
+func mysqlQuery(p *Profile, sql string) (string, error) {
+	return mysqlQueryArgs(p, sql)
+}
+
+// mysqlQueryRaw is mysqlQuery without escaping of special characters in
+// the output, for statements which are fed back to the server.
+func mysqlQueryRaw(p *Profile, sql string) (string, error) {
+	return mysqlQueryArgs(p, sql, "--raw")
+}
+
+func mysqlQueryArgs(p *Profile, sql string, args ...string) (string, error) {
+	args = append([]string{"--skip-column-names", "--batch"}, args...)
+	cmd := mysqlCommand(p, append(args, "--execute="+sql)...)
+	var out strings.Builder
+	cmd.Stdout = &out
+	err := runMysql(cmd)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// mysqlLoad feeds an SQL dump into database, or into the databases named
+// by the dump if database is empty. The client commands which run shell
+// commands, \! and system, are turned off: --system-command of MySQL 8.0.40
+// and later and --sandbox of MariaDB. The loose- prefix has older clients,
+// and each the option of the other, warn about the option rather than
+// fail.
+func mysqlLoad(p *Profile, database string, dump io.Reader) error {
+	args := []string{"--loose-system-command=OFF", "--loose-sandbox"}
+	if database != "" {
+		args = append(args, database)
+	}
+	cmd := mysqlCommand(p, args...)
+	cmd.Stdin = dump
+	return runMysql(cmd)
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func quoteString(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
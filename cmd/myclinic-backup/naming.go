@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const stampPlaceholder = "{stamp}"
+
+// legacyEncryptedPattern matches names made by legacyEncryptedName, e.g.
+// dump-201912311504-sql.cf, or files-201912311504-tar.cf for file archives.
+var legacyEncryptedPattern = regexp.MustCompile(`^(?:dump-(\d{12})-sql|files-(\d{12})-tar)\.cf$`)
+
+func validateNameTemplate(tmpl string) error {
+	if strings.Count(tmpl, stampPlaceholder) != 1 {
+		return fmt.Errorf("encrypted_name must contain %s exactly once: %s", stampPlaceholder, tmpl)
+	}
+	if strings.ContainsAny(tmpl, `/\`) {
+		return fmt.Errorf("encrypted_name must not contain path separators: %s", tmpl)
+	}
+	return nil
+}
+
+// backupFilePath returns the path of the plain dump or file archive taken
+// at t.
+func (p *Profile) backupFilePath(t time.Time) string {
+	if p.isFiles() {
+		return createArchiveFilePath(p.BackupDir, t)
+	}
+	return createBackupFilePath(p.BackupDir, t)
+}
+
+// legacyEncryptedName returns the historical name of the encrypted backup
+// taken at t: that of the plain dump or archive with its extension made
+// part of the name.
+func (p *Profile) legacyEncryptedName(t time.Time) string {
+	if p.isFiles() {
+		return "files-" + t.Format("200601021504") + "-tar.cf"
+	}
+	return "dump-" + t.Format("200601021504") + "-sql.cf"
+}
+
+// encryptedFilePath returns the path of the encrypted backup taken at t.
+// Without encrypted_name the historical naming is used.
+func (p *Profile) encryptedFilePath(t time.Time) string {
+	name := p.legacyEncryptedName(t)
+	if p.EncryptedName != "" {
+		name = strings.Replace(p.EncryptedName, stampPlaceholder, t.Format("200601021504"), 1)
+	}
+	return filepath.Join(p.EncryptedDir, dirPart(t), name)
+}
+
+// artifactPaths returns the files and directories a backup of the profile
+// taken at t is kept in, by what they hold.
+func (p *Profile) artifactPaths(t time.Time) map[string]string {
+	plain := p.backupFilePath(t)
+	paths := map[string]string{
+		"plain backup":            plain,
+		"compressed plain backup": plain + ".gz",
+		"encrypted backup":        p.encryptedFilePath(t),
+	}
+	if p.Grants {
+		paths["grants"] = p.grantsFilePath(t)
+	}
+	if p.Binlog != nil {
+		paths["binary logs"] = p.binlogDir(t)
+	}
+	return paths
+}
+
+// validateArtifactPaths fails if two artifacts of a backup would be kept in
+// the same file, as with an encrypted_name naming the plain dump while
+// encrypted_dir is backup_dir; one would overwrite the other. It also fails
+// if one would be kept inside another, such as a file inside the directory
+// of the binary logs. Names differing only in case are the same file on
+// Windows and macOS.
+func (p *Profile) validateArtifactPaths() error {
+	paths := p.artifactPaths(time.Date(2019, 12, 31, 15, 4, 0, 0, time.Local))
+	keys := sortedKeys(paths)
+	for i, what := range keys {
+		path := strings.ToLower(filepath.Clean(paths[what]))
+		for _, other := range keys[:i] {
+			otherPath := strings.ToLower(filepath.Clean(paths[other]))
+			if path == otherPath {
+				return fmt.Errorf("the %s and the %s would both be kept in %s", other, what, paths[what])
+			}
+			if strings.HasPrefix(path, otherPath+string(filepath.Separator)) {
+				return fmt.Errorf("the %s would be kept inside the %s, %s", what, other, paths[other])
+			}
+			if strings.HasPrefix(otherPath, path+string(filepath.Separator)) {
+				return fmt.Errorf("the %s would be kept inside the %s, %s", other, what, paths[what])
+			}
+		}
+	}
+	return nil
+}
+
+func nameTemplatePattern(tmpl string) *regexp.Regexp {
+	parts := strings.SplitN(tmpl, stampPlaceholder, 2)
+	return regexp.MustCompile("^" + regexp.QuoteMeta(parts[0]) + `(\d{12})` +
+		regexp.QuoteMeta(parts[1]) + "$")
+}
+
+// encryptedBackupTime recognizes the name of an encrypted backup of the
+// profile, made either with its encrypted_name or with the historical
+// naming, and returns the time the backup was taken.
+func (p *Profile) encryptedBackupTime(name string) (time.Time, bool) {
+	patterns := []*regexp.Regexp{legacyEncryptedPattern}
+	if p.EncryptedName != "" {
+		patterns = append(patterns, nameTemplatePattern(p.EncryptedName))
+	}
+	for _, re := range patterns {
+		if m := re.FindStringSubmatch(name); m != nil {
+			// Only one of the alternative groups matched.
+			t, err := time.ParseInLocation("200601021504", strings.Join(m[1:], ""), time.Local)
+			if err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var namingTime = time.Date(2019, 12, 31, 15, 4, 0, 0, time.Local)
+
+func TestLegacyEncryptedName(t *testing.T) {
+	dump := &Profile{EncryptedDir: "enc"}
+	files := &Profile{Type: profileFiles, EncryptedDir: "enc"}
+	for _, tc := range []struct {
+		p    *Profile
+		want string
+	}{
+		{dump, "dump-201912311504-sql.cf"},
+		{files, "files-201912311504-tar.cf"},
+	} {
+		name := tc.p.legacyEncryptedName(namingTime)
+		if name != tc.want {
+			t.Errorf("legacyEncryptedName = %q, want %q", name, tc.want)
+		}
+		if !legacyEncryptedPattern.MatchString(name) {
+			t.Errorf("%q does not match legacyEncryptedPattern", name)
+		}
+		if path := tc.p.encryptedFilePath(namingTime); path != filepath.Join("enc", "2019-12", tc.want) {
+			t.Errorf("encryptedFilePath = %q", path)
+		}
+		if got, ok := tc.p.encryptedBackupTime(name); !ok || !got.Equal(namingTime) {
+			t.Errorf("encryptedBackupTime(%q) = %v, %v", name, got, ok)
+		}
+	}
+}
+
+func TestEncryptedNameTemplate(t *testing.T) {
+	p := &Profile{EncryptedDir: "enc", EncryptedName: "clinic.{stamp}.bak"}
+	if path := p.encryptedFilePath(namingTime); path != filepath.Join("enc", "2019-12", "clinic.201912311504.bak") {
+		t.Errorf("encryptedFilePath = %q", path)
+	}
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"clinic.201912311504.bak", true},
+		// Backups taken before encrypted_name was set are still found.
+		{"dump-201912311504-sql.cf", true},
+		{"files-201912311504-tar.cf", true},
+		// The dots are not wildcards.
+		{"clinicX201912311504.bak", false},
+		{"clinic.20191231150.bak", false},
+		{"clinic.201912311504.bak.tmp", false},
+		{"clinic.201913311504.bak", false},
+		{"grants-201912311504-sql.cf", false},
+	} {
+		got, ok := p.encryptedBackupTime(tc.name)
+		if ok != tc.ok || ok && !got.Equal(namingTime) {
+			t.Errorf("encryptedBackupTime(%q) = %v, %v", tc.name, got, ok)
+		}
+	}
+}
+
+func TestValidateNameTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		tmpl string
+		ok   bool
+	}{
+		{"{stamp}", true},
+		{"clinic-{stamp}.cf", true},
+		{"clinic.cf", false},
+		{"{stamp}-{stamp}.cf", false},
+		{"sub/{stamp}.cf", false},
+		{`sub\{stamp}.cf`, false},
+	} {
+		if err := validateNameTemplate(tc.tmpl); (err == nil) != tc.ok {
+			t.Errorf("validateNameTemplate(%q): %v", tc.tmpl, err)
+		}
+	}
+}
+
+func TestArtifactPaths(t *testing.T) {
+	p := &Profile{BackupDir: "plain", EncryptedDir: "enc", Grants: true, Binlog: &BinlogConfig{}}
+	month := filepath.Join("enc", "2019-12")
+	want := map[string]string{
+		"plain backup":            filepath.Join("plain", "2019-12", "dump-201912311504.sql"),
+		"compressed plain backup": filepath.Join("plain", "2019-12", "dump-201912311504.sql.gz"),
+		"encrypted backup":        filepath.Join(month, "dump-201912311504-sql.cf"),
+		"grants":                  filepath.Join(month, "grants-201912311504-sql.cf"),
+		"binary logs":             filepath.Join(month, "binlog-201912311504"),
+	}
+	paths := p.artifactPaths(namingTime)
+	if len(paths) != len(want) {
+		t.Errorf("artifactPaths = %q", paths)
+	}
+	for what, path := range want {
+		if paths[what] != path {
+			t.Errorf("%s: %q, want %q", what, paths[what], path)
+		}
+	}
+	files := &Profile{Type: profileFiles, BackupDir: "plain", EncryptedDir: "enc"}
+	paths = files.artifactPaths(namingTime)
+	if len(paths) != 3 || paths["plain backup"] != filepath.Join("plain", "2019-12", "files-201912311504.tar") {
+		t.Errorf("files profile: %q", paths)
+	}
+}
+
+func TestValidateArtifactPaths(t *testing.T) {
+	nested := filepath.Join("same", "2019-12", "binlog-201912311504")
+	for _, tc := range []struct {
+		name string
+		p    *Profile
+		err  string
+	}{
+		{"defaults", &Profile{BackupDir: "plain", EncryptedDir: "enc", Grants: true, Binlog: &BinlogConfig{}}, ""},
+		{"one directory", &Profile{BackupDir: "same", EncryptedDir: "same", Grants: true, Binlog: &BinlogConfig{}}, ""},
+		{"files, one directory", &Profile{Type: profileFiles, BackupDir: "same", EncryptedDir: "same"}, ""},
+		{"template, one directory", &Profile{BackupDir: "same", EncryptedDir: "same", EncryptedName: "{stamp}.cf"}, ""},
+		{"plain dump", &Profile{BackupDir: "same", EncryptedDir: "same", EncryptedName: "dump-{stamp}.sql"},
+			"encrypted backup and the plain backup"},
+		{"plain dump in other case", &Profile{BackupDir: "same", EncryptedDir: "SAME", EncryptedName: "Dump-{stamp}.SQL"},
+			"encrypted backup and the plain backup"},
+		{"unclean directory", &Profile{BackupDir: "same", EncryptedDir: "./same/", EncryptedName: "dump-{stamp}.sql"},
+			"encrypted backup and the plain backup"},
+		{"compressed plain dump", &Profile{BackupDir: "same", EncryptedDir: "same", EncryptedName: "dump-{stamp}.sql.gz"},
+			"compressed plain backup and the encrypted backup"},
+		{"archive", &Profile{Type: profileFiles, BackupDir: "same", EncryptedDir: "same", EncryptedName: "files-{stamp}.tar"},
+			"encrypted backup and the plain backup"},
+		{"grants", &Profile{BackupDir: "plain", EncryptedDir: "enc", EncryptedName: "GRANTS-{stamp}-sql.cf", Grants: true},
+			"encrypted backup and the grants"},
+		{"grants not kept", &Profile{BackupDir: "plain", EncryptedDir: "enc", EncryptedName: "grants-{stamp}-sql.cf"}, ""},
+		{"binary logs", &Profile{BackupDir: "plain", EncryptedDir: "enc", EncryptedName: "binlog-{stamp}", Binlog: &BinlogConfig{}},
+			"binary logs and the encrypted backup"},
+		{"inside binary logs", &Profile{BackupDir: nested, EncryptedDir: "same", Binlog: &BinlogConfig{}},
+			"plain backup would be kept inside the binary logs"},
+		{"binary logs inside", &Profile{BackupDir: "plain", EncryptedDir: filepath.Join("plain", "2019-12", "dump-201912311504.sql"),
+			Binlog: &BinlogConfig{}},
+			"binary logs would be kept inside the plain backup"},
+	} {
+		err := tc.p.validateArtifactPaths()
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got %v, want an error with %q", tc.name, err, tc.err)
+		}
+	}
+}
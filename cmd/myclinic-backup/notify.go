@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NotifyConfig tells where the result of a profile's backup is reported.
+type NotifyConfig struct {
+	// Webhook receives the result as JSON in a POST request.
+	Webhook string `yaml:"webhook"`
+	// Line receives a summary of the result in LINE.
+	Line *LineConfig `yaml:"line"`
+	// SMS receives a text message on repeated failures and overdue
+	// backups only.
+	SMS *SMSConfig `yaml:"sms"`
+	// Sinks are further destinations, each with its own severity filter
+	// and rate limit; see pipeline.go.
+	Sinks []*SinkConfig `yaml:"sinks"`
+	// WeeklySummary is when the daemon sends the weekly summary for the
+	// clinic staff, e.g. "0 9 * * 1" for Mondays at nine.
+	WeeklySummary string `yaml:"weekly_summary"`
+
+	// pipeline are the sinks of the destinations above and Sinks, made by
+	// validate.
+	pipeline []*SinkConfig
+}
+
+func (n *NotifyConfig) validate() error {
+	if n.WeeklySummary != "" {
+		_, err := parseSchedule(n.WeeklySummary)
+		if err != nil {
+			return fmt.Errorf("weekly_summary: %v", err)
+		}
+	}
+	n.pipeline = nil
+	if n.Webhook != "" {
+		n.pipeline = append(n.pipeline, &SinkConfig{Type: sinkWebhook, URL: n.Webhook})
+	}
+	if n.Line != nil {
+		n.pipeline = append(n.pipeline, &SinkConfig{Type: sinkLine, Line: n.Line})
+	}
+	if n.SMS != nil {
+		n.pipeline = append(n.pipeline, &SinkConfig{Type: sinkSMS, SMS: n.SMS})
+	}
+	n.pipeline = append(n.pipeline, n.Sinks...)
+	for _, s := range n.pipeline {
+		err := s.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mails reports whether an email sink is configured, which needs smtp.
+func (n *NotifyConfig) mails() bool {
+	for _, s := range n.Sinks {
+		if s.Type == sinkEmail {
+			return true
+		}
+	}
+	return false
+}
+
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+func postJSON(url string, value interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Kinds of events.
+const (
+	eventBackup  = "backup"
+	eventOverdue = "overdue"
+	// eventObjectives reports recovery objectives breached.
+	eventObjectives = "objectives"
+	eventStandby    = "standby"
+	eventSummary    = "summary"
+)
+
+// Event is what is reported to the notification destinations.
+type Event struct {
+	Kind    string `json:"kind"`
+	Profile string `json:"profile"`
+	Success bool   `json:"success"`
+	// Severity is info, warning or critical; see Event.severity.
+	Severity string `json:"severity"`
+	// Failures is how many backups of the profile have failed in a row,
+	// for a failed backup, and Recovered how many had before a backup
+	// succeeding again.
+	Failures  int            `json:"failures,omitempty"`
+	Recovered int            `json:"recovered,omitempty"`
+	Time      time.Time      `json:"time"`
+	Summary   string         `json:"summary"`
+	Result    *ProfileResult `json:"result,omitempty"`
+}
+
+// backupEvent returns the event of the result, which the audit log, where
+// the run is recorded first, tells the failures in a row of.
+func backupEvent(result *ProfileResult) *Event {
+	e := &Event{
+		Kind:    eventBackup,
+		Profile: result.Profile,
+		Success: result.Success,
+		Time:    result.Finished,
+		Result:  result,
+	}
+	if auditLog != nil {
+		var err error
+		e.Failures, e.Recovered, err = auditLog.failureStreaks(result.Profile)
+		if err != nil {
+			fmt.Fprintf(stderr, tr("[%s] audit log: %v\n"), result.Profile, err)
+		}
+	}
+	switch {
+	case result.Success && e.Recovered > 0:
+		e.Summary = trf("backup of %s succeeded again after %d failures", result.Profile, e.Recovered)
+	case result.Success:
+		e.Summary = trf("backup of %s succeeded", result.Profile)
+	case e.Failures > 1:
+		e.Summary = trf("backup of %s failed %d times in a row: %s", result.Profile, e.Failures, result.Error)
+	default:
+		e.Summary = trf("backup of %s failed: %s", result.Profile, result.Error)
+	}
+	return e
+}
+
+// notify passes the event through the pipeline of sinks, going on after a
+// failure so that one broken destination does not silence the others.
+func notify(config NotifyConfig, event *Event) error {
+	if event.Severity == "" {
+		event.Severity = event.severity()
+	}
+	var errs []string
+	for _, s := range config.pipeline {
+		err := s.send(event)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A profile may declare recovery objectives: rpo, how much data the clinic
+// can afford to lose, and rto, how long it can do without the database.
+// The recovery point actually achieved is the age of the newest uploaded
+// backup whose last verification did not fail, and so goes on growing
+// until the next backup is uploaded; the recovery time is that of the
+// latest successful restore drill, downloading, decrypting and loading the
+// backup. An objective no drill has measured counts as breached, since it
+// is not known to be met.
+
+// recoveryPoint returns the newest backup of the profile restorable from
+// S3, or nil if there is none.
+func recoveryPoint(entries []*CatalogEntry, profile string) *CatalogEntry {
+	var newest *CatalogEntry
+	for _, e := range entries {
+		if e.Profile != profile || !e.isDump() || e.S3Key == "" {
+			continue
+		}
+		if n := len(e.Verifications); n > 0 && !e.Verifications[n-1].OK {
+			continue
+		}
+		if newest == nil || e.Time.After(newest.Time) {
+			newest = e
+		}
+	}
+	return newest
+}
+
+// measuredRecovery returns the latest successful restore drill of the
+// profile which measured the recovery time, or nil if there is none.
+func measuredRecovery(entries []*CatalogEntry, profile string) *Verification {
+	var latest *Verification
+	for _, e := range entries {
+		if e.Profile != profile {
+			continue
+		}
+		for _, v := range e.Verifications {
+			if v.Kind == "drill" && v.OK && v.RecoveryTime > 0 && (latest == nil || v.Time.After(latest.Time)) {
+				latest = v
+			}
+		}
+	}
+	return latest
+}
+
+// objectivesStatus is how a profile stands against its objectives.
+type objectivesStatus struct {
+	Profile string
+	// Point is the newest restorable backup, or nil.
+	Point *CatalogEntry
+	// Drill is the latest drill measuring the recovery time, or nil.
+	Drill    *Verification
+	breaches []string
+}
+
+func (s *objectivesStatus) recoveryPoint(now time.Time) time.Duration {
+	return now.Sub(s.Point.Time)
+}
+
+func checkObjectives(entries []*CatalogEntry, p *Profile, now time.Time) *objectivesStatus {
+	s := &objectivesStatus{
+		Profile: p.Name,
+		Point:   recoveryPoint(entries, p.Name),
+		Drill:   measuredRecovery(entries, p.Name),
+	}
+	if p.RPO > 0 {
+		if s.Point == nil {
+			s.breaches = append(s.breaches, tr("RPO: no restorable backup in S3"))
+		} else if age := s.recoveryPoint(now); age > p.RPO {
+			s.breaches = append(s.breaches, trf("RPO: newest restorable backup is %s old, objective %s",
+				age.Round(time.Minute), p.RPO))
+		}
+	}
+	if p.RTO > 0 {
+		if s.Drill == nil {
+			s.breaches = append(s.breaches, tr("RTO: not measured by any restore drill"))
+		} else if s.Drill.RecoveryTime > p.RTO {
+			s.breaches = append(s.breaches, trf("RTO: restore drill of %s took %s, objective %s",
+				s.Drill.Time.Local().Format("2006-01-02"), s.Drill.RecoveryTime.Round(time.Second), p.RTO))
+		}
+	}
+	return s
+}
+
+// objectivesEvent returns an event if the profile breaches its recovery
+// objectives, and nil otherwise.
+func objectivesEvent(p *Profile, now time.Time) (*Event, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	return checkObjectives(entries, p, now).event(now), nil
+}
+
+// event returns the event reporting the breaches, or nil if there are
+// none.
+func (s *objectivesStatus) event(now time.Time) *Event {
+	if len(s.breaches) == 0 {
+		return nil
+	}
+	return &Event{
+		Kind:    eventObjectives,
+		Profile: s.Profile,
+		Time:    now,
+		Summary: trf("recovery objectives of %s breached: %s", s.Profile, strings.Join(s.breaches, "; ")),
+	}
+}
+
+// objectivesCommand prints the recovery point and time of the profiles
+// against their objectives, and like check exits with an error and sends
+// notifications if any is breached.
+func objectivesCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("objectives", flag.ExitOnError)
+	noNotify := flags.Bool("no-notify", false, "does not send notifications of breaches")
+	flags.Parse(args)
+	entries, err := catalog.Entries()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	breached := 0
+	for _, p := range profiles {
+		s := checkObjectives(entries, p, now)
+		fmt.Fprintf(stdout, "%s\n", p.Name)
+		point := tr("none")
+		if s.Point != nil {
+			point = trf("%s (backup of %s)", s.recoveryPoint(now).Round(time.Minute), s.Point.Time.Local().Format("2006-01-02 15:04"))
+		}
+		fmt.Fprintf(stdout, tr("  recovery point: %s, objective %s\n"), point, describeObjective(p.RPO))
+		recovery := tr("not measured")
+		if s.Drill != nil {
+			recovery = trf("%s (drill of %s)", s.Drill.RecoveryTime.Round(time.Second), s.Drill.Time.Local().Format("2006-01-02"))
+		}
+		fmt.Fprintf(stdout, tr("  recovery time: %s, objective %s\n"), recovery, describeObjective(p.RTO))
+		if len(s.breaches) == 0 {
+			continue
+		}
+		breached++
+		for _, b := range s.breaches {
+			fmt.Fprintf(stdout, tr("  BREACHED %s\n"), b)
+		}
+		if *noNotify {
+			continue
+		}
+		err = notify(p.Notify, s.event(now))
+		if err != nil {
+			fmt.Fprintf(stderr, tr("%s: notification failed: %v\n"), p.Name, err)
+		}
+	}
+	if breached > 0 {
+		return fmt.Errorf("%d profile(s) breach their recovery objectives", breached)
+	}
+	return nil
+}
+
+func describeObjective(d time.Duration) string {
+	if d == 0 {
+		return tr("not set")
+	}
+	return d.String()
+}
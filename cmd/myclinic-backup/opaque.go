@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Object names such as clinic/2019-12/dump-201912311504-sql.cf tell anyone
+// who can list the bucket when and how often the clinic is backed up, and
+// with grants and put what else is kept. With opaque_names the objects of
+// a profile are stored directly under its prefix by names derived with
+// HMAC-SHA256 from what they would be called otherwise, and the true names
+// are kept only in the catalog and in a manifest in the bucket, encrypted
+// like the backups and itself stored under an opaque name. Listings of
+// the bucket read the manifest to know the backups. The names are derived
+// with a key of their own, which is derived from the key_file of the
+// profile, so that no further key needs to be kept safe.
+//
+// The manifest is rewritten after each run from the catalog and, unless
+// the credentials are write_only, the manifest it replaces, keeping the
+// objects still in the bucket. Machines sharing a prefix need
+// s3_key_instance to keep their manifests apart.
+
+// manifestName is the true name of the manifest.
+const manifestName = "manifest"
+
+// nameKey returns the key deriving opaque names.
+func (p *Profile) nameKey() ([]byte, error) {
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("myclinic-backup object names"))
+	return m.Sum(nil), nil
+}
+
+func opaqueKey(p *Profile, nameKey []byte, name string) string {
+	m := hmac.New(sha256.New, nameKey)
+	m.Write([]byte(name))
+	return normalizePrefix(p.s3KeyPrefix()) + hex.EncodeToString(m.Sum(nil)[:20])
+}
+
+// objectKey returns the key the object named name is stored under: name
+// itself, or with opaque_names the name derived from it.
+func (p *Profile) objectKey(name string) (string, error) {
+	if !p.OpaqueNames {
+		return name, nil
+	}
+	nameKey, err := p.nameKey()
+	if err != nil {
+		return "", err
+	}
+	return opaqueKey(p, nameKey, name), nil
+}
+
+// objectName returns the true name of the encrypted file if it is stored
+// under an opaque name, for ObjectName.
+func (p *Profile) objectName(encryptedFile string) string {
+	if !p.OpaqueNames {
+		return ""
+	}
+	return createS3Key(p.s3KeyPrefix(), encryptedFile)
+}
+
+// manifestKey returns the key of the manifest of the profile.
+func (p *Profile) manifestKey() (string, error) {
+	nameKey, err := p.nameKey()
+	if err != nil {
+		return "", err
+	}
+	return opaqueKey(p, nameKey, manifestName), nil
+}
+
+// readManifest returns the entries of the manifest of the profile, or nil
+// if there is none yet.
+func (p *Profile) readManifest(sess *session.Session) ([]*CatalogEntry, error) {
+	mkey, err := p.manifestKey()
+	if err != nil {
+		return nil, err
+	}
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	enc, err := downloadFromS3(sess, p.S3Bucket, mkey)
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest: %v", err)
+	}
+	return openManifest(key, enc)
+}
+
+// sealManifest returns the manifest of entries, encrypted with key.
+func sealManifest(key []byte, entries []*CatalogEntry) ([]byte, error) {
+	src, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	return compressAndEncrypt(key, src)
+}
+
+// openManifest returns the entries of the manifest sealed by sealManifest.
+func openManifest(key []byte, enc []byte) ([]*CatalogEntry, error) {
+	src, err := decryptBackup(key, enc)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: %v", err)
+	}
+	var entries []*CatalogEntry
+	err = json.Unmarshal(src, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: %v", err)
+	}
+	return entries, nil
+}
+
+// manifestEntry returns what the manifest records of the catalog entry:
+// what listings of the bucket would tell without opaque names.
+func manifestEntry(e *CatalogEntry) *CatalogEntry {
+	return &CatalogEntry{RunID: e.RunID, Profile: e.Profile, Kind: e.Kind, Name: e.Name, Time: e.Time,
+		S3Bucket: e.S3Bucket, S3Key: e.S3Key, ObjectName: e.ObjectName, EncryptedSize: e.EncryptedSize,
+		Instance: e.Instance}
+}
+
+// updateManifest rewrites the manifest of the profile with the objects of
+// the catalog stored under opaque names.
+func (p *Profile) updateManifest() error {
+	sess, err := p.uploadSession()
+	if err != nil {
+		return fmt.Errorf("cannot create AWS session: %v", err)
+	}
+	byKey := make(map[string]*CatalogEntry)
+	if !p.WriteOnly {
+		old, err := p.readManifest(sess)
+		if err != nil {
+			return err
+		}
+		for _, e := range old {
+			byKey[e.S3Key] = e
+		}
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Profile == p.Name && e.S3Bucket == p.S3Bucket && e.ObjectName != "" {
+			byKey[e.S3Key] = manifestEntry(e)
+		}
+	}
+	if !p.WriteOnly {
+		stored := make(map[string]bool)
+		err = s3.New(sess).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(p.S3Bucket),
+			Prefix: aws.String(normalizePrefix(p.s3KeyPrefix())),
+		}, func(page *s3.ListObjectsV2Output, last bool) bool {
+			for _, obj := range page.Contents {
+				stored[aws.StringValue(obj.Key)] = true
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("cannot list bucket: %v", err)
+		}
+		for k := range byKey {
+			if !stored[k] {
+				delete(byKey, k)
+			}
+		}
+	}
+	var list []*CatalogEntry
+	for _, e := range byKey {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.Before(list[j].Time) || list[i].Time.Equal(list[j].Time) && list[i].S3Key < list[j].S3Key
+	})
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	enc, err := sealManifest(key, list)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "manifest-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(enc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	mkey, err := p.manifestKey()
+	if err != nil {
+		return err
+	}
+	return uploadToS3(sess, p.S3Bucket, mkey, f.Name(), p.WriteOnly)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// testKeyFile writes a key file of the byte b repeated, returning its
+// path.
+func testKeyFile(t *testing.T, dir string, b byte) string {
+	t.Helper()
+	path := filepath.Join(dir, hex.EncodeToString([]byte{b})+".key")
+	err := ioutil.WriteFile(path, []byte(hex.EncodeToString(bytes.Repeat([]byte{b}, 32))+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A backup stored under an opaque name is found again from the catalog
+// and from the manifest: the true name they record derives the key the
+// object is stored under.
+func TestOpaqueNameRoundTrip(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	p := &Profile{Name: "clinic", S3Bucket: "backups", S3Prefix: "clinic", OpaqueNames: true,
+		KeyFile: testKeyFile(t, dir, 1)}
+	encryptedFile := filepath.Join(dir, "2019-12", "dump-201912311504-sql.cf")
+
+	// As a run records the backup.
+	s3Key, err := p.objectKey(createS3Key(p.s3KeyPrefix(), encryptedFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &CatalogEntry{RunID: "run", Profile: p.Name, Time: time.Date(2019, 12, 31, 15, 4, 0, 0, time.UTC),
+		S3Bucket: p.S3Bucket, S3Key: s3Key, ObjectName: p.objectName(encryptedFile)}
+	if e.ObjectName != "clinic/2019-12/dump-201912311504-sql.cf" {
+		t.Errorf("object name %s", e.ObjectName)
+	}
+	if !strings.HasPrefix(s3Key, "clinic/") || strings.ContainsAny(strings.TrimPrefix(s3Key, "clinic/"), "/-.") ||
+		strings.Contains(s3Key, "2019") {
+		t.Errorf("key %s is not opaque", s3Key)
+	}
+	if key, err := p.objectKey(e.ObjectName); err != nil || key != s3Key {
+		t.Errorf("object name derives %s, %v; stored as %s", key, err, s3Key)
+	}
+	other := *p
+	other.KeyFile = testKeyFile(t, dir, 2)
+	if key, _ := other.objectKey(e.ObjectName); key == s3Key {
+		t.Error("another key derives the same name")
+	}
+
+	// The manifest in the bucket gives the true name of the object.
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealManifest(key, []*CatalogEntry{manifestEntry(e)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkey, err := p.manifestKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeS3{objects: map[string][]byte{"/backups/" + mkey: sealed}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("ap-northeast-1"),
+		Endpoint:         aws.String(srv.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := p.readManifest(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].S3Key != s3Key || entries[0].ObjectName != e.ObjectName || !entries[0].Time.Equal(e.Time) {
+		t.Fatalf("manifest holds %+v", entries)
+	}
+	// Under another key the manifest is under another name.
+	if entries, err := other.readManifest(sess); entries != nil || err != nil {
+		t.Errorf("another key found a manifest: %v, %v", entries, err)
+	}
+	if _, err := openManifest(bytes.Repeat([]byte{2}, 32), sealed); err == nil {
+		t.Error("manifest opened with another key")
+	}
+}
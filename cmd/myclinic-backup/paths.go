@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	appName          = "myclinic-backup"
+	configFileEnvVar = "MYCLINIC_BACKUP_CONFIG"
+	stateDirEnvVar   = "MYCLINIC_BACKUP_STATE_DIR"
+)
+
+// defaultConfigFile returns the configuration file used when -config is not
+// given: $MYCLINIC_BACKUP_CONFIG, or config.yaml in the platform's user
+// configuration directory (~/.config/myclinic-backup, %AppData%\myclinic-backup)
+// if it exists. It returns "" if there is none.
+func defaultConfigFile() string {
+	if path := os.Getenv(configFileEnvVar); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(dir, appName, "config.yaml")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// defaultStateDir returns the platform's directory for persistent state:
+// $XDG_STATE_HOME/myclinic-backup (~/.local/state/myclinic-backup) on Unix,
+// %LocalAppData%\myclinic-backup on Windows and
+// ~/Library/Application Support/myclinic-backup on macOS.
+func defaultStateDir() (string, error) {
+	switch runtime.GOOS {
+	case "windows":
+		dir := os.Getenv("LocalAppData")
+		if dir == "" {
+			return "", fmt.Errorf("%%LocalAppData%% is not defined")
+		}
+		return filepath.Join(dir, appName), nil
+	case "darwin":
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, appName), nil
+	default:
+		if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+			return filepath.Join(dir, appName), nil
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, ".local", "state", appName), nil
+	}
+}
+
+// resolveStateDir applies -state-dir, $MYCLINIC_BACKUP_STATE_DIR, the
+// state_dir of the configuration, and the platform default in this order.
+func resolveStateDir(configured string) (string, error) {
+	if *stateDirFlag != "" {
+		return *stateDirFlag, nil
+	}
+	if dir := os.Getenv(stateDirEnvVar); dir != "" {
+		return dir, nil
+	}
+	if configured != "" {
+		return configured, nil
+	}
+	return defaultStateDir()
+}
+
+func (c *Config) catalogPath() string {
+	return filepath.Join(c.StateDir, "catalog.json")
+}
+
+func (c *Config) logDir() string {
+	return filepath.Join(c.StateDir, "logs")
+}
+
+// Output of the tool. openLog makes these also write to the log file.
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// timestampWriter prefixes every write with the current time. Each write is
+// expected to be a whole line.
+type timestampWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := fmt.Fprintf(t.w, "%s %s", time.Now().Format("2006-01-02 15:04:05"), p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// openLog appends the output of the tool to myclinic-backup.log in the log
+// directory.
+func openLog(dir string) (io.Closer, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, appName+".log"),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	tw := &timestampWriter{w: f}
+	stdout = io.MultiWriter(os.Stdout, tw)
+	stderr = io.MultiWriter(os.Stderr, tw)
+	return f, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pickerSize is how many recent backups restore -pick offers.
+const pickerSize = 20
+
+// errPickCanceled is returned when the operator leaves the picker without
+// choosing.
+var errPickCanceled = errors.New("canceled")
+
+// restoreCandidates returns the uploaded dumps of the profile in the
+// catalog, newest first, at most pickerSize of them.
+func restoreCandidates(p *Profile) ([]*CatalogEntry, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*CatalogEntry
+	for _, e := range entries {
+		if e.Profile == p.Name && e.isDump() && e.S3Key != "" {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no uploaded backup of profile %s in catalog", p.Name)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Time.After(candidates[j].Time) })
+	if len(candidates) > pickerSize {
+		candidates = candidates[:pickerSize]
+	}
+	return candidates, nil
+}
+
+// pickerLine describes a backup in the picker. The weekday is there so
+// that the day meant is easy to tell from its neighbours.
+func pickerLine(e *CatalogEntry) string {
+	t := e.Time.Local()
+	return fmt.Sprintf("%s (%s) %s  %10s  %s%s", t.Format("2006-01-02"), tr(t.Format("Mon")), t.Format("15:04"),
+		formatBytes(e.Size), verificationSummary(e), labelSummary(e))
+}
+
+// picker lets the operator choose one of the recent backups of a profile
+// before a restore. In a terminal it is driven with the arrow keys;
+// elsewhere a number is typed.
+type picker struct {
+	in *bufio.Reader
+}
+
+func newPicker() *picker {
+	return &picker{in: bufio.NewReader(os.Stdin)}
+}
+
+// pick returns the backup chosen, or errPickCanceled.
+func (k *picker) pick(p *Profile) (*CatalogEntry, error) {
+	candidates, err := restoreCandidates(p)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, len(candidates))
+	for i, e := range candidates {
+		lines[i] = pickerLine(e)
+	}
+	fmt.Fprintf(stdout, tr("Backups of %s, newest first:\n"), p.Name)
+	var i int
+	restoreTerminal, err := rawTerminal()
+	if err == nil {
+		i, err = k.pickWithKeys(lines)
+		restoreTerminal()
+	} else {
+		i, err = k.pickByNumber(lines)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(stdout, tr("chosen: %s\n"), lines[i])
+	return candidates[i], nil
+}
+
+// pickWithKeys draws the lines with a cursor moved by the arrow keys, or
+// j and k, and returns the index of the line chosen with Enter. The
+// terminal must be in raw mode. Redrawing goes to the terminal rather than
+// stdout, so that it is not copied to the log.
+func (k *picker) pickWithKeys(lines []string) (int, error) {
+	out := os.Stdout
+	fmt.Fprintf(out, tr("↑↓ to move, Enter to choose, q to cancel\r\n"))
+	cursor := 0
+	draw := func() {
+		for i, line := range lines {
+			if i == cursor {
+				fmt.Fprintf(out, "\x1b[7m > %s\x1b[0m\x1b[K\r\n", line)
+			} else {
+				fmt.Fprintf(out, "   %s\x1b[K\r\n", line)
+			}
+		}
+	}
+	draw()
+	for {
+		c, err := k.in.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case '\r', '\n':
+			return cursor, nil
+		case 'q', 'Q', 3, 4: // Ctrl-C and Ctrl-D do not signal in raw mode
+			return 0, errPickCanceled
+		case 'k':
+			c = 'A'
+		case 'j':
+			c = 'B'
+		case 0x1b:
+			// Arrow keys send ESC [ A and ESC [ B, or ESC O A and ESC O B.
+			next, err := k.in.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			if next != '[' && next != 'O' {
+				continue
+			}
+			c, err = k.in.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+		default:
+			continue
+		}
+		switch {
+		case c == 'A' && cursor > 0:
+			cursor--
+		case c == 'B' && cursor < len(lines)-1:
+			cursor++
+		default:
+			continue
+		}
+		fmt.Fprintf(out, "\x1b[%dA", len(lines))
+		draw()
+	}
+}
+
+// pickByNumber lists the lines numbered and reads the number of the one
+// chosen, for input which is not a terminal.
+func (k *picker) pickByNumber(lines []string) (int, error) {
+	for i, line := range lines {
+		fmt.Fprintf(stdout, "  %3d  %s\n", i+1, line)
+	}
+	for {
+		answer, err := k.ask("Number of the backup to restore (q to cancel): ")
+		if err != nil {
+			return 0, err
+		}
+		if answer == "q" {
+			return 0, errPickCanceled
+		}
+		n, err := strconv.Atoi(answer)
+		if err == nil && n >= 1 && n <= len(lines) {
+			return n - 1, nil
+		}
+		fmt.Fprintf(stdout, tr("Enter a number from 1 to %d.\n"), len(lines))
+	}
+}
+
+// ask prints the prompt and returns the answer without surrounding space.
+func (k *picker) ask(format string, args ...interface{}) (string, error) {
+	fmt.Fprintf(stdout, tr(format), args...)
+	line, err := k.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// confirm asks the operator to type yes before restoring the chosen
+// backup over target.
+func (k *picker) confirm(e *CatalogEntry, target string) (bool, error) {
+	answer, err := k.ask(tr("Restore the backup taken %s into %s?")+tr(" Type yes to continue: "),
+		e.Time.Local().Format("2006-01-02 15:04"), target)
+	return answer == "yes", err
+}
+
+// restoreTarget describes where restore puts the backup of the profile.
+func restoreTarget(p *Profile, targetDB string, targetDir string) string {
+	switch {
+	case p.isFiles():
+		return targetDir
+	case p.isMultiDatabase():
+		return strings.Join(p.Databases, ", ")
+	case targetDB != "":
+		return targetDB
+	}
+	return p.databases()[0]
+}
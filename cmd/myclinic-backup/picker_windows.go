@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32           = syscall.NewLazyDLL("kernel32.dll")
+	procGetConsoleMode = kernel32.NewProc("GetConsoleMode")
+	procSetConsoleMode = kernel32.NewProc("SetConsoleMode")
+)
+
+// Console modes, from wincon.h.
+const (
+	enableProcessedInput            = 0x0001
+	enableLineInput                 = 0x0002
+	enableEchoInput                 = 0x0004
+	enableVirtualTerminalInput      = 0x0200
+	enableVirtualTerminalProcessing = 0x0004
+)
+
+func getConsoleMode(f *os.File) (uint32, error) {
+	var mode uint32
+	r, _, err := procGetConsoleMode.Call(f.Fd(), uintptr(unsafe.Pointer(&mode)))
+	if r == 0 {
+		return 0, err
+	}
+	return mode, nil
+}
+
+func setConsoleMode(f *os.File, mode uint32) error {
+	r, _, err := procSetConsoleMode.Call(f.Fd(), uintptr(mode))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// rawTerminal makes the console deliver keys as they are pressed, with
+// the arrow keys as the escape sequences of other terminals, and interpret
+// such sequences in output. It returns a function which restores the
+// console, and fails if stdin or stdout is not a console or the console
+// is too old for escape sequences.
+func rawTerminal() (func(), error) {
+	inMode, err := getConsoleMode(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	outMode, err := getConsoleMode(os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	err = setConsoleMode(os.Stdout, outMode|enableVirtualTerminalProcessing)
+	if err != nil {
+		return nil, err
+	}
+	raw := inMode&^(enableProcessedInput|enableLineInput|enableEchoInput) | enableVirtualTerminalInput
+	err = setConsoleMode(os.Stdin, raw)
+	if err != nil {
+		setConsoleMode(os.Stdout, outMode)
+		return nil, err
+	}
+	return func() {
+		setConsoleMode(os.Stdin, inMode)
+		setConsoleMode(os.Stdout, outMode)
+	}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sinks of type ping report backups to a monitor which expects a ping
+// after each, such as healthchecks.io, Cronitor or Uptime Kuma, and raises
+// the alarm itself when a ping says the backup failed or none comes at
+// all, which catches the runs that never got as far as notifying. Sinks of
+// type slack post the summaries to a Slack incoming webhook.
+
+// pingURL returns where the ping for the backup event goes: the URL of the
+// sink, or for a failure fail_url, by default the URL followed by /fail as
+// healthchecks.io expects.
+func (s *SinkConfig) pingURL(event *Event) string {
+	switch {
+	case event.Success:
+		return s.URL
+	case s.FailURL != "":
+		return s.FailURL
+	}
+	return strings.TrimSuffix(s.URL, "/") + "/fail"
+}
+
+// ping pings the monitor of the sink about a backup, with the details of
+// the result as the body, which healthchecks.io shows as the log of the
+// ping. Other events are not pinged.
+func (s *SinkConfig) ping(event *Event) error {
+	if event.Kind != eventBackup {
+		return nil
+	}
+	url := s.pingURL(event)
+	resp, err := notifyClient.Post(url, "text/plain; charset=utf-8", strings.NewReader(eventDetails(event)))
+	if err != nil {
+		return fmt.Errorf("ping: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return nil
+}
+
+// eventDetails is the summary of the event followed by how long the
+// backup took, how large it is and where it is stored.
+func eventDetails(event *Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", event.Summary)
+	if r := event.Result; r != nil {
+		fmt.Fprintf(&b, tr("Duration: %s\n"), r.Finished.Sub(r.Started).Round(time.Second))
+		if r.Size > 0 {
+			fmt.Fprintf(&b, tr("Size: %s\n"), formatBytes(r.Size))
+		}
+		if r.S3Key != "" {
+			fmt.Fprintf(&b, tr("Key: %s\n"), r.S3Key)
+		}
+	}
+	return b.String()
+}
+
+// sendSlack posts the event to the Slack incoming webhook of the sink.
+func (s *SinkConfig) sendSlack(event *Event) error {
+	mark := ":white_check_mark:"
+	if !event.Success {
+		mark = ":warning:"
+	}
+	err := postJSON(s.URL, map[string]string{"text": mark + " " + eventDetails(event)})
+	if err != nil {
+		return fmt.Errorf("slack: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifications go through a pipeline of sinks, each with the least
+// severity of the events it is sent and a limit on how many it sends in an
+// hour, so that mail can get everything, a webhook everything as JSON and
+// text messages only what is critical, and a profile failing over and over
+// does not flood anyone. A sink may also be a contact escalated to, who
+// hears of a profile failing only once it has failed several times in a
+// row, again as the failures go on, ever less often, and of it working
+// again. The webhook, line and sms settings of notify are sinks too,
+// sending what they always did. Rate limits are kept by the process, which
+// for the daemon is as long as it runs.
+
+// Severities of events, in increasing order.
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+var severityRank = map[string]int{severityInfo: 1, severityWarning: 2, severityCritical: 3}
+
+// criticalFailures is how many backups of a profile failing in a row make
+// the failure critical.
+const criticalFailures = 3
+
+// Types of sinks.
+const (
+	sinkWebhook = "webhook"
+	sinkEmail   = "email"
+	sinkLine    = "line"
+	sinkSMS     = "sms"
+	sinkSlack   = "slack"
+	sinkPing    = "ping"
+)
+
+// notifySMTP is the mail server of email sinks.
+var notifySMTP *SMTPConfig
+
+// SinkConfig is one destination of notifications.
+type SinkConfig struct {
+	// Type is webhook, email, line, sms, slack or ping; see ping.go for
+	// the last two.
+	Type string `yaml:"type"`
+	// MinSeverity is the least severity of the events sent: info
+	// (default), warning or critical. An sms sink without it sends what
+	// its settings find critical, as notify.sms does.
+	MinSeverity string `yaml:"min_severity"`
+	// RateLimit is the most events sent in an hour (0 does not limit).
+	RateLimit int `yaml:"rate_limit"`
+	// EscalateAfter makes the sink a contact escalated to: of failed
+	// backups it is sent only the EscalateAfter-th in a row, and then the
+	// 2×, 4×, ... EscalateAfter-th, and of successful ones only the one
+	// ending those failures.
+	EscalateAfter int `yaml:"escalate_after"`
+	// URL is where a webhook sink posts the events as JSON, the incoming
+	// webhook of a slack sink or what a ping sink pings.
+	URL string `yaml:"url"`
+	// FailURL is what a ping sink pings for failures (default URL/fail).
+	FailURL string `yaml:"fail_url"`
+	// To are the addresses of an email sink.
+	To []string `yaml:"to"`
+	// Line and SMS are the settings of line and sms sinks.
+	Line *LineConfig `yaml:"line"`
+	SMS  *SMSConfig  `yaml:"sms"`
+
+	mu sync.Mutex
+	// sent are the times of the events sent in the last hour.
+	sent []time.Time
+}
+
+func (s *SinkConfig) validate() error {
+	if s.MinSeverity != "" && severityRank[s.MinSeverity] == 0 {
+		return fmt.Errorf("sink %s: min_severity must be %s, %s or %s", s.Type, severityInfo, severityWarning, severityCritical)
+	}
+	if s.RateLimit < 0 || s.EscalateAfter < 0 {
+		return fmt.Errorf("sink %s: rate_limit and escalate_after must not be negative", s.Type)
+	}
+	switch s.Type {
+	case sinkWebhook, sinkSlack, sinkPing:
+		if s.URL == "" {
+			return fmt.Errorf("sink %s: url is required", s.Type)
+		}
+	case sinkEmail:
+		if len(s.To) == 0 {
+			return fmt.Errorf("sink email: to is required")
+		}
+	case sinkLine:
+		if s.Line == nil {
+			return fmt.Errorf("sink line: line is required")
+		}
+		return s.Line.validate()
+	case sinkSMS:
+		if s.SMS == nil {
+			return fmt.Errorf("sink sms: sms is required")
+		}
+		return s.SMS.validate()
+	default:
+		return fmt.Errorf("sink type must be %s, %s, %s, %s, %s or %s: %q", sinkWebhook, sinkEmail, sinkLine, sinkSMS,
+			sinkSlack, sinkPing, s.Type)
+	}
+	return nil
+}
+
+// severity returns how urgently the event needs attention. A backup
+// succeeding again has the severity of the failures it ends, so that it
+// reaches those told of them.
+func (e *Event) severity() string {
+	switch {
+	case e.Kind == eventOverdue || e.Kind == eventObjectives:
+		return severityCritical
+	case e.Kind == eventBackup && e.Success && e.Recovered > 0:
+		return failureSeverity(e.Recovered)
+	case e.Success:
+		return severityInfo
+	case e.Kind == eventBackup:
+		return failureSeverity(e.Failures)
+	}
+	return severityWarning
+}
+
+func failureSeverity(failures int) string {
+	if failures >= criticalFailures {
+		return severityCritical
+	}
+	return severityWarning
+}
+
+// escalates reports whether the failures-th failure in a row is escalated
+// to a sink escalated to after after failures.
+func escalates(failures int, after int) bool {
+	for n := after; n <= failures; n *= 2 {
+		if n == failures {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts reports whether the event passes the escalation and severity
+// filters of the sink.
+func (s *SinkConfig) accepts(event *Event) bool {
+	if s.EscalateAfter > 0 && event.Kind == eventBackup {
+		if event.Success && event.Recovered < s.EscalateAfter {
+			return false
+		}
+		if !event.Success && !escalates(event.Failures, s.EscalateAfter) {
+			return false
+		}
+	}
+	if s.Type == sinkSMS && s.MinSeverity == "" {
+		return s.SMS.critical(event)
+	}
+	min := s.MinSeverity
+	if min == "" {
+		min = severityInfo
+	}
+	return severityRank[event.Severity] >= severityRank[min]
+}
+
+// allow reports whether the rate limit lets another event be sent now,
+// and counts it if so.
+func (s *SinkConfig) allow(now time.Time) bool {
+	if s.RateLimit == 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recent := s.sent[:0]
+	for _, t := range s.sent {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	s.sent = recent
+	if len(s.sent) >= s.RateLimit {
+		return false
+	}
+	s.sent = append(s.sent, now)
+	return true
+}
+
+// send passes the event to the destination if the filter and the rate
+// limit of the sink let it.
+func (s *SinkConfig) send(event *Event) error {
+	if !s.accepts(event) {
+		return nil
+	}
+	if !s.allow(time.Now()) {
+		fmt.Fprintf(stderr, tr("[%s] %s notification dropped by rate_limit: %s\n"), event.Profile, s.Type, event.Summary)
+		return nil
+	}
+	switch s.Type {
+	case sinkWebhook:
+		return postJSON(s.URL, event)
+	case sinkEmail:
+		return sendEventMail(s.To, event)
+	case sinkLine:
+		return s.Line.send(event)
+	case sinkSMS:
+		return s.SMS.send(event)
+	case sinkSlack:
+		return s.sendSlack(event)
+	case sinkPing:
+		return s.ping(event)
+	}
+	return nil
+}
+
+// sendEventMail mails the event, by default with its summary as the
+// subject.
+func sendEventMail(to []string, event *Event) error {
+	subject := renderText(templateEmailSubject, event, "[myclinic-backup] "+event.Summary)
+	if i := strings.IndexByte(strings.TrimSpace(subject), '\n'); i >= 0 {
+		subject = strings.TrimSpace(subject)[:i]
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s\n\n", event.Summary)
+	fmt.Fprintf(&body, tr("Profile: %s\n"), event.Profile)
+	fmt.Fprintf(&body, tr("Time: %s\n"), event.Time.Local().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&body, tr("Severity: %s\n"), tr(event.Severity))
+	err := sendMailHTML(notifySMTP, to, strings.TrimSpace(subject), renderText(templateEmailBody, event, body.String()),
+		renderEmailHTML(event))
+	if err != nil {
+		return fmt.Errorf("email: %v", err)
+	}
+	return nil
+}
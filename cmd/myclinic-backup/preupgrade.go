@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// preUpgradeCommand is called by the myclinic upgrade script before it
+// changes anything. It backs up the selected profiles with a label,
+// confirms that each backup is in S3 and verifies it by downloading it.
+// Any failure makes it return an error, and so exit non-zero, and the
+// script must not go on with the upgrade.
+func preUpgradeCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("pre-upgrade", flag.ExitOnError)
+	label := flags.String("label", "", "label recorded with the backups (default pre-upgrade-YYYYMMDD-HHMM)")
+	note := flags.String("note", "", "note recorded with the backups, e.g. the version upgraded to")
+	deep := flags.Bool("deep", false, "also verifies by loading each backup into a temporary database")
+	flags.Parse(args)
+	if *dryRun {
+		return fmt.Errorf("pre-upgrade cannot be run with -dry-run")
+	}
+	now := time.Now()
+	if *label == "" {
+		*label = "pre-upgrade-" + now.Format("20060102-1504")
+	}
+	err := validateLabel(*label)
+	if err != nil {
+		return err
+	}
+	// An interrupted earlier run would be finished with its old dump,
+	// while the backup must be of the database as it is now.
+	*noResume = true
+	applyResourceLimits(config)
+	results := runProfiles(config, profiles, newLimiter(config.Workers), runOptions{
+		now:       now,
+		trigger:   triggerPreUpgrade,
+		label:     *label,
+		note:      *note,
+		labelled:  len(profiles) > 1,
+		transfers: newLimiter(config.TransferWorkers),
+	})
+	var failed []string
+	for i, result := range results {
+		p := profiles[i]
+		if !result.Success {
+			failed = append(failed, fmt.Sprintf("%s: %s", p.Name, result.Error))
+			continue
+		}
+		e, err := findEntry(p, result.RunID)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", p.Name, err))
+			continue
+		}
+		fmt.Fprintf(stdout, tr("verifying %s\n"), entryLocation(e))
+		v := &Verification{Time: time.Now(), Kind: "verify", Deep: *deep}
+		err = verifyEntry(p, e, *deep)
+		if err != nil {
+			v.Error = redactError(err)
+			failed = append(failed, fmt.Sprintf("%s: verification failed: %v", p.Name, err))
+		} else {
+			v.OK = true
+		}
+		if rerr := recordVerification(e, v); rerr != nil {
+			fmt.Fprintf(stderr, tr("cannot record verification: %v\n"), rerr)
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(stderr, tr("\nPRE-UPGRADE BACKUP FAILED. Do not proceed with the upgrade.\n"))
+		for _, f := range failed {
+			fmt.Fprintf(stderr, "  %s\n", f)
+		}
+		return fmt.Errorf("no verified backup for %d profile(s)", len(failed))
+	}
+	fmt.Fprintf(stdout, tr("pre-upgrade backup %s is uploaded and verified; the upgrade may proceed\n"), *label)
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	createTablePattern = regexp.MustCompile("^CREATE TABLE `((?:[^`]|``)+)`")
+	usePattern         = regexp.MustCompile("^USE `((?:[^`]|``)+)`;$")
+)
+
+// dumpSchema reads an SQL dump of one database and returns the CREATE
+// TABLE statement of each table it creates.
+func dumpSchema(r io.Reader) (map[string]string, error) {
+	schemas, err := dumpSchemas(r)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]string)
+	for _, t := range schemas {
+		for name, stmt := range t {
+			tables[name] = stmt
+		}
+	}
+	return tables, nil
+}
+
+// dumpSchemas reads an SQL dump and returns the CREATE TABLE statement of
+// each table it creates by database. A dump of several databases switches
+// between them with USE; the tables of a dump of one are under "".
+func dumpSchemas(r io.Reader) (map[string]map[string]string, error) {
+	schemas := map[string]map[string]string{"": {}}
+	tables := schemas[""]
+	br := bufio.NewReaderSize(r, 64*1024)
+	var current string
+	var stmt strings.Builder
+	for {
+		line, isPrefix, err := br.ReadLine()
+		if err == io.EOF {
+			if len(schemas[""]) == 0 && len(schemas) > 1 {
+				delete(schemas, "")
+			}
+			return schemas, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isPrefix {
+			// Only long INSERT lines exceed the buffer; skip the rest.
+			for isPrefix && err == nil {
+				_, isPrefix, err = br.ReadLine()
+			}
+			continue
+		}
+		s := string(line)
+		if current == "" {
+			if m := usePattern.FindStringSubmatch(s); m != nil {
+				db := strings.Replace(m[1], "``", "`", -1)
+				if schemas[db] == nil {
+					schemas[db] = make(map[string]string)
+				}
+				tables = schemas[db]
+				continue
+			}
+			if m := createTablePattern.FindStringSubmatch(s); m != nil {
+				current = strings.Replace(m[1], "``", "`", -1)
+				stmt.Reset()
+				stmt.WriteString(s)
+			}
+			continue
+		}
+		stmt.WriteString("\n" + s)
+		if strings.HasSuffix(s, ";") {
+			tables[current] = strings.TrimSuffix(stmt.String(), ";")
+			current = ""
+		}
+	}
+}
+
+var autoIncrementPattern = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
+// normalizeCreateTable makes CREATE TABLE statements from a dump and from
+// SHOW CREATE TABLE comparable.
+func normalizeCreateTable(s string) string {
+	s = strings.Replace(s, `\n`, " ", -1)
+	s = autoIncrementPattern.ReplaceAllString(s, "")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// liveSchema returns the CREATE TABLE statement of each table of database,
+// or nil if the database does not exist.
+func liveSchema(p *Profile, database string) (map[string]string, error) {
+	exists, err := mysqlQuery(p, "SELECT COUNT(*) FROM information_schema.schemata WHERE schema_name = "+
+		quoteString(database))
+	if err != nil {
+		return nil, err
+	}
+	if exists == "0" {
+		return nil, nil
+	}
+	names, err := mysqlQuery(p, "SELECT table_name FROM information_schema.tables WHERE table_schema = "+
+		quoteString(database))
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]string)
+	for _, name := range strings.Split(names, "\n") {
+		if name == "" {
+			continue
+		}
+		out, err := mysqlQuery(p, "SHOW CREATE TABLE "+quoteIdent(database)+"."+quoteIdent(name))
+		if err != nil {
+			return nil, err
+		}
+		if i := strings.Index(out, "\t"); i >= 0 {
+			out = out[i+1:]
+		}
+		tables[name] = out
+	}
+	return tables, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// restorePreview reports what restoring the backup into targetDB would
+// do, without changing anything.
+func restorePreview(p *Profile, e *CatalogEntry, targetDB string) error {
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	storage, err := entryStorage(p, e)
+	if err != nil {
+		return err
+	}
+	body, size, err := storage.Get(e.S3Key)
+	if err != nil {
+		return fmt.Errorf("download failed: %v", err)
+	}
+	defer body.Close()
+	plain, err := newDecryptReader(key, newProgressReader(body, stdout, "reading backup", size), true)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	dump, err := dumpSchema(plain)
+	if err != nil {
+		return err
+	}
+	// Reading to the end authenticates the backup.
+	_, err = io.Copy(ioutil.Discard, plain)
+	if err != nil {
+		return err
+	}
+	live, err := liveSchema(p, targetDB)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, tr("Backup: %s\n"), entryLocation(e))
+	fmt.Fprintf(stdout, tr("Taken: %s\n"), e.Time.Format("2006-01-02 15:04"))
+	fmt.Fprintf(stdout, tr("Size: %s (encrypted %s)\n"), formatBytes(e.Size), formatBytes(size))
+	if live == nil {
+		fmt.Fprintf(stdout, tr("Target database: %s (does not exist; will be created)\n"), targetDB)
+	} else {
+		fmt.Fprintf(stdout, tr("Target database: %s (exists, %d tables)\n"), targetDB, len(live))
+	}
+	var create, same, differ, untouched []string
+	for _, name := range sortedKeys(dump) {
+		liveStmt, ok := live[name]
+		switch {
+		case !ok:
+			create = append(create, name)
+		case normalizeCreateTable(liveStmt) == normalizeCreateTable(dump[name]):
+			same = append(same, name)
+		default:
+			differ = append(differ, name)
+		}
+	}
+	for _, name := range sortedKeys(live) {
+		if _, ok := dump[name]; !ok {
+			untouched = append(untouched, name)
+		}
+	}
+	printTableList("Tables to create", create)
+	printTableList("Tables to overwrite (same schema)", same)
+	printTableList("Tables to overwrite (schema differs from live)", differ)
+	printTableList("Live tables not in backup (left as is)", untouched)
+	return nil
+}
+
+func printTableList(title string, names []string) {
+	fmt.Fprintf(stdout, "%s: %d\n", tr(title), len(names))
+	for _, name := range names {
+		fmt.Fprintf(stdout, "  %s\n", name)
+	}
+}
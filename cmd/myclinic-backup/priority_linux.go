@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+const lowNiceness = 19
+
+// lowPriorityCommand runs cmd under nice and idle-class ionice when these
+// are available.
+func lowPriorityCommand(cmd *exec.Cmd) *exec.Cmd {
+	args := cmd.Args
+	if ionice, err := exec.LookPath("ionice"); err == nil {
+		args = append([]string{ionice, "-c", "3"}, args...)
+	}
+	if nice, err := exec.LookPath("nice"); err == nil {
+		args = append([]string{nice, "-n", strconv.Itoa(lowNiceness)}, args...)
+	}
+	low := exec.Command(args[0], args[1:]...)
+	low.Stdout = cmd.Stdout
+	low.Stderr = cmd.Stderr
+	low.Stdin = cmd.Stdin
+	low.Env = cmd.Env
+	low.Dir = cmd.Dir
+	return low
+}
+
+// lowerProcessPriority lowers the scheduling priority of this process. Linux
+// keeps niceness per thread, so every existing thread is reniced; threads
+// created later inherit it.
+func lowerProcessPriority() error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, 0, lowNiceness)
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		err = syscall.Setpriority(syscall.PRIO_PROCESS, tid, lowNiceness)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+const lowNiceness = 19
+
+// lowPriorityCommand runs cmd under nice when it is available.
+func lowPriorityCommand(cmd *exec.Cmd) *exec.Cmd {
+	nice, err := exec.LookPath("nice")
+	if err != nil {
+		return cmd
+	}
+	args := append([]string{nice, "-n", strconv.Itoa(lowNiceness)}, cmd.Args...)
+	low := exec.Command(args[0], args[1:]...)
+	low.Stdout = cmd.Stdout
+	low.Stderr = cmd.Stderr
+	low.Stdin = cmd.Stdin
+	low.Env = cmd.Env
+	low.Dir = cmd.Dir
+	return low
+}
+
+// lowerProcessPriority lowers the scheduling priority of this process.
+func lowerProcessPriority() error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, lowNiceness)
+}
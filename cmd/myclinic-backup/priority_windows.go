@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+const belowNormalPriorityClass = 0x00004000
+
+// lowPriorityCommand starts cmd with below normal priority.
+func lowPriorityCommand(cmd *exec.Cmd) *exec.Cmd {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= belowNormalPriorityClass
+	return cmd
+}
+
+// lowerProcessPriority sets the priority class of this process to below
+// normal.
+func lowerProcessPriority() error {
+	kernel32 := syscall.NewLazyDLL("kernel32.dll")
+	proc, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	r, _, err := kernel32.NewProc("SetPriorityClass").Call(uintptr(proc), belowNormalPriorityClass)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
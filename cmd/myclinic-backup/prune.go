@@ -0,0 +1,508 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encrypted backups, in encrypted_dir and in the bucket, are kept until
+// the retention policy of the profile expires them:
+//
+//	retention:
+//	  keep_last: 3      the newest backups
+//	  keep_daily: 7     the newest backup of each of the latest 7 days
+//	  keep_weekly: 4    ... of each of the latest 4 weeks
+//	  keep_monthly: 12  ... of each of the latest 12 months
+//	  keep_yearly: 5    ... of each of the latest 5 years
+//	  after_backup: true
+//
+// Days, weeks, months and years count only those having backups, so a
+// long outage does not expire the backups taken before it. A backup kept
+// by any rule is kept, as are held backups and, with keep_labeled, labeled
+// ones. prune deletes the others, with their grants, from the disk and
+// the bucket and drops them from the catalog; with after_backup every
+// successful backup does. Backups the catalog does not record are not
+// touched; catalog import records them. Plain dumps have their own rules,
+// plain_retention and the others.
+//
+// Objects are deleted in batches of up to 1000 keys, at most delete_rate
+// objects a second (0, the default, sets no limit). Each batch is deleted
+// under the lock of the catalog and dropped from it at once, so that a
+// hold placed meanwhile is not missed and an interrupted prune goes on
+// where it stopped when run again. The delete_concurrency workers (default
+// 4) therefore take turns deleting.
+// In a versioned bucket the deletions leave delete markers, and the
+// versions are expired by the lifecycle rule of the bucket.
+
+// RetentionConfig is the retention policy of the encrypted backups of a
+// profile.
+type RetentionConfig struct {
+	KeepLast    int `yaml:"keep_last"`
+	KeepDaily   int `yaml:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly"`
+	KeepYearly  int `yaml:"keep_yearly"`
+	// AfterBackup prunes after every successful backup.
+	AfterBackup bool `yaml:"after_backup"`
+}
+
+func (r *RetentionConfig) validate(p *Profile) error {
+	for _, n := range []int{r.KeepLast, r.KeepDaily, r.KeepWeekly, r.KeepMonthly, r.KeepYearly} {
+		if n < 0 {
+			return fmt.Errorf("retention: the numbers to keep must not be negative")
+		}
+	}
+	if r.KeepLast+r.KeepDaily+r.KeepWeekly+r.KeepMonthly+r.KeepYearly == 0 {
+		return fmt.Errorf("retention keeps no backups; set keep_last or another keep_ rule")
+	}
+	if r.AfterBackup && p.WriteOnly {
+		return fmt.Errorf("retention: after_backup cannot delete with write_only credentials; run prune with -reader-aws-profile")
+	}
+	return nil
+}
+
+// describe tells what the policy keeps.
+func (r *RetentionConfig) describe() string {
+	var rules []string
+	for _, rule := range []struct {
+		n      int
+		format string
+	}{
+		{r.KeepLast, "the newest %d"},
+		{r.KeepDaily, "%d daily"},
+		{r.KeepWeekly, "%d weekly"},
+		{r.KeepMonthly, "%d monthly"},
+		{r.KeepYearly, "%d yearly"},
+	} {
+		if rule.n > 0 {
+			rules = append(rules, trf(rule.format, rule.n))
+		}
+	}
+	return strings.Join(rules, ", ")
+}
+
+// retentionPeriods are the periods the keep_ rules count, by the key of
+// the period of a time.
+var retentionPeriods = []func(t time.Time) string{
+	func(t time.Time) string { return t.Format("2006-01-02") },
+	func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	},
+	func(t time.Time) string { return t.Format("2006-01") },
+	func(t time.Time) string { return t.Format("2006") },
+}
+
+// expiredBackups returns the backups, given newest first, which the policy
+// expires.
+func (r *RetentionConfig) expiredBackups(backups []*CatalogEntry, keepLabeled bool) []*CatalogEntry {
+	limits := []int{r.KeepDaily, r.KeepWeekly, r.KeepMonthly, r.KeepYearly}
+	seen := make([]map[string]bool, len(retentionPeriods))
+	for i := range seen {
+		seen[i] = make(map[string]bool)
+	}
+	var expired []*CatalogEntry
+	for i, e := range backups {
+		keep := i < r.KeepLast || e.Hold != nil || (keepLabeled && e.Label != "")
+		t := e.Time.Local()
+		for j, period := range retentionPeriods {
+			key := period(t)
+			if !seen[j][key] {
+				seen[j][key] = true
+				if len(seen[j]) <= limits[j] {
+					keep = true
+				}
+			}
+		}
+		if !keep {
+			expired = append(expired, e)
+		}
+	}
+	return expired
+}
+
+// expiredEntries returns the entries of the profile which its policy
+// expires: the dumps, oldest first, and the grants and binary logs stored
+// with them.
+func (p *Profile) expiredEntries(entries []*CatalogEntry) []*CatalogEntry {
+	dumps := catalogBackups(entries, p, dateRange{})
+	sort.SliceStable(dumps, func(i, j int) bool { return dumps[i].Time.After(dumps[j].Time) })
+	expired := p.Retention.expiredBackups(dumps, p.KeepLabeled)
+	runs := make(map[string]bool)
+	for _, e := range expired {
+		runs[e.RunID] = true
+	}
+	var result []*CatalogEntry
+	for _, e := range entries {
+		if e.Profile == p.Name && (e.Kind == kindGrants || e.Kind == kindBinlog) && runs[e.RunID] && e.Hold == nil {
+			result = append(result, e)
+		}
+	}
+	for i := len(expired) - 1; i >= 0; i-- {
+		result = append(result, expired[i])
+	}
+	return result
+}
+
+// deleteBatchSize is the most keys DeleteObjects takes.
+const deleteBatchSize = 1000
+
+// defaultDeleteConcurrency is the number of DeleteObjects requests made at
+// once without delete_concurrency.
+const defaultDeleteConcurrency = 4
+
+// rateLimiter spaces out operations to at most rate a second; a nil
+// rateLimiter does not limit.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait waits until n more operations may be done.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(n) * l.interval)
+	l.mu.Unlock()
+	time.Sleep(time.Until(start))
+}
+
+// pruner deletes expired entries and drops them from the catalog.
+type pruner struct {
+	limiter *rateLimiter
+	mu      sync.Mutex
+	total   int
+	deleted int
+	failed  int
+	// skipped counts the entries held since they expired.
+	skipped int
+	// err is the first failure.
+	err error
+}
+
+// deleteEntries deletes the objects and local files of the entries of the
+// profile and drops them from the catalog.
+func deleteEntries(p *Profile, entries []*CatalogEntry) (*pruner, error) {
+	byRoot := make(map[string][]*CatalogEntry)
+	var order []string
+	for _, e := range entries {
+		root := ""
+		if e.S3Key != "" {
+			root = storageRoot(e)
+		}
+		if _, ok := byRoot[root]; !ok {
+			order = append(order, root)
+		}
+		byRoot[root] = append(byRoot[root], e)
+	}
+	storages := make(map[string]Storage)
+	for _, root := range order {
+		if root == "" {
+			continue
+		}
+		var err error
+		storages[root], err = entryStorage(p, byRoot[root][0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	r := &pruner{limiter: newRateLimiter(transfer.deleteRate), total: len(entries)}
+	type batch struct {
+		storage Storage
+		entries []*CatalogEntry
+	}
+	batches := make(chan batch)
+	var wg sync.WaitGroup
+	workers := transfer.deleteConcurrency
+	if workers <= 0 {
+		workers = defaultDeleteConcurrency
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				r.deleteBatch(b.storage, b.entries)
+			}
+		}()
+	}
+	for _, root := range order {
+		list := byRoot[root]
+		for len(list) > 0 {
+			n := len(list)
+			if n > deleteBatchSize {
+				n = deleteBatchSize
+			}
+			batches <- batch{storages[root], list[:n]}
+			list = list[n:]
+		}
+	}
+	close(batches)
+	wg.Wait()
+	return r, nil
+}
+
+// storageRoot identifies the bucket, or other storage, of an uploaded
+// entry.
+func storageRoot(e *CatalogEntry) string {
+	if e.Target != "" {
+		return e.Target
+	}
+	return "s3://" + e.S3Bucket
+}
+
+// deleteBatch deletes the objects of the entries, which are in one bucket
+// or other storage, then their local files, and drops those fully deleted
+// from the catalog. Entries which were not uploaded have no storage.
+//
+// The expired entries are found in a copy of the catalog read before
+// pruning, so the batch is deleted under the lock of the catalog, and
+// entries held, or dropped from the catalog, since they expired are
+// skipped: a hold is either placed before and seen here, or finds the
+// entry gone. The batches of the workers are thus deleted one at a time.
+func (r *pruner) deleteBatch(storage Storage, batch []*CatalogEntry) {
+	r.limiter.wait(len(batch))
+	gone := make(map[string]bool)
+	var failures []string
+	skipped := 0
+	err := catalog.Update(func(entries []*CatalogEntry) ([]*CatalogEntry, error) {
+		current := make(map[string]*CatalogEntry)
+		for _, e := range entries {
+			current[e.catalogID()] = e
+		}
+		skipped = 0
+		var todo []*CatalogEntry
+		for _, e := range batch {
+			id := e.catalogID()
+			c, ok := current[id]
+			switch {
+			case gone[id] && ok && c.Hold != nil:
+				// Held on another host, with a catalog in S3, while
+				// this was written: the hold stays in the catalog.
+				delete(gone, id)
+				failures = append(failures, fmt.Sprintf("%s was held while it was deleted", pruneLocation(e)))
+			case gone[id]:
+			case !ok || c.Hold != nil:
+				skipped++
+			default:
+				todo = append(todo, e)
+			}
+		}
+		done, fails := deleteObjects(storage, todo)
+		failures = append(failures, fails...)
+		for _, e := range done {
+			gone[e.catalogID()] = true
+		}
+		kept := entries[:0]
+		for _, e := range entries {
+			if !gone[e.catalogID()] {
+				kept = append(kept, e)
+			}
+		}
+		return kept, nil
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deleted := len(gone)
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("cannot update catalog: %v", err))
+		deleted = 0
+	}
+	r.deleted += deleted
+	r.failed += len(batch) - skipped - deleted
+	r.skipped += skipped
+	if len(failures) > 0 && r.err == nil {
+		r.err = fmt.Errorf("%s", failures[0])
+	}
+	fmt.Fprintf(stdout, tr("deleted %d of %d backups\n"), r.deleted, r.total)
+}
+
+// deleteObjects deletes the objects of the entries from storage, then
+// their local files, and returns the entries fully deleted.
+func deleteObjects(storage Storage, batch []*CatalogEntry) ([]*CatalogEntry, []string) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+	done := make(map[*CatalogEntry]bool)
+	var failures []string
+	if storage == nil {
+		for _, e := range batch {
+			done[e] = true
+		}
+	} else {
+		keys := make([]string, len(batch))
+		for i, e := range batch {
+			keys[i] = e.S3Key
+		}
+		failed, err := storage.Delete(keys)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("cannot delete from %s: %v", storageRoot(batch[0]), err))
+		} else {
+			for _, e := range batch {
+				if msg, ok := failed[e.S3Key]; ok {
+					failures = append(failures, fmt.Sprintf("cannot delete %s: %s", entryLocation(e), msg))
+				} else {
+					done[e] = true
+				}
+			}
+		}
+	}
+	var deleted []*CatalogEntry
+	for _, e := range batch {
+		if !done[e] {
+			continue
+		}
+		if e.EncryptedFile != "" {
+			err := removeMovedFile(e.EncryptedFile)
+			if err != nil && !os.IsNotExist(err) {
+				failures = append(failures, err.Error())
+				continue
+			}
+		}
+		deleted = append(deleted, e)
+	}
+	return deleted, failures
+}
+
+// catalogID identifies the entry among those of the catalog.
+func (e *CatalogEntry) catalogID() string {
+	return strings.Join([]string{e.Profile, e.RunID, e.Kind, e.Name}, "\x00")
+}
+
+// pruneProfile deletes the entries of the profile which its retention
+// policy expires, or with -dry-run lists them, and returns the number
+// deleted, or listed.
+func pruneProfile(p *Profile, prefix string) (int, error) {
+	if p.Retention == nil {
+		return 0, nil
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return 0, err
+	}
+	expired := p.expiredEntries(entries)
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	if *dryRun {
+		for _, e := range expired {
+			fmt.Fprintf(stdout, prefix+tr("would delete %s (taken %s)\n"), pruneLocation(e), e.Time.Format("2006-01-02 15:04"))
+		}
+		return len(expired), nil
+	}
+	r, err := deleteEntries(p, expired)
+	if err != nil {
+		return 0, err
+	}
+	if r.skipped > 0 {
+		fmt.Fprintf(stdout, prefix+tr("kept %d backups held since they expired\n"), r.skipped)
+	}
+	if r.deleted > 0 && p.OpaqueNames && p.S3Bucket != "" {
+		if merr := p.updateManifest(); merr != nil && r.err == nil {
+			r.err = fmt.Errorf("cannot update manifest: %v", merr)
+		}
+	}
+	if r.err != nil {
+		return r.deleted, fmt.Errorf("%d backups not deleted: %v", r.failed, r.err)
+	}
+	return r.deleted, nil
+}
+
+// pruneLocation tells where an expired backup is.
+func pruneLocation(e *CatalogEntry) string {
+	if e.S3Key == "" {
+		return e.EncryptedFile
+	}
+	if e.EncryptedFile == "" {
+		return entryLocation(e)
+	}
+	return e.EncryptedFile + ", " + entryLocation(e)
+}
+
+// pruneBackups prunes after a successful run if the profile asks to.
+func (r *backupRun) pruneBackups() {
+	p := r.profile
+	if p.Retention == nil || !p.Retention.AfterBackup || *dryRun {
+		return
+	}
+	if r.clockOff {
+		r.logf("backups not pruned while the clock is off\n")
+		return
+	}
+	deleted, err := pruneProfile(p, r.prefix)
+	if deleted > 0 {
+		r.logf("pruned %d expired backups\n", deleted)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, tr("%scannot prune expired backups: %v\n"), r.prefix, err)
+	}
+}
+
+// pruneCommand deletes the backups of the selected profiles which their
+// retention policies expire.
+func pruneCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: prune")
+	}
+	pruned := false
+	for _, p := range profiles {
+		if p.Retention == nil {
+			continue
+		}
+		pruned = true
+		fmt.Fprintf(stdout, tr("%s: keeping %s\n"), p.Name, p.Retention.describe())
+		deleted, err := pruneProfile(p, "")
+		rec := &AuditRecord{
+			Time:    time.Now(),
+			RunID:   newRunID(),
+			Profile: p.Name,
+			Trigger: triggerManual,
+			User:    currentUser(),
+			Command: commandLine(),
+			Stages:  []string{"prune"},
+			Outcome: "success",
+		}
+		rec.Host, _ = os.Hostname()
+		if err != nil {
+			rec.Outcome = "failure"
+			rec.Error = redactError(err)
+		}
+		if !*dryRun {
+			if aerr := auditLog.Append(rec); aerr != nil {
+				fmt.Fprintf(stderr, tr("audit log: %v\n"), aerr)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", p.Name, err)
+		}
+		if deleted == 0 {
+			fmt.Fprintf(stdout, tr("%s: no expired backups\n"), p.Name)
+		}
+	}
+	if !pruned {
+		return fmt.Errorf("no retention policy is set for the selected profiles")
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withCatalog replaces the catalog with an empty one in dir, until the
+// function returned is called.
+func withCatalog(dir string) func() {
+	saved := catalog
+	catalog = newCatalog(filepath.Join(dir, "catalog.json"))
+	return func() { catalog = saved }
+}
+
+// storedBackups stores and catalogs the backups "newest", "old" and
+// "older" under store, and returns those expired when the newest is kept.
+func storedBackups(t *testing.T, store string) []*CatalogEntry {
+	t.Helper()
+	p := &Profile{Name: "myclinic", Retention: &RetentionConfig{KeepLast: 1}}
+	now := time.Date(2020, 1, 10, 3, 0, 0, 0, time.Local)
+	for i, id := range []string{"old", "older", "newest"} {
+		e := &CatalogEntry{RunID: id, Profile: p.Name, Time: now.AddDate(0, 0, -[]int{1, 2, 0}[i]),
+			S3Key: id + ".cf", Target: "file://" + filepath.ToSlash(store)}
+		err := os.MkdirAll(store, 0700)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(store, e.S3Key), []byte(id), 0600)
+		}
+		if err == nil {
+			err = catalog.Add(e)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := p.expiredEntries(entries)
+	if len(expired) != 2 {
+		t.Fatalf("%d entries expired, want 2", len(expired))
+	}
+	return expired
+}
+
+// holdBackup holds the backup of the run as hold does, failing if it is
+// no longer in the catalog.
+func holdBackup(runID string) error {
+	return catalog.Update(func(entries []*CatalogEntry) ([]*CatalogEntry, error) {
+		for _, e := range entries {
+			if e.RunID == runID {
+				e.Hold = &Hold{Time: time.Now(), User: "test", Reason: "dispute"}
+				return entries, nil
+			}
+		}
+		return nil, fmt.Errorf("%s deleted meanwhile", runID)
+	})
+}
+
+func TestPruneSkipsHeldSinceExpired(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer withCatalog(dir)()
+	savedOut := stdout
+	stdout = ioutil.Discard
+	defer func() { stdout = savedOut }()
+	store := filepath.Join(dir, "store")
+	expired := storedBackups(t, store)
+
+	// The backup is held once expired, before the batch is deleted.
+	err := holdBackup("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &pruner{total: len(expired)}
+	r.deleteBatch(&fileStorage{dir: store}, expired)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.deleted != 1 || r.skipped != 1 || r.failed != 0 {
+		t.Errorf("deleted %d, skipped %d, failed %d; want 1, 1, 0", r.deleted, r.skipped, r.failed)
+	}
+	if _, err := os.Stat(filepath.Join(store, "old.cf")); err != nil {
+		t.Errorf("held backup deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(store, "older.cf")); !os.IsNotExist(err) {
+		t.Errorf("expired backup not deleted: %v", err)
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.RunID)
+	}
+	if len(ids) != 2 || ids[0] != "old" || ids[1] != "newest" {
+		t.Errorf("catalog has %v, want [old newest]", ids)
+	}
+}
+
+// holdingStorage tries to hold a backup while it deletes.
+type holdingStorage struct {
+	Storage
+	held chan error
+}
+
+func (s *holdingStorage) Delete(keys []string) (map[string]string, error) {
+	go func() { s.held <- holdBackup("old") }()
+	select {
+	case err := <-s.held:
+		s.held <- fmt.Errorf("held while the batch was deleted (%v)", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	return s.Storage.Delete(keys)
+}
+
+func TestPruneHoldWhileDeleting(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer withCatalog(dir)()
+	savedOut := stdout
+	stdout = ioutil.Discard
+	defer func() { stdout = savedOut }()
+	store := filepath.Join(dir, "store")
+	expired := storedBackups(t, store)
+
+	// The hold waits for the batch, and then finds the backup gone rather
+	// than holding a deleted one.
+	s := &holdingStorage{&fileStorage{dir: store}, make(chan error, 1)}
+	r := &pruner{total: len(expired)}
+	r.deleteBatch(s, expired)
+	if r.err != nil || r.deleted != 2 {
+		t.Fatalf("deleted %d: %v", r.deleted, r.err)
+	}
+	if err := <-s.held; err == nil || strings.Contains(err.Error(), "while the batch") {
+		t.Errorf("hold: %v, want the backup gone", err)
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Hold != nil {
+			t.Errorf("deleted backup %s held", e.RunID)
+		}
+	}
+}
+
+func TestExpiredBackups(t *testing.T) {
+	saved := time.Local
+	defer func() { time.Local = saved }()
+	tokyo := time.FixedZone("JST", 9*60*60)
+	ny := newYork(t)
+	for _, tc := range []struct {
+		name        string
+		loc         *time.Location
+		rules       RetentionConfig
+		keepLabeled bool
+		// backups are times, newest first; a suffix of " held" or
+		// " labeled" marks the backup so.
+		backups []string
+		want    string
+	}{
+		{
+			name:    "last",
+			loc:     tokyo,
+			rules:   RetentionConfig{KeepLast: 2},
+			backups: []string{"2020-01-10 03:00 +0900", "2020-01-09 03:00 +0900", "2020-01-08 03:00 +0900"},
+			want:    "2020-01-08 03:00 +0900",
+		},
+		{
+			name:  "daily",
+			loc:   tokyo,
+			rules: RetentionConfig{KeepDaily: 2},
+			backups: []string{"2020-01-10 03:00 +0900", "2020-01-10 01:00 +0900", "2020-01-09 03:00 +0900",
+				"2020-01-08 03:00 +0900"},
+			want: "2020-01-10 01:00 +0900,2020-01-08 03:00 +0900",
+		},
+		{
+			// Days are local: 2019-12-31 20:00 UTC is January 1 in Tokyo.
+			name:    "daily in local time",
+			loc:     tokyo,
+			rules:   RetentionConfig{KeepDaily: 1},
+			backups: []string{"2020-01-01 05:00 +0900", "2019-12-31 20:00 +0000", "2019-12-31 10:00 +0000"},
+			want:    "2019-12-31 20:00 +0000,2019-12-31 10:00 +0000",
+		},
+		{
+			// Monday December 30, 2019 starts week 1 of 2020.
+			name:  "weekly across the year",
+			loc:   tokyo,
+			rules: RetentionConfig{KeepWeekly: 2},
+			backups: []string{"2020-01-02 03:00 +0900", "2019-12-30 03:00 +0900", "2019-12-29 03:00 +0900",
+				"2019-12-22 03:00 +0900"},
+			want: "2019-12-30 03:00 +0900,2019-12-22 03:00 +0900",
+		},
+		{
+			// The months count only those having backups.
+			name:  "monthly with gaps",
+			loc:   tokyo,
+			rules: RetentionConfig{KeepMonthly: 2},
+			backups: []string{"2020-05-10 03:00 +0900", "2020-01-31 03:00 +0900", "2020-01-01 03:00 +0900",
+				"2019-06-01 03:00 +0900"},
+			want: "2020-01-01 03:00 +0900,2019-06-01 03:00 +0900",
+		},
+		{
+			name:  "yearly",
+			loc:   tokyo,
+			rules: RetentionConfig{KeepYearly: 2},
+			backups: []string{"2021-01-01 00:30 +0900", "2020-12-31 23:30 +0900", "2020-06-01 03:00 +0900",
+				"2019-12-31 03:00 +0900"},
+			want: "2020-06-01 03:00 +0900,2019-12-31 03:00 +0900",
+		},
+		{
+			name:  "rules together",
+			loc:   tokyo,
+			rules: RetentionConfig{KeepLast: 1, KeepDaily: 2, KeepMonthly: 2},
+			backups: []string{"2020-03-02 03:00 +0900", "2020-03-02 01:00 +0900", "2020-03-01 03:00 +0900",
+				"2020-02-29 03:00 +0900", "2020-02-28 03:00 +0900", "2020-01-31 03:00 +0900"},
+			want: "2020-03-02 01:00 +0900,2020-02-28 03:00 +0900,2020-01-31 03:00 +0900",
+		},
+		{
+			name:  "held and labeled",
+			loc:   tokyo,
+			rules: RetentionConfig{KeepLast: 1},
+			backups: []string{"2020-01-10 03:00 +0900", "2020-01-09 03:00 +0900 held", "2020-01-08 03:00 +0900 labeled",
+				"2020-01-07 03:00 +0900"},
+			want: "2020-01-08 03:00 +0900,2020-01-07 03:00 +0900",
+		},
+		{
+			name:        "labeled kept",
+			loc:         tokyo,
+			rules:       RetentionConfig{KeepLast: 1},
+			keepLabeled: true,
+			backups: []string{"2020-01-10 03:00 +0900", "2020-01-09 03:00 +0900 held", "2020-01-08 03:00 +0900 labeled",
+				"2020-01-07 03:00 +0900"},
+			want: "2020-01-07 03:00 +0900",
+		},
+		{
+			// March 8, 2020 was 23 hours long in New York.
+			name:  "daily across the start of daylight saving time",
+			loc:   ny,
+			rules: RetentionConfig{KeepDaily: 2},
+			backups: []string{"2020-03-08 23:30 -0400", "2020-03-08 03:30 -0400", "2020-03-08 00:30 -0500",
+				"2020-03-07 23:30 -0500", "2020-03-06 23:30 -0500"},
+			want: "2020-03-08 03:30 -0400,2020-03-08 00:30 -0500,2020-03-06 23:30 -0500",
+		},
+		{
+			// November 1, 2020 was 25 hours long in New York, with 01:30
+			// twice.
+			name:  "daily across the end of daylight saving time",
+			loc:   ny,
+			rules: RetentionConfig{KeepDaily: 1},
+			backups: []string{"2020-11-01 23:30 -0500", "2020-11-01 01:30 -0500", "2020-11-01 01:30 -0400",
+				"2020-10-31 23:30 -0400"},
+			want: "2020-11-01 01:30 -0500,2020-11-01 01:30 -0400,2020-10-31 23:30 -0400",
+		},
+	} {
+		time.Local = tc.loc
+		var backups []*CatalogEntry
+		for _, s := range tc.backups {
+			fields := strings.SplitN(s, " ", 4)
+			tm, err := time.Parse("2006-01-02 15:04 -0700", strings.Join(fields[:3], " "))
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := &CatalogEntry{RunID: strings.Join(fields[:3], " "), Time: tm}
+			if len(fields) == 4 && fields[3] == "held" {
+				e.Hold = &Hold{Time: tm, User: "test"}
+			}
+			if len(fields) == 4 && fields[3] == "labeled" {
+				e.Label = "year-end"
+			}
+			backups = append(backups, e)
+		}
+		var ids []string
+		for _, e := range tc.rules.expiredBackups(backups, tc.keepLabeled) {
+			ids = append(ids, e.RunID)
+		}
+		if got := strings.Join(ids, ","); got != tc.want {
+			t.Errorf("%s: expired %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestExpiredEntriesTakeChains(t *testing.T) {
+	p := &Profile{Name: "myclinic", Retention: &RetentionConfig{KeepLast: 1}}
+	now := time.Date(2020, 1, 10, 3, 0, 0, 0, time.UTC)
+	entries := []*CatalogEntry{
+		{Profile: p.Name, RunID: "old", Time: now.AddDate(0, 0, -1)},
+		{Profile: p.Name, RunID: "old", Kind: kindBinlog, Name: "mysql-bin.000001"},
+		{Profile: p.Name, RunID: "old", Kind: kindBinlog, Name: "mysql-bin.000002"},
+		{Profile: p.Name, RunID: "old", Kind: kindGrants},
+		{Profile: p.Name, RunID: "new", Time: now},
+		{Profile: p.Name, RunID: "new", Kind: kindBinlog, Name: "mysql-bin.000003"},
+	}
+	var got []string
+	for _, e := range p.expiredEntries(entries) {
+		got = append(got, e.RunID+"/"+e.Kind+e.Name)
+	}
+	want := "old/binlogmysql-bin.000001,old/binlogmysql-bin.000002,old/grants,old/"
+	if strings.Join(got, ",") != want {
+		t.Errorf("expired %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const kindPut = "put"
+
+var putNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// putFilePath returns the path of the encrypted artifact named name stored
+// at t. Artifacts are kept apart from the dumps, under put/.
+func putFilePath(p *Profile, name string, t time.Time) string {
+	return filepath.Join(p.EncryptedDir, kindPut, dirPart(t),
+		name+"-"+t.Format("200601021504")+".cf")
+}
+
+func putS3Key(p *Profile, encryptedFile string) (string, error) {
+	return p.objectKey(putObjectName(p, encryptedFile))
+}
+
+func putObjectName(p *Profile, encryptedFile string) string {
+	return createS3Key(normalizePrefix(p.s3KeyPrefix())+kindPut, encryptedFile)
+}
+
+// putArtifact encrypts the content read from src, uploads it and records it
+// in the catalog. The content is streamed into the encrypted file.
+func putArtifact(p *Profile, name string, src io.Reader, r *AuditRecord) (*CatalogEntry, error) {
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	fingerprint, err := p.checkKeyFingerprint(key)
+	if err != nil {
+		return nil, err
+	}
+	entry := &CatalogEntry{
+		RunID:          r.RunID,
+		Profile:        p.Name,
+		Kind:           kindPut,
+		Name:           name,
+		Time:           r.Time,
+		S3Bucket:       p.storageBucket(),
+		Target:         p.targetURL(),
+		Trigger:        triggerManual,
+		CryptoMode:     cryptoMode(),
+		Compression:    transfer.compressor.Name(),
+		KeyFingerprint: fingerprint,
+		Instance:       instanceID,
+	}
+	entry.EncryptedFile = putFilePath(p, name, r.Time)
+	err = os.MkdirAll(filepath.Dir(entry.EncryptedFile), 0700)
+	if err != nil {
+		return nil, err
+	}
+	entry.Size, entry.SHA256, err = encryptTo(key, src, entry.EncryptedFile)
+	if err != nil {
+		os.Remove(entry.EncryptedFile)
+		return nil, fmt.Errorf("encryption failed: %v", err)
+	}
+	entry.EncryptedSHA256, entry.EncryptedSize, err = hashFile(entry.EncryptedFile)
+	if err != nil {
+		return nil, err
+	}
+	r.Stages = append(r.Stages, stageEncrypt)
+	r.Artifacts = append(r.Artifacts, entry.EncryptedFile)
+	fmt.Fprintf(stdout, tr("encrypted file: %s\n"), entry.EncryptedFile)
+	entry.S3Key, err = putS3Key(p, entry.EncryptedFile)
+	if err != nil {
+		return nil, err
+	}
+	if p.OpaqueNames {
+		entry.ObjectName = putObjectName(p, entry.EncryptedFile)
+	}
+	storage, err := p.storage()
+	if err != nil {
+		return nil, err
+	}
+	err = storage.Put(entry.S3Key, entry.EncryptedFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload to %s: %v", p.targetName(), err)
+	}
+	r.Stages = append(r.Stages, stageUpload)
+	r.Artifacts = append(r.Artifacts, p.storedLocation(entry.S3Key))
+	fmt.Fprintf(stdout, tr("S3 key: %s\n"), entry.S3Key)
+	err = catalog.Add(entry)
+	if err != nil {
+		return nil, fmt.Errorf("cannot record artifact in catalog: %v", err)
+	}
+	r.Stages = append(r.Stages, stageRecord)
+	if p.OpaqueNames {
+		err = p.updateManifest()
+		if err != nil {
+			return nil, fmt.Errorf("cannot update manifest: %v", err)
+		}
+	}
+	return entry, nil
+}
+
+// encryptTo compresses and encrypts what is read from src into the file
+// dst, and returns the size and SHA-256 of what was read.
+func encryptTo(key []byte, src io.Reader, dst string) (int64, string, error) {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	plain := &countingWriter{hash: h}
+	enc, err := newEncryptWriter(key, out)
+	if err == nil {
+		plain.w = enc
+		_, err = io.Copy(plain, src)
+		if err == nil {
+			err = enc.Close()
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return plain.n, hex.EncodeToString(h.Sum(nil)), err
+}
+
+func putCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	file := flags.String("file", "", "file to store (default stdin)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: myclinic-backup put [-file PATH] NAME\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("put needs a name")
+	}
+	name := flags.Arg(0)
+	if !putNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid name (use letters, digits, '.', '_' and '-'): %s", name)
+	}
+	p, err := singleProfile(profiles)
+	if err != nil {
+		return err
+	}
+	var src io.Reader = os.Stdin
+	source := "stdin"
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+		source = *file
+	}
+	now := time.Now()
+	if *dryRun {
+		path := putFilePath(p, name, now)
+		fmt.Fprintf(stdout, tr("would store %s as %s and upload it to %s\n"),
+			source, path, p.storedLocation(putObjectName(p, path)))
+		return nil
+	}
+	rec := &AuditRecord{
+		RunID:     newRunID(),
+		Time:      now,
+		Profile:   p.Name,
+		Trigger:   triggerManual,
+		User:      currentUser(),
+		Command:   commandLine(),
+		Artifacts: []string{source},
+		Outcome:   "success",
+	}
+	rec.Host, _ = os.Hostname()
+	entry, err := putArtifact(p, name, src, rec)
+	if err != nil {
+		rec.Outcome = "failure"
+		rec.Error = redactError(err)
+	} else {
+		rec.SHA256 = entry.SHA256
+	}
+	if aerr := auditLog.Append(rec); aerr != nil {
+		fmt.Fprintf(stderr, tr("audit log: %v\n"), aerr)
+	}
+	h := &HistoryRecord{RunID: rec.RunID, Profile: p.Name, Kind: historyPut, Trigger: rec.Trigger, Started: now,
+		Finished: time.Now(), Success: err == nil, Error: rec.Error}
+	if entry != nil {
+		h.Size, h.S3Key = entry.EncryptedSize, entry.S3Key
+	}
+	recordHistory(h)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, tr("stored %s (%s) as %s\n"), source, formatBytes(entry.Size), name)
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redacted replaces secrets in output.
+const redacted = "********"
+
+// minSecretLength is the shortest secret that is redacted; replacing
+// shorter values would garble unrelated text. Such passwords are still
+// kept off command lines.
+const minSecretLength = 4
+
+// secretSet holds the passwords and tokens which must not appear in
+// output, logs, errors or records.
+type secretSet struct {
+	mu     sync.Mutex
+	values []string
+}
+
+var secrets = &secretSet{}
+
+func (s *secretSet) add(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.values {
+		if v == value {
+			return
+		}
+	}
+	s.values = append(s.values, value)
+	// Longer secrets first, in case one contains another.
+	sort.Slice(s.values, func(i, j int) bool { return len(s.values[i]) > len(s.values[j]) })
+}
+
+// redact replaces the secrets in text.
+func redact(text string) string {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	for _, v := range secrets.values {
+		text = strings.Replace(text, v, redacted, -1)
+	}
+	return text
+}
+
+// redactError returns the message of err with the secrets replaced.
+func redactError(err error) string {
+	return redact(err.Error())
+}
+
+// partialSecret returns the length of the longest end of text which is the
+// start of a secret, and may be completed by what follows.
+func partialSecret(text string) int {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	longest := 0
+	for _, v := range secrets.values {
+		for n := len(v) - 1; n > longest; n-- {
+			if strings.HasSuffix(text, v[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// redactingWriter replaces secrets in what is written through it, also
+// those split across writes: the end of a write which may start a secret
+// is held back until the next write or Flush.
+type redactingWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	held string
+}
+
+func newRedactingWriter(w io.Writer) *redactingWriter {
+	return &redactingWriter{w: w}
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	text := redact(r.held + string(p))
+	n := len(text) - partialSecret(text)
+	r.held = text[n:]
+	_, err := io.WriteString(r.w, text[:n])
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes what is held back.
+func (r *redactingWriter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := io.WriteString(r.w, r.held)
+	r.held = ""
+	return err
+}
+
+// registerSecrets adds the secrets of the configuration.
+func (c *Config) registerSecrets() {
+	for _, p := range c.Profiles {
+		secrets.add(p.DBPass)
+		p.Notify.registerSecrets()
+	}
+	if c.SMTP != nil {
+		secrets.add(c.SMTP.Password)
+	}
+	if c.Controller != nil {
+		for _, s := range c.Controller.Sites {
+			s.Notify.registerSecrets()
+		}
+	}
+}
+
+// registerSecrets adds the URLs notifications are sent to, which hold the
+// token of a Slack webhook or the ID of a ping check, and let anyone who
+// has them post or ping.
+func (n *NotifyConfig) registerSecrets() {
+	secrets.add(n.Webhook)
+	for _, s := range n.Sinks {
+		secrets.add(s.URL)
+		secrets.add(s.FailURL)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withSecrets leaves no secrets but those the test registers, until the
+// function returned is called.
+func withSecrets() func() {
+	saved := secrets
+	secrets = &secretSet{}
+	return func() { secrets = saved }
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "myclinic-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestRedact(t *testing.T) {
+	defer withSecrets()()
+	c := &Config{
+		Profiles: []*Profile{
+			{Name: "a", DBPass: "db-pass-a", Notify: NotifyConfig{Webhook: "https://example.com/hook/k3y"}},
+			{Name: "b", DBPass: "abc", Notify: NotifyConfig{Sinks: []*SinkConfig{
+				{Type: sinkSlack, URL: "https://hooks.slack.com/services/T0/B0/xyz"},
+				{Type: sinkPing, URL: "https://hc-ping.com/6f1c", FailURL: "https://hc.example/f/6f1c"},
+			}}},
+		},
+		SMTP: &SMTPConfig{Password: "smtp-Pw9"},
+		Controller: &ControllerConfig{Sites: []*SiteConfig{
+			{Name: "s", Notify: NotifyConfig{Webhook: "https://example.com/site-hook"}},
+		}},
+	}
+	c.registerSecrets()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "token")
+	err := ioutil.WriteFile(path, []byte("  file-token\r\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := readSecretFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "file-token" {
+		t.Fatalf("readSecretFile: %q", token)
+	}
+	secrets.add("db-pass-a-longer")
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{"", ""},
+		{"nothing secret", "nothing secret"},
+		{"password db-pass-a", "password ********"},
+		{"db-pass-adb-pass-a", "****************"},
+		{"smtp-Pw9 and file-token", "******** and ********"},
+		{"Bearer file-token\n", "Bearer ********\n"},
+		// Notification URLs hold tokens.
+		{`Post "https://hooks.slack.com/services/T0/B0/xyz": timeout`, `Post "********": timeout`},
+		{"ping https://hc-ping.com/6f1c/fail", "ping ********/fail"},
+		{"https://hc.example/f/6f1c https://example.com/hook/k3y", "******** ********"},
+		{"https://example.com/site-hook", "********"},
+		// The longer secret is replaced whole, not its start.
+		{"db-pass-a-longer", "********"},
+		// Values shorter than minSecretLength are left in.
+		{"abc abcd", "abc abcd"},
+		{"db-pass", "db-pass"},
+	} {
+		if got := redact(tc.text); got != tc.want {
+			t.Errorf("redact(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestSecretSetAdd(t *testing.T) {
+	defer withSecrets()()
+	for _, v := range []string{"", "a", "abc", "abcd", "abcd", "abcdef"} {
+		secrets.add(v)
+	}
+	want := []string{"abcdef", "abcd"}
+	if fmt.Sprint(secrets.values) != fmt.Sprint(want) {
+		t.Errorf("secrets %q, want %q", secrets.values, want)
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	defer withSecrets()()
+	p := &Profile{Name: "k", DBUser: "root", DBPass: "s3cret-pw", Database: "clinic"}
+	c := &Config{Profiles: []*Profile{p}}
+	c.registerSecrets()
+	cmd := p.mysqldumpCommand()
+	if strings.Contains(strings.Join(cmd.Args, " "), "s3cret-pw") {
+		t.Fatalf("password in %q", cmd.Args)
+	}
+	// A password given as an argument, as in a command line run by hand,
+	// is echoed by errors.
+	cmd.Args = append(cmd.Args, "-p"+p.DBPass)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	cmd.Path = filepath.Join(dir, "missing")
+	runErr := cmd.Run()
+	if runErr == nil {
+		t.Fatal("missing program ran")
+	}
+	for _, err := range []error{
+		fmt.Errorf("%s: %v", strings.Join(cmd.Args, " "), runErr),
+		fmt.Errorf("mysqldump failed: %w: %s", errors.New("exit status 2"), "mysqldump -ps3cret-pw: Got error"),
+		&os.PathError{Op: "open", Path: "/tmp/s3cret-pw", Err: os.ErrNotExist},
+	} {
+		msg := redactError(err)
+		if strings.Contains(msg, "s3cret-pw") {
+			t.Errorf("redactError left the password in %q", msg)
+		}
+		if !strings.Contains(msg, redacted) {
+			t.Errorf("redactError(%q) = %q", err, msg)
+		}
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	defer withSecrets()()
+	secrets.add("hunter2!")
+	secrets.add("abc")
+	text := "user root, password hunter2! and abc\n"
+	want := "user root, password ******** and abc\n"
+	// Every way of splitting the text in two writes, the secret too.
+	for i := 0; i <= len(text); i++ {
+		var buf bytes.Buffer
+		w := newRedactingWriter(&buf)
+		for _, p := range []string{text[:i], text[i:]} {
+			n, err := w.Write([]byte(p))
+			if err != nil || n != len(p) {
+				t.Fatalf("split at %d: Write returned %d, %v", i, n, err)
+			}
+		}
+		if buf.String() != want {
+			t.Errorf("split at %d: %q", i, buf.String())
+		}
+	}
+	// One byte at a time.
+	var buf bytes.Buffer
+	w := newRedactingWriter(&buf)
+	for i := 0; i < len(text); i++ {
+		w.Write([]byte{text[i]})
+	}
+	if buf.String() != want {
+		t.Errorf("byte by byte: %q", buf.String())
+	}
+}
+
+func TestRedactingWriterHolds(t *testing.T) {
+	defer withSecrets()()
+	secrets.add("hunter2!")
+	var buf bytes.Buffer
+	w := newRedactingWriter(&buf)
+	// A prompt not ending in the start of a secret is written at once.
+	w.Write([]byte("Proceed? [y/N] "))
+	if buf.String() != "Proceed? [y/N] " {
+		t.Errorf("prompt: %q", buf.String())
+	}
+	// The start of a secret is held until it is known not to be one.
+	buf.Reset()
+	w.Write([]byte("hun"))
+	if buf.String() != "" {
+		t.Errorf("start of a secret written: %q", buf.String())
+	}
+	w.Write([]byte("gry\n"))
+	if buf.String() != "hungry\n" {
+		t.Errorf("after the rest: %q", buf.String())
+	}
+	buf.Reset()
+	w.Write([]byte("last hunter2"))
+	if buf.String() != "last " {
+		t.Errorf("before Flush: %q", buf.String())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "last hunter2" {
+		t.Errorf("after Flush: %q", buf.String())
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, which makes a file share the blocks of
+// another on file systems such as Btrfs and XFS.
+const ficlone = 0x40049409
+
+// reflink creates dst sharing the blocks of src.
+func reflink(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	cerr := out.Close()
+	if errno != 0 {
+		os.Remove(dst)
+		return errno
+	}
+	if cerr != nil {
+		os.Remove(dst)
+	}
+	return cerr
+}
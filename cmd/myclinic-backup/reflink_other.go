@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// reflink is not supported beyond Linux.
+func reflink(src string, dst string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BinlogCoordinates is the position of the source server a dump
+// corresponds to, as written by mysqldump --master-data=2.
+type BinlogCoordinates struct {
+	File     string `json:"file"`
+	Position int64  `json:"position"`
+	// GTIDPurged is the GTID set of the dump if the server uses GTIDs.
+	GTIDPurged string `json:"gtid_purged,omitempty"`
+}
+
+var (
+	changeMasterPattern = regexp.MustCompile(
+		`^-- CHANGE (?:MASTER|REPLICATION SOURCE) TO (?:MASTER|SOURCE)_LOG_FILE='([^']+)', (?:MASTER|SOURCE)_LOG_POS=(\d+);`)
+	gtidPurgedPattern = regexp.MustCompile(`^SET @@GLOBAL\.GTID_PURGED=(?:/\*!80000 '\+'\*/ )?'`)
+)
+
+// maxHeaderLines bounds how far into a dump the coordinates are looked for;
+// mysqldump writes them before any table.
+const maxHeaderLines = 200
+
+// readBinlogCoordinates finds the coordinates in the header of a dump. It
+// returns nil if there are none.
+func readBinlogCoordinates(r io.Reader) (*BinlogCoordinates, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	var c *BinlogCoordinates
+	var gtid strings.Builder
+	inGTID := false
+	for i := 0; i < maxHeaderLines && scanner.Scan(); i++ {
+		line := scanner.Text()
+		if inGTID {
+			// A large GTID set continues over several lines.
+			gtid.WriteString(strings.TrimSpace(line))
+			inGTID = !strings.HasSuffix(line, "';")
+			continue
+		}
+		if m := changeMasterPattern.FindStringSubmatch(line); m != nil {
+			pos, err := strconv.ParseInt(m[2], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			if c == nil {
+				c = &BinlogCoordinates{}
+			}
+			c.File, c.Position = m[1], pos
+			continue
+		}
+		if loc := gtidPurgedPattern.FindStringIndex(line); loc != nil {
+			gtid.WriteString(line[loc[1]:])
+			inGTID = !strings.HasSuffix(line, "';")
+			continue
+		}
+		if strings.HasPrefix(line, "CREATE TABLE") {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if c != nil && gtid.Len() > 0 {
+		c.GTIDPurged = strings.TrimSuffix(gtid.String(), "';")
+	}
+	return c, nil
+}
+
+func readBinlogCoordinatesFile(path string) (*BinlogCoordinates, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readBinlogCoordinates(f)
+}
+
+// changeSourceStatements returns the statements that start replication on
+// a server seeded from a dump taken at c.
+func changeSourceStatements(c *BinlogCoordinates, host string, port int, user string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CHANGE MASTER TO MASTER_HOST=%s, MASTER_PORT=%d, MASTER_USER=%s, MASTER_PASSWORD='<password>'",
+		quoteString(host), port, quoteString(user))
+	if c.GTIDPurged != "" {
+		b.WriteString(", MASTER_AUTO_POSITION=1;\n")
+	} else {
+		fmt.Fprintf(&b, ", MASTER_LOG_FILE=%s, MASTER_LOG_POS=%d;\n", quoteString(c.File), c.Position)
+	}
+	b.WriteString("START SLAVE;\n")
+	return b.String()
+}
+
+func seedReplicaCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("seed-replica", flag.ExitOnError)
+	host := flags.String("host", "", "replica server to restore into, as host or host:port")
+	sourceHost := flags.String("source-host", "", "source server the replica connects to (default db_host or this host)")
+	sourcePort := flags.Int("source-port", 3306, "port of the source server")
+	sourceUser := flags.String("source-user", "repl", "replication account on the source server")
+	flags.Parse(args)
+	p, err := singleProfile(profiles)
+	if err != nil {
+		return err
+	}
+	if *host == "" {
+		return fmt.Errorf("give the replica server with -host")
+	}
+	e, err := latestUploaded(p)
+	if err != nil {
+		return err
+	}
+	if e.Binlog == nil {
+		return fmt.Errorf("backup %s has no binlog coordinates; set binlog_coordinates in profile %s", e.S3Key, p.Name)
+	}
+	src := *sourceHost
+	if src == "" {
+		src = p.DBHost
+	}
+	if src == "" {
+		src, _ = os.Hostname()
+	}
+	replica := *p
+	replica.DBHost = *host
+	db := ""
+	if !p.isMultiDatabase() {
+		db = p.databases()[0]
+	}
+	if e.Binlog.GTIDPurged != "" {
+		fmt.Fprintf(stdout, tr("the backup sets gtid_purged; gtid_executed of the replica must be empty (RESET MASTER)\n"))
+	}
+	if *dryRun {
+		fmt.Fprintf(stdout, tr("would restore %s (taken %s) into %s\n"), entryLocation(e),
+			e.Time.Format("2006-01-02 15:04"), *host)
+	} else {
+		fmt.Fprintf(stdout, tr("restoring %s (taken %s) into %s\n"), entryLocation(e),
+			e.Time.Format("2006-01-02 15:04"), *host)
+		err = restoreStream(&replica, e, db, stdout)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, tr("run on the replica to start replication:\n"))
+	fmt.Fprint(stdout, changeSourceStatements(e.Binlog, src, *sourcePort, *sourceUser))
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const dumpPreamble = `/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+/*!40101 SET NAMES utf8 */;
+/*!40103 SET TIME_ZONE='+00:00' */;
+/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, UNIQUE_CHECKS=0 */;
+SET @MYSQLDUMP_TEMP_LOG_BIN = @@SESSION.SQL_LOG_BIN;
+SET @@SESSION.SQL_LOG_BIN= 0;
+`
+
+const dumpTable = `
+--
+-- Table structure for table ` + "`patient`" + `
+--
+
+DROP TABLE IF EXISTS ` + "`patient`" + `;
+CREATE TABLE ` + "`patient`" + ` (
+  ` + "`patient_id`" + ` int(11) NOT NULL AUTO_INCREMENT,
+  PRIMARY KEY (` + "`patient_id`" + `)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`
+
+func TestReadBinlogCoordinates(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header string
+		want   *BinlogCoordinates
+	}{
+		{"5.7", `-- MySQL dump 10.13  Distrib 5.7.44, for Linux (x86_64)
+--
+-- Host: localhost    Database: clinic
+-- ------------------------------------------------------
+-- Server version	5.7.44-log
+
+` + dumpPreamble + `
+--
+-- Position to start replication or point-in-time recovery from
+--
+
+-- CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000003', MASTER_LOG_POS=154;
+`, &BinlogCoordinates{File: "mysql-bin.000003", Position: 154}},
+		{"5.7 with GTIDs", `-- MySQL dump 10.13  Distrib 5.7.44, for Linux (x86_64)
+--
+-- Host: localhost    Database: clinic
+-- ------------------------------------------------------
+-- Server version	5.7.44-log
+
+` + dumpPreamble + `
+--
+-- GTID state at the beginning of the backup 
+--
+
+SET @@GLOBAL.GTID_PURGED='3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5';
+
+--
+-- Position to start replication or point-in-time recovery from
+--
+
+-- CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000003', MASTER_LOG_POS=1207;
+`, &BinlogCoordinates{File: "mysql-bin.000003", Position: 1207,
+			GTIDPurged: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"}},
+		{"8.0 with GTIDs on several lines", `-- MySQL dump 10.13  Distrib 8.0.22, for Linux (x86_64)
+--
+-- Host: localhost    Database: clinic
+-- ------------------------------------------------------
+-- Server version	8.0.22
+
+` + dumpPreamble + `
+--
+-- GTID state at the beginning of the backup 
+--
+
+SET @@GLOBAL.GTID_PURGED=/*!80000 '+'*/ '3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5,
+4f2ac1e0-71ca-11e1-9e33-c80aa9429562:1-1200:1300-1400,
+8a94f357-aab4-11df-86ab-c80aa9429562:1-3';
+
+--
+-- Position to start replication or point-in-time recovery from
+--
+
+-- CHANGE MASTER TO MASTER_LOG_FILE='binlog.000012', MASTER_LOG_POS=4711;
+`, &BinlogCoordinates{File: "binlog.000012", Position: 4711,
+			GTIDPurged: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5," +
+				"4f2ac1e0-71ca-11e1-9e33-c80aa9429562:1-1200:1300-1400," +
+				"8a94f357-aab4-11df-86ab-c80aa9429562:1-3"}},
+		{"8.0 with --source-data", `-- MySQL dump 10.13  Distrib 8.0.36, for Linux (x86_64)
+--
+-- Host: localhost    Database: clinic
+-- ------------------------------------------------------
+-- Server version	8.0.36
+
+` + dumpPreamble + `
+--
+-- Position to start replication or point-in-time recovery from
+--
+
+-- CHANGE REPLICATION SOURCE TO SOURCE_LOG_FILE='binlog.000002', SOURCE_LOG_POS=157;
+`, &BinlogCoordinates{File: "binlog.000002", Position: 157}},
+		{"no coordinates", `-- MySQL dump 10.13  Distrib 8.0.36, for Linux (x86_64)
+--
+-- Server version	8.0.36
+
+` + dumpPreamble, nil},
+		{"GTIDs only", `-- MySQL dump 10.13  Distrib 5.7.44, for Linux (x86_64)
+
+` + dumpPreamble + `
+SET @@GLOBAL.GTID_PURGED='3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5';
+`, nil},
+	} {
+		c, err := readBinlogCoordinates(strings.NewReader(tc.header + dumpTable))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, c, tc.want)
+		}
+	}
+}
+
+func TestReadBinlogCoordinatesHeaderOnly(t *testing.T) {
+	// Data which happens to look like coordinates is not read.
+	dump := dumpPreamble + dumpTable +
+		"INSERT INTO `patient` VALUES (1);\n" +
+		"-- CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000003', MASTER_LOG_POS=154;\n"
+	c, err := readBinlogCoordinates(strings.NewReader(dump))
+	if err != nil || c != nil {
+		t.Errorf("got %+v, %v", c, err)
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hangilc/myclinic-backup/internal/cfstream"
+)
+
+func openS3Object(sess *session.Session, bucket string, key string) (io.ReadCloser, int64, error) {
+	if transfer.downloadConcurrency > 1 {
+		return openS3ObjectParallel(sess, bucket, key, transfer.downloadConcurrency)
+	}
+	out, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return out.Body, aws.Int64Value(out.ContentLength), nil
+}
+
+func openLocalFile(path string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// progressReader reports periodically to out how much of r has been read,
+// and when the total is known, about how long the rest will take.
+type progressReader struct {
+	r        io.Reader
+	out      io.Writer
+	label    string
+	total    int64
+	n        int64
+	started  time.Time
+	reported time.Time
+	// detail, if set, adds to the reports, such as what a restore has
+	// loaded so far.
+	detail func() string
+}
+
+const progressInterval = 10 * time.Second
+
+func newProgressReader(r io.Reader, out io.Writer, label string, total int64) *progressReader {
+	now := time.Now()
+	return &progressReader{r: r, out: out, label: label, total: total, started: now, reported: now}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if time.Since(p.reported) >= progressInterval {
+		p.report()
+	}
+	return n, err
+}
+
+func (p *progressReader) report() {
+	p.reported = time.Now()
+	var line string
+	if p.total > 0 {
+		line = fmt.Sprintf(tr("%s: %s of %s (%d%%)"), tr(p.label), formatBytes(p.n), formatBytes(p.total),
+			p.n*100/p.total)
+		if p.n > 0 && p.n < p.total {
+			elapsed := p.reported.Sub(p.started)
+			left := time.Duration(float64(elapsed) * float64(p.total-p.n) / float64(p.n))
+			line += fmt.Sprintf(tr(", about %s left"), left.Round(time.Second))
+		}
+	} else {
+		line = fmt.Sprintf("%s: %s", tr(p.label), formatBytes(p.n))
+	}
+	if p.detail != nil {
+		if d := p.detail(); d != "" {
+			line += "; " + d
+		}
+	}
+	fmt.Fprintln(p.out, line)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// openBackupStream opens the decrypted, decompressed content of the backup
+// on S3. Reading it to the end verifies its authenticity. The progress of
+// the download is reported to log.
+func openBackupStream(p *Profile, e *CatalogEntry, log io.Writer) (io.ReadCloser, *progressReader, error) {
+	return openDecryptedStream(p, e, log, true)
+}
+
+// openDecryptedStream is openBackupStream, leaving the content compressed
+// as it was stored unless decompress is set. An entry without an S3 key is
+// read from its local encrypted file.
+func openDecryptedStream(p *Profile, e *CatalogEntry, log io.Writer, decompress bool) (io.ReadCloser, *progressReader, error) {
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	var body io.ReadCloser
+	var size int64
+	if e.S3Key == "" {
+		body, size, err = openLocalFile(e.EncryptedFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		storage, err := entryStorage(p, e)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, size, err = storage.Get(e.S3Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("download failed: %v", err)
+		}
+	}
+	progress := newProgressReader(body, log, "restoring", size)
+	plain, err := newDecryptReader(key, progress, decompress)
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+	return &stackedCloser{plain, body}, progress, nil
+}
+
+// stackedCloser closes the underlying reader along with r.
+type stackedCloser struct {
+	io.ReadCloser
+	under io.Closer
+}
+
+func (s *stackedCloser) Close() error {
+	err := s.ReadCloser.Close()
+	s.under.Close()
+	return err
+}
+
+// restoreFiles extracts the file archive from S3 under dir.
+func restoreFiles(p *Profile, e *CatalogEntry, dir string) error {
+	plain, progress, err := openBackupStream(p, e, stdout)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	n, err := extractArchive(plain, dir)
+	if err == nil {
+		// Drain the rest so that the authentication tag is checked.
+		_, err = io.Copy(ioutil.Discard, plain)
+	}
+	if errors.Is(err, cfstream.ErrAuth) {
+		return fmt.Errorf("backup failed authentication (wrong key or corrupted); files under %s are NOT trustworthy", dir)
+	}
+	if err != nil {
+		return err
+	}
+	progress.report()
+	fmt.Fprintf(stdout, tr("%d entries extracted\n"), n)
+	return nil
+}
+
+// loadUnverified, set by restore -load-unverified, makes restoreStream pipe
+// a backup into mysql as it is decrypted, before it is authenticated.
+var loadUnverified bool
+
+// restoreStream pipes the backup through decryption and decompression into
+// the mysql client. The tag authenticating the backup is only checked at
+// its end, and mysql runs what it is given, so the backup is first
+// downloaded, still encrypted, into a temporary directory and read through
+// once: nothing altered in storage reaches mysql. With loadUnverified it is
+// streamed from storage straight into mysql instead, without the temporary
+// copy, and a tampered backup is only found once mysql has run it.
+// An empty targetDB loads a dump of several databases into the databases it
+// names. Progress is reported to log.
+func restoreStream(p *Profile, e *CatalogEntry, targetDB string, log io.Writer) error {
+	if !loadUnverified {
+		verified, cleanup, err := authenticatedCopy(p, e, log)
+		if err != nil {
+			return fmt.Errorf("backup not loaded: %v", err)
+		}
+		defer cleanup()
+		e = verified
+	}
+	plain, progress, err := openBackupStream(p, e, log)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	if targetDB != "" {
+		err = mysqlExecute(p, "CREATE DATABASE IF NOT EXISTS "+quoteIdent(targetDB))
+		if err != nil {
+			return err
+		}
+	}
+	sql := newSQLProgress(plain)
+	progress.detail = sql.summary
+	err = mysqlLoad(p, targetDB, sql)
+	if errors.Is(err, cfstream.ErrAuth) {
+		dbs := targetDB
+		if dbs == "" {
+			dbs = strings.Join(p.databases(), ", ")
+		}
+		return fmt.Errorf("backup failed authentication (wrong key or corrupted); database %s is NOT trustworthy", dbs)
+	}
+	if err != nil {
+		return err
+	}
+	progress.detail = sql.finalSummary
+	progress.report()
+	return nil
+}
+
+// authenticatedCopy returns the entry to restore the backup of e from a
+// local encrypted file which has been authenticated, and checked against
+// the checksum of the catalog if it records one. A backup in storage is
+// downloaded into a temporary directory, which cleanup removes.
+func authenticatedCopy(p *Profile, e *CatalogEntry, log io.Writer) (*CatalogEntry, func(), error) {
+	cleanup := func() {}
+	if e.S3Key != "" {
+		dir, err := ioutil.TempDir("", "myclinic-backup-restore-")
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { os.RemoveAll(dir) }
+		c := *e
+		c.S3Bucket, c.S3Key = "", ""
+		c.EncryptedFile = filepath.Join(dir, "backup.cf")
+		err = downloadEncrypted(p, e, c.EncryptedFile, log)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		e = &c
+	}
+	fmt.Fprintf(log, tr("authenticating the backup before loading it\n"))
+	var err error
+	if e.SHA256 != "" {
+		err = readBackup(p, e, nil)
+	} else {
+		err = drainDecrypted(p, e)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return e, cleanup, nil
+}
+
+// downloadEncrypted copies the stored backup of e, as it is, into file.
+func downloadEncrypted(p *Profile, e *CatalogEntry, file string, log io.Writer) error {
+	storage, err := entryStorage(p, e)
+	if err != nil {
+		return err
+	}
+	body, size, err := storage.Get(e.S3Key)
+	if err != nil {
+		return fmt.Errorf("download failed: %v", err)
+	}
+	defer body.Close()
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	progress := newProgressReader(body, log, "downloading", size)
+	_, err = io.Copy(out, progress)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("download failed: %v", err)
+	}
+	progress.report()
+	return nil
+}
+
+// drainDecrypted reads the backup of e through decryption, which
+// authenticates it at the end.
+func drainDecrypted(p *Profile, e *CatalogEntry) error {
+	dec, _, err := openDecryptedStream(p, e, ioutil.Discard, false)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	_, err = io.Copy(ioutil.Discard, dec)
+	if errors.Is(err, cfstream.ErrAuth) {
+		return fmt.Errorf("decryption failed (wrong key or corrupted data)")
+	}
+	return err
+}
+
+// backupTakenAt returns the backup of the profile taken at stamp, such as
+// 202401021504: from the catalog, or if it is not there and not local, from
+// the bucket.
+func backupTakenAt(p *Profile, stamp string, local bool) (*CatalogEntry, error) {
+	t, err := time.ParseInLocation("200601021504", stamp, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("-date must be a time such as 202401021504: %s", stamp)
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	r := dateRange{since: t, until: t.Add(time.Minute)}
+	for _, e := range catalogBackups(entries, p, r) {
+		if local && e.EncryptedFile != "" || !local && e.S3Key != "" {
+			return e, nil
+		}
+	}
+	if !local && p.hasStorage() {
+		l, err := listRemote(p, r)
+		if err != nil {
+			return nil, err
+		}
+		if len(l.backups) > 0 {
+			return l.backups[0], nil
+		}
+	}
+	return nil, fmt.Errorf("no backup of profile %s taken at %s", p.Name, t.Format("2006-01-02 15:04"))
+}
+
+// latestLocal returns the latest backup of the profile in the catalog whose
+// encrypted file is still in encrypted_dir.
+func latestLocal(p *Profile) (*CatalogEntry, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var latest *CatalogEntry
+	for _, e := range catalogBackups(entries, p, dateRange{}) {
+		if e.EncryptedFile == "" {
+			continue
+		}
+		if _, err := os.Stat(e.EncryptedFile); err == nil {
+			latest = e
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no backup of profile %s in catalog has a local copy", p.Name)
+	}
+	return latest, nil
+}
+
+// localCopy returns the entry to restore the backup of e from its local
+// encrypted file rather than from S3.
+func localCopy(e *CatalogEntry) (*CatalogEntry, error) {
+	if _, err := os.Stat(e.EncryptedFile); e.EncryptedFile == "" || err != nil {
+		return nil, fmt.Errorf("the backup taken %s has no local copy", e.Time.Format("2006-01-02 15:04"))
+	}
+	c := *e
+	c.S3Bucket, c.S3Key = "", ""
+	return &c, nil
+}
+
+func singleProfile(profiles []*Profile) (*Profile, error) {
+	if len(profiles) != 1 {
+		return nil, fmt.Errorf("select one profile with -profile")
+	}
+	return profiles[0], nil
+}
+
+func restoreCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	targetDB := flags.String("target-db", "", "database to restore into (default the profile's database, after a confirmation or -yes)")
+	yes := flags.Bool("yes", false, "restores over the profile's database without -target-db or a confirmation")
+	targetDir := flags.String("target-dir", "", "directory to extract into, for profiles of type files")
+	preview := flags.Bool("dry-run", false, "reports what the restore would change without changing anything")
+	from := flags.String("from", "s3", "where to restore from: s3, local for the copy in encrypted_dir, or the s3://bucket/key of a backup")
+	date := flags.String("date", "", "restores the backup taken at this time, e.g. 202401021504")
+	latest := flags.Bool("latest", false, "restores the latest backup in the catalog (default)")
+	pick := flags.Bool("pick", false, "chooses the backup from the recent ones in the catalog, with the arrow keys in a terminal")
+	snapshot := flags.Bool("snapshot", false, "backs up the database before replacing it (default restore_snapshot of the profile)")
+	pointInTime := flags.String("point-in-time", "", "replays the shipped binary logs on top of the backup up to this time, e.g. \"2024-01-02 15:04:05\"")
+	unverified := flags.Bool("load-unverified", false, "streams the backup into mysql without a temporary copy, before it is authenticated; mysql then runs a tampered backup before the restore fails")
+	source := addS3SourceFlags(flags)
+	flags.Parse(args)
+	loadUnverified = *unverified
+	p, err := singleProfile(profiles)
+	if err != nil {
+		return err
+	}
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if !explicit["snapshot"] {
+		*snapshot = p.RestoreSnapshot
+	}
+	if p.isFiles() && *targetDir == "" {
+		return fmt.Errorf("profile %s backs up files; give -target-dir", p.Name)
+	}
+	local := *from == "local"
+	fromURL := *from != "s3" && !local
+	if fromURL && !strings.HasPrefix(*from, "s3://") {
+		return fmt.Errorf("-from must be s3, local or an s3:// URL: %s", *from)
+	}
+	chosen := 0
+	for _, given := range []bool{fromURL, *date != "", *latest, *pick} {
+		if given {
+			chosen++
+		}
+	}
+	if chosen > 1 {
+		return fmt.Errorf("only one of -from with a URL, -date, -latest and -pick can be given")
+	}
+	var until time.Time
+	if *pointInTime != "" {
+		until, err = time.ParseInLocation(pointInTimeLayout, *pointInTime, time.Local)
+		if err != nil {
+			return fmt.Errorf("-point-in-time must be a time such as \"2024-01-02 15:04:05\": %s", *pointInTime)
+		}
+		if p.Binlog == nil {
+			return fmt.Errorf("profile %s does not ship binary logs; set binlog", p.Name)
+		}
+		if fromURL || *preview || *dryRun {
+			return fmt.Errorf("-point-in-time cannot be given with -from with a URL or -dry-run")
+		}
+	}
+	var e *CatalogEntry
+	var k *picker
+	switch {
+	case fromURL:
+		p, e, err = source.resolve(p, *from)
+	case *date != "":
+		e, err = backupTakenAt(p, *date, local)
+	case *pick:
+		k = newPicker()
+		e, err = k.pick(p)
+	case !until.IsZero():
+		e, err = latestWithCoordinates(p, until)
+	case local:
+		e, err = latestLocal(p)
+	default:
+		e, err = latestUploaded(p)
+	}
+	if err == errPickCanceled {
+		fmt.Fprintf(stdout, tr("restore canceled\n"))
+		return nil
+	}
+	if err == nil && local {
+		e, err = localCopy(e)
+	}
+	if err != nil {
+		return err
+	}
+	if !until.IsZero() && (e.Binlog == nil || e.Time.After(until)) {
+		return fmt.Errorf("the backup taken %s cannot be replayed to %s", e.Time.Format("2006-01-02 15:04"),
+			until.Format(pointInTimeLayout))
+	}
+	// Choosing by hand is where the wrong day gets restored, so the
+	// choice is confirmed.
+	if k != nil && !*preview && !*dryRun {
+		ok, err := k.confirm(e, restoreTarget(p, *targetDB, *targetDir))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintf(stdout, tr("restore canceled\n"))
+			return nil
+		}
+	}
+	// Without -target-db the restore replaces the live database, so that
+	// is confirmed too, unless -yes is given for scripts.
+	if !p.isFiles() && *targetDB == "" && k == nil && !*yes && !*preview && !*dryRun {
+		target := restoreTarget(p, "", "")
+		ok, err := newPicker().confirm(e, target)
+		if err == io.EOF {
+			fmt.Fprintln(stdout)
+			return fmt.Errorf("restoring over %s needs a confirmation; give -target-db, or -yes to restore over it", target)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintf(stdout, tr("restore canceled\n"))
+			return nil
+		}
+	}
+	if p.isFiles() {
+		if *preview || *dryRun {
+			fmt.Fprintf(stdout, tr("would extract %s (taken %s) under %s\n"), entryLocation(e),
+				e.Time.Format("2006-01-02 15:04"), *targetDir)
+			return nil
+		}
+		fmt.Fprintf(stdout, tr("extracting %s (taken %s) under %s\n"), entryLocation(e),
+			e.Time.Format("2006-01-02 15:04"), *targetDir)
+		return restoreFiles(p, e, *targetDir)
+	}
+	if p.isMultiDatabase() {
+		if *targetDB != "" || *preview || *dryRun {
+			return fmt.Errorf("profile %s dumps several databases; -target-db and -dry-run are not supported", p.Name)
+		}
+		var snap *CatalogEntry
+		if *snapshot {
+			snap, err = takeRestoreSnapshot(config, p, e, "", nil)
+			if err != nil {
+				return err
+			}
+		}
+		dbs := strings.Join(p.Databases, ", ")
+		fmt.Fprintf(stdout, tr("restoring %s (taken %s) into %s\n"), entryLocation(e),
+			e.Time.Format("2006-01-02 15:04"), dbs)
+		err = restoreStream(p, e, "", stdout)
+		if err == nil {
+			fmt.Fprintf(stdout, tr("restored into %s\n"), dbs)
+			_, err = checkRestore(p, "", stdout)
+		}
+		printRollback(p, snap)
+		return err
+	}
+	db := *targetDB
+	if db == "" {
+		db = p.databases()[0]
+	}
+	if *preview || *dryRun {
+		return restorePreview(p, e, db)
+	}
+	var snap *CatalogEntry
+	if *snapshot {
+		snap, err = takeRestoreSnapshot(config, p, e, db, nil)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, tr("restoring %s (taken %s) into %s\n"), entryLocation(e),
+		e.Time.Format("2006-01-02 15:04"), db)
+	err = restoreStream(p, e, db, stdout)
+	if err == nil && !until.IsZero() {
+		err = replayBinlogs(p, e, db, until, local, stdout)
+	}
+	if err == nil {
+		fmt.Fprintf(stdout, tr("restored into %s\n"), db)
+		_, err = checkRestore(p, db, stdout)
+	}
+	printRollback(p, snap)
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticatedCopy(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	keyFile := filepath.Join(dir, "backup.key")
+	err := ioutil.WriteFile(keyFile, []byte(strings.Repeat("0123456789abcdef", 4)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := readEncryptionKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := filepath.Join(dir, "store")
+	if err := os.Mkdir(store, 0700); err != nil {
+		t.Fatal(err)
+	}
+	object := filepath.Join(store, "backup.cf")
+	_, sum, err := encryptTo(key, strings.NewReader("CREATE TABLE patient (id int);\n"), object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Profile{Name: "myclinic", KeyFile: keyFile}
+	stored := &CatalogEntry{Profile: p.Name, S3Key: "backup.cf", Target: "file://" + filepath.ToSlash(store), SHA256: sum}
+
+	c, done, err := authenticatedCopy(p, stored, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.S3Key != "" || c.EncryptedFile == "" {
+		t.Errorf("copy %+v is not local", c)
+	}
+	want, _ := ioutil.ReadFile(object)
+	if got, err := ioutil.ReadFile(c.EncryptedFile); err != nil || string(got) != string(want) {
+		t.Errorf("copy differs from the stored backup: %v", err)
+	}
+	done()
+	if _, err := os.Stat(c.EncryptedFile); !os.IsNotExist(err) {
+		t.Errorf("copy not removed: %v", err)
+	}
+
+	wrongSum := *stored
+	wrongSum.SHA256 = strings.Repeat("0", 64)
+	if _, _, err := authenticatedCopy(p, &wrongSum, ioutil.Discard); err == nil {
+		t.Error("backup with another checksum accepted")
+	}
+
+	// A change anywhere fails the authentication, checked before any of the
+	// backup is used, with or without a checksum in the catalog.
+	want[len(want)/2] ^= 1
+	if err := ioutil.WriteFile(object, want, 0600); err != nil {
+		t.Fatal(err)
+	}
+	unsummed := *stored
+	unsummed.SHA256 = ""
+	for _, e := range []*CatalogEntry{stored, &unsummed} {
+		if _, _, err := authenticatedCopy(p, e, ioutil.Discard); err == nil {
+			t.Errorf("tampered backup accepted (checksum %q)", e.SHA256)
+		}
+	}
+}
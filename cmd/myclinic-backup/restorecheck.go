@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A restore which loaded every statement can still leave an application
+// which does not work: a table restored empty, a view over a missing
+// column, a server which cannot start against the data. after_restore lists
+// checks run once a restore has completed, whose results are reported with
+// it, so that a restore succeeds only if they pass. Drills restore into a
+// temporary database the application does not use, and run the query
+// checks only.
+
+// RestoreCheck is one check of after_restore. Exactly one of Query,
+// Command and URL is set.
+type RestoreCheck struct {
+	Name string `yaml:"name"`
+	// Query is SQL run in the restored database. Its first value must be
+	// at least Min if set, such as a row count, and otherwise be neither
+	// empty, 0 nor NULL.
+	Query string `yaml:"query"`
+	Min   *int64 `yaml:"min"`
+	// Command is run with the restored database in
+	// $MYCLINIC_RESTORE_DATABASE, and passes if it exits with 0.
+	Command []string `yaml:"command"`
+	// URL is fetched, such as the health check of the myclinic server,
+	// and passes with a 2xx status.
+	URL string `yaml:"url"`
+	// Timeout limits the check (default 1 minute).
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+const restoreDatabaseEnvVar = "MYCLINIC_RESTORE_DATABASE"
+
+const defaultRestoreCheckTimeout = time.Minute
+
+func (c *RestoreCheck) validate() error {
+	set := 0
+	for _, s := range []bool{c.Query != "", len(c.Command) > 0, c.URL != ""} {
+		if s {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("one of query, command and url must be set")
+	}
+	if c.Min != nil && c.Query == "" {
+		return fmt.Errorf("min is only for query")
+	}
+	return nil
+}
+
+// label names the check in reports.
+func (c *RestoreCheck) label() string {
+	switch {
+	case c.Name != "":
+		return c.Name
+	case c.Query != "":
+		return c.Query
+	case c.URL != "":
+		return c.URL
+	}
+	return strings.Join(c.Command, " ")
+}
+
+func (c *RestoreCheck) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultRestoreCheckTimeout
+}
+
+// RestoreCheckResult is the outcome of a check, as reported and returned
+// by the API.
+type RestoreCheckResult struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	// Detail is the value of a query, the last line printed by a command
+	// or the status of a URL.
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// runRestoreChecks runs the after_restore checks of the profile against
+// db, which is empty for the databases of a dump of several, and returns
+// their results. queriesOnly skips commands and URLs.
+func runRestoreChecks(p *Profile, db string, queriesOnly bool) []*RestoreCheckResult {
+	var results []*RestoreCheckResult
+	for _, c := range p.AfterRestore {
+		if queriesOnly && c.Query == "" {
+			continue
+		}
+		r := &RestoreCheckResult{Name: c.label()}
+		var err error
+		switch {
+		case c.Query != "":
+			r.Detail, err = c.runQuery(p, db)
+		case c.URL != "":
+			r.Detail, err = c.fetch()
+		default:
+			dbs := db
+			if dbs == "" {
+				dbs = strings.Join(p.databases(), " ")
+			}
+			r.Detail, err = c.runCommand(dbs)
+		}
+		if err != nil {
+			r.Error = redactError(err)
+		} else {
+			r.OK = true
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func (c *RestoreCheck) runQuery(p *Profile, db string) (string, error) {
+	sql := c.Query
+	if db != "" {
+		sql = "USE " + quoteIdent(db) + "; " + sql
+	}
+	cmd := mysqlCommand(p, "--skip-column-names", "--batch", "--execute="+sql)
+	var out, errOut strings.Builder
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	err := cmd.Start()
+	if err != nil {
+		return "", err
+	}
+	timer := time.AfterFunc(c.timeout(), func() { cmd.Process.Kill() })
+	err = cmd.Wait()
+	if !timer.Stop() {
+		return "", fmt.Errorf("no result in %s", c.timeout())
+	}
+	if err != nil {
+		return "", fmt.Errorf("mysql failed: %w: %s", err, redact(strings.TrimSpace(errOut.String())))
+	}
+	value := strings.SplitN(strings.SplitN(strings.TrimSpace(out.String()), "\n", 2)[0], "\t", 2)[0]
+	if c.Min != nil {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return value, fmt.Errorf("result %q is not a number", value)
+		}
+		if n < *c.Min {
+			return value, fmt.Errorf("result %d is less than %d", n, *c.Min)
+		}
+		return value, nil
+	}
+	if value == "" || value == "0" || value == "NULL" {
+		return value, fmt.Errorf("result is %q", value)
+	}
+	return value, nil
+}
+
+func (c *RestoreCheck) runCommand(db string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Env = append(os.Environ(), restoreDatabaseEnvVar+"="+db)
+	// The output goes to a file rather than a pipe, which children left
+	// running by a command killed on timeout would keep Wait waiting on.
+	f, err := ioutil.TempFile("", "myclinic-restore-check-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	cmd.Stdout = f
+	cmd.Stderr = f
+	err = cmd.Run()
+	out, readErr := ioutil.ReadFile(f.Name())
+	if readErr != nil && err == nil {
+		err = readErr
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+	if ctx.Err() != nil {
+		return last, fmt.Errorf("did not finish in %s", c.timeout())
+	}
+	return last, err
+}
+
+func (c *RestoreCheck) fetch() (string, error) {
+	client := &http.Client{Timeout: c.timeout()}
+	resp, err := client.Get(c.URL)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.Status, fmt.Errorf("status %s", resp.Status)
+	}
+	return resp.Status, nil
+}
+
+// restoreChecksFailed returns an error telling how many checks failed, or
+// nil if all passed.
+func restoreChecksFailed(results []*RestoreCheckResult) error {
+	failed := 0
+	for _, r := range results {
+		if !r.OK {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d checks after the restore failed", failed, len(results))
+}
+
+// restoreResult is the result of a restore through the API: the backup
+// restored, with the checks run after it.
+type restoreResult struct {
+	*CatalogEntry
+	// Snapshot is the backup taken before the restore, which undoes it.
+	Snapshot *CatalogEntry         `json:"snapshot,omitempty"`
+	Checks   []*RestoreCheckResult `json:"checks,omitempty"`
+}
+
+// checkRestore runs the checks after a restore into db, reports them to w
+// and returns them, with an error if any failed.
+func checkRestore(p *Profile, db string, w io.Writer) ([]*RestoreCheckResult, error) {
+	results := runRestoreChecks(p, db, false)
+	printRestoreChecks(w, results)
+	return results, restoreChecksFailed(results)
+}
+
+// printRestoreChecks reports the results to w.
+func printRestoreChecks(w io.Writer, results []*RestoreCheckResult) {
+	if len(results) == 0 {
+		return
+	}
+	fmt.Fprintf(w, tr("Checks after restore:\n"))
+	for _, r := range results {
+		status := tr("PASS")
+		if !r.OK {
+			status = tr("FAIL")
+		}
+		line := "  " + status + "  " + r.Name
+		if r.Detail != "" {
+			line += ": " + r.Detail
+		}
+		if r.Error != "" {
+			line += " (" + r.Error + ")"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
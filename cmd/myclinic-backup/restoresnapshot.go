@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A restore replaces the database it loads into, and restoring the wrong
+// day onto the live database loses the work done since, unless it was
+// backed up first. restore -snapshot, or restore_snapshot in the profile,
+// backs the databases of the profile up before loading anything, labelled
+// pre-restore-YYYYMMDD-HHMM, and prints how to restore that backup to undo
+// the restore. Databases which do not exist or have no tables have nothing
+// to lose and are not backed up; restores into databases other than those
+// of the profile are not snapshot either, as the profile does not back
+// them up.
+
+// restoreSnapshotNeeded reports whether restoring into db, or into the
+// databases of a profile of several, replaces any tables.
+func restoreSnapshotNeeded(p *Profile, db string) (bool, error) {
+	dbs := p.databases()
+	if !p.isMultiDatabase() && db != dbs[0] {
+		fmt.Fprintf(stdout, tr("no snapshot taken: profile %s does not back up %s\n"), p.Name, db)
+		return false, nil
+	}
+	quoted := make([]string, len(dbs))
+	for i, d := range dbs {
+		quoted[i] = quoteString(d)
+	}
+	n, err := mysqlQuery(p, "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema IN ("+
+		strings.Join(quoted, ", ")+")")
+	if err != nil {
+		return false, fmt.Errorf("cannot inspect %s: %v", strings.Join(dbs, ", "), err)
+	}
+	return n != "0", nil
+}
+
+// takeRestoreSnapshot backs up the databases of the profile before the
+// backup e is restored into db, and returns the entry of the snapshot, or
+// nil if there is nothing to back up. A failed snapshot is an error, and
+// the restore must not go on.
+func takeRestoreSnapshot(config *Config, p *Profile, e *CatalogEntry, db string, log io.Writer) (*CatalogEntry, error) {
+	needed, err := restoreSnapshotNeeded(p, db)
+	if err != nil || !needed {
+		return nil, err
+	}
+	now := time.Now()
+	label := "pre-restore-" + now.Format("20060102-1504")
+	fmt.Fprintf(stdout, tr("backing up the current state as %s before restoring\n"), label)
+	if log != nil {
+		fmt.Fprintf(log, tr("backing up the current state as %s before restoring\n"), label)
+	}
+	// An interrupted earlier run would be finished with its old dump,
+	// while the snapshot must be of the database as it is now.
+	result := runProfile(config, p, runOptions{
+		now:     now,
+		trigger: triggerPreRestore,
+		label:   label,
+		note:    "before restoring the backup taken " + e.Time.Format("2006-01-02 15:04"),
+		fresh:   true,
+		log:     log,
+	})
+	if !result.Success {
+		return nil, fmt.Errorf("snapshot before restoring failed, so nothing was restored: %s", result.Error)
+	}
+	return findEntry(p, result.RunID)
+}
+
+// printRollback tells how to undo the restore with the snapshot.
+func printRollback(p *Profile, snapshot *CatalogEntry) {
+	if snapshot == nil {
+		return
+	}
+	fmt.Fprintf(stdout, tr("to undo the restore: myclinic-backup -profile %s restore -date %s\n"), p.Name,
+		snapshot.Time.Local().Format("200601021504"))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var plainDumpPattern = regexp.MustCompile(`^(?:dump-(\d{12})\.sql|files-(\d{12})\.tar)(\.gz)?$`)
+
+// plainDumpTime returns the time a plain dump or file archive was taken, as
+// encoded in its file name by filePart or createArchiveFilePath.
+func plainDumpTime(name string) (time.Time, bool) {
+	m := plainDumpPattern.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation("200601021504", m[1]+m[2], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// retentionRules decide which plain dumps are deleted. With days set, a
+// dump older than days days is deleted; with only keepLast set, any dump
+// is. Either way the keepLast newest dumps are kept whatever their age,
+// and with keepMonthly the newest dump of each of the keepMonthly latest
+// calendar months having any, so that after a long outage followed by
+// pruning the most recent dumps, and one a month, are still there.
+type retentionRules struct {
+	days        int
+	keepLast    int
+	keepMonthly int
+}
+
+func (r retentionRules) prunes() bool {
+	return r.days > 0 || r.keepLast > 0
+}
+
+// plainDump is a plain dump found on disk.
+type plainDump struct {
+	path string
+	time time.Time
+}
+
+// listPlainDumps returns the plain dumps in the month directories under
+// dir, newest first.
+func listPlainDumps(dir string) ([]*plainDump, error) {
+	months, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dumps []*plainDump
+	for _, month := range months {
+		if !month.IsDir() {
+			continue
+		}
+		monthDir := filepath.Join(dir, month.Name())
+		files, err := ioutil.ReadDir(monthDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if t, ok := plainDumpTime(f.Name()); ok {
+				dumps = append(dumps, &plainDump{path: filepath.Join(monthDir, f.Name()), time: t})
+			}
+		}
+	}
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].time.After(dumps[j].time) })
+	return dumps, nil
+}
+
+// expiredPlainDumps returns the dumps, newest first, which the rules
+// delete at now, leaving those in keep.
+func expiredPlainDumps(dumps []*plainDump, rules retentionRules, now time.Time, keep map[string]bool) []*plainDump {
+	if !rules.prunes() {
+		return nil
+	}
+	limit := now.AddDate(0, 0, -rules.days)
+	months := make(map[string]bool)
+	var expired []*plainDump
+	for i, d := range dumps {
+		month := d.time.Format("2006-01")
+		newestOfMonth := !months[month]
+		months[month] = true
+		switch {
+		case i < rules.keepLast:
+		case newestOfMonth && len(months) <= rules.keepMonthly:
+		case rules.days > 0 && !d.time.Before(limit):
+		case keep[filepath.Clean(d.path)]:
+		default:
+			expired = append(expired, d)
+		}
+	}
+	return expired
+}
+
+// expirePlainDumps deletes the plain dumps under dir which the rules
+// delete at now, except those in keep and those not in uploaded, whose
+// only copy they may be. Month directories left empty are removed too.
+func expirePlainDumps(dir string, rules retentionRules, now time.Time, keep, uploaded map[string]bool) ([]string, error) {
+	dumps, err := listPlainDumps(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, d := range expiredPlainDumps(dumps, rules, now, keep) {
+		if !uploaded[filepath.Clean(d.path)] {
+			continue
+		}
+		err := os.Remove(d.path)
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, d.path)
+		// Fails unless the month directory is left empty.
+		os.Remove(filepath.Dir(d.path))
+	}
+	return removed, nil
+}
+
+func (p *Profile) retentionRules() retentionRules {
+	return retentionRules{days: p.PlainRetention, keepLast: p.PlainKeepLast, keepMonthly: p.PlainKeepMonthly}
+}
+
+// prunesPlainDumps reports whether plain dumps of the profile are ever
+// deleted.
+func (p *Profile) prunesPlainDumps() bool {
+	return p.retentionRules().prunes()
+}
+
+// describeRetention tells which plain dumps of the profile are deleted,
+// for confirmations.
+func (p *Profile) describeRetention() string {
+	r := p.retentionRules()
+	var s string
+	if r.days > 0 {
+		s = trf("older than %d days", r.days)
+	} else {
+		s = tr("beyond the newest")
+	}
+	if r.keepLast > 0 {
+		s += trf(", keeping the newest %d", r.keepLast)
+	}
+	if r.keepMonthly > 0 {
+		s += trf(", keeping one for each of the latest %d months", r.keepMonthly)
+	}
+	return s
+}
+
+// expirePlainDumps enforces the retention rules of the profile, keeping
+// current, the dump of a run in progress, the dumps of held backups, with
+// keep_labeled the dumps of labeled backups, and the dumps the catalog
+// does not have an uploaded copy of.
+func (p *Profile) expirePlainDumps(now time.Time, current string) ([]string, error) {
+	keep := make(map[string]bool)
+	if current != "" {
+		keep[filepath.Clean(current)] = true
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	uploaded := make(map[string]bool)
+	for _, e := range entries {
+		if e.Profile != p.Name || e.BackupFile == "" {
+			continue
+		}
+		if e.Hold != nil || (p.KeepLabeled && e.Label != "") {
+			keep[filepath.Clean(e.BackupFile)] = true
+		}
+		if e.isDump() && e.S3Key != "" {
+			uploaded[filepath.Clean(e.BackupFile)] = true
+		}
+	}
+	return expirePlainDumps(p.BackupDir, p.retentionRules(), now, keep, uploaded)
+}
+
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// validateLabel checks a label given with -label, which is meant to be
+// short and usable in scripts, e.g. pre-upgrade-2.3.
+func validateLabel(label string) error {
+	if label != "" && !labelPattern.MatchString(label) {
+		return fmt.Errorf("invalid label %q: use up to 64 letters, digits, '.', '_' and '-'", label)
+	}
+	return nil
+}
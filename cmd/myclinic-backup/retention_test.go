@@ -0,0 +1,214 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newYork observes daylight saving time, which Japan does not.
+func newYork(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	return loc
+}
+
+// dumpsAt returns plain dumps taken at the times, given as 2006-01-02
+// 15:04 in loc, newest first, named by their times.
+func dumpsAt(t *testing.T, loc *time.Location, times ...string) []*plainDump {
+	t.Helper()
+	var dumps []*plainDump
+	for _, s := range times {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dumps = append(dumps, &plainDump{path: s, time: tm})
+	}
+	return dumps
+}
+
+func TestPlainDumpTime(t *testing.T) {
+	want := time.Date(2019, 12, 31, 15, 4, 0, 0, time.Local)
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"dump-201912311504.sql", true},
+		{"dump-201912311504.sql.gz", true},
+		{"files-201912311504.tar", true},
+		{"files-201912311504.tar.gz", true},
+		{"dump-201912311504.sql.tmp", false},
+		{"dump-201913311504.sql", false},
+		{"grants-201912311504.sql", false},
+	} {
+		got, ok := plainDumpTime(tc.name)
+		if ok != tc.ok || ok && !got.Equal(want) {
+			t.Errorf("plainDumpTime(%q) = %v, %v", tc.name, got, ok)
+		}
+	}
+}
+
+func TestExpiredPlainDumps(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	ny := newYork(t)
+	for _, tc := range []struct {
+		name  string
+		loc   *time.Location
+		rules retentionRules
+		now   string
+		dumps []string
+		keep  string
+		want  string
+	}{
+		{
+			name:  "no rules",
+			loc:   tokyo,
+			now:   "2020-01-10 12:00",
+			dumps: []string{"2020-01-09 03:00", "2019-01-09 03:00"},
+		},
+		{
+			name:  "keep last",
+			loc:   tokyo,
+			rules: retentionRules{keepLast: 2},
+			now:   "2020-01-10 12:00",
+			dumps: []string{"2020-01-09 03:00", "2020-01-08 03:00", "2020-01-07 03:00", "2020-01-06 03:00"},
+			want:  "2020-01-07 03:00,2020-01-06 03:00",
+		},
+		{
+			// 2020 is a leap year: three days before March 2 is February
+			// 28.
+			name:  "days across the end of February",
+			loc:   tokyo,
+			rules: retentionRules{days: 3},
+			now:   "2020-03-02 03:00",
+			dumps: []string{"2020-03-02 03:00", "2020-03-01 03:00", "2020-02-29 03:00", "2020-02-28 03:00", "2020-02-27 03:00"},
+			want:  "2020-02-27 03:00",
+		},
+		{
+			name:  "days across the year",
+			loc:   tokyo,
+			rules: retentionRules{days: 2},
+			now:   "2020-01-01 02:00",
+			dumps: []string{"2019-12-31 03:00", "2019-12-30 03:00", "2019-12-29 03:00"},
+			want:  "2019-12-29 03:00",
+		},
+		{
+			name:  "monthly across the year",
+			loc:   tokyo,
+			rules: retentionRules{keepLast: 1, keepMonthly: 3},
+			now:   "2020-01-16 12:00",
+			dumps: []string{"2020-01-15 03:00", "2020-01-05 03:00", "2019-12-20 03:00", "2019-12-10 03:00",
+				"2019-11-30 03:00", "2019-10-01 03:00"},
+			want: "2020-01-05 03:00,2019-12-10 03:00,2019-10-01 03:00",
+		},
+		{
+			// The months count only those having dumps.
+			name:  "monthly after an outage",
+			loc:   tokyo,
+			rules: retentionRules{days: 7, keepMonthly: 2},
+			now:   "2020-06-01 12:00",
+			dumps: []string{"2020-05-31 03:00", "2020-01-31 03:00", "2020-01-01 03:00", "2019-06-01 03:00"},
+			want:  "2020-01-01 03:00,2019-06-01 03:00",
+		},
+		{
+			name:  "kept",
+			loc:   tokyo,
+			rules: retentionRules{keepLast: 1},
+			now:   "2020-01-10 12:00",
+			dumps: []string{"2020-01-09 03:00", "2020-01-08 03:00", "2020-01-07 03:00"},
+			keep:  "2020-01-08 03:00",
+			want:  "2020-01-07 03:00",
+		},
+		{
+			// Days are calendar days: seven days before 01:30 EDT on
+			// March 15 is 01:30 EST on March 8, 169 hours earlier.
+			name:  "days across the start of daylight saving time",
+			loc:   ny,
+			rules: retentionRules{days: 7},
+			now:   "2020-03-15 01:30",
+			dumps: []string{"2020-03-08 03:30", "2020-03-08 01:30", "2020-03-08 01:00"},
+			want:  "2020-03-08 01:00",
+		},
+		{
+			name:  "days across the end of daylight saving time",
+			loc:   ny,
+			rules: retentionRules{days: 1},
+			now:   "2020-11-01 12:00",
+			dumps: []string{"2020-11-01 00:30", "2020-10-31 12:00", "2020-10-31 11:30"},
+			want:  "2020-10-31 11:30",
+		},
+	} {
+		now, err := time.ParseInLocation("2006-01-02 15:04", tc.now, tc.loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keep := make(map[string]bool)
+		if tc.keep != "" {
+			keep[filepath.Clean(tc.keep)] = true
+		}
+		var names []string
+		for _, d := range expiredPlainDumps(dumpsAt(t, tc.loc, tc.dumps...), tc.rules, now, keep) {
+			names = append(names, d.path)
+		}
+		if got := strings.Join(names, ","); got != tc.want {
+			t.Errorf("%s: expired %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Plain dumps are expired after a failed run as after any other, deleting
+// only those with an uploaded backup.
+func TestExpirePlainDumpsAfterFailedRun(t *testing.T) {
+	r, cleanup := testRun(t)
+	defer cleanup()
+	defer withCatalog(r.config.StateDir)()
+	dir := r.config.StateDir
+	r.config.ClockCheck = clockOff
+	r.profile.BackupDir = filepath.Join(dir, "backup")
+	r.profile.PlainRetention = 7
+	r.profile.KeyFile = testKeyFile(t, dir, 1)
+	old := time.Now().AddDate(0, 0, -30)
+	dump := func(at time.Time, uploaded bool) string {
+		t.Helper()
+		path := filepath.Join(r.profile.BackupDir, dirPart(at), filePart(at))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("dump"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		e := &CatalogEntry{RunID: newRunID(), Profile: r.profile.Name, Time: at, BackupFile: path}
+		if uploaded {
+			e.S3Key = filepath.Base(path) + ".cf"
+			// Recorded with another key, which fails the run.
+			e.KeyFingerprint = "0123456789abcdef"
+		}
+		if err := catalog.Add(e); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	expired := dump(old, true)
+	notUploaded := dump(old.Add(time.Hour), false)
+	recent := dump(time.Now().Add(-time.Hour), true)
+
+	err := r.backUp(time.Now(), &ProfileResult{})
+	if err == nil || !strings.Contains(err.Error(), "fingerprint") {
+		t.Fatalf("run ended with %v, want the key check failing", err)
+	}
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("expired dump left: %v", err)
+	}
+	for _, path := range []string{notUploaded, recent} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("dump deleted: %v", err)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ProfileResult is the outcome of backing up one profile.
+type ProfileResult struct {
+	Profile       string    `json:"profile"`
+	RunID         string    `json:"run_id"`
+	Trigger       string    `json:"trigger,omitempty"`
+	Success       bool      `json:"success"`
+	Started       time.Time `json:"started"`
+	Finished      time.Time `json:"finished"`
+	BackupFile    string    `json:"backup_file,omitempty"`
+	EncryptedFile string    `json:"encrypted_file,omitempty"`
+	S3Key         string    `json:"s3_key,omitempty"`
+	// Size is that of the encrypted backup.
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// backupRun carries the state of a backup of one profile.
+type backupRun struct {
+	config  *Config
+	profile *Profile
+	state   *runState
+	entry   *CatalogEntry
+	// work is the work directory of the run.
+	work    string
+	trigger string
+	prefix  string
+	// label and note are recorded with the backup.
+	label string
+	note  string
+	// artifacts are stored besides those of the stages.
+	artifacts []string
+	// log, if set, also receives the progress messages.
+	log io.Writer
+	// dumps and transfers bound the dump and the encryption and upload;
+	// see runOptions.
+	dumps     limiter
+	transfers limiter
+	// clockOff is set if the clock was found off; see checkClock.
+	clockOff bool
+	// span traces the run, and stageSpan the stage being run.
+	span      *span
+	stageSpan *span
+	// keyFingerprint is of the key of the run; see checkKey.
+	keyFingerprint string
+	// fresh ignores an interrupted run; see runOptions.
+	fresh bool
+}
+
+func (r *backupRun) logf(format string, args ...interface{}) {
+	format = tr(format)
+	fmt.Fprintf(stdout, r.prefix+format, args...)
+	if r.log != nil {
+		fmt.Fprintf(r.log, format, args...)
+	}
+}
+
+// prepare resumes the unfinished run of the profile if there is one, or
+// starts a new run at now.
+func (r *backupRun) prepare(now time.Time) error {
+	if !*noResume && !r.fresh && !*dryRun {
+		s, err := loadRunState(r.config.StateDir, r.profile.Name)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			if time.Since(s.Time) <= maxResumeAge {
+				r.logf("resuming run %s started at %s\n", s.RunID, s.Time.Format("2006-01-02 15:04"))
+				r.state = s
+				return nil
+			}
+			r.logf("abandoning unfinished run %s started at %s\n", s.RunID, s.Time.Format("2006-01-02 15:04"))
+		}
+	}
+	r.state = newRunState(r.config.StateDir, r.profile.Name, now)
+	return nil
+}
+
+// createWork creates the work directory of the run.
+func (r *backupRun) createWork() error {
+	if *dryRun {
+		return nil
+	}
+	dir, err := createWorkDir(r.config.workBase(r.profile), r.state.RunID)
+	if err != nil {
+		return fmt.Errorf("cannot create work directory: %v", err)
+	}
+	r.work = dir
+	return nil
+}
+
+// workFile returns where in the work directory the file to be put at
+// final is written.
+func (r *backupRun) workFile(final string) string {
+	return filepath.Join(r.work, filepath.Base(final))
+}
+
+// stage runs f unless an earlier attempt of this run already completed it,
+// and records its completion. Running a stage again, say a dump whose file
+// was lost, makes the stages after it run again too.
+func (r *backupRun) stage(name string, f func() error) error {
+	if r.state.resumable(name) {
+		r.logf("%s already done; skipped\n", name)
+		return nil
+	}
+	if *dryRun {
+		return nil
+	}
+	r.state.redo(name)
+	r.stageSpan = r.span.child(name)
+	err := injectedStageFailure(name)
+	if err == nil {
+		err = f()
+	}
+	r.stageSpan.finish(err)
+	if err != nil {
+		return err
+	}
+	r.state.Done[name] = true
+	return r.state.save()
+}
+
+func (r *backupRun) run(result *ProfileResult) error {
+	var err error
+	// A run interrupted after the dump of a profile not streamed before is
+	// finished as it was started.
+	if r.profile.Stream && (r.state.Streamed != nil || !r.state.Done[stageDump]) {
+		r.dumps.do(func() {
+			r.transfers.do(func() {
+				err = r.stream(result)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return r.complete()
+	}
+	r.dumps.do(func() {
+		err = r.dump(result)
+	})
+	if err != nil {
+		return err
+	}
+	r.transfers.do(func() {
+		err = r.transfer(result)
+	})
+	return err
+}
+
+// dump runs the dump stage.
+func (r *backupRun) dump(result *ProfileResult) error {
+	p := r.profile
+	st := r.state
+	st.BackupFile = p.backupFilePath(st.Time)
+	err := r.stage(stageDump, func() error {
+		tmp := r.workFile(st.BackupFile)
+		if p.isFiles() {
+			err := archiveFiles(tmp, p.Files)
+			if err != nil {
+				return fmt.Errorf("file archive failed: %v", err)
+			}
+		} else if *simulateFlag {
+			err := dumpSynthetic(tmp)
+			if err != nil {
+				return fmt.Errorf("simulated dump failed: %v", err)
+			}
+		} else {
+			err := dumpMysql(tmp, p.mysqldumpCommand(), r.config.LowPriority)
+			if err != nil {
+				return fmt.Errorf("mysql backup failed: %v", err)
+			}
+		}
+		previous, how, err := p.placePlainDump(tmp, st.BackupFile)
+		if err == nil && previous != "" {
+			r.logf("dump is identical to %s; stored as a %s\n", previous, tr(how))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	result.BackupFile = st.BackupFile
+	if p.isFiles() {
+		r.logf("files archived to %s\n", st.BackupFile)
+	} else if *simulateFlag {
+		r.logf("simulated database dump written to %s\n", st.BackupFile)
+	} else {
+		r.logf("database backed up to %s\n", st.BackupFile)
+	}
+	return nil
+}
+
+// transfer runs the stages after the dump: encryption and upload, and
+// then completes the run.
+func (r *backupRun) transfer(result *ProfileResult) error {
+	p := r.profile
+	st := r.state
+	st.EncryptedFile = p.encryptedFilePath(st.Time)
+	err := r.stage(stageEncrypt, func() error {
+		key, err := readEncryptionKey(p.KeyFile)
+		if err != nil {
+			return fmt.Errorf("cannot read encryption key: %v", err)
+		}
+		tmp := r.workFile(st.EncryptedFile)
+		err = encryptBackupFile(tmp, key, st.BackupFile, r.stageSpan)
+		if err != nil {
+			return fmt.Errorf("encryption failed: %v", err)
+		}
+		return moveIntoPlace(tmp, st.EncryptedFile)
+	})
+	if err != nil {
+		return err
+	}
+	result.EncryptedFile = st.EncryptedFile
+	r.logf("encrypted file: %s\n", st.EncryptedFile)
+	if p.target() == targetS3 {
+		r.logf("region: %s\n", p.S3Region)
+	}
+	st.S3Key, err = p.objectKey(createS3Key(p.s3KeyPrefix(), st.EncryptedFile))
+	if err != nil {
+		return err
+	}
+	if p.usesS3API() {
+		r.logf("S3 key: %s\n", st.S3Key)
+	} else {
+		r.logf("stored as: %s\n", p.storedLocation(st.S3Key))
+	}
+	err = r.stage(stageUpload, func() error {
+		storage, err := p.storage(r.stageSpan.s3Requests())
+		if err != nil {
+			return err
+		}
+		err = storage.Put(st.S3Key, st.EncryptedFile)
+		if err != nil {
+			return fmt.Errorf("failed to upload to %s: %v", p.targetName(), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	result.S3Key = st.S3Key
+	return r.complete()
+}
+
+// complete runs the stages after the upload: recording, and storing the
+// grants.
+func (r *backupRun) complete() error {
+	p := r.profile
+	st := r.state
+	err := r.stage(stageRecord, func() error {
+		err := r.record()
+		if err != nil {
+			return fmt.Errorf("cannot record backup in catalog: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return nil
+	}
+	if p.Grants {
+		err = r.backupGrants()
+		if err != nil {
+			return err
+		}
+	}
+	if p.OpaqueNames {
+		err = p.updateManifest()
+		if err != nil {
+			return fmt.Errorf("cannot update manifest: %v", err)
+		}
+	}
+	return st.finish()
+}
+
+// expirePlainDumps enforces plain_retention and the other retention
+// rules, keeping the time unencrypted data stays on disk short. It is done
+// after every run, failed or not: only dumps with an uploaded backup are
+// deleted, so a failed run does not leave the dumps before it the only
+// copies.
+func (r *backupRun) expirePlainDumps() {
+	if !r.profile.prunesPlainDumps() || *dryRun {
+		return
+	}
+	if r.clockOff {
+		r.logf("plain dumps not pruned while the clock is off\n")
+		return
+	}
+	var current string
+	if r.state != nil {
+		current = r.state.BackupFile
+	}
+	removed, err := r.profile.expirePlainDumps(time.Now(), current)
+	for _, path := range removed {
+		r.logf("removed expired plain dump %s\n", path)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, tr("%scannot remove expired plain dumps: %v\n"), r.prefix, err)
+	}
+}
+
+func (r *backupRun) record() error {
+	st := r.state
+	b := st.Streamed
+	if b == nil {
+		var err error
+		b, err = r.measure()
+		if err != nil {
+			return err
+		}
+	}
+	if r.profile.BinlogCoordinates && b.Binlog == nil {
+		fmt.Fprintf(stderr, tr("%sno binlog coordinates in dump; is binary logging enabled?\n"), r.prefix)
+	}
+	r.entry = &CatalogEntry{
+		RunID:           st.RunID,
+		Profile:         r.profile.Name,
+		Time:            st.Time,
+		BackupFile:      st.BackupFile,
+		EncryptedFile:   st.EncryptedFile,
+		S3Bucket:        r.profile.storageBucket(),
+		S3Key:           st.S3Key,
+		Target:          r.profile.targetURL(),
+		ObjectName:      r.profile.objectName(st.EncryptedFile),
+		Size:            b.Size,
+		SHA256:          b.SHA256,
+		EncryptedSize:   b.EncryptedSize,
+		Binlog:          b.Binlog,
+		EncryptedSHA256: b.EncryptedSHA256,
+		Label:           r.label,
+		Note:            r.note,
+		Trigger:         r.trigger,
+		CryptoMode:      cryptoMode(),
+		KeyFingerprint:  r.keyFingerprint,
+		Compression:     transfer.compressor.Name(),
+		Instance:        instanceID,
+	}
+	if st.Streamed != nil {
+		if !r.profile.keepsPlain() {
+			r.entry.BackupFile = ""
+		}
+		if !r.profile.keepsEncrypted() {
+			r.entry.EncryptedFile = ""
+		}
+	}
+	return catalog.Add(r.entry)
+}
+
+// measure reads the sizes, the checksums and the binlog coordinates of the
+// dump and the encrypted backup of the run from their files.
+func (r *backupRun) measure() (*streamedBackup, error) {
+	st := r.state
+	b := &streamedBackup{}
+	var err error
+	b.SHA256, b.Size, err = hashFile(st.BackupFile)
+	if err != nil {
+		return nil, err
+	}
+	b.EncryptedSHA256, b.EncryptedSize, err = hashFile(st.EncryptedFile)
+	if err != nil {
+		return nil, err
+	}
+	if r.profile.BinlogCoordinates {
+		b.Binlog, err = readBinlogCoordinatesFile(st.BackupFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// runOptions tells how profiles are run.
+type runOptions struct {
+	now     time.Time
+	trigger string
+	// label and note are recorded with the backups.
+	label string
+	note  string
+	// labelled prefixes output lines with the profile name.
+	labelled bool
+	// log, if set, also receives the progress messages.
+	log io.Writer
+	// dumps and transfers, if set, bound the number of profiles being
+	// dumped and being encrypted and uploaded at the same time. A profile
+	// gives up its dump slot before waiting for a transfer slot, so the
+	// next profile is dumped while the last one is still uploading.
+	dumps     limiter
+	transfers limiter
+	// fresh starts a new run even if an earlier one was interrupted, as
+	// -no-resume does.
+	fresh bool
+}
+
+func runProfile(config *Config, p *Profile, opts runOptions) *ProfileResult {
+	prefix := ""
+	if opts.labelled {
+		prefix = "[" + p.Name + "] "
+	}
+	r := &backupRun{config: config, profile: p, trigger: opts.trigger, prefix: prefix, log: opts.log,
+		label: opts.label, note: opts.note, dumps: opts.dumps, transfers: opts.transfers, fresh: opts.fresh}
+	result := &ProfileResult{Profile: p.Name, Trigger: opts.trigger, Started: time.Now()}
+	r.span = startTrace("backup")
+	r.span.set("profile", p.Name)
+	r.span.set("trigger", opts.trigger)
+	err := catchPanic(prefix, r.span, func() error { return r.backUp(opts.now, result) })
+	result.Finished = time.Now()
+	if err != nil {
+		result.Error = redactError(err)
+		printError(prefix, err)
+	} else {
+		result.Success = true
+	}
+	r.span.set("run_id", result.RunID)
+	if r.entry != nil {
+		result.Size = r.entry.EncryptedSize
+		r.span.set("backup.encrypted_bytes", r.entry.EncryptedSize)
+	}
+	r.span.finish(err)
+	if !*dryRun {
+		err = auditLog.Append(newAuditRecord(r, result))
+		if err != nil {
+			fmt.Fprintf(stderr, tr("%saudit log: %v\n"), prefix, err)
+		}
+	}
+	h := &HistoryRecord{RunID: result.RunID, Profile: p.Name, Kind: historyBackup, Trigger: result.Trigger,
+		Started: result.Started, Finished: result.Finished, Success: result.Success, Error: result.Error,
+		S3Key: result.S3Key, Label: opts.label}
+	if r.entry != nil {
+		h.Size = r.entry.EncryptedSize
+	}
+	recordHistory(h)
+	err = notify(p.Notify, backupEvent(result))
+	if err != nil {
+		fmt.Fprintf(stderr, prefix+tr("notification failed: %v\n"), err)
+	}
+	return result
+}
+
+// backUp runs the stages of the backup and the pruning after it.
+func (r *backupRun) backUp(now time.Time, result *ProfileResult) error {
+	now, err := r.checkClock(now)
+	if err != nil {
+		return err
+	}
+	defer r.expirePlainDumps()
+	err = r.checkKey()
+	if err == nil {
+		err = r.prepare(now)
+	}
+	if err != nil {
+		return err
+	}
+	result.RunID = r.state.RunID
+	err = r.createWork()
+	if err != nil {
+		return err
+	}
+	err = catchPanic(r.prefix, r.span, func() error { return r.run(result) })
+	if r.work != "" {
+		if rerr := removeWorkDir(r.work); rerr != nil {
+			fmt.Fprintf(stderr, tr("%scannot remove work directory: %v\n"), r.prefix, rerr)
+		}
+	}
+	if err == nil {
+		r.pruneBackups()
+	}
+	return err
+}
+
+// catchPanic returns the error of f, or that of a panic in f, whose stack
+// is printed, so that a bug failing a backup still has it recorded and
+// notified rather than ending the process unnoticed. The trace of s is
+// sent at once, with the spans still open failed by the panic. Panics in
+// goroutines f starts are not caught.
+func catchPanic(prefix string, s *span, f func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			fmt.Fprintf(stderr, "%spanic: %v\n%s", prefix, v, debug.Stack())
+			err = fmt.Errorf("panic: %v", v)
+			s.abort(err)
+		}
+	}()
+	return f()
+}
+
+// limiter bounds the number of profiles backed up concurrently. A nil
+// limiter does not limit.
+type limiter chan struct{}
+
+func newLimiter(n int) limiter {
+	return make(limiter, n)
+}
+
+func (l limiter) do(f func()) {
+	if l == nil {
+		f()
+		return
+	}
+	l <- struct{}{}
+	defer func() { <-l }()
+	f()
+}
+
+// runProfiles backs up the given profiles concurrently, dumping at most as
+// many at a time as lim allows and encrypting and uploading as many as
+// opts.transfers allows, and returns the results in the order of profiles.
+func runProfiles(config *Config, profiles []*Profile, lim limiter, opts runOptions) []*ProfileResult {
+	opts.dumps = lim
+	results := make([]*ProfileResult, len(profiles))
+	var wg sync.WaitGroup
+	for i, p := range profiles {
+		wg.Add(1)
+		go func(i int, p *Profile) {
+			defer wg.Done()
+			results[i] = runProfile(config, p, opts)
+		}(i, p)
+	}
+	wg.Wait()
+	return results
+}
+
+func printResults(results []*ProfileResult) {
+	if len(results) <= 1 {
+		return
+	}
+	for _, r := range results {
+		status := tr("ok")
+		if !r.Success {
+			status = tr("FAILED: ") + r.Error
+		}
+		fmt.Fprintf(stdout, "%s: %s (%s)\n", r.Profile, status,
+			r.Finished.Sub(r.Started).Round(time.Second))
+	}
+}
+
+func allSucceeded(results []*ProfileResult) bool {
+	for _, r := range results {
+		if !r.Success {
+			return false
+		}
+	}
+	return true
+}
+
+// applyResourceLimits keeps a backup from starving interactive use of the
+// machine. Compression runs in this process, so it is lowered in priority
+// with the process itself; compress_threads is applied by the compressor.
+func applyResourceLimits(config *Config) {
+	if config.LowPriority {
+		err := lowerProcessPriority()
+		if err != nil {
+			fmt.Fprintf(stderr, tr("warning: cannot lower process priority: %v\n"), err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Stages of a backup run, in order.
+const (
+	stageDump    = "dump"
+	stageEncrypt = "encrypt"
+	stageUpload  = "upload"
+	stageRecord  = "record"
+)
+
+var stages = []string{stageDump, stageEncrypt, stageUpload, stageRecord}
+
+// maxResumeAge is how old an unfinished run may be to be resumed. Older
+// ones are abandoned and a fresh run is started.
+const maxResumeAge = 24 * time.Hour
+
+// runState is persisted after every stage so that a run interrupted by a
+// crash can be resumed without repeating finished stages.
+type runState struct {
+	RunID         string          `json:"run_id"`
+	Profile       string          `json:"profile"`
+	Time          time.Time       `json:"time"`
+	Done          map[string]bool `json:"done"`
+	BackupFile    string          `json:"backup_file,omitempty"`
+	EncryptedFile string          `json:"encrypted_file,omitempty"`
+	S3Key         string          `json:"s3_key,omitempty"`
+	// Streamed is set once a streamed backup is uploaded; see stream.go.
+	Streamed *streamedBackup `json:"streamed,omitempty"`
+	path     string
+}
+
+func newRunID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func runStatePath(stateDir string, profile string) string {
+	return filepath.Join(stateDir, "runs", profile+".json")
+}
+
+// loadRunState returns the unfinished run of the profile, or nil if there
+// is none to resume.
+func loadRunState(stateDir string, profile string) (*runState, error) {
+	path := runStatePath(stateDir, profile)
+	src, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	src, err = openMetadata(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var s runState
+	err = json.Unmarshal(src, &s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	s.path = path
+	return &s, nil
+}
+
+func newRunState(stateDir string, profile string, now time.Time) *runState {
+	return &runState{
+		RunID:   newRunID(),
+		Profile: profile,
+		Time:    now,
+		Done:    make(map[string]bool),
+		path:    runStatePath(stateDir, profile),
+	}
+}
+
+func (s *runState) save() error {
+	src, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	src, err = sealMetadata(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, src, 0600)
+}
+
+func (s *runState) finish() error {
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// resumable reports whether the stage was completed by an earlier attempt
+// and its output is still there.
+func (s *runState) resumable(stage string) bool {
+	if !s.Done[stage] {
+		return false
+	}
+	switch stage {
+	case stageDump:
+		return fileExists(s.BackupFile)
+	case stageEncrypt:
+		return fileExists(s.EncryptedFile)
+	default:
+		return true
+	}
+}
+
+// redo forgets the completion of the stages after stage, which work on the
+// output it is about to produce again.
+func (s *runState) redo(stage string) {
+	for i, st := range stages {
+		if st != stage {
+			continue
+		}
+		for _, later := range stages[i+1:] {
+			delete(s.Done, later)
+		}
+		return
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testRun returns a run of a profile keeping its state in dir, with its
+// output discarded until the function returned is called.
+func testRun(t *testing.T) (*backupRun, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "runstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := stdout
+	stdout = ioutil.Discard
+	r := &backupRun{config: &Config{StateDir: dir}, profile: &Profile{Name: "myclinic"}}
+	return r, func() {
+		stdout = saved
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPrepareResume(t *testing.T) {
+	r, cleanup := testRun(t)
+	defer cleanup()
+	now := time.Now()
+	for _, tc := range []struct {
+		age     time.Duration
+		resumed bool
+	}{
+		{time.Minute, true},
+		{23 * time.Hour, true},
+		{25 * time.Hour, false},
+		{7 * 24 * time.Hour, false},
+	} {
+		s := newRunState(r.config.StateDir, r.profile.Name, now.Add(-tc.age))
+		s.Done[stageDump] = true
+		if err := s.save(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.prepare(now); err != nil {
+			t.Fatal(err)
+		}
+		if resumed := r.state.RunID == s.RunID; resumed != tc.resumed {
+			t.Errorf("run started %v ago: resumed %v, want %v", tc.age, resumed, tc.resumed)
+		}
+		if !tc.resumed && (!r.state.Time.Equal(now) || len(r.state.Done) != 0) {
+			t.Errorf("run started %v ago: new run at %v with %v done", tc.age, r.state.Time, r.state.Done)
+		}
+	}
+
+	// A finished run is not resumed.
+	s := newRunState(r.config.StateDir, r.profile.Name, now)
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.prepare(now); err != nil {
+		t.Fatal(err)
+	}
+	if r.state.RunID == s.RunID {
+		t.Errorf("finished run %s resumed", s.RunID)
+	}
+}
+
+func TestStageResume(t *testing.T) {
+	r, cleanup := testRun(t)
+	defer cleanup()
+	st := newRunState(r.config.StateDir, r.profile.Name, time.Now())
+	r.state = st
+	st.BackupFile = filepath.Join(r.config.StateDir, "dump.sql")
+	st.EncryptedFile = filepath.Join(r.config.StateDir, "dump.sql.cf")
+	ran := make(map[string]int)
+	stage := func(name string, output string) {
+		t.Helper()
+		err := r.stage(name, func() error {
+			ran[name]++
+			return ioutil.WriteFile(output, []byte(name), 0600)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stage(stageDump, st.BackupFile)
+	stage(stageEncrypt, st.EncryptedFile)
+
+	// The run is resumed from the state saved after each stage.
+	s, err := loadRunState(r.config.StateDir, r.profile.Name)
+	if err != nil || s == nil {
+		t.Fatalf("loadRunState = %v, %v", s, err)
+	}
+	if !s.Done[stageDump] || !s.Done[stageEncrypt] || s.BackupFile != st.BackupFile {
+		t.Fatalf("saved state %+v", s)
+	}
+	r.state = s
+	stage(stageDump, st.BackupFile)
+	stage(stageEncrypt, st.EncryptedFile)
+	if ran[stageDump] != 1 || ran[stageEncrypt] != 1 {
+		t.Errorf("finished stages run again: %v", ran)
+	}
+
+	// A stage whose output is lost is done again.
+	if err := os.Remove(st.EncryptedFile); err != nil {
+		t.Fatal(err)
+	}
+	stage(stageDump, st.BackupFile)
+	stage(stageEncrypt, st.EncryptedFile)
+	if ran[stageDump] != 1 || ran[stageEncrypt] != 2 {
+		t.Errorf("stages run %v, want the encryption again", ran)
+	}
+	if err := os.Remove(st.BackupFile); err != nil {
+		t.Fatal(err)
+	}
+	stage(stageDump, st.BackupFile)
+	if ran[stageDump] != 2 {
+		t.Errorf("stages run %v, want the dump again", ran)
+	}
+
+	// The stages after one done again work on its new output.
+	stage(stageEncrypt, st.EncryptedFile)
+	if ran[stageEncrypt] != 3 {
+		t.Errorf("stages run %v, want the encryption after the new dump", ran)
+	}
+}
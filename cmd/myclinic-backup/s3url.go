@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/hangilc/myclinic-backup/internal/cfstream"
+)
+
+// s3SourceFlags give the credentials for reading a backup by URL, which
+// may be in another bucket or account than that of the profile, such as an
+// escrow copy. Without them the credentials of the profile are used.
+type s3SourceFlags struct {
+	region     *string
+	awsProfile *string
+	roleARN    *string
+	externalID *string
+}
+
+func addS3SourceFlags(flags *flag.FlagSet) *s3SourceFlags {
+	return &s3SourceFlags{
+		region:     flags.String("source-region", "", "region of the bucket of the URL (default looked up)"),
+		awsProfile: flags.String("source-aws-profile", "", "named AWS profile with credentials for the URL"),
+		roleARN:    flags.String("source-role-arn", "", "role to assume for reading the URL"),
+		externalID: flags.String("source-external-id", "", "external ID for -source-role-arn"),
+	}
+}
+
+// resolve returns a copy of p which reads the object at url, and the
+// catalog entry of the object, or one made up from its metadata if it is
+// not in the catalog.
+func (f *s3SourceFlags) resolve(p *Profile, url string) (*Profile, *CatalogEntry, error) {
+	bucket, key, err := parseS3URL(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	src := *p
+	src.S3Bucket = bucket
+	if *f.awsProfile != "" || *f.roleARN != "" {
+		src.AWSProfile = *f.awsProfile
+		src.S3RoleARN = *f.roleARN
+		src.S3ExternalID = *f.externalID
+	}
+	src.S3Region = *f.region
+	if src.S3Region == "" {
+		hint := p.S3Region
+		if hint == "" {
+			hint = "us-east-1"
+		}
+		sess, err := newAWSSession(hint, src.AWSProfile, src.S3RoleARN, src.S3ExternalID, p.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		src.S3Region, err = s3manager.GetBucketRegion(aws.BackgroundContext(), sess, bucket, hint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot find the region of bucket %s (give -source-region): %v", bucket, err)
+		}
+	}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		if e.S3Bucket == bucket && e.S3Key == key {
+			return &src, e, nil
+		}
+	}
+	sess, err := newS3Session(&src)
+	if err != nil {
+		return nil, nil, err
+	}
+	head, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read %s: %v", url, err)
+	}
+	e := &CatalogEntry{
+		Profile:       p.Name,
+		Time:          aws.TimeValue(head.LastModified),
+		S3Bucket:      bucket,
+		S3Key:         key,
+		EncryptedSize: aws.Int64Value(head.ContentLength),
+	}
+	return &src, e, nil
+}
+
+// fetchBackupTo writes the backup of the entry to out, decrypted if
+// decrypt is set and then decompressed if decompress is, reporting
+// progress to log. The object is streamed through, never held in memory.
+func fetchBackupTo(p *Profile, e *CatalogEntry, decrypt bool, decompress bool, out io.Writer, log io.Writer) error {
+	if decrypt {
+		plain, progress, err := openDecryptedStream(p, e, log, decompress)
+		if err != nil {
+			return err
+		}
+		defer plain.Close()
+		_, err = io.Copy(out, plain)
+		if errors.Is(err, cfstream.ErrAuth) {
+			return fmt.Errorf("backup failed authentication (wrong key or corrupted); the output is NOT trustworthy")
+		}
+		if err != nil {
+			return err
+		}
+		progress.report()
+		return nil
+	}
+	storage, err := entryStorage(p, e)
+	if err != nil {
+		return err
+	}
+	body, size, err := storage.Get(e.S3Key)
+	if err != nil {
+		return fmt.Errorf("download failed: %v", err)
+	}
+	defer body.Close()
+	progress := newProgressReader(body, log, "downloading", size)
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), progress)
+	if err != nil {
+		return fmt.Errorf("download failed: %v", err)
+	}
+	progress.report()
+	if sum := hex.EncodeToString(h.Sum(nil)); e.EncryptedSHA256 != "" && sum != e.EncryptedSHA256 {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", e.EncryptedSHA256, sum)
+	}
+	return nil
+}
+
+// fetchCommand downloads a backup, given by URL or else the latest of the
+// profile, as it is stored or decrypted.
+func fetchCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+	output := flags.String("o", "", "file to write, or - for stdout (default the name of the object)")
+	decrypt := flags.Bool("decrypt", false, "decrypts the backup with the key of the profile")
+	decompress := flags.Bool("decompress", true, "with -decrypt, also decompresses the backup; -decompress=false writes it compressed as stored")
+	source := addS3SourceFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		return fmt.Errorf("usage: fetch [options] [s3://bucket/key]")
+	}
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if explicit["decompress"] && *decompress && !*decrypt {
+		return fmt.Errorf("-decompress needs -decrypt: the compressed content is inside the encryption")
+	}
+	p, err := singleProfile(profiles)
+	if err != nil {
+		return err
+	}
+	var e *CatalogEntry
+	if flags.NArg() == 1 {
+		p, e, err = source.resolve(p, flags.Arg(0))
+	} else {
+		e, err = latestUploaded(p)
+	}
+	if err != nil {
+		return err
+	}
+	dest := *output
+	if dest == "" {
+		dest = path.Base(e.S3Key)
+		if *decrypt {
+			dest = strings.TrimSuffix(dest, ".cf")
+			if !*decompress {
+				dest += compressedExt(e.Compression)
+			}
+		}
+	}
+	if *dryRun {
+		fmt.Fprintf(stdout, tr("would fetch %s to %s\n"), entryLocation(e), dest)
+		return nil
+	}
+	if dest == "-" {
+		// The data must not go through stdout, which is copied to the log.
+		return fetchBackupTo(p, e, *decrypt, *decompress, os.Stdout, stderr)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dest), ".fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = fetchBackupTo(p, e, *decrypt, *decompress, f, stdout)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), dest)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, tr("fetched %s to %s\n"), entryLocation(e), dest)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression with the usual five fields
+// (minute, hour, day of month, month, day of week).
+type Schedule struct {
+	minute, hour, dom, month, dow fieldSet
+	domStar, dowStar              bool
+}
+
+type fieldSet map[int]bool
+
+var scheduleFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func parseSchedule(spec string) (*Schedule, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != len(scheduleFields) {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields", spec)
+	}
+	sets := make([]fieldSet, len(parts))
+	for i, part := range parts {
+		f := scheduleFields[i]
+		set, err := parseField(part, f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s: %v", spec, f.name, err)
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &Schedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: parts[2] == "*",
+		dowStar: parts[4] == "*",
+	}, nil
+}
+
+func parseField(field string, min, max int) (fieldSet, error) {
+	set := make(fieldSet)
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			s, err := strconv.Atoi(item[i+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("invalid step: %s", item)
+			}
+			step = s
+			item = item[:i]
+		}
+		lo, hi := min, max
+		if item != "*" {
+			if i := strings.Index(item, "-"); i >= 0 {
+				a, err1 := strconv.Atoi(item[:i])
+				b, err2 := strconv.Atoi(item[i+1:])
+				if err1 != nil || err2 != nil {
+					return nil, fmt.Errorf("invalid range: %s", item)
+				}
+				lo, hi = a, b
+			} else {
+				a, err := strconv.Atoi(item)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value: %s", item)
+				}
+				lo, hi = a, a
+				if step > 1 {
+					hi = max
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("out of range: %s", item)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// Match reports whether the schedule fires at the minute containing t.
+func (s *Schedule) Match(t time.Time) bool {
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+	domMatch := s.dom[t.Day()]
+	dowMatch := s.dow[int(t.Weekday())]
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"0 3 * *",
+		"0 3 * * * *",
+		"60 3 * * *",
+		"0 24 * * *",
+		"0 3 0 * *",
+		"0 3 32 * *",
+		"0 3 * 13 *",
+		"0 3 * * 8",
+		"0 5-3 * * *",
+		"0 3-x * * *",
+		"*/0 3 * * *",
+		"*/x 3 * * *",
+		"0 three * * *",
+		// Names of weekdays are not supported.
+		"0 3 * * mon-fri",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded", spec)
+		}
+	}
+}
+
+// firings returns the minutes from from until to, given as 2006-01-02
+// 15:04 in loc, at which the schedule fires. The minutes are counted in
+// absolute time, as the daemon does, and printed with their offset.
+func firings(t *testing.T, spec string, loc *time.Location, from, to string) string {
+	t.Helper()
+	s := mustParseSchedule(t, spec)
+	start, err := time.ParseInLocation("2006-01-02 15:04", from, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end, err := time.ParseInLocation("2006-01-02 15:04", to, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fired []string
+	for m := start; m.Before(end); m = m.Add(time.Minute) {
+		if s.Match(m) {
+			fired = append(fired, m.Format("2006-01-02 15:04 -0700"))
+		}
+	}
+	return strings.Join(fired, ",")
+}
+
+func TestScheduleMatch(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		from, to string
+		want     string
+	}{
+		{"30 3 * * *", "2020-01-01 00:00", "2020-01-03 00:00",
+			"2020-01-01 03:30 +0900,2020-01-02 03:30 +0900"},
+		{"*/20 9-10 1 1 *", "2020-01-01 00:00", "2020-01-02 00:00",
+			"2020-01-01 09:00 +0900,2020-01-01 09:20 +0900,2020-01-01 09:40 +0900," +
+				"2020-01-01 10:00 +0900,2020-01-01 10:20 +0900,2020-01-01 10:40 +0900"},
+		{"5/30 0 1 1 *", "2020-01-01 00:00", "2020-01-02 00:00",
+			"2020-01-01 00:05 +0900,2020-01-01 00:35 +0900"},
+		{"0 0 1,15 1 *", "2020-01-01 00:00", "2020-02-01 00:00",
+			"2020-01-01 00:00 +0900,2020-01-15 00:00 +0900"},
+		// 7 is Sunday, as 0 is.
+		{"0 0 * 1 7", "2020-01-01 00:00", "2020-01-15 00:00",
+			"2020-01-05 00:00 +0900,2020-01-12 00:00 +0900"},
+		{"0 0 * 1 0", "2020-01-01 00:00", "2020-01-15 00:00",
+			"2020-01-05 00:00 +0900,2020-01-12 00:00 +0900"},
+		// With both restricted, the day of month or the day of week fires.
+		{"0 0 13 1 0", "2020-01-01 00:00", "2020-01-20 00:00",
+			"2020-01-05 00:00 +0900,2020-01-12 00:00 +0900,2020-01-13 00:00 +0900,2020-01-19 00:00 +0900"},
+		// With either unrestricted, both must.
+		{"0 0 13 1 *", "2020-01-01 00:00", "2020-01-20 00:00", "2020-01-13 00:00 +0900"},
+		{"0 0 * 1 1", "2020-01-01 00:00", "2020-01-20 00:00",
+			"2020-01-06 00:00 +0900,2020-01-13 00:00 +0900"},
+		// The 31st fires only in the months having it.
+		{"0 0 31 * *", "2020-01-01 00:00", "2020-06-01 00:00",
+			"2020-01-31 00:00 +0900,2020-03-31 00:00 +0900,2020-05-31 00:00 +0900"},
+		{"0 0 29 2 *", "2019-01-01 00:00", "2021-01-01 00:00", "2020-02-29 00:00 +0900"},
+		// Across the year.
+		{"0 23 31 12 *", "2019-12-31 00:00", "2020-01-02 00:00", "2019-12-31 23:00 +0900"},
+	} {
+		if got := firings(t, tc.spec, jst, tc.from, tc.to); got != tc.want {
+			t.Errorf("%q from %s to %s fires at %q, want %q", tc.spec, tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+func TestScheduleDaylightSavingTime(t *testing.T) {
+	ny := newYork(t)
+	for _, tc := range []struct {
+		spec     string
+		from, to string
+		want     string
+	}{
+		// 02:30 does not happen on March 8, 2020 in New York.
+		{"30 2 * * *", "2020-03-07 00:00", "2020-03-10 00:00",
+			"2020-03-07 02:30 -0500,2020-03-09 02:30 -0400"},
+		{"30 3 * * *", "2020-03-08 00:00", "2020-03-09 00:00", "2020-03-08 03:30 -0400"},
+		// 01:30 happens twice on November 1, 2020.
+		{"30 1 * * *", "2020-11-01 00:00", "2020-11-02 00:00",
+			"2020-11-01 01:30 -0400,2020-11-01 01:30 -0500"},
+		{"0 */6 * * *", "2020-11-01 00:00", "2020-11-02 00:00",
+			"2020-11-01 00:00 -0400,2020-11-01 06:00 -0500,2020-11-01 12:00 -0500,2020-11-01 18:00 -0500"},
+	} {
+		if got := firings(t, tc.spec, ny, tc.from, tc.to); got != tc.want {
+			t.Errorf("%q from %s to %s fires at %q, want %q", tc.spec, tc.from, tc.to, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// A migration run on the live database changes its tables while the
+// backups taken before it, and drills restoring them, go on working. Once
+// a backup is needed, the restored tables then do not fit the application.
+// schema-check compares the tables created by the latest backup with the
+// live database, and drills compare the database they restore into.
+
+// tableDiff is a table whose CREATE TABLE statement differs between the
+// backup and the live database, with the lines found in only one of them.
+type tableDiff struct {
+	Name   string
+	Backup []string
+	Live   []string
+}
+
+// schemaDrift is how the tables of a live database differ from those of a
+// backup.
+type schemaDrift struct {
+	Database   string
+	Exists     bool
+	Same       int
+	OnlyBackup []string
+	OnlyLive   []string
+	Differ     []*tableDiff
+}
+
+func (d *schemaDrift) drifted() bool {
+	return len(d.OnlyBackup) > 0 || len(d.OnlyLive) > 0 || len(d.Differ) > 0
+}
+
+// compareSchemas compares the CREATE TABLE statements of the backup with
+// those of the live database, which is nil if it does not exist.
+func compareSchemas(database string, backup, live map[string]string) *schemaDrift {
+	d := &schemaDrift{Database: database, Exists: live != nil}
+	for _, name := range sortedKeys(backup) {
+		liveStmt, ok := live[name]
+		switch {
+		case !ok:
+			d.OnlyBackup = append(d.OnlyBackup, name)
+		case normalizeCreateTable(liveStmt) == normalizeCreateTable(backup[name]):
+			d.Same++
+		default:
+			b, l := createTableLines(backup[name]), createTableLines(liveStmt)
+			d.Differ = append(d.Differ, &tableDiff{name, linesMissing(b, l), linesMissing(l, b)})
+		}
+	}
+	for _, name := range sortedKeys(live) {
+		if _, ok := backup[name]; !ok {
+			d.OnlyLive = append(d.OnlyLive, name)
+		}
+	}
+	return d
+}
+
+// createTableLines splits a CREATE TABLE statement into the normalized
+// lines of its columns, keys and options. The comma ending a line is
+// dropped, so that adding a column does not change the line before it.
+func createTableLines(s string) []string {
+	s = strings.Replace(s, `\n`, "\n", -1)
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSuffix(normalizeCreateTable(line), ",")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// linesMissing returns the lines of a not in b.
+func linesMissing(a, b []string) []string {
+	in := make(map[string]bool)
+	for _, line := range b {
+		in[line] = true
+	}
+	var missing []string
+	for _, line := range a {
+		if !in[line] {
+			missing = append(missing, line)
+		}
+	}
+	return missing
+}
+
+// schemaCheck compares the tables of the latest backup of the profile with
+// the live databases.
+func schemaCheck(p *Profile) (*CatalogEntry, []*schemaDrift, error) {
+	if p.isFiles() {
+		return nil, nil, fmt.Errorf("profile %s backs up files, not a database", p.Name)
+	}
+	e, err := latestUploaded(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	storage, err := entryStorage(p, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, size, err := storage.Get(e.S3Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("download failed: %v", err)
+	}
+	defer body.Close()
+	plain, err := newDecryptReader(key, newProgressReader(body, stdout, "reading backup", size), true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer plain.Close()
+	schemas, err := dumpSchemas(plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Reading to the end authenticates the backup.
+	_, err = io.Copy(ioutil.Discard, plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	var drifts []*schemaDrift
+	for _, db := range sortedSchemaKeys(schemas) {
+		name := db
+		if name == "" {
+			name = p.databases()[0]
+		}
+		live, err := liveSchema(p, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		drifts = append(drifts, compareSchemas(name, schemas[db], live))
+	}
+	return e, drifts, nil
+}
+
+func sortedSchemaKeys(m map[string]map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func printSchemaDrift(w io.Writer, d *schemaDrift) {
+	if !d.Exists {
+		fmt.Fprintf(w, tr("Database %s: does not exist\n"), d.Database)
+	} else {
+		fmt.Fprintf(w, tr("Database %s: %d tables as in backup\n"), d.Database, d.Same)
+	}
+	for _, name := range d.OnlyBackup {
+		fmt.Fprintf(w, tr("  only in backup: %s\n"), name)
+	}
+	for _, name := range d.OnlyLive {
+		fmt.Fprintf(w, tr("  only in live database: %s\n"), name)
+	}
+	for _, t := range d.Differ {
+		fmt.Fprintf(w, tr("  differs: %s\n"), t.Name)
+		for _, line := range t.Backup {
+			fmt.Fprintf(w, "    - %s\n", line)
+		}
+		for _, line := range t.Live {
+			fmt.Fprintf(w, "    + %s\n", line)
+		}
+	}
+}
+
+func schemaCheckCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("schema-check", flag.ExitOnError)
+	flags.Parse(args)
+	var drifted []string
+	failed := false
+	for _, p := range profiles {
+		prefix := ""
+		if len(profiles) > 1 {
+			prefix = "[" + p.Name + "] "
+		}
+		e, drifts, err := schemaCheck(p)
+		if err != nil {
+			fmt.Fprintf(stderr, tr("%sschema check: %v\n"), prefix, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(stdout, tr("%sBackup: %s (taken %s)\n"), prefix, entryLocation(e), e.Time.Format("2006-01-02 15:04"))
+		for _, d := range drifts {
+			printSchemaDrift(stdout, d)
+			if d.drifted() {
+				drifted = append(drifted, d.Database)
+			}
+		}
+	}
+	if len(drifted) > 0 {
+		return fmt.Errorf("schema of %s differs from the latest backup", strings.Join(drifted, ", "))
+	}
+	if failed {
+		return fmt.Errorf("schema check failed")
+	}
+	return nil
+}
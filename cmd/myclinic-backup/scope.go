@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newS3Session creates the AWS session used for the profile. If the profile
+// has a role, its credentials are obtained by assuming that role, so that
+// what the profile can access is limited by the role's policy.
+func newS3Session(p *Profile) (*session.Session, error) {
+	if p.target() == targetGCS {
+		// Cloud Storage takes HMAC keys as AWS credentials, in any region.
+		region := p.S3Region
+		if region == "" {
+			region = "auto"
+		}
+		sess, err := newAWSSession(region, p.AWSProfile, "", "", p.Name)
+		if err != nil {
+			return nil, err
+		}
+		return sess.Copy(&aws.Config{Endpoint: aws.String(gcsEndpoint)}), nil
+	}
+	return newAWSSession(p.S3Region, p.AWSProfile, p.S3RoleARN, p.S3ExternalID, p.Name)
+}
+
+// newAWSSession creates a session with the credentials of awsProfile in
+// the shared credentials file, or of the default chain if it is empty,
+// which assumes roleARN if given.
+func newAWSSession(region string, awsProfile string, roleARN string, externalID string, name string) (*session.Session, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region:     aws.String(region),
+			HTTPClient: awsHTTPClient(),
+			// The SDK otherwise computes and checks MD5 digests.
+			S3DisableContentMD5Validation: aws.Bool(fipsMode),
+		},
+		Profile: awsProfile,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if roleARN == "" {
+		return sess, nil
+	}
+	creds := stscreds.NewCredentials(sess, roleARN, func(arp *stscreds.AssumeRoleProvider) {
+		arp.RoleSessionName = "myclinic-backup-" + name
+		if externalID != "" {
+			arp.ExternalID = aws.String(externalID)
+		}
+	})
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// validateIsolation checks that profiles sharing a bucket cannot see each
+// other's backups: they must use distinct, non-nested prefixes, distinct
+// encryption keys, and (if any of them uses a role) distinct roles. It
+// returns warnings for profiles sharing a bucket without a role.
+func validateIsolation(profiles []*Profile) ([]configWarning, error) {
+	var warnings []configWarning
+	byBucket := make(map[string][]*Profile)
+	for _, p := range profiles {
+		bucket := p.targetURL()
+		if bucket == "" {
+			bucket = p.S3Bucket
+		}
+		byBucket[bucket] = append(byBucket[bucket], p)
+	}
+	for bucket, ps := range byBucket {
+		if len(ps) < 2 {
+			continue
+		}
+		for _, p := range ps {
+			if p.S3Prefix == "" {
+				return nil, fmt.Errorf("profile %s: s3_prefix is required since bucket %s is shared",
+					p.Name, bucket)
+			}
+		}
+		for i, a := range ps {
+			for _, b := range ps[i+1:] {
+				pa, pb := normalizePrefix(a.S3Prefix), normalizePrefix(b.S3Prefix)
+				if strings.HasPrefix(pa, pb) || strings.HasPrefix(pb, pa) {
+					return nil, fmt.Errorf("profiles %s and %s have overlapping S3 prefixes in bucket %s",
+						a.Name, b.Name, bucket)
+				}
+				if filepath.Clean(a.KeyFile) == filepath.Clean(b.KeyFile) {
+					return nil, fmt.Errorf("profiles %s and %s share encryption key %s",
+						a.Name, b.Name, a.KeyFile)
+				}
+				if (a.S3RoleARN != "" || b.S3RoleARN != "") && a.S3RoleARN == b.S3RoleARN {
+					return nil, fmt.Errorf("profiles %s and %s share role %s",
+						a.Name, b.Name, a.S3RoleARN)
+				}
+			}
+			if a.S3RoleARN == "" {
+				warnings = append(warnings, configWarning{
+					"warning: profile %s shares bucket %s but has no s3_role_arn; its credentials are not scoped to its prefix\n",
+					[]interface{}{a.Name, bucket}})
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// bucketFeatures are what the actions a profile needs depend on of its
+// bucket, which the configuration does not tell.
+type bucketFeatures struct {
+	// objectLock lets hold place S3 legal holds.
+	objectLock bool
+	// versioned keeps the versions of overwritten and deleted objects.
+	versioned bool
+}
+
+// iamPolicy returns an IAM policy document granting access only to the
+// profile's prefix, to be attached to the profile's role, with the
+// actions the profile needs in a bucket with features b.
+func iamPolicy(p *Profile, b bucketFeatures) (string, error) {
+	prefix := normalizePrefix(p.S3Prefix)
+	bucketArn := "arn:aws:s3:::" + p.S3Bucket
+	objectActions := []string{"s3:PutObject", "s3:GetObject", "s3:DeleteObject", "s3:AbortMultipartUpload"}
+	listActions := []string{"s3:ListBucket"}
+	if b.objectLock {
+		objectActions = append(objectActions, "s3:PutObjectLegalHold", "s3:GetObjectLegalHold")
+	}
+	if b.versioned {
+		// Uploads are checked by the version they made.
+		objectActions = append(objectActions, "s3:GetObjectVersion")
+		if p.Retention != nil {
+			// Pruned backups leave versions behind.
+			objectActions = append(objectActions, "s3:DeleteObjectVersion")
+			listActions = append(listActions, "s3:ListBucketVersions")
+		}
+	}
+	policy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{
+			{
+				"Effect":   "Allow",
+				"Action":   objectActions,
+				"Resource": bucketArn + "/" + prefix + "*",
+			},
+			{
+				"Effect":   "Allow",
+				"Action":   listActions,
+				"Resource": bucketArn,
+				"Condition": map[string]interface{}{
+					"StringLike": map[string]interface{}{
+						"s3:prefix": prefix + "*",
+					},
+				},
+			},
+			{
+				// hold looks whether the bucket has Object Lock.
+				"Effect":   "Allow",
+				"Action":   "s3:GetBucketObjectLockConfiguration",
+				"Resource": bucketArn,
+			},
+		},
+	}
+	doc, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(doc), nil
+}
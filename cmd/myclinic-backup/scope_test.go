@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidateIsolation(t *testing.T) {
+	savedErr := stderr
+	var errOut bytes.Buffer
+	stderr = &errOut
+	defer func() { stderr = savedErr }()
+	profile := func(name, prefix, key, role string) *Profile {
+		return &Profile{Name: name, S3Bucket: "clinic", S3Prefix: prefix, KeyFile: key, S3RoleARN: role}
+	}
+	for _, tc := range []struct {
+		profiles []*Profile
+		warnings string
+		ok       bool
+	}{
+		{[]*Profile{profile("a", "", "a.key", ""), {Name: "b", S3Bucket: "other", KeyFile: "a.key"}}, "", true},
+		{[]*Profile{profile("a", "a", "a.key", "role/a"), profile("b", "b", "b.key", "role/b")}, "", true},
+		{[]*Profile{profile("a", "a", "a.key", "role/a"), profile("b", "b", "b.key", "")},
+			"warning: profile b shares bucket clinic but has no s3_role_arn; its credentials are not scoped to its prefix\n", true},
+		{[]*Profile{profile("a", "a", "a.key", "role/a"), profile("b", "", "b.key", "role/b")}, "", false},
+		{[]*Profile{profile("a", "a/", "a.key", "role/a"), profile("b", "/a/b", "b.key", "role/b")}, "", false},
+		{[]*Profile{profile("a", "a", "a.key", "role/a"), profile("b", "b", "a.key", "role/b")}, "", false},
+		{[]*Profile{profile("a", "a", "a.key", "role/a"), profile("b", "b", "b.key", "role/a")}, "", false},
+	} {
+		warnings, err := validateIsolation(tc.profiles)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s and %s: %v", tc.profiles[0].Name, tc.profiles[1].Name, err)
+		}
+		var got string
+		for _, w := range warnings {
+			got += fmt.Sprintf(w.format, w.args...)
+		}
+		if got != tc.warnings {
+			t.Errorf("warnings %q, want %q", got, tc.warnings)
+		}
+	}
+	if errOut.Len() != 0 {
+		t.Errorf("validateIsolation wrote %q", errOut.String())
+	}
+}
+
+// policyActions returns the actions the policy allows, with the resource
+// of their statement.
+func policyActions(t *testing.T, doc string) map[string]string {
+	t.Helper()
+	var policy struct {
+		Statement []struct {
+			Action   interface{}
+			Resource string
+		}
+	}
+	if err := json.Unmarshal([]byte(doc), &policy); err != nil {
+		t.Fatal(err)
+	}
+	actions := make(map[string]string)
+	for _, st := range policy.Statement {
+		switch a := st.Action.(type) {
+		case string:
+			actions[a] = st.Resource
+		case []interface{}:
+			for _, v := range a {
+				actions[v.(string)] = st.Resource
+			}
+		}
+	}
+	return actions
+}
+
+func TestIAMPolicyActions(t *testing.T) {
+	objects, bucket := "arn:aws:s3:::clinic/a/*", "arn:aws:s3:::clinic"
+	base := []string{"s3:PutObject", "s3:GetObject", "s3:DeleteObject", "s3:AbortMultipartUpload", "s3:ListBucket",
+		"s3:GetBucketObjectLockConfiguration"}
+	hold := []string{"s3:PutObjectLegalHold", "s3:GetObjectLegalHold"}
+	versions := []string{"s3:DeleteObjectVersion", "s3:ListBucketVersions"}
+	pruned := &RetentionConfig{KeepLast: 3}
+	for _, tc := range []struct {
+		name      string
+		retention *RetentionConfig
+		features  bucketFeatures
+		want      []string
+	}{
+		{"plain bucket", pruned, bucketFeatures{}, base},
+		{"object lock", pruned, bucketFeatures{objectLock: true}, append(append([]string{}, base...), hold...)},
+		{"versioned", nil, bucketFeatures{versioned: true}, append(append([]string{}, base...), "s3:GetObjectVersion")},
+		{"versioned, pruned", pruned, bucketFeatures{versioned: true},
+			append(append([]string{}, base...), append(versions, "s3:GetObjectVersion")...)},
+	} {
+		p := &Profile{Name: "a", S3Bucket: "clinic", S3Prefix: "a", Retention: tc.retention}
+		doc, err := iamPolicy(p, tc.features)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := policyActions(t, doc)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: actions %v, want %v", tc.name, got, tc.want)
+		}
+		for _, a := range tc.want {
+			resource, ok := got[a]
+			if !ok {
+				t.Errorf("%s: %s not allowed", tc.name, a)
+				continue
+			}
+			want := objects
+			if strings.HasPrefix(a, "s3:ListBucket") || strings.HasPrefix(a, "s3:GetBucket") {
+				want = bucket
+			}
+			if resource != want {
+				t.Errorf("%s: %s allowed on %s, want %s", tc.name, a, resource, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// SFTPConfig is the SFTP server backups are stored on with target sftp.
+// As with ssh, only key authentication is used, and the host key must
+// already be known.
+type SFTPConfig struct {
+	SSHConfig `yaml:",inline"`
+	// Dir is the directory on the server the keys are below.
+	Dir string `yaml:"dir"`
+}
+
+const (
+	sftpHostEnvVar  = "MYCLINIC_BACKUP_SFTP_HOST"
+	targetDirEnvVar = "MYCLINIC_BACKUP_TARGET_DIR"
+)
+
+// sftpEnv returns the server given by $MYCLINIC_BACKUP_SFTP_HOST as
+// [user@]host[:port], with the directory of $MYCLINIC_BACKUP_TARGET_DIR,
+// or nil if it is not set.
+func sftpEnv() (*SFTPConfig, error) {
+	host := os.Getenv(sftpHostEnvVar)
+	if host == "" {
+		return nil, nil
+	}
+	u, err := url.Parse("sftp://" + host)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", sftpHostEnvVar, err)
+	}
+	c := &SFTPConfig{Dir: os.Getenv(targetDirEnvVar)}
+	c.Host = u.Hostname()
+	c.User = u.User.Username()
+	if port := u.Port(); port != "" {
+		c.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", sftpHostEnvVar, err)
+		}
+	}
+	return c, nil
+}
+
+// sftpStorage stores objects on an SFTP server with the sftp command, so
+// that servers allowing SFTP only, as is usual, can be used. Each call
+// runs one batch of sftp commands.
+type sftpStorage struct {
+	ssh SSHConfig
+	dir string
+}
+
+// sftpQuote quotes an argument of a command of sftp.
+func sftpQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+func (s *sftpStorage) path(key string) string {
+	return path.Join(s.dir, key)
+}
+
+// run runs the sftp commands, which stop at the first failing unless
+// prefixed with -, and returns what they printed.
+func (s *sftpStorage) run(commands []string) ([]byte, error) {
+	args := []string{"-b", "-", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes"}
+	if s.ssh.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+s.ssh.KnownHostsFile)
+	}
+	if s.ssh.IdentityFile != "" {
+		args = append(args, "-o", "IdentitiesOnly=yes", "-i", s.ssh.IdentityFile)
+	}
+	if s.ssh.Port != 0 {
+		args = append(args, "-P", strconv.Itoa(s.ssh.Port))
+	}
+	dest := s.ssh.Host
+	if s.ssh.User != "" {
+		dest = s.ssh.User + "@" + s.ssh.Host
+	}
+	cmd := exec.Command("sftp", append(args, dest)...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	var out, errOut bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(errOut.String())
+		if msg == "" {
+			return nil, fmt.Errorf("sftp to %s failed: %v", dest, err)
+		}
+		return nil, fmt.Errorf("sftp to %s failed: %v: %s", dest, err, msg)
+	}
+	return out.Bytes(), nil
+}
+
+// Put uploads the file next to its place and renames it into place, so
+// that the stored file appears only whole, then checks its size.
+func (s *sftpStorage) Put(key string, filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	dst := s.path(key)
+	var commands []string
+	// Directories which exist already make mkdir fail, which - ignores.
+	var dirs []string
+	for d := path.Dir(dst); d != "." && d != "/"; d = path.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+	}
+	for _, d := range dirs {
+		commands = append(commands, "-mkdir "+sftpQuote(d))
+	}
+	tmp := dst + ".tmp"
+	commands = append(commands, "put "+sftpQuote(filename)+" "+sftpQuote(tmp),
+		"-rm "+sftpQuote(dst), "rename "+sftpQuote(tmp)+" "+sftpQuote(dst))
+	_, err = s.run(commands)
+	if err != nil {
+		return err
+	}
+	objects, err := s.listDir(path.Dir(dst), path.Dir(key))
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if o.Key == key {
+			if o.Size != info.Size() {
+				return fmt.Errorf("stored %s has %d bytes, expected %d", dst, o.Size, info.Size())
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not found after upload", dst)
+}
+
+// Get downloads the object to a temporary file, as sftp cannot write to
+// a pipe, which is removed when closed.
+func (s *sftpStorage) Get(key string) (io.ReadCloser, int64, error) {
+	f, err := ioutil.TempFile("", "myclinic-backup-sftp-")
+	if err != nil {
+		return nil, 0, err
+	}
+	tmp := f.Name()
+	f.Close()
+	_, err = s.run([]string{"get " + sftpQuote(s.path(key)) + " " + sftpQuote(tmp)})
+	if err == nil {
+		var body io.ReadCloser
+		var size int64
+		body, size, err = openLocalFile(tmp)
+		if err == nil {
+			return &removingCloser{body, tmp}, size, nil
+		}
+	}
+	os.Remove(tmp)
+	return nil, 0, err
+}
+
+// removingCloser removes the file it reads when closed.
+type removingCloser struct {
+	io.ReadCloser
+	path string
+}
+
+func (c *removingCloser) Close() error {
+	err := c.ReadCloser.Close()
+	os.Remove(c.path)
+	return err
+}
+
+// List walks the directories below the prefix, one batch for each.
+func (s *sftpStorage) List(prefix string) ([]storedObject, error) {
+	var objects []storedObject
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := s.listDir(s.path(dir), dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if strings.HasSuffix(e.Key, "/") {
+				sub := strings.TrimSuffix(e.Key, "/")
+				if strings.HasPrefix(sub+"/", prefix) || strings.HasPrefix(prefix, sub+"/") {
+					err = walk(sub)
+					if err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(e.Key, prefix) && !strings.HasSuffix(e.Key, ".tmp") {
+				objects = append(objects, e)
+			}
+		}
+		return nil
+	}
+	err := walk("")
+	sortObjects(objects)
+	return objects, err
+}
+
+// listDir lists the remote directory dir, whose key is keyDir, returning
+// the keys of subdirectories with a trailing slash. A missing directory is
+// empty.
+func (s *sftpStorage) listDir(dir string, keyDir string) ([]storedObject, error) {
+	if dir == "" {
+		dir = "."
+	}
+	out, err := s.run([]string{"-ls -ln " + sftpQuote(dir)})
+	if err != nil {
+		return nil, err
+	}
+	var objects []storedObject
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		// -rw-r--r--    1 1000     1000         1234 Jun  1 12:00 name
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 9 || strings.HasPrefix(fields[0], "sftp>") {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			continue
+		}
+		name := path.Base(strings.Join(fields[8:], " "))
+		if name == "." || name == ".." {
+			continue
+		}
+		key := name
+		if keyDir != "" && keyDir != "." {
+			key = keyDir + "/" + name
+		}
+		switch fields[0][0] {
+		case 'd':
+			objects = append(objects, storedObject{Key: key + "/"})
+		case '-':
+			objects = append(objects, storedObject{key, size})
+		}
+	}
+	return objects, nil
+}
+
+// Delete removes the files in one batch, then lists their directories to
+// find those which are left.
+func (s *sftpStorage) Delete(keys []string) (map[string]string, error) {
+	var commands []string
+	dirs := make(map[string]bool)
+	var order []string
+	for _, key := range keys {
+		commands = append(commands, "-rm "+sftpQuote(s.path(key)))
+		d := path.Dir(key)
+		if !dirs[d] {
+			dirs[d] = true
+			order = append(order, d)
+		}
+	}
+	_, err := s.run(commands)
+	if err != nil {
+		return nil, err
+	}
+	left := make(map[string]bool)
+	for _, d := range order {
+		objects, err := s.listDir(s.path(d), d)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			left[o.Key] = true
+		}
+	}
+	failed := make(map[string]string)
+	for _, key := range keys {
+		if left[key] {
+			failed[key] = "still present after rm"
+		}
+	}
+	return failed, nil
+}
+
+func (s *sftpStorage) Target() string {
+	u := &url.URL{Scheme: "sftp", Host: s.ssh.Host, Path: s.dir}
+	if s.ssh.Port != 0 {
+		u.Host += ":" + strconv.Itoa(s.ssh.Port)
+	}
+	if s.ssh.User != "" {
+		u.User = url.User(s.ssh.User)
+	}
+	if !path.IsAbs(s.dir) {
+		// The directory is relative to the home directory, which the
+		// path of a URL cannot tell but by this.
+		u.Path = "./" + s.dir
+	}
+	return u.String()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Privacy policies may require that no one person can decrypt patient
+// data. split-key splits the key of a profile into shares by Shamir's
+// secret sharing, such that any threshold of them, say those of the clinic
+// director and of the IT contractor, recover the key with combine-key,
+// while fewer tell nothing about it. Shares are printable like escrow
+// bundles and are not otherwise protected, so each must be handed to its
+// holder and the key file itself kept only where backups are taken. A
+// split is recorded in the catalog as an escrow of the key.
+
+const shareTitle = "KEY SHARE"
+
+// gf256Exp and gf256Log are the powers of 3 in GF(2^8) with the AES
+// polynomial, and their logarithms.
+var gf256Exp, gf256Log = gf256Tables()
+
+func gf256Tables() (exp [255]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		log[x] = byte(i)
+		// x *= 3
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return
+}
+
+func gf256Mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gf256Exp[(int(gf256Log[a])+int(gf256Log[b]))%255]
+}
+
+func gf256Div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gf256Exp[(int(gf256Log[a])-int(gf256Log[b])+255)%255]
+}
+
+// splitSecret returns n shares of the secret, any k of which recover it.
+// Share i is evaluated at x = i+1, which it starts with.
+func splitSecret(secret []byte, n int, k int) ([][]byte, error) {
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, 1+len(secret))
+		shares[i][0] = byte(i + 1)
+	}
+	coef := make([]byte, k)
+	for j, s := range secret {
+		coef[0] = s
+		_, err := rand.Read(coef[1:])
+		if err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := shares[i][0]
+			// Horner's rule.
+			var y byte
+			for c := k - 1; c >= 0; c-- {
+				y = gf256Mul(y, x) ^ coef[c]
+			}
+			shares[i][1+j] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineShares recovers the secret from shares made by splitSecret, by
+// Lagrange interpolation at 0.
+func combineShares(shares [][]byte) ([]byte, error) {
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if len(s) != len(shares[0]) || len(s) < 2 || s[0] == 0 {
+			return nil, fmt.Errorf("the shares do not belong together")
+		}
+		if seen[s[0]] {
+			return nil, fmt.Errorf("share %d is given twice", s[0])
+		}
+		seen[s[0]] = true
+	}
+	secret := make([]byte, len(shares[0])-1)
+	for i, si := range shares {
+		// The Lagrange basis polynomial of share i at 0.
+		l := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				l = gf256Mul(l, gf256Div(sj[0], sj[0]^si[0]))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gf256Mul(l, si[1+b])
+		}
+	}
+	return secret, nil
+}
+
+// splitKeyCommand writes the shares of the key of a profile to files.
+func splitKeyCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("split-key", flag.ExitOnError)
+	n := flags.Int("shares", 3, "number of shares")
+	k := flags.Int("threshold", 2, "number of shares needed to recover the key")
+	dir := flags.String("o", ".", "directory to write the shares to")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: split-key [-shares N] [-threshold K] [-o DIR]")
+	}
+	if *k < 2 || *n < *k || *n > 255 {
+		return fmt.Errorf("-threshold must be at least 2 and at most -shares, which must be at most 255")
+	}
+	p, err := singleProfile(profiles)
+	if err != nil {
+		return err
+	}
+	key, err := readEncryptionKey(p.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read encryption key: %v", err)
+	}
+	fingerprint := keyFingerprint(key)
+	paths := make([]string, *n)
+	for i := range paths {
+		paths[i] = filepath.Join(*dir, fmt.Sprintf("%s-key-share-%d-of-%d.txt", p.Name, i+1, *n))
+		if _, err := os.Stat(paths[i]); err == nil {
+			return fmt.Errorf("%s exists", paths[i])
+		}
+	}
+	if *dryRun {
+		fmt.Fprintf(stdout, tr("would split the key of %s (fingerprint %s) into %d shares, %d of which recover it\n"),
+			p.Name, fingerprint, *n, *k)
+		return nil
+	}
+	shares, err := splitSecret(key, *n, *k)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 4)
+	_, err = rand.Read(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i, share := range shares {
+		var b bytes.Buffer
+		writeArmored(&b, shareTitle, []string{
+			"Profile: " + p.Name,
+			"Fingerprint: " + fingerprint,
+			"Split: " + hex.EncodeToString(id) + " " + now.Format("2006-01-02 15:04 -0700"),
+			fmt.Sprintf("Share: %d of %d", i+1, *n),
+			fmt.Sprintf("Threshold: %d", *k),
+		}, share)
+		err = writeFileAtomic(paths[i], b.Bytes(), 0600)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, tr("share %d written to %s\n"), i+1, paths[i])
+	}
+	err = catalog.Add(&CatalogEntry{RunID: newRunID(), Profile: p.Name, Kind: kindEscrow, Time: now,
+		Name: fmt.Sprintf("%d of %d shares", *k, *n), KeyFingerprint: fingerprint, Trigger: triggerManual,
+		Instance: instanceID})
+	if err != nil {
+		return fmt.Errorf("cannot record the split in catalog: %v", err)
+	}
+	fmt.Fprintf(stdout, tr("hand each share to its holder and delete the files; any %d of them recover the key\n"), *k)
+	return nil
+}
+
+// keyShare is a share as read back.
+type keyShare struct {
+	path        string
+	split       string
+	fingerprint string
+	threshold   int
+	data        []byte
+}
+
+func readKeyShare(path string) (*keyShare, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	headers, data, err := readArmored(f, shareTitle)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	s := &keyShare{path: path, split: strings.Fields(headers["Split"] + " ")[0],
+		fingerprint: headers["Fingerprint"], data: data}
+	s.threshold, err = strconv.Atoi(headers["Threshold"])
+	if err != nil || s.threshold < 2 || s.split == "" {
+		return nil, fmt.Errorf("%s: not a complete key share", path)
+	}
+	return s, nil
+}
+
+// combineKeyCommand recovers a key from its shares and writes it to a key
+// file.
+func combineKeyCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("combine-key", flag.ExitOnError)
+	output := flags.String("o", "", "key file to write (default the key_file of the profile)")
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		return fmt.Errorf("usage: combine-key [-o KEYFILE] SHARE SHARE...")
+	}
+	dest := *output
+	if dest == "" {
+		p, err := singleProfile(profiles)
+		if err != nil {
+			return fmt.Errorf("%v, or give the key file with -o", err)
+		}
+		dest = p.KeyFile
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s exists; move it away or give another file with -o", dest)
+	}
+	var shares []*keyShare
+	var data [][]byte
+	for _, path := range flags.Args() {
+		s, err := readKeyShare(path)
+		if err != nil {
+			return err
+		}
+		if len(shares) > 0 && s.split != shares[0].split {
+			return fmt.Errorf("%s is a share of another split than %s", path, shares[0].path)
+		}
+		shares = append(shares, s)
+		data = append(data, s.data)
+	}
+	if len(shares) < shares[0].threshold {
+		return fmt.Errorf("%d shares are needed to recover the key, not %d", shares[0].threshold, len(shares))
+	}
+	key, err := combineShares(data)
+	if err != nil {
+		return err
+	}
+	if keyFingerprint(key) != shares[0].fingerprint {
+		return fmt.Errorf("the recovered key does not match the fingerprint of the shares, %s", shares[0].fingerprint)
+	}
+	return writeKeyFile(dest, key)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+// slowMul multiplies in GF(2^8) with the AES polynomial bit by bit.
+func slowMul(a, b byte) byte {
+	var p byte
+	for b != 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		hi := a & 0x80
+		a <<= 1
+		if hi != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func TestGF256Tables(t *testing.T) {
+	seen := make(map[byte]bool)
+	for i, x := range gf256Exp {
+		if x == 0 || seen[x] {
+			t.Fatalf("3^%d = %d is zero or repeated", i, x)
+		}
+		seen[x] = true
+		if int(gf256Log[x]) != i {
+			t.Fatalf("log %d = %d, want %d", x, gf256Log[x], i)
+		}
+	}
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			p := gf256Mul(byte(a), byte(b))
+			if want := slowMul(byte(a), byte(b)); p != want {
+				t.Fatalf("%d * %d = %d, want %d", a, b, p, want)
+			}
+			if b != 0 && gf256Div(p, byte(b)) != byte(a) {
+				t.Fatalf("%d * %d / %d = %d", a, b, b, gf256Div(p, byte(b)))
+			}
+		}
+	}
+}
+
+// subsets calls f with every subset of k of the indices below n, in
+// increasing and in decreasing order.
+func subsets(n, k int, f func([]int)) {
+	var rec func(start int, chosen []int)
+	rec = func(start int, chosen []int) {
+		if len(chosen) == k {
+			f(chosen)
+			reversed := make([]int, k)
+			for i, c := range chosen {
+				reversed[k-1-i] = c
+			}
+			f(reversed)
+			return
+		}
+		for i := start; i < n; i++ {
+			rec(i+1, append(chosen, i))
+		}
+	}
+	rec(0, nil)
+}
+
+func pick(shares [][]byte, indices []int) [][]byte {
+	var picked [][]byte
+	for _, i := range indices {
+		picked = append(picked, shares[i])
+	}
+	return picked
+}
+
+func TestSplitSecret(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := keyFingerprint(key)
+	for n := 2; n <= 6; n++ {
+		for k := 2; k <= n; k++ {
+			shares, err := splitSecret(key, n, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(shares) != n {
+				t.Fatalf("%d of %d: %d shares", k, n, len(shares))
+			}
+			for i, s := range shares {
+				if len(s) != 1+len(key) || s[0] != byte(i+1) {
+					t.Fatalf("%d of %d: share %d starts %d, is %d bytes", k, n, i, s[0], len(s))
+				}
+			}
+			subsets(n, k, func(indices []int) {
+				got, err := combineShares(pick(shares, indices))
+				if err != nil {
+					t.Fatalf("%d of %d, shares %v: %v", k, n, indices, err)
+				}
+				if !bytes.Equal(got, key) {
+					t.Fatalf("%d of %d, shares %v: wrong key", k, n, indices)
+				}
+			})
+			// More than k recover it too.
+			if k < n {
+				subsets(n, k+1, func(indices []int) {
+					got, err := combineShares(pick(shares, indices))
+					if err != nil || !bytes.Equal(got, key) {
+						t.Fatalf("%d of %d, shares %v: %v", k, n, indices, err)
+					}
+				})
+			}
+			subsets(n, k-1, func(indices []int) {
+				got, err := combineShares(pick(shares, indices))
+				if err != nil {
+					t.Fatalf("%d of %d, shares %v: %v", k, n, indices, err)
+				}
+				if keyFingerprint(got) == fp {
+					t.Fatalf("%d of %d: shares %v alone match the fingerprint of the key", k, n, indices)
+				}
+			})
+		}
+	}
+}
+
+func TestSplitSecretMostShares(t *testing.T) {
+	key := []byte("a key of 32 bytes, known to all.")
+	shares, err := splitSecret(key, 255, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, indices := range [][]int{{0, 1, 2}, {254, 253, 252}, {0, 127, 254}} {
+		got, err := combineShares(pick(shares, indices))
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("shares %v: %q, %v", indices, got, err)
+		}
+	}
+}
+
+func TestCombineSharesRejects(t *testing.T) {
+	shares, err := splitSecret([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := splitSecret([]byte("longer secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"twice", [][]byte{shares[0], shares[0]}},
+		{"other lengths", [][]byte{shares[0], other[1]}},
+		{"x of 0", [][]byte{append([]byte{0}, shares[0][1:]...), shares[1]}},
+		{"no secret", [][]byte{{1}, {2}}},
+	} {
+		if _, err := combineShares(tc.shares); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
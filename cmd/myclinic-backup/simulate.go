@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseByteSize parses a size such as 500KB, 20MB or 1GB, in units of
+// 1024 bytes as formatBytes prints them.
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"GIB", 1 << 30}, {"GB", 1 << 30}, {"G", 1 << 30},
+		{"MIB", 1 << 20}, {"MB", 1 << 20}, {"M", 1 << 20},
+		{"KIB", 1 << 10}, {"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	}
+	t := strings.ToUpper(strings.TrimSpace(s))
+	factor := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(t, u.suffix) {
+			t = strings.TrimSpace(strings.TrimSuffix(t, u.suffix))
+			factor = u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return int64(n * float64(factor)), nil
+}
+
+// syntheticTables is the part of the myclinic schema the simulated dump
+// contains. Rows are generated by the row functions.
+var syntheticTables = []struct {
+	name   string
+	create string
+	row    func(g *syntheticGenerator, id int) string
+}{
+	{"patient", "CREATE TABLE `patient` (\n" +
+		"  `patient_id` int NOT NULL AUTO_INCREMENT,\n" +
+		"  `last_name` varchar(40) NOT NULL,\n" +
+		"  `first_name` varchar(40) NOT NULL,\n" +
+		"  `last_name_yomi` varchar(40) NOT NULL,\n" +
+		"  `first_name_yomi` varchar(40) NOT NULL,\n" +
+		"  `birth_day` date NOT NULL,\n" +
+		"  `sex` char(1) NOT NULL,\n" +
+		"  `address` varchar(200) DEFAULT NULL,\n" +
+		"  `phone` varchar(40) DEFAULT NULL,\n" +
+		"  PRIMARY KEY (`patient_id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8;",
+		func(g *syntheticGenerator, id int) string {
+			last, lastYomi := g.pickName(syntheticLastNames)
+			first, firstYomi := g.pickName(syntheticFirstNames)
+			sex := "M"
+			if g.rand.Intn(2) == 0 {
+				sex = "F"
+			}
+			birth := time.Date(1930+g.rand.Intn(90), time.January, 1, 0, 0, 0, 0, time.UTC).
+				AddDate(0, 0, g.rand.Intn(365))
+			return fmt.Sprintf("(%d,'%s','%s','%s','%s','%s','%s','東京都杉並区%d-%d-%d','03-%04d-%04d')",
+				id, last, first, lastYomi, firstYomi, birth.Format("2006-01-02"), sex,
+				1+g.rand.Intn(5), 1+g.rand.Intn(30), 1+g.rand.Intn(20), g.rand.Intn(10000), g.rand.Intn(10000))
+		}},
+	{"visit", "CREATE TABLE `visit` (\n" +
+		"  `visit_id` int NOT NULL AUTO_INCREMENT,\n" +
+		"  `patient_id` int NOT NULL,\n" +
+		"  `v_datetime` datetime NOT NULL,\n" +
+		"  `shahokokuho_id` int NOT NULL DEFAULT '0',\n" +
+		"  `koukikourei_id` int NOT NULL DEFAULT '0',\n" +
+		"  PRIMARY KEY (`visit_id`),\n" +
+		"  KEY `patient_id` (`patient_id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8;",
+		func(g *syntheticGenerator, id int) string {
+			return fmt.Sprintf("(%d,%d,'%s',%d,0)", id, 1+g.rand.Intn(g.patients),
+				g.visitTime().Format("2006-01-02 15:04:05"), g.rand.Intn(5000))
+		}},
+	{"visit_text", "CREATE TABLE `visit_text` (\n" +
+		"  `text_id` int NOT NULL AUTO_INCREMENT,\n" +
+		"  `visit_id` int NOT NULL,\n" +
+		"  `content` text NOT NULL,\n" +
+		"  PRIMARY KEY (`text_id`),\n" +
+		"  KEY `visit_id` (`visit_id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8;",
+		func(g *syntheticGenerator, id int) string {
+			var b strings.Builder
+			for i := 0; i < 2+g.rand.Intn(4); i++ {
+				b.WriteString(g.pick(syntheticTexts))
+				b.WriteString(`\n`)
+			}
+			return fmt.Sprintf("(%d,%d,'%s')", id, 1+g.rand.Intn(g.visits), b.String())
+		}},
+	{"visit_shinryou", "CREATE TABLE `visit_shinryou` (\n" +
+		"  `shinryou_id` int NOT NULL AUTO_INCREMENT,\n" +
+		"  `visit_id` int NOT NULL,\n" +
+		"  `shinryoucode` int NOT NULL,\n" +
+		"  PRIMARY KEY (`shinryou_id`),\n" +
+		"  KEY `visit_id` (`visit_id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8;",
+		func(g *syntheticGenerator, id int) string {
+			return fmt.Sprintf("(%d,%d,%d)", id, 1+g.rand.Intn(g.visits), 111000110+g.rand.Intn(2000000))
+		}},
+	{"visit_drug", "CREATE TABLE `visit_drug` (\n" +
+		"  `drug_id` int NOT NULL AUTO_INCREMENT,\n" +
+		"  `visit_id` int NOT NULL,\n" +
+		"  `d_iyakuhincode` int NOT NULL,\n" +
+		"  `d_amount` varchar(20) NOT NULL,\n" +
+		"  `d_usage` varchar(200) NOT NULL,\n" +
+		"  `d_days` int NOT NULL,\n" +
+		"  PRIMARY KEY (`drug_id`),\n" +
+		"  KEY `visit_id` (`visit_id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8;",
+		func(g *syntheticGenerator, id int) string {
+			return fmt.Sprintf("(%d,%d,%d,'%d','%s',%d)", id, 1+g.rand.Intn(g.visits), 610400000+g.rand.Intn(100000),
+				1+g.rand.Intn(3), g.pick(syntheticUsages), 7*(1+g.rand.Intn(8)))
+		}},
+}
+
+var (
+	syntheticLastNames  = [][2]string{{"佐藤", "さとう"}, {"鈴木", "すずき"}, {"高橋", "たかはし"}, {"田中", "たなか"}, {"伊藤", "いとう"}, {"渡辺", "わたなべ"}, {"山本", "やまもと"}, {"中村", "なかむら"}}
+	syntheticFirstNames = [][2]string{{"太郎", "たろう"}, {"花子", "はなこ"}, {"一郎", "いちろう"}, {"恵子", "けいこ"}, {"健", "けん"}, {"幸子", "さちこ"}, {"誠", "まこと"}, {"由美", "ゆみ"}}
+	syntheticTexts      = []string{"頭痛あり。", "血圧 132/84", "咳が続いている。", "体温 36.8", "経過良好。", "Do処方。", "胸部聴診上異常なし。"}
+	syntheticUsages     = []string{"分３　毎食後", "分１　朝食後", "分２　朝夕食後", "就寝前"}
+)
+
+// syntheticGenerator writes a dump resembling one of the myclinic
+// database, with made up patients, for trying the tool without real data.
+type syntheticGenerator struct {
+	rand     *rand.Rand
+	patients int
+	visits   int
+}
+
+// pickName returns a name and its reading.
+func (g *syntheticGenerator) pickName(names [][2]string) (string, string) {
+	v := names[g.rand.Intn(len(names))]
+	return v[0], v[1]
+}
+
+func (g *syntheticGenerator) pick(values []string) string {
+	return values[g.rand.Intn(len(values))]
+}
+
+func (g *syntheticGenerator) visitTime() time.Time {
+	return time.Date(2010, time.January, 1, 9, 0, 0, 0, time.UTC).
+		AddDate(0, 0, g.rand.Intn(365*10)).Add(time.Duration(g.rand.Intn(9*60)) * time.Minute)
+}
+
+// syntheticBatch is the number of rows per INSERT, as mysqldump's extended
+// inserts have.
+const syntheticBatch = 100
+
+// writeSyntheticDump writes a dump of about size bytes to out. The output
+// is the same for the same size.
+func writeSyntheticDump(out io.Writer, size int64) error {
+	w := bufio.NewWriter(out)
+	cw := &countingWriter{w: w, hash: ioutil.Discard}
+	// Patients and visits are in proportion to the size, so that other
+	// rows refer to existing ones.
+	g := &syntheticGenerator{rand: rand.New(rand.NewSource(1))}
+	g.patients = int(size/(200*1024)) + 10
+	g.visits = g.patients * 20
+	fmt.Fprintf(cw, "-- Synthetic dump generated by myclinic-backup -simulate; contains no patient data\n")
+	fmt.Fprintf(cw, "/*!40101 SET NAMES utf8 */;\n\n")
+	for _, t := range syntheticTables {
+		fmt.Fprintf(cw, "DROP TABLE IF EXISTS `%s`;\n%s\n\n", t.name, t.create)
+	}
+	ids := make([]int, len(syntheticTables))
+	for i := 0; cw.n < size; i = (i + 1) % len(syntheticTables) {
+		t := syntheticTables[i]
+		// Patients and visits stop at their counts; the other tables
+		// grow until the size is reached.
+		rows := syntheticBatch
+		switch t.name {
+		case "patient":
+			rows = minInt(rows, g.patients-ids[i])
+		case "visit":
+			rows = minInt(rows, g.visits-ids[i])
+		}
+		if rows <= 0 {
+			continue
+		}
+		fmt.Fprintf(cw, "INSERT INTO `%s` VALUES ", t.name)
+		for j := 0; j < rows; j++ {
+			ids[i]++
+			if j > 0 {
+				cw.Write([]byte{','})
+			}
+			fmt.Fprint(cw, t.row(g, ids[i]))
+		}
+		_, err := fmt.Fprintf(cw, ";\n")
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(cw, "\n-- Dump completed\n")
+	return w.Flush()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// simulateSize returns the size of simulated dumps given by -simulate-size.
+func simulateSize() (int64, error) {
+	return parseByteSize(*simulateSizeFlag)
+}
+
+// dumpSynthetic writes a simulated dump to backupFile in place of
+// mysqldump.
+func dumpSynthetic(backupFile string) error {
+	size, err := simulateSize()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(backupFile), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(backupFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeSyntheticDump(f, size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// SMS providers.
+const (
+	smsTwilio = "twilio"
+	smsSNS    = "sns"
+)
+
+// SMSConfig sends text messages for the events which need someone to act
+// soon: a backup failing several times in a row, or no backup for longer
+// than max_age. The person responsible at a small clinic may not read
+// mail every day, but reads text messages.
+type SMSConfig struct {
+	// Provider is twilio or sns.
+	Provider string `yaml:"provider"`
+	// To are the phone numbers in E.164 form, e.g. +819012345678.
+	To []string `yaml:"to"`
+	// ConsecutiveFailures is how many backups of the profile must fail
+	// in a row before a message is sent (default 3).
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+	// AccountSID, AuthTokenFile and From are for Twilio.
+	AccountSID    string `yaml:"account_sid"`
+	AuthTokenFile string `yaml:"auth_token_file"`
+	From          string `yaml:"from"`
+	// Region and AWSProfile are for Amazon SNS (default the standard
+	// credential chain). The account must be out of the SMS sandbox or
+	// the numbers verified.
+	Region     string `yaml:"region"`
+	AWSProfile string `yaml:"aws_profile"`
+}
+
+func (s *SMSConfig) validate() error {
+	if len(s.To) == 0 {
+		return fmt.Errorf("sms: to is required")
+	}
+	for _, to := range s.To {
+		if !strings.HasPrefix(to, "+") {
+			return fmt.Errorf("sms: %s is not in international form, e.g. +819012345678", to)
+		}
+	}
+	if s.ConsecutiveFailures < 0 {
+		return fmt.Errorf("sms: consecutive_failures must not be negative")
+	}
+	if s.ConsecutiveFailures == 0 {
+		s.ConsecutiveFailures = 3
+	}
+	switch s.Provider {
+	case smsTwilio:
+		if s.AccountSID == "" || s.AuthTokenFile == "" || s.From == "" {
+			return fmt.Errorf("sms: account_sid, auth_token_file and from are required for twilio")
+		}
+	case smsSNS:
+		if s.Region == "" {
+			return fmt.Errorf("sms: region is required for sns")
+		}
+	default:
+		return fmt.Errorf("sms: provider must be %s or %s", smsTwilio, smsSNS)
+	}
+	return nil
+}
+
+// critical reports whether the event is worth a text message, which
+// includes a backup succeeding again after the failures texted about.
+func (s *SMSConfig) critical(event *Event) bool {
+	switch event.Kind {
+	case eventOverdue, eventObjectives:
+		return true
+	case eventBackup:
+		if event.Success {
+			return event.Recovered >= s.ConsecutiveFailures
+		}
+		return event.Failures >= s.ConsecutiveFailures
+	}
+	return false
+}
+
+// smsMaxText keeps a message, which may be in Japanese, within a few
+// segments.
+const smsMaxText = 200
+
+func smsText(event *Event) string {
+	text := renderText(templateSMS, event, "[myclinic-backup] "+event.Summary)
+	if r := []rune(text); len(r) > smsMaxText {
+		text = string(r[:smsMaxText-1]) + "…"
+	}
+	return text
+}
+
+// send sends the event to every number. Which events are sent is up to
+// the sink; see SinkConfig.accepts.
+func (s *SMSConfig) send(event *Event) error {
+	text := smsText(event)
+	var err error
+	for _, to := range s.To {
+		if s.Provider == smsSNS {
+			err = s.sendSNS(to, text)
+		} else {
+			err = s.sendTwilio(to, text)
+		}
+		if err != nil {
+			return fmt.Errorf("sms to %s: %v", to, err)
+		}
+	}
+	return nil
+}
+
+var twilioEndpoint = "https://api.twilio.com/2010-04-01/Accounts/"
+
+func (s *SMSConfig) sendTwilio(to string, text string) error {
+	token, err := readSecretFile(s.AuthTokenFile)
+	if err != nil {
+		return err
+	}
+	form := url.Values{"To": {to}, "From": {s.From}, "Body": {text}}
+	req, err := http.NewRequest(http.MethodPost, twilioEndpoint+url.PathEscape(s.AccountSID)+"/Messages.json",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.AccountSID, token)
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("twilio responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *SMSConfig) sendSNS(to string, text string) error {
+	sess, err := newAWSSession(s.Region, s.AWSProfile, "", "", "sms")
+	if err != nil {
+		return err
+	}
+	_, err = sns.New(sess).Publish(&sns.PublishInput{
+		PhoneNumber: aws.String(to),
+		Message:     aws.String(text),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			// Alerts must not be dropped as promotional messages are.
+			"AWS.SNS.SMS.SMSType": {DataType: aws.String("String"), StringValue: aws.String("Transactional")},
+		},
+	})
+	return err
+}
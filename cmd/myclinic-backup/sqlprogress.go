@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// A restore of a large database runs for most of an hour with the mysql
+// client silent. sqlProgress follows the dump on its way to mysql and
+// counts what has been sent: the tables, by their CREATE TABLE statements,
+// and the rows, by the value lists of the INSERT statements mysqldump
+// writes, one line each. Rows are counted outside of quoted strings, but
+// the count is approximate: dumps written otherwise are not parsed.
+type sqlProgress struct {
+	r io.Reader
+	// head is the beginning of the current line.
+	head []byte
+	// inInsert is set on the line of an INSERT statement once its VALUES
+	// are reached, and quoted and escaped are of strings within it.
+	inInsert bool
+	quoted   bool
+	escaped  bool
+	depth    int
+	tables   int
+	table    string
+	rows     int64
+}
+
+// sqlLineHead is how much of each line is kept to recognize statements.
+const sqlLineHead = 256
+
+var (
+	createTablePrefix = []byte("CREATE TABLE `")
+	insertPrefix      = []byte("INSERT INTO ")
+	valuesKeyword     = []byte(" VALUES ")
+)
+
+func newSQLProgress(r io.Reader) *sqlProgress {
+	return &sqlProgress{r: r}
+}
+
+func (s *sqlProgress) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	for _, c := range b[:n] {
+		s.scan(c)
+	}
+	return n, err
+}
+
+func (s *sqlProgress) scan(c byte) {
+	if c == '\n' {
+		s.endLine()
+		return
+	}
+	if len(s.head) < sqlLineHead {
+		s.head = append(s.head, c)
+		if !s.inInsert && bytes.HasPrefix(s.head, insertPrefix) && bytes.HasSuffix(s.head, valuesKeyword) {
+			s.inInsert = true
+		}
+	}
+	if !s.inInsert {
+		return
+	}
+	switch {
+	case s.escaped:
+		s.escaped = false
+	case s.quoted && c == '\\':
+		s.escaped = true
+	case c == '\'':
+		s.quoted = !s.quoted
+	case s.quoted:
+	case c == '(':
+		if s.depth == 0 {
+			s.rows++
+		}
+		s.depth++
+	case c == ')':
+		s.depth--
+	}
+}
+
+func (s *sqlProgress) endLine() {
+	if bytes.HasPrefix(s.head, createTablePrefix) {
+		name := s.head[len(createTablePrefix):]
+		if i := bytes.IndexByte(name, '`'); i >= 0 {
+			s.tables++
+			s.table = string(name[:i])
+		}
+	}
+	s.head = s.head[:0]
+	s.inInsert, s.quoted, s.escaped, s.depth = false, false, false, 0
+}
+
+// summary tells how far the load has got, for the progress reports.
+func (s *sqlProgress) summary() string {
+	if s.tables == 0 {
+		return ""
+	}
+	return fmt.Sprintf(tr("%d tables done, now %s, about %d rows"), s.tables-1, s.table, s.rows)
+}
+
+// finalSummary tells what was loaded once the dump has been read.
+func (s *sqlProgress) finalSummary() string {
+	return fmt.Sprintf(tr("%d tables, about %d rows"), s.tables, s.rows)
+}
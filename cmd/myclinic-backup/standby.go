@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StandbyConfig makes the daemon keep a standby server current: whenever
+// the schedule fires, the newest backup in the bucket is restored into it
+// unless it already was. It is meant for a second machine, which has no
+// catalog of the backups, so the bucket itself is watched.
+type StandbyConfig struct {
+	Schedule string `yaml:"schedule"`
+	// Database is restored into. It is required and must not be a
+	// database the profile backs up, so that the live data is never
+	// restored over.
+	Database string `yaml:"database"`
+}
+
+// standbyState is the last restore into the standby, kept in the state
+// directory.
+type standbyState struct {
+	S3Key      string    `json:"s3_key"`
+	BackupTime time.Time `json:"backup_time"`
+	Restored   time.Time `json:"restored"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func standbyStatePath(stateDir string, profile string) string {
+	return filepath.Join(stateDir, "standby", profile+".json")
+}
+
+func loadStandbyState(path string) (*standbyState, error) {
+	src, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &standbyState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	src, err = openMetadata(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var s standbyState
+	err = json.Unmarshal(src, &s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &s, nil
+}
+
+// latestInBucket returns the newest backup of the profile in its bucket,
+// recognized by its name, or nil if there is none.
+func latestInBucket(p *Profile) (*CatalogEntry, error) {
+	l, err := listRemote(p, dateRange{})
+	if err != nil {
+		return nil, err
+	}
+	if len(l.backups) == 0 {
+		return nil, nil
+	}
+	return l.backups[len(l.backups)-1], nil
+}
+
+// refreshStandby restores the newest backup into the standby if it is not
+// there yet. It returns false if there was nothing to do.
+func refreshStandby(config *Config, p *Profile, prefix string) (bool, error) {
+	statePath := standbyStatePath(config.StateDir, p.Name)
+	state, err := loadStandbyState(statePath)
+	if err != nil {
+		return false, err
+	}
+	e, err := latestInBucket(p)
+	if err != nil {
+		return false, fmt.Errorf("cannot list bucket: %v", err)
+	}
+	if e == nil {
+		return false, fmt.Errorf("no backup in %s", p.storedLocation(normalizePrefix(p.S3Prefix)))
+	}
+	if e.S3Key == state.S3Key && state.Error == "" {
+		return false, nil
+	}
+	db := p.Standby.Database
+	fmt.Fprintf(stdout, tr("%srestoring %s (taken %s) into standby\n"), prefix, e.S3Key,
+		e.Time.Format("2006-01-02 15:04"))
+	if *dryRun {
+		return true, nil
+	}
+	err = restoreStream(p, e, db, stdout)
+	if err == nil {
+		var tables string
+		tables, err = mysqlQuery(p, "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = "+
+			quoteString(db))
+		if err == nil && tables == "0" {
+			err = fmt.Errorf("restored database has no tables")
+		}
+	}
+	next := &standbyState{S3Key: e.S3Key, BackupTime: e.Time, Restored: time.Now()}
+	if err != nil {
+		next.Error = redactError(err)
+	}
+	src, merr := json.MarshalIndent(next, "", "  ")
+	if merr == nil {
+		src, merr = sealMetadata(src)
+	}
+	if merr != nil {
+		return true, merr
+	}
+	if serr := writeFileAtomic(statePath, src, 0600); serr != nil {
+		fmt.Fprintf(stderr, tr("%scannot save standby state: %v\n"), prefix, serr)
+	}
+	return true, err
+}
+
+// runStandby refreshes the standby and reports failures, and the first
+// success after a failure.
+func runStandby(config *Config, p *Profile, prefix string) error {
+	previous, _ := loadStandbyState(standbyStatePath(config.StateDir, p.Name))
+	restored, err := refreshStandby(config, p, prefix)
+	event := &Event{Kind: eventStandby, Profile: p.Name, Success: err == nil, Time: time.Now()}
+	if err != nil {
+		event.Summary = trf("standby restore of %s failed: %s", p.Name, redactError(err))
+		fmt.Fprintf(stderr, "%s%s\n", prefix, event.Summary)
+	} else if restored {
+		event.Summary = trf("standby of %s is current", p.Name)
+		fmt.Fprintf(stdout, "%s%s\n", prefix, event.Summary)
+		if previous == nil || previous.Error == "" {
+			return nil
+		}
+	} else {
+		return nil
+	}
+	if nerr := notify(p.Notify, event); nerr != nil {
+		fmt.Fprintf(stderr, tr("%snotification failed: %v\n"), prefix, nerr)
+	}
+	return err
+}
+
+// standbyCommand refreshes the standby once, for running from cron instead
+// of the daemon.
+func standbyCommand(config *Config, profiles []*Profile, args []string) error {
+	failed := 0
+	for _, p := range profiles {
+		if p.Standby == nil {
+			fmt.Fprintf(stdout, tr("%s: no standby configured\n"), p.Name)
+			continue
+		}
+		err := runStandby(config, p, "["+p.Name+"] ")
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("standby restore failed")
+	}
+	return nil
+}
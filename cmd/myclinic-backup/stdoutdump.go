@@ -0,0 +1,166 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// dumpMetadata describes a dump written to stdout. It is printed to
+// stderr, since stdout carries the data.
+type dumpMetadata struct {
+	RunID      string    `json:"run_id"`
+	Profile    string    `json:"profile"`
+	Database   string    `json:"database"`
+	Time       time.Time `json:"time"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	Compressed bool      `json:"compressed"`
+	Encrypted  bool      `json:"encrypted"`
+}
+
+// countingWriter counts and hashes what passes through it.
+type countingWriter struct {
+	w    io.Writer
+	n    int64
+	hash io.Writer
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.hash.Write(p[:n])
+	return n, err
+}
+
+// writeBackup writes the plain dump, or the file archive for a profile of
+// type files, to out.
+func writeBackup(p *Profile, out io.Writer, lowPriority bool) error {
+	if p.isFiles() {
+		return writeArchive(p.Files, out)
+	}
+	if *simulateFlag {
+		size, err := simulateSize()
+		if err != nil {
+			return err
+		}
+		return writeSyntheticDump(out, size)
+	}
+	return runMysqldump(p, out, lowPriority)
+}
+
+func runMysqldump(p *Profile, out io.Writer, lowPriority bool) error {
+	cmd := p.mysqldumpCommand()
+	if lowPriority {
+		cmd = lowPriorityCommand(cmd)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("mysqldump failed: %v", err)
+	}
+	return nil
+}
+
+// dumpTo writes the dump of the profile to out, gzip compressed or
+// encrypted if requested. The dump is streamed in either case.
+func dumpTo(config *Config, p *Profile, out io.Writer, compress bool, encrypt bool) (*dumpMetadata, error) {
+	meta := &dumpMetadata{
+		RunID:      newRunID(),
+		Profile:    p.Name,
+		Database:   strings.Join(p.databases(), ","),
+		Time:       time.Now(),
+		Compressed: compress || encrypt,
+		Encrypted:  encrypt,
+	}
+	h := sha256.New()
+	plain := &countingWriter{hash: h}
+	if encrypt {
+		key, err := readEncryptionKey(p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read encryption key: %v", err)
+		}
+		enc, err := newEncryptWriter(key, out)
+		if err != nil {
+			return nil, err
+		}
+		plain.w = enc
+		err = writeBackup(p, plain, config.LowPriority)
+		if err != nil {
+			return nil, err
+		}
+		err = enc.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if compress {
+		gz := gzip.NewWriter(out)
+		plain.w = gz
+		err := writeBackup(p, plain, config.LowPriority)
+		if err != nil {
+			return nil, err
+		}
+		err = gz.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		plain.w = out
+		err := writeBackup(p, plain, config.LowPriority)
+		if err != nil {
+			return nil, err
+		}
+	}
+	meta.Size = plain.n
+	meta.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return meta, nil
+}
+
+func backupToStdout(config *Config, profiles []*Profile, compress bool, encrypt bool, trigger string) error {
+	p, err := singleProfile(profiles)
+	if err != nil {
+		return err
+	}
+	// Messages must not mix with the data.
+	stdout = stderr
+	started := time.Now()
+	meta, err := dumpTo(config, p, os.Stdout, compress, encrypt)
+	rec := &AuditRecord{
+		Time:      time.Now(),
+		Profile:   p.Name,
+		Trigger:   trigger,
+		User:      currentUser(),
+		Command:   commandLine(),
+		Stages:    []string{stageDump},
+		Artifacts: []string{"stdout"},
+		Outcome:   "success",
+	}
+	rec.Host, _ = os.Hostname()
+	if err != nil {
+		rec.RunID = newRunID()
+		rec.Outcome = "failure"
+		rec.Error = redactError(err)
+	} else {
+		rec.RunID = meta.RunID
+		rec.SHA256 = meta.SHA256
+	}
+	if aerr := auditLog.Append(rec); aerr != nil {
+		fmt.Fprintf(stderr, tr("audit log: %v\n"), aerr)
+	}
+	recordHistory(&HistoryRecord{RunID: rec.RunID, Profile: p.Name, Kind: historyStdout, Trigger: trigger, Started: started,
+		Finished: rec.Time, Success: err == nil, Error: rec.Error})
+	if err != nil {
+		return err
+	}
+	src, _ := json.Marshal(meta)
+	fmt.Fprintf(stderr, "%s\n", src)
+	fmt.Fprintf(stderr, tr("dumped %s in %s\n"), formatBytes(meta.Size), time.Since(started).Round(time.Second))
+	return nil
+}
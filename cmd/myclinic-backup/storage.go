@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Targets are where the encrypted backups are stored. S3 is the default;
+// gcs is Google Cloud Storage through its S3-compatible XML API with HMAC
+// keys, sftp an SFTP server reached with the sftp command of OpenSSH, and
+// file a directory such as a NAS mount.
+const (
+	targetS3   = "s3"
+	targetGCS  = "gcs"
+	targetSFTP = "sftp"
+	targetFile = "file"
+)
+
+const targetEnvVar = "MYCLINIC_BACKUP_TARGET"
+
+// gcsEndpoint serves the S3-compatible API of Google Cloud Storage.
+const gcsEndpoint = "https://storage.googleapis.com"
+
+func (p *Profile) validateTarget() error {
+	switch p.Target {
+	case "", targetS3, targetGCS, targetFile:
+	case targetSFTP:
+		if p.SFTP == nil {
+			return fmt.Errorf("sftp is not set (nor env var %s)", sftpHostEnvVar)
+		}
+		if p.SFTP.Host == "" {
+			return fmt.Errorf("sftp: host is not set")
+		}
+	default:
+		return fmt.Errorf("target must be %s, %s, %s or %s: %s", targetS3, targetGCS, targetSFTP, targetFile, p.Target)
+	}
+	if p.S3RoleARN != "" && p.target() != targetS3 {
+		return fmt.Errorf("s3_role_arn needs target %s", targetS3)
+	}
+	if p.usesS3API() {
+		return nil
+	}
+	only := []struct {
+		set   bool
+		field string
+	}{
+		{p.WriteOnly, "write_only"},
+		{p.OpaqueNames, "opaque_names"},
+		{p.Stream, "stream"},
+	}
+	for _, o := range only {
+		if o.set {
+			return fmt.Errorf("%s needs target %s or %s", o.field, targetS3, targetGCS)
+		}
+	}
+	return nil
+}
+
+// target returns the target of the profile.
+func (p *Profile) target() string {
+	if p.Target == "" {
+		return targetS3
+	}
+	return p.Target
+}
+
+// usesS3API reports whether the backups of the profile are stored through
+// the S3 API, which S3-only features such as write_only, opaque_names,
+// stream and legal holds need.
+func (p *Profile) usesS3API() bool {
+	t := p.target()
+	return t == targetS3 || t == targetGCS
+}
+
+// hasStorage reports whether the profile uploads its backups anywhere.
+func (p *Profile) hasStorage() bool {
+	return !p.usesS3API() || p.S3Bucket != ""
+}
+
+// targetName names the target in messages.
+func (p *Profile) targetName() string {
+	switch p.target() {
+	case targetGCS:
+		return "GCS"
+	case targetSFTP:
+		return "SFTP"
+	case targetFile:
+		return p.TargetDir
+	}
+	return "S3"
+}
+
+// targetURL is the root of the target as recorded in the catalog, or ""
+// for S3.
+func (p *Profile) targetURL() string {
+	switch p.target() {
+	case targetGCS:
+		return "gs://" + p.S3Bucket
+	case targetSFTP:
+		return (&sftpStorage{ssh: p.SFTP.SSHConfig, dir: p.SFTP.Dir}).Target()
+	case targetFile:
+		return (&fileStorage{dir: p.TargetDir}).Target()
+	}
+	return ""
+}
+
+// storageBucket is the bucket recorded with objects of the profile, none
+// if they are not stored through the S3 API.
+func (p *Profile) storageBucket() string {
+	if !p.usesS3API() {
+		return ""
+	}
+	return p.S3Bucket
+}
+
+// storedLocation tells where the object of key is stored.
+func (p *Profile) storedLocation(key string) string {
+	return entryLocation(&CatalogEntry{S3Bucket: p.storageBucket(), S3Key: key, Target: p.targetURL()})
+}
+
+// storedObject is an object found by Storage.List.
+type storedObject struct {
+	Key  string
+	Size int64
+}
+
+// Storage is where encrypted backups are uploaded to, by key. Keys are
+// those of S3, slash separated, with the prefix of the profile.
+type Storage interface {
+	// Put stores the file under key, and checks the stored copy.
+	Put(key string, filename string) error
+	// Get opens the object stored under key, and returns its size.
+	Get(key string) (io.ReadCloser, int64, error)
+	// List returns the objects whose keys start with prefix.
+	List(prefix string) ([]storedObject, error)
+	// Delete deletes the objects, and returns why those it could not
+	// delete were not deleted, by key.
+	Delete(keys []string) (map[string]string, error)
+	// Target is the root of the storage as recorded in the catalog, or ""
+	// for S3.
+	Target() string
+}
+
+// storage returns the storage the profile uploads to. opts are applied to
+// the requests of S3 uploads.
+func (p *Profile) storage(opts ...request.Option) (Storage, error) {
+	switch p.target() {
+	case targetSFTP:
+		return &sftpStorage{ssh: p.SFTP.SSHConfig, dir: p.SFTP.Dir}, nil
+	case targetFile:
+		return &fileStorage{dir: p.TargetDir}, nil
+	}
+	sess, err := newS3Session(p)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create AWS session: %v", err)
+	}
+	s := &s3Storage{sess: sess, bucket: p.S3Bucket, gcs: p.target() == targetGCS,
+		writeOnly: p.WriteOnly, check: p.checkWriteOnly, opts: opts}
+	if p.writer != nil {
+		s.upload, err = p.uploadSession()
+		if err != nil {
+			return nil, fmt.Errorf("cannot create AWS session: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// entryStorage returns the storage the entry was uploaded to, which may
+// no longer be the target of the profile.
+func entryStorage(p *Profile, e *CatalogEntry) (Storage, error) {
+	if e.Target == "" {
+		sess, err := newS3Session(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create AWS session: %v", err)
+		}
+		return &s3Storage{sess: sess, bucket: e.S3Bucket}, nil
+	}
+	// The directory of a file target is not escaped, so that a % or the
+	// like in its name would not parse as a URL.
+	if strings.HasPrefix(e.Target, "file://") {
+		return &fileStorage{dir: filepath.FromSlash(strings.TrimPrefix(e.Target, "file://"))}, nil
+	}
+	u, err := url.Parse(e.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %s: %v", e.Target, err)
+	}
+	switch u.Scheme {
+	case "gs":
+		q := *p
+		q.Target = targetGCS
+		sess, err := newS3Session(&q)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create AWS session: %v", err)
+		}
+		return &s3Storage{sess: sess, bucket: u.Host, gcs: true}, nil
+	case "sftp":
+		s := &sftpStorage{dir: strings.TrimPrefix(u.Path, "/./")}
+		if p.SFTP != nil {
+			s.ssh = p.SFTP.SSHConfig
+		}
+		s.ssh.Host = u.Hostname()
+		s.ssh.User = u.User.Username()
+		s.ssh.Port = 0
+		if port := u.Port(); port != "" {
+			s.ssh.Port, err = strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target %s: %v", e.Target, err)
+			}
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown target %s", e.Target)
+}
+
+// s3Storage stores objects in an S3 bucket, or with gcs in a Google Cloud
+// Storage bucket through its XML API.
+type s3Storage struct {
+	sess *session.Session
+	// upload, if set, is the session Put uses instead of sess.
+	upload    *session.Session
+	bucket    string
+	gcs       bool
+	writeOnly bool
+	// check confirms that write-only credentials cannot read, before
+	// uploading with them.
+	check func(sess *session.Session) error
+	opts  []request.Option
+}
+
+func (s *s3Storage) Put(key string, filename string) error {
+	sess := s.sess
+	if s.upload != nil {
+		sess = s.upload
+	}
+	if s.writeOnly && s.check != nil {
+		err := s.check(sess)
+		if err != nil {
+			return err
+		}
+	}
+	return uploadToS3(sess, s.bucket, key, filename, s.writeOnly, s.opts...)
+}
+
+func (s *s3Storage) Get(key string) (io.ReadCloser, int64, error) {
+	return openS3Object(s.sess, s.bucket, key)
+}
+
+func (s *s3Storage) List(prefix string) ([]storedObject, error) {
+	var objects []storedObject
+	err := s3.New(s.sess).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, storedObject{aws.StringValue(obj.Key), aws.Int64Value(obj.Size)})
+		}
+		return true
+	})
+	return objects, err
+}
+
+func (s *s3Storage) Delete(keys []string) (map[string]string, error) {
+	svc := s3.New(s.sess)
+	failed := make(map[string]string)
+	if s.gcs {
+		// The XML API of Cloud Storage has no multi-object delete.
+		for _, key := range keys {
+			_, err := svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+			if err != nil {
+				failed[key] = err.Error()
+			}
+		}
+		return failed, nil
+	}
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+	}
+	out, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range out.Errors {
+		failed[aws.StringValue(f.Key)] = aws.StringValue(f.Message)
+	}
+	return failed, nil
+}
+
+func (s *s3Storage) Target() string {
+	if s.gcs {
+		return "gs://" + s.bucket
+	}
+	return ""
+}
+
+// fileStorage stores objects as files under a directory, such as a NAS
+// mount, the key giving the path below it.
+type fileStorage struct {
+	dir string
+}
+
+func (s *fileStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// Put copies the file next to its place and renames it into place, so
+// that the stored file appears only whole.
+func (s *fileStorage) Put(key string, filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	dst := s.path(key)
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, in)
+	if err == nil {
+		// A NAS may acknowledge writes it has not stored yet.
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = checkStoredSize(tmp, n)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func checkStoredSize(path string, size int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("stored %s has %d bytes, expected %d", path, info.Size(), size)
+	}
+	return nil
+}
+
+func (s *fileStorage) Get(key string) (io.ReadCloser, int64, error) {
+	return openLocalFile(s.path(key))
+}
+
+func (s *fileStorage) List(prefix string) ([]storedObject, error) {
+	var objects []storedObject
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, storedObject{key, info.Size()})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+func (s *fileStorage) Delete(keys []string) (map[string]string, error) {
+	failed := make(map[string]string)
+	for _, key := range keys {
+		err := removeMovedFile(s.path(key))
+		if err != nil && !os.IsNotExist(err) {
+			failed[key] = err.Error()
+		}
+	}
+	return failed, nil
+}
+
+func (s *fileStorage) Target() string {
+	return "file://" + filepath.ToSlash(s.dir)
+}
+
+// sortObjects orders objects by key, as S3 lists them.
+func sortObjects(objects []storedObject) {
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+}
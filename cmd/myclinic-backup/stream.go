@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// A profile with stream set does not write the dump and the encrypted
+// backup to disk before uploading: the output of mysqldump is compressed,
+// encrypted and uploaded in parts as it comes, so neither the dump nor a
+// second pass over it is needed before the upload. stream_keep tells which
+// local copies are written along the way:
+//
+//	both       the plain dump and the encrypted backup (default)
+//	plain      the plain dump only
+//	encrypted  the encrypted backup only
+//	none       nothing; the backup is only in the bucket
+//
+// The checksums are computed on the way and recorded in the catalog. The
+// SHA-256 of the object is not known when the upload starts, so it is not
+// stored in the metadata of the object; the ETag is checked as for other
+// uploads. A failed dump or upload leaves nothing behind in the bucket, and
+// the run is retried from the start.
+
+// Values of stream_keep.
+const (
+	streamKeepBoth      = "both"
+	streamKeepPlain     = "plain"
+	streamKeepEncrypted = "encrypted"
+	streamKeepNone      = "none"
+)
+
+// keepsPlain reports whether streamed backups of the profile leave the
+// plain dump on disk.
+func (p *Profile) keepsPlain() bool {
+	return p.StreamKeep == "" || p.StreamKeep == streamKeepBoth || p.StreamKeep == streamKeepPlain
+}
+
+// keepsEncrypted reports whether streamed backups of the profile leave the
+// encrypted backup on disk.
+func (p *Profile) keepsEncrypted() bool {
+	return p.StreamKeep == "" || p.StreamKeep == streamKeepBoth || p.StreamKeep == streamKeepEncrypted
+}
+
+func (p *Profile) validateStream() error {
+	switch p.StreamKeep {
+	case "", streamKeepBoth, streamKeepPlain, streamKeepEncrypted, streamKeepNone:
+	default:
+		return fmt.Errorf("stream_keep must be %s, %s, %s or %s: %s", streamKeepBoth, streamKeepPlain,
+			streamKeepEncrypted, streamKeepNone, p.StreamKeep)
+	}
+	if p.StreamKeep != "" && !p.Stream {
+		return fmt.Errorf("stream_keep needs stream")
+	}
+	if p.Stream && p.DedupPlain && !p.keepsPlain() {
+		return fmt.Errorf("dedup_plain needs the plain dump; set stream_keep to %s or %s", streamKeepBoth, streamKeepPlain)
+	}
+	return nil
+}
+
+// streamedBackup holds the sizes, the checksums and the binlog coordinates
+// of a backup, which a streamed backup computes on the way.
+type streamedBackup struct {
+	Size            int64              `json:"size"`
+	SHA256          string             `json:"sha256"`
+	EncryptedSize   int64              `json:"encrypted_size"`
+	EncryptedSHA256 string             `json:"encrypted_sha256"`
+	Binlog          *BinlogCoordinates `json:"binlog,omitempty"`
+}
+
+// defaultStreamPartSize is the part size of streamed uploads without
+// upload_part_size. The size of a stream is not known in advance, so the
+// part size cannot be raised to fit; parts of 16MB allow backups of up to
+// 160GB, buffering upload_concurrency parts in memory.
+const defaultStreamPartSize = 16 << 20
+
+func streamPartSize() int64 {
+	if transfer.partSize > 0 {
+		return transfer.partSize
+	}
+	return defaultStreamPartSize
+}
+
+// streamChecksums computes the checksums of an upload of unknown size as
+// the uploader reads it.
+type streamChecksums struct {
+	r        io.Reader
+	partSize int64
+	size     int64
+	whole    hash.Hash
+	// part is the MD5 of the part being read, and sums those of the parts
+	// read, as computeUploadChecksums computes them.
+	part   hash.Hash
+	inPart int64
+	sums   []byte
+	parts  int
+}
+
+func newStreamChecksums(r io.Reader, partSize int64) *streamChecksums {
+	return &streamChecksums{r: r, partSize: partSize, whole: sha256.New(), part: md5.New()}
+}
+
+func (s *streamChecksums) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	b := p[:n]
+	s.whole.Write(b)
+	s.size += int64(n)
+	for !fipsMode && len(b) > 0 {
+		k := s.partSize - s.inPart
+		if k > int64(len(b)) {
+			k = int64(len(b))
+		}
+		s.part.Write(b[:k])
+		s.inPart += k
+		b = b[k:]
+		if s.inPart == s.partSize {
+			s.sums = s.part.Sum(s.sums)
+			s.part.Reset()
+			s.inPart = 0
+			s.parts++
+		}
+	}
+	return n, err
+}
+
+// result returns the checksums of what was read. The uploader puts less
+// than a part in a single request and anything else in a multipart upload,
+// even a single full part.
+func (s *streamChecksums) result() *uploadChecksums {
+	c := &uploadChecksums{sha256: s.whole.Sum(nil)}
+	if fipsMode {
+		return c
+	}
+	if s.size < s.partSize {
+		c.etag = hex.EncodeToString(s.part.Sum(nil))
+		return c
+	}
+	sums, parts := s.sums, s.parts
+	if s.inPart > 0 {
+		sums = s.part.Sum(sums)
+		parts++
+	}
+	sum := md5.Sum(sums)
+	c.etag = fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts)
+	return c
+}
+
+// uploadStream uploads what is read from body until io.EOF and checks the
+// uploaded object as uploadToS3 does. It returns the size and the
+// checksums of the content.
+func uploadStream(sess *session.Session, bucket string, key string, body io.Reader, writeOnly bool,
+	opts ...request.Option) (int64, *uploadChecksums, error) {
+	partSize := streamPartSize()
+	sums := newStreamChecksums(body, partSize)
+	uploader := newUploader(sess, partSize)
+	out, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   sums,
+		Metadata: map[string]*string{
+			cryptoModeMetadataKey:  aws.String(cryptoMode()),
+			compressionMetadataKey: aws.String(transfer.compressor.Name()),
+			hostMetadataKey:        aws.String(hostMetadata()),
+			instanceMetadataKey:    aws.String(instanceID),
+		},
+	}, s3manager.WithUploaderRequestOptions(opts...))
+	if err != nil {
+		return 0, nil, err
+	}
+	c := sums.result()
+	if writeOnly {
+		return sums.size, c, nil
+	}
+	return sums.size, c, c.check(s3.New(sess), bucket, key, out.VersionID)
+}
+
+// headBuffer keeps the first bytes written to it, where mysqldump writes
+// the binlog coordinates.
+type headBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if rest := h.max - h.Len(); rest > 0 {
+		if rest > len(p) {
+			rest = len(p)
+		}
+		h.Buffer.Write(p[:rest])
+	}
+	return len(p), nil
+}
+
+// streamCopy is a file written along with a streamed upload, in the work
+// directory until the upload succeeds.
+type streamCopy struct {
+	tmp  string
+	file *os.File
+	w    *bufio.Writer
+}
+
+func createStreamCopy(tmp string) (*streamCopy, error) {
+	err := os.MkdirAll(filepath.Dir(tmp), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &streamCopy{tmp: tmp, file: f, w: bufio.NewWriterSize(f, 1<<20)}, nil
+}
+
+func (c *streamCopy) close() error {
+	err := c.w.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writers returns the writers of the copies which are not nil, and w.
+func writers(w io.Writer, copies ...*streamCopy) io.Writer {
+	ws := []io.Writer{w}
+	for _, c := range copies {
+		if c != nil {
+			ws = append(ws, c.w)
+		}
+	}
+	if len(ws) == 1 {
+		return w
+	}
+	return io.MultiWriter(ws...)
+}
+
+// streamBackup dumps, encrypts and uploads the backup of the run in one
+// pass, writing the local copies stream_keep asks for.
+func (r *backupRun) streamBackup(key []byte, sess *session.Session) (*streamedBackup, error) {
+	p := r.profile
+	st := r.state
+	var plainCopy, encCopy *streamCopy
+	var err error
+	if p.keepsPlain() {
+		plainCopy, err = createStreamCopy(r.workFile(st.BackupFile))
+		if err != nil {
+			return nil, err
+		}
+		defer plainCopy.close()
+	}
+	if p.keepsEncrypted() {
+		encCopy, err = createStreamCopy(r.workFile(st.EncryptedFile))
+		if err != nil {
+			return nil, err
+		}
+		defer encCopy.close()
+	}
+	pr, pw := io.Pipe()
+	type upload struct {
+		size int64
+		sums *uploadChecksums
+		err  error
+	}
+	done := make(chan upload, 1)
+	go func() {
+		size, sums, err := uploadStream(sess, p.S3Bucket, st.S3Key, pr, p.WriteOnly, r.stageSpan.s3Requests())
+		if err != nil {
+			// The dump stops at its next write.
+			pr.CloseWithError(err)
+		}
+		done <- upload{size, sums, err}
+	}()
+	enc, err := newEncryptWriter(key, writers(pw, encCopy))
+	if err != nil {
+		pw.CloseWithError(err)
+		<-done
+		return nil, err
+	}
+	h := sha256.New()
+	head := &headBuffer{max: 1 << 20}
+	plain := &countingWriter{w: writers(io.MultiWriter(enc, head), plainCopy), hash: h}
+	err = writeBackup(p, plain, r.config.LowPriority)
+	if err == nil {
+		err = enc.Close()
+	}
+	pw.CloseWithError(err)
+	u := <-done
+	if err != nil {
+		return nil, err
+	}
+	if u.err != nil {
+		return nil, fmt.Errorf("failed to upload to S3: %v", u.err)
+	}
+	b := &streamedBackup{
+		Size:            plain.n,
+		SHA256:          hex.EncodeToString(h.Sum(nil)),
+		EncryptedSize:   u.size,
+		EncryptedSHA256: hex.EncodeToString(u.sums.sha256),
+	}
+	if p.BinlogCoordinates {
+		b.Binlog, err = readBinlogCoordinates(bytes.NewReader(head.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if encCopy != nil {
+		err = encCopy.close()
+		if err == nil {
+			err = moveIntoPlace(encCopy.tmp, st.EncryptedFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if plainCopy != nil {
+		err = plainCopy.close()
+		if err != nil {
+			return nil, err
+		}
+		previous, how, err := p.placePlainDump(plainCopy.tmp, st.BackupFile)
+		if err != nil {
+			return nil, err
+		}
+		if previous != "" {
+			r.logf("dump is identical to %s; stored as a %s\n", previous, tr(how))
+		}
+	}
+	return b, nil
+}
+
+// stream runs a streamed backup as the dump, encrypt and upload stages at
+// once.
+func (r *backupRun) stream(result *ProfileResult) error {
+	p := r.profile
+	st := r.state
+	st.BackupFile = p.backupFilePath(st.Time)
+	st.EncryptedFile = p.encryptedFilePath(st.Time)
+	var err error
+	st.S3Key, err = p.objectKey(createS3Key(p.s3KeyPrefix(), st.EncryptedFile))
+	if err != nil {
+		return err
+	}
+	err = r.stage(stageUpload, func() error {
+		key, err := readEncryptionKey(p.KeyFile)
+		if err != nil {
+			return fmt.Errorf("cannot read encryption key: %v", err)
+		}
+		sess, err := p.uploadSession()
+		if err != nil {
+			return fmt.Errorf("cannot create AWS session: %v", err)
+		}
+		if p.WriteOnly {
+			err = p.checkWriteOnly(sess)
+			if err != nil {
+				return err
+			}
+		}
+		r.logf("streaming backup to %s: %s/%s\n", p.targetName(), p.S3Bucket, st.S3Key)
+		st.Streamed, err = r.streamBackup(key, sess)
+		if err != nil {
+			return err
+		}
+		st.Done[stageDump] = true
+		st.Done[stageEncrypt] = true
+		return nil
+	})
+	if err != nil || *dryRun {
+		return err
+	}
+	if p.keepsPlain() {
+		result.BackupFile = st.BackupFile
+		r.logf("database backed up to %s\n", st.BackupFile)
+	}
+	if p.keepsEncrypted() {
+		result.EncryptedFile = st.EncryptedFile
+		r.logf("encrypted file: %s\n", st.EncryptedFile)
+	}
+	r.logf("streamed %s (%s encrypted) to S3\n", formatBytes(st.Streamed.Size), formatBytes(st.Streamed.EncryptedSize))
+	result.S3Key = st.S3Key
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// fakeMultipartS3 stores objects put whole or in multipart uploads, with
+// the ETags S3 gives them, and records how each was uploaded.
+type fakeMultipartS3 struct {
+	mu      sync.Mutex
+	etags   map[string]string
+	parts   map[string]map[int][]byte
+	uploads map[string]int
+}
+
+func newFakeMultipartS3() *fakeMultipartS3 {
+	return &fakeMultipartS3{
+		etags:   make(map[string]string),
+		parts:   make(map[string]map[int][]byte),
+		uploads: make(map[string]int),
+	}
+}
+
+func (f *fakeMultipartS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path, q := r.URL.Path, r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && q.Get("uploadId") == "":
+		f.parts[path] = make(map[int][]byte)
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>1</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		src, _ := ioutil.ReadAll(r.Body)
+		f.parts[path][n] = src
+		w.Header().Set("ETag", etagOf(src))
+	case r.Method == http.MethodPost:
+		var numbers []int
+		for n := range f.parts[path] {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var sums []byte
+		for _, n := range numbers {
+			sum := md5.Sum(f.parts[path][n])
+			sums = append(sums, sum[:]...)
+		}
+		f.etags[path] = fmt.Sprintf("\"%x-%d\"", md5.Sum(sums), len(numbers))
+		f.uploads[path] = len(numbers)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>", f.etags[path])
+	case r.Method == http.MethodPut:
+		src, _ := ioutil.ReadAll(r.Body)
+		f.etags[path] = etagOf(src)
+		f.uploads[path] = 0
+		w.Header().Set("ETag", f.etags[path])
+	case r.Method == http.MethodHead:
+		w.Header().Set("ETag", f.etags[path])
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// TestUploadStreamETag checks the ETag computed by streamChecksums against
+// the uploads s3manager makes of a stream around the part boundaries:
+// reading a stream, it puts a single object only when the first part comes
+// short, and after an exact multiple of the part size it completes the
+// upload without an empty last part.
+func TestUploadStreamETag(t *testing.T) {
+	savedPartSize := transfer.partSize
+	defer func() { transfer.partSize = savedPartSize }()
+	part := s3manager.MinUploadPartSize
+	transfer.partSize = part
+	fake := newFakeMultipartS3()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("ap-northeast-1"),
+		Endpoint:         aws.String(srv.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 2*part+1)
+	_, err = io.ReadFull(rand.Reader, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		size  int64
+		parts int
+	}{
+		{0, 0},
+		{1, 0},
+		{part - 1, 0},
+		{part, 1},
+		{part + 1, 2},
+		{2 * part, 2},
+		{2*part + 1, 3},
+	} {
+		key := fmt.Sprintf("stream-%d", tc.size)
+		// A reader without Seek, as the pipe of streamBackup.
+		body := struct{ io.Reader }{bytes.NewReader(data[:tc.size])}
+		size, sums, err := uploadStream(sess, "backups", key, body, false)
+		if err != nil {
+			t.Errorf("size %d: %v", tc.size, err)
+			continue
+		}
+		if size != tc.size {
+			t.Errorf("size %d: %d bytes read", tc.size, size)
+		}
+		if got := fake.uploads["/backups/"+key]; got != tc.parts {
+			t.Errorf("size %d: uploaded in %d parts, want %d", tc.size, got, tc.parts)
+		}
+		if want := fake.etags["/backups/"+key]; `"`+sums.etag+`"` != want {
+			t.Errorf("size %d: ETag %s, S3 has %s", tc.size, sums.etag, want)
+		}
+	}
+}
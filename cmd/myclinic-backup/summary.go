@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// summaryPeriod is the span the weekly summary covers, up to when it is
+// made.
+const summaryPeriod = 7 * 24 * time.Hour
+
+// weekTotals is what the weekly summary reports of a profile.
+type weekTotals struct {
+	successes int
+	failures  int
+	last      time.Time
+	size      int64
+}
+
+func countWeek(p *Profile, now time.Time) (*weekTotals, error) {
+	since := now.Add(-summaryPeriod)
+	w := &weekTotals{}
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Profile != p.Name || !e.isDump() || e.Time.Before(since) || e.Time.After(now) {
+			continue
+		}
+		w.successes++
+		size := e.EncryptedSize
+		if size == 0 {
+			size = e.Size
+		}
+		w.size += size
+		if e.Time.After(w.last) {
+			w.last = e.Time
+		}
+	}
+	records, err := auditLog.records()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if r.Profile == p.Name && r.Outcome == "failure" && !r.Time.Before(since) && !r.Time.After(now) {
+			w.failures++
+		}
+	}
+	return w, nil
+}
+
+// staffBytes writes a size as staff are used to seeing it, e.g. 3.2GB.
+func staffBytes(n int64) string {
+	return strings.NewReplacer(" ", "", "iB", "B").Replace(formatBytes(n))
+}
+
+// weeklySummary returns the weekly summary of the profile. It is always in
+// Japanese, whatever the language of the rest of the output, and leaves
+// out technical detail: it is for the clinic staff, who need to know that
+// the backups are being taken, or whom to call when they are not.
+func weeklySummary(p *Profile, now time.Time) (*Event, error) {
+	w, err := countWeek(p, now)
+	if err != nil {
+		return nil, err
+	}
+	var parts []string
+	if w.successes > 0 {
+		parts = append(parts, fmt.Sprintf("%d回成功", w.successes),
+			"最終 "+w.last.Local().Format("1/2 15:04"),
+			"合計 "+staffBytes(w.size))
+	} else {
+		parts = append(parts, "成功したバックアップはありません")
+	}
+	if w.failures > 0 {
+		parts = append(parts, fmt.Sprintf("%d回失敗", w.failures))
+	}
+	ok := w.successes > 0 && w.failures == 0
+	advice := "問題はありません。"
+	if !ok {
+		advice = "担当者に連絡してください。"
+	}
+	data := &weeklySummaryData{Profile: p.Name, Successes: w.successes, Failures: w.failures, Last: w.last,
+		Size: w.size, OK: ok}
+	return &Event{
+		Kind:    eventSummary,
+		Profile: p.Name,
+		Success: ok,
+		Time:    now,
+		Summary: strings.TrimSpace(renderText(templateWeeklySummary, data,
+			fmt.Sprintf("今週のバックアップ（%s）：%s\n%s", p.Name, strings.Join(parts, "、"), advice))),
+	}, nil
+}
+
+// weeklySummaryData is what the template of the weekly summary is
+// executed with.
+type weeklySummaryData struct {
+	Profile   string
+	Successes int
+	Failures  int
+	// Last is the time of the latest backup, zero if there is none.
+	Last time.Time
+	Size int64
+	// OK is set if there were backups and no failures.
+	OK bool
+}
+
+// sendWeeklySummary sends the weekly summary of the profile from the
+// daemon.
+func sendWeeklySummary(p *Profile, now time.Time) {
+	event, err := weeklySummary(p, now)
+	if err == nil {
+		err = notify(p.Notify, event)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, tr("[%s] weekly summary: %v\n"), p.Name, err)
+	}
+}
+
+// summaryCommand prints the weekly summary of the selected profiles, to
+// try the wording or to send it from an outside scheduler.
+func summaryCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("summary", flag.ExitOnError)
+	send := flags.Bool("send", false, "also sends the summary to the notifiers of each profile")
+	flags.Parse(args)
+	now := time.Now()
+	failed := 0
+	for _, p := range profiles {
+		event, err := weeklySummary(p, now)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s\n", event.Summary)
+		if *send {
+			err = notify(p.Notify, event)
+			if err != nil {
+				fmt.Fprintf(stderr, tr("%s: notification failed: %v\n"), p.Name, err)
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("summary of %d profile(s) not sent", failed)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"text/template"
+	"time"
+)
+
+// Sites may replace the wording of what the tool sends, to match the
+// formats and language of the clinic group, with Go templates in files
+// named in the templates section of the config. Notifications are
+// executed with the Event, whose Result is the result of the run for
+// backups; the drill report with the drill, and the weekly summary with
+// its totals. A template that fails to execute falls back to the built-in
+// text, so that a mistake in one never silences a notification.
+//
+// Besides the built-in functions of templates, these are available:
+//
+//	tr        translates a message of the tool, e.g. {{tr "PASS"}}
+//	localtime formats a time in local time, e.g. {{localtime .Time "01/02 15:04"}}
+//	bytes     formats a size, e.g. {{bytes .Result.Size}}
+//	seconds   rounds a duration to seconds
+
+// TemplatesConfig names the template files replacing the built-in texts.
+type TemplatesConfig struct {
+	// EmailSubject and EmailBody are of the mails of email sinks, and
+	// EmailHTML, if set, an HTML version of the body sent along with it.
+	EmailSubject string `yaml:"email_subject"`
+	EmailBody    string `yaml:"email_body"`
+	EmailHTML    string `yaml:"email_html"`
+	// Line and SMS are the texts of LINE and text messages.
+	Line string `yaml:"line"`
+	SMS  string `yaml:"sms"`
+	// DrillReport is the body of the mail reporting a restore drill.
+	DrillReport string `yaml:"drill_report"`
+	// WeeklySummary is the weekly summary for the clinic staff.
+	WeeklySummary string `yaml:"weekly_summary"`
+
+	texts map[string]*template.Template
+	html  *htmltemplate.Template
+}
+
+// Names of the texts templates replace.
+const (
+	templateEmailSubject  = "email_subject"
+	templateEmailBody     = "email_body"
+	templateLine          = "line"
+	templateSMS           = "sms"
+	templateDrillReport   = "drill_report"
+	templateWeeklySummary = "weekly_summary"
+)
+
+// messageTemplates are the templates of the config, or nil.
+var messageTemplates *TemplatesConfig
+
+var templateFuncs = map[string]interface{}{
+	"tr": tr,
+	"localtime": func(t time.Time, layout string) string {
+		return t.Local().Format(layout)
+	},
+	"bytes": staffBytes,
+	"seconds": func(d time.Duration) time.Duration {
+		return d.Round(time.Second)
+	},
+}
+
+// load parses the template files.
+func (t *TemplatesConfig) load() error {
+	t.texts = make(map[string]*template.Template)
+	for name, path := range map[string]string{
+		templateEmailSubject:  t.EmailSubject,
+		templateEmailBody:     t.EmailBody,
+		templateLine:          t.Line,
+		templateSMS:           t.SMS,
+		templateDrillReport:   t.DrillReport,
+		templateWeeklySummary: t.WeeklySummary,
+	} {
+		if path == "" {
+			continue
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("templates: %s: %v", name, err)
+		}
+		t.texts[name], err = template.New(name).Funcs(templateFuncs).Parse(string(src))
+		if err != nil {
+			return fmt.Errorf("templates: %v", err)
+		}
+	}
+	if t.EmailHTML != "" {
+		src, err := ioutil.ReadFile(t.EmailHTML)
+		if err != nil {
+			return fmt.Errorf("templates: email_html: %v", err)
+		}
+		t.html, err = htmltemplate.New("email_html").Funcs(templateFuncs).Parse(string(src))
+		if err != nil {
+			return fmt.Errorf("templates: %v", err)
+		}
+	}
+	return nil
+}
+
+// renderText returns the text named name executed with data, or def if
+// no template replaces it or the template fails.
+func renderText(name string, data interface{}, def string) string {
+	if messageTemplates == nil || messageTemplates.texts[name] == nil {
+		return def
+	}
+	var b bytes.Buffer
+	err := messageTemplates.texts[name].Execute(&b, data)
+	if err != nil {
+		fmt.Fprintf(stderr, tr("template %s: %v; the built-in text is used\n"), name, err)
+		return def
+	}
+	return b.String()
+}
+
+// renderEmailHTML returns the HTML version of the mail of the event, or ""
+// if there is none.
+func renderEmailHTML(event *Event) string {
+	if messageTemplates == nil || messageTemplates.html == nil {
+		return ""
+	}
+	var b bytes.Buffer
+	err := messageTemplates.html.Execute(&b, event)
+	if err != nil {
+		fmt.Fprintf(stderr, tr("template email_html: %v; the mail is sent as text only\n"), err)
+		return ""
+	}
+	return b.String()
+}
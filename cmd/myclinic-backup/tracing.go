@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// With tracing configured, every backup run is sent as an OpenTelemetry
+// trace to an OTLP/HTTP endpoint, such as a collector or a backend that
+// takes OTLP directly, so that where a slow night spent its time shows
+// in the observability stack of the site. The run is the root span, its
+// stages the children, the dump, compression and encryption separate, and
+// each request of an upload, a part of a multipart upload included, a
+// span of its own. The trace is sent as OTLP JSON when the run ends, or at
+// once when it panics, which needs no OpenTelemetry SDK.
+
+// TracingConfig is where traces are sent.
+type TracingConfig struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver, e.g.
+	// http://localhost:4318; traces are posted to /v1/traces under it.
+	Endpoint string `yaml:"endpoint"`
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// ServiceName is the service.name of the traces (default
+	// myclinic-backup).
+	ServiceName string `yaml:"service_name"`
+}
+
+func (t *TracingConfig) validate() error {
+	u, err := url.Parse(t.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("tracing: endpoint must be an http or https URL: %q", t.Endpoint)
+	}
+	if t.ServiceName == "" {
+		t.ServiceName = "myclinic-backup"
+	}
+	return nil
+}
+
+// tracing is the configuration of tracing, or nil if traces are not sent.
+var tracing *TracingConfig
+
+var tracingClient = &http.Client{Timeout: 30 * time.Second}
+
+// span is an operation of a trace. The methods of a nil span do nothing,
+// so that runs are traced the same way whether tracing is on or not.
+type span struct {
+	trace    *trace
+	id       string
+	parentID string
+	name     string
+	client   bool
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      string
+}
+
+// trace collects the spans of a run until it ends.
+type trace struct {
+	id    string
+	mu    sync.Mutex
+	spans []*span
+	// sent is set once the trace has been sent; it is sent only once.
+	sent bool
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startTrace starts the root span of a trace, or returns nil if tracing
+// is off.
+func startTrace(name string) *span {
+	if tracing == nil {
+		return nil
+	}
+	t := &trace{id: randomHex(16)}
+	return t.start(name, "")
+}
+
+func (t *trace) start(name string, parentID string) *span {
+	s := &span{trace: t, id: randomHex(8), parentID: parentID, name: name, start: time.Now(),
+		attrs: make(map[string]interface{})}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return s
+}
+
+// child starts a span within s.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	return s.trace.start(name, s.id)
+}
+
+// set sets an attribute of the span: a string, a bool or an integer.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.trace.mu.Lock()
+	s.attrs[key] = value
+	s.trace.mu.Unlock()
+}
+
+// finish ends the span, as failed if err is not nil. Finishing the root
+// span sends the trace.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.trace.mu.Lock()
+	s.end = time.Now()
+	if err != nil {
+		s.err = redactError(err)
+	}
+	s.trace.mu.Unlock()
+	if s.parentID == "" {
+		s.trace.send()
+	}
+}
+
+// abort ends the spans of the trace still open, s among them, as failed
+// with err, and sends the trace at once. It is called on a panic, which
+// may yet take the process down before the root span finishes.
+func (s *span) abort(err error) {
+	if s == nil {
+		return
+	}
+	s.trace.mu.Lock()
+	now := time.Now()
+	for _, o := range s.trace.spans {
+		if o.end.IsZero() {
+			o.end = now
+			o.err = redactError(err)
+		}
+	}
+	s.trace.mu.Unlock()
+	s.trace.send()
+}
+
+// send exports the trace unless it has been already.
+func (t *trace) send() {
+	t.mu.Lock()
+	sent := t.sent
+	t.sent = true
+	t.mu.Unlock()
+	if sent {
+		return
+	}
+	err := t.export()
+	if err != nil {
+		fmt.Fprintf(stderr, tr("cannot send trace: %v\n"), err)
+	}
+}
+
+// s3Requests returns a request option making each request to S3 a span
+// within s.
+func (s *span) s3Requests() request.Option {
+	return func(r *request.Request) {
+		if s == nil {
+			return
+		}
+		var c *span
+		r.Handlers.Send.PushFront(func(r *request.Request) {
+			c = s.child("s3." + r.Operation.Name)
+			c.client = true
+			if input, ok := r.Params.(*s3.UploadPartInput); ok {
+				c.set("s3.part_number", aws.Int64Value(input.PartNumber))
+			}
+			if r.HTTPRequest.ContentLength > 0 {
+				c.set("http.request_content_length", r.HTTPRequest.ContentLength)
+			}
+		})
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if c == nil {
+				return
+			}
+			if r.HTTPResponse != nil {
+				c.set("http.status_code", int64(r.HTTPResponse.StatusCode))
+			}
+			c.set("aws.retry_count", int64(r.RetryCount))
+			c.finish(r.Error)
+		})
+	}
+}
+
+// OTLP JSON, as in opentelemetry/proto/trace/v1.
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// Span kinds and status codes of OTLP.
+const (
+	otlpKindInternal = 1
+	otlpKindClient   = 3
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	var list []otlpAttribute
+	for k, v := range attrs {
+		a := otlpAttribute{Key: k}
+		switch v := v.(type) {
+		case bool:
+			a.Value.BoolValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			a.Value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			a.Value.IntValue = &s
+		default:
+			s := fmt.Sprint(v)
+			a.Value.StringValue = &s
+		}
+		list = append(list, a)
+	}
+	return list
+}
+
+// export posts the spans of the trace.
+func (t *trace) export() error {
+	t.mu.Lock()
+	var spans []otlpSpan
+	for _, s := range t.spans {
+		end := s.end
+		if end.IsZero() {
+			end = time.Now()
+		}
+		o := otlpSpan{
+			TraceID:           t.id,
+			SpanID:            s.id,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+		if s.client {
+			o.Kind = otlpKindClient
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{Code: otlpStatusError, Message: s.err}
+		}
+		spans = append(spans, o)
+	}
+	t.mu.Unlock()
+	resource := otlpAttributes(map[string]interface{}{
+		"service.name":        tracing.ServiceName,
+		"service.instance.id": instanceID,
+	})
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "myclinic-backup"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(tracing.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range tracing.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := tracingClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded with %s", req.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCatchPanicSendsTrace(t *testing.T) {
+	var mu sync.Mutex
+	var exports [][]otlpSpan
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		exports = append(exports, body.ResourceSpans[0].ScopeSpans[0].Spans)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	savedTracing, savedErr := tracing, stderr
+	tracing = &TracingConfig{Endpoint: server.URL, ServiceName: "myclinic-backup"}
+	stderr = ioutil.Discard
+	defer func() { tracing, stderr = savedTracing, savedErr }()
+
+	root := startTrace("backup")
+	root.child("verify").finish(nil)
+	dump := root.child("dump")
+	err := catchPanic("", root, func() error { panic("nil map") })
+	if err == nil {
+		t.Fatal("panic not caught")
+	}
+	mu.Lock()
+	if len(exports) != 1 {
+		t.Fatalf("trace sent %d times on the panic, want 1", len(exports))
+	}
+	status := make(map[string]otlpStatus)
+	for _, s := range exports[0] {
+		status[s.Name] = s.Status
+	}
+	mu.Unlock()
+	for name, code := range map[string]int{"backup": otlpStatusError, "dump": otlpStatusError, "verify": otlpStatusOK} {
+		if status[name].Code != code {
+			t.Errorf("span %s has status %+v, want code %d", name, status[name], code)
+		}
+	}
+	if status["dump"].Message != "panic: nil map" {
+		t.Errorf("span dump has message %q", status["dump"].Message)
+	}
+
+	// The run finishing afterwards does not send the trace again.
+	dump.finish(nil)
+	root.finish(err)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(exports) != 1 {
+		t.Errorf("trace sent %d times, want 1", len(exports))
+	}
+}
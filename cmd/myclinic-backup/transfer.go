@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	cflib "github.com/hangilc/crypt-file/lib"
+	"github.com/hangilc/myclinic-backup/internal/cfstream"
+)
+
+// transfer holds the compression and upload settings of the
+// configuration, which apply to every profile.
+var transfer = struct {
+	compressor  Compressor
+	partSize    int64
+	concurrency int
+	// downloadConcurrency is the number of parts of an object read at
+	// once; see openS3ObjectParallel.
+	downloadConcurrency int
+	// deleteConcurrency and deleteRate pace the deletion of backups; see
+	// deleteEntries.
+	deleteConcurrency int
+	deleteRate        float64
+}{compressor: zlibCompressor{level: zlib.DefaultCompression}}
+
+// maxZstdLevel is the highest level of zstd without --ultra.
+const maxZstdLevel = 19
+
+// applyTransferSettings checks the compression settings,
+// upload_part_size, upload_concurrency, download_concurrency and the pace
+// of deletions and makes them effective.
+func (c *Config) applyTransferSettings() error {
+	maxLevel := zlib.BestCompression
+	if c.Compression == compressionZstd {
+		maxLevel = maxZstdLevel
+	}
+	if c.CompressionLevel < 0 || c.CompressionLevel > maxLevel {
+		return fmt.Errorf("compression_level must be between 1 and %d", maxLevel)
+	}
+	compressor, err := c.newCompressor()
+	if err != nil {
+		return err
+	}
+	transfer.compressor = compressor
+	decompressionCommand = strings.Fields(c.DecompressionCommand)
+	if c.UploadPartSize != "" {
+		size, err := parseByteSize(c.UploadPartSize)
+		if err != nil {
+			return fmt.Errorf("upload_part_size: %v", err)
+		}
+		if size < minPartSize {
+			return fmt.Errorf("upload_part_size must be at least %s", formatBytes(minPartSize))
+		}
+		transfer.partSize = size
+	}
+	if c.UploadConcurrency < 0 {
+		return fmt.Errorf("upload_concurrency must not be negative")
+	}
+	transfer.concurrency = c.UploadConcurrency
+	if c.DownloadConcurrency < 0 {
+		return fmt.Errorf("download_concurrency must not be negative")
+	}
+	transfer.downloadConcurrency = c.DownloadConcurrency
+	if c.DeleteConcurrency < 0 || c.DeleteRate < 0 {
+		return fmt.Errorf("delete_concurrency and delete_rate must not be negative")
+	}
+	transfer.deleteConcurrency = c.DeleteConcurrency
+	transfer.deleteRate = c.DeleteRate
+	return nil
+}
+
+// minPartSize is the smallest part S3 accepts in a multipart upload.
+const minPartSize = 5 << 20
+
+// maxObjectSize is the largest object S3 stores.
+const maxObjectSize = 5 << 40
+
+// compressAndEncrypt is cflib.CompressAndEncrypt with the configured
+// compressor.
+func compressAndEncrypt(key []byte, plain []byte) ([]byte, error) {
+	compressed, err := compress(transfer.compressor, plain)
+	if err != nil {
+		return nil, err
+	}
+	return cflib.Encrypt(key, compressed)
+}
+
+// newEncryptWriter returns a writer compressing with the configured
+// compressor and encrypting what is written to it into w, as
+// compressAndEncrypt does at once. Close completes the data. In FIPS mode
+// the data is sealed by crypto/cipher on Close; see fipsMode.
+func newEncryptWriter(key []byte, w io.Writer) (io.WriteCloser, error) {
+	if fipsMode {
+		return cfstream.NewSealedPlainWriter(key, w, transfer.compressor.NewWriter)
+	}
+	return cfstream.NewPlainWriter(key, w, transfer.compressor.NewWriter)
+}
+
+// newDecryptReader returns a reader of the decrypted content of the data
+// read from src, decompressed if decompress is set. Reading it to the end
+// authenticates the data.
+func newDecryptReader(key []byte, src io.Reader, decompress bool) (io.ReadCloser, error) {
+	switch {
+	case fipsMode && decompress:
+		return cfstream.NewSealedPlainReader(key, src, decompressReader)
+	case fipsMode:
+		dec, err := cfstream.NewSealedReader(key, src)
+		return ioutil.NopCloser(dec), err
+	case decompress:
+		return cfstream.NewPlainReader(key, src, decompressReader)
+	}
+	dec, err := cfstream.NewReader(key, src)
+	return ioutil.NopCloser(dec), err
+}
+
+func compressLevel(plain []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(plain)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newUploader returns an uploader with the part size and the configured
+// concurrency.
+func newUploader(sess *session.Session, partSize int64) *s3manager.Uploader {
+	return s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+		if transfer.concurrency > 0 {
+			u.Concurrency = transfer.concurrency
+		}
+	})
+}
+
+// uploadPartSize returns the part size for uploading size bytes: the
+// configured one, or else the default raised as the SDK raises it to stay
+// within s3manager.MaxUploadParts. A configured part size needing more
+// parts is an error rather than silently changed.
+func uploadPartSize(size int64) (int64, error) {
+	if size > maxObjectSize {
+		return 0, fmt.Errorf("%s is too large for S3, which stores objects of at most %s",
+			formatBytes(size), formatBytes(maxObjectSize))
+	}
+	if transfer.partSize > 0 {
+		if size/transfer.partSize >= s3manager.MaxUploadParts {
+			need := (size/s3manager.MaxUploadParts + 1 + 1<<20 - 1) &^ (1<<20 - 1)
+			return 0, fmt.Errorf("upload_part_size %s is too small for %s: S3 allows at most %d parts; set it to at least %dMB",
+				formatBytes(transfer.partSize), formatBytes(size), s3manager.MaxUploadParts, need>>20)
+		}
+		return transfer.partSize, nil
+	}
+	partSize := int64(s3manager.DefaultUploadPartSize)
+	if size/partSize >= s3manager.MaxUploadParts {
+		partSize = size/s3manager.MaxUploadParts + 1
+	}
+	return partSize, nil
+}
+
+// uploadChecksums are the checksums of a file to be uploaded.
+type uploadChecksums struct {
+	// etag is the ETag S3 gives the content uploaded in parts of the
+	// part size: the MD5 of the content if it fits in one part, or else
+	// the MD5 of the MD5s of the parts followed by the number of parts.
+	// It is empty in FIPS mode, which does not compute MD5.
+	etag string
+	// sha256 is the SHA-256 of the whole content.
+	sha256 []byte
+}
+
+// computeUploadChecksums reads the content of f, of size bytes, to be
+// uploaded in parts of partSize.
+func computeUploadChecksums(f io.Reader, size int64, partSize int64) (*uploadChecksums, error) {
+	whole := sha256.New()
+	if fipsMode {
+		_, err := io.Copy(whole, f)
+		if err != nil {
+			return nil, err
+		}
+		return &uploadChecksums{sha256: whole.Sum(nil)}, nil
+	}
+	var sums []byte
+	parts := 0
+	for remaining := size; parts == 0 || remaining > 0; remaining -= partSize {
+		h := md5.New()
+		_, err := io.CopyN(io.MultiWriter(h, whole), f, partSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		sums = h.Sum(sums)
+		parts++
+	}
+	c := &uploadChecksums{sha256: whole.Sum(nil)}
+	if parts == 1 {
+		c.etag = hex.EncodeToString(sums)
+	} else {
+		sum := md5.Sum(sums)
+		c.etag = fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts)
+	}
+	return c, nil
+}
+
+// Headers of the S3 checksum feature, which the SDK does not know yet.
+const (
+	checksumSHA256Header = "X-Amz-Checksum-Sha256"
+	// checksumAlgorithmHeader names the checksum sent, which S3 accepts
+	// in place of Content-MD5 where that is required.
+	checksumAlgorithmHeader = "X-Amz-Sdk-Checksum-Algorithm"
+	// sha256MetadataKey stores the SHA-256 as user metadata, also on
+	// multipart uploads, for catalog import and migrate-layout to record.
+	// S3 stores it as given, so it tells nothing about the upload.
+	sha256MetadataKey = "sha256"
+)
+
+// withChecksums makes a single PUT by the uploader carry the SHA-256 of
+// the content, which S3 checks before storing it and returns, and
+// verifies the returned value. Every request of a multipart upload
+// already carries the MD5 and SHA-256 of its part (Content-MD5 and the
+// signed payload hash), which S3 checks; whole object SHA-256 checksums
+// on multipart uploads need a newer SDK.
+func (c *uploadChecksums) withChecksums(r *request.Request) {
+	if r.Operation.Name != "PutObject" {
+		return
+	}
+	encoded := base64.StdEncoding.EncodeToString(c.sha256)
+	r.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.Header.Set(checksumSHA256Header, encoded)
+	})
+	r.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		returned := r.HTTPResponse.Header.Get(checksumSHA256Header)
+		if returned != "" && returned != encoded {
+			r.Error = fmt.Errorf("S3 returned SHA-256 checksum %s, expected %s", returned, encoded)
+		}
+	})
+}
+
+// check compares the ETag of the uploaded object with the checksums,
+// which confirms that S3 assembled the completed parts into the same
+// content. The object is not read back: with SSE-KMS, whose ETag is not an
+// MD5, and in FIPS mode, which computes no MD5, only the checks made by S3
+// at upload remain, those of each part and of the SHA-256 of a single PUT.
+func (c *uploadChecksums) check(svc *s3.S3, bucket string, key string, versionID *string) error {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(key),
+		VersionId: versionID,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot check uploaded object: %v", err)
+	}
+	if c.etag == "" || aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		return nil
+	}
+	etag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	if etag != c.etag {
+		return fmt.Errorf("uploaded object s3://%s/%s does not match the local file: ETag %s, expected %s",
+			bucket, key, etag, c.etag)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	mib = int64(1) << 20
+	gib = int64(1) << 30
+	tib = int64(1) << 40
+)
+
+// maxPartSize is the largest part S3 accepts in a multipart upload.
+const maxPartSize = 5 * gib
+
+func TestUploadPartSize(t *testing.T) {
+	defer func(saved int64) { transfer.partSize = saved }(transfer.partSize)
+	defaultSize := int64(s3manager.DefaultUploadPartSize)
+	limit := int64(s3manager.MaxUploadParts)
+	for _, tc := range []struct {
+		name       string
+		configured int64
+		size       int64
+		want       int64
+		err        string
+	}{
+		{"empty", 0, 0, defaultSize, ""},
+		{"below single PUT limit", 0, 5*gib - 1, defaultSize, ""},
+		{"single PUT limit", 0, 5 * gib, defaultSize, ""},
+		{"above single PUT limit", 0, 5*gib + 1, defaultSize, ""},
+		{"last size of default parts", 0, limit*defaultSize - 1, defaultSize, ""},
+		// As the SDK raises it, so that the checksums are of its parts.
+		{"first size of raised parts", 0, limit * defaultSize, limit*defaultSize/limit + 1, ""},
+		{"50GiB", 0, 50 * gib, 50*gib/limit + 1, ""},
+		{"5TiB", 0, 5 * tib, 5*tib/limit + 1, ""},
+		{"above 5TiB", 0, 5*tib + 1, 0, "too large for S3"},
+		{"configured, 5GiB", 16 * mib, 5 * gib, 16 * mib, ""},
+		{"configured, 50GiB", 16 * mib, 50 * gib, 16 * mib, ""},
+		{"configured, last size", 16 * mib, limit*16*mib - 1, 16 * mib, ""},
+		{"configured, too many parts", 16 * mib, limit * 16 * mib, 0, "set it to at least 17MB"},
+		{"configured too small for 5TiB", 16 * mib, 5 * tib, 0, "set it to at least 525MB"},
+		{"configured for 5TiB", 525 * mib, 5 * tib, 525 * mib, ""},
+		{"configured, above 5TiB", 1 * gib, 5*tib + 1, 0, "too large for S3"},
+	} {
+		transfer.partSize = tc.configured
+		got, err := uploadPartSize(tc.size)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got %d, %v; want an error with %q", tc.name, got, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: part size %d, want %d", tc.name, got, tc.want)
+		}
+		parts := (tc.size + got - 1) / got
+		if parts > limit {
+			t.Errorf("%s: %d parts of %d", tc.name, parts, got)
+		}
+		if got < minPartSize || got > maxPartSize {
+			t.Errorf("%s: part size %d out of S3's range", tc.name, got)
+		}
+	}
+}
+
+// The part size an error suggests is enough.
+func TestUploadPartSizeSuggestion(t *testing.T) {
+	defer func(saved int64) { transfer.partSize = saved }(transfer.partSize)
+	for _, size := range []int64{50 * gib, 500 * gib, 5 * tib} {
+		transfer.partSize = minPartSize
+		_, err := uploadPartSize(size)
+		if err == nil {
+			t.Errorf("%d bytes in parts of %d: no error", size, minPartSize)
+			continue
+		}
+		var need int64
+		i := strings.Index(err.Error(), "at least ")
+		if i < 0 {
+			t.Fatalf("no suggestion in %q", err)
+		}
+		for _, c := range err.Error()[i+len("at least "):] {
+			if c < '0' || c > '9' {
+				break
+			}
+			need = need*10 + int64(c-'0')
+		}
+		transfer.partSize = need * mib
+		if _, err := uploadPartSize(size); err != nil {
+			t.Errorf("%d bytes in parts of the suggested %dMB: %v", size, need, err)
+		}
+	}
+}
+
+// multipartETag computes the ETag S3 gives content uploaded in the parts.
+func multipartETag(parts ...string) string {
+	if len(parts) == 1 {
+		sum := md5.Sum([]byte(parts[0]))
+		return hex.EncodeToString(sum[:])
+	}
+	var sums []byte
+	for _, p := range parts {
+		sum := md5.Sum([]byte(p))
+		sums = append(sums, sum[:]...)
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(parts))
+}
+
+func TestComputeUploadChecksums(t *testing.T) {
+	const partSize = 4
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"empty", "", multipartETag("")},
+		{"below a part", "abc", multipartETag("abc")},
+		// The uploader puts content of exactly one part in a single PUT.
+		{"one part", "abcd", multipartETag("abcd")},
+		{"above a part", "abcde", multipartETag("abcd", "e")},
+		// An exact multiple has no empty last part.
+		{"two parts", "abcdefgh", multipartETag("abcd", "efgh")},
+		{"above two parts", "abcdefghi", multipartETag("abcd", "efgh", "i")},
+	} {
+		c, err := computeUploadChecksums(strings.NewReader(tc.content), int64(len(tc.content)), partSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.etag != tc.want {
+			t.Errorf("%s: ETag %s, want %s", tc.name, c.etag, tc.want)
+		}
+		if sum := sha256.Sum256([]byte(tc.content)); !bytes.Equal(c.sha256, sum[:]) {
+			t.Errorf("%s: SHA-256 %x, want %x", tc.name, c.sha256, sum)
+		}
+	}
+}
+
+// FIPS mode computes no MD5, so there is no ETag to check.
+func TestComputeUploadChecksumsFIPS(t *testing.T) {
+	defer func(saved bool) { fipsMode = saved }(fipsMode)
+	fipsMode = true
+	c, err := computeUploadChecksums(strings.NewReader("abcde"), 5, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256([]byte("abcde")); c.etag != "" || !bytes.Equal(c.sha256, sum[:]) {
+		t.Errorf("checksums %q, %x; want no ETag and %x", c.etag, c.sha256, sum)
+	}
+}
+
+// In FIPS mode a backup is sealed at once by crypto/cipher, in the same
+// format as the stream.
+func TestEncryptWriterFIPS(t *testing.T) {
+	defer func(saved bool) { fipsMode = saved }(fipsMode)
+	fipsMode = true
+	key := bytes.Repeat([]byte{7}, 32)
+	plain := bytes.Repeat([]byte("backup "), 1000)
+	var buf bytes.Buffer
+	w, err := newEncryptWriter(key, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes written before Close", buf.Len())
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fips := range []bool{true, false} {
+		fipsMode = fips
+		r, err := newDecryptReader(key, bytes.NewReader(buf.Bytes()), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("fips %v: %v", fips, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("fips %v: content differs", fips)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tuiPageSize is how many backups the tui lists at a time.
+const tuiPageSize = 15
+
+// tui is a menu driven terminal interface to the catalog, for operators
+// who would rather not remember subcommands and flags during an incident.
+// It reads plain lines, so it works in any console.
+type tui struct {
+	config   *Config
+	profiles []*Profile
+	in       *bufio.Reader
+	// filter is the date prefix backups are listed by, e.g. 2020-06.
+	filter  string
+	page    int
+	entries []*CatalogEntry
+}
+
+// ask prints the prompt and returns the answer without surrounding space.
+// It returns io.EOF when the input ends.
+func (t *tui) ask(format string, args ...interface{}) (string, error) {
+	fmt.Fprintf(stdout, tr(format), args...)
+	line, err := t.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// confirm asks the operator to type yes before something irreversible.
+func (t *tui) confirm(format string, args ...interface{}) (bool, error) {
+	answer, err := t.ask(tr(format)+tr(" Type yes to continue: "), args...)
+	return answer == "yes", err
+}
+
+func (t *tui) pause() error {
+	_, err := t.ask("\nPress Enter to go back.")
+	return err
+}
+
+// load reads the backups of the profiles matching the filter, newest
+// first.
+func (t *tui) load() error {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return err
+	}
+	t.entries = nil
+	for _, e := range entries {
+		if !e.isDump() || findProfile(t.profiles, e.Profile) == nil {
+			continue
+		}
+		if t.filter != "" && !strings.HasPrefix(e.Time.Local().Format("2006-01-02 15:04"), t.filter) {
+			continue
+		}
+		t.entries = append(t.entries, e)
+	}
+	sort.Slice(t.entries, func(i, j int) bool { return t.entries[i].Time.After(t.entries[j].Time) })
+	return nil
+}
+
+func verificationSummary(e *CatalogEntry) string {
+	if len(e.Verifications) == 0 {
+		return tr("not verified")
+	}
+	v := e.Verifications[len(e.Verifications)-1]
+	if v.OK {
+		return tr("verified ") + v.Time.Local().Format("2006-01-02")
+	}
+	return tr("VERIFICATION FAILED ") + v.Time.Local().Format("2006-01-02")
+}
+
+func (t *tui) list() {
+	fmt.Fprintf(stdout, tr("\n=== Backups"))
+	if t.filter != "" {
+		fmt.Fprintf(stdout, tr(" taken %s"), t.filter)
+	}
+	fmt.Fprintf(stdout, " ===\n\n")
+	if len(t.entries) == 0 {
+		fmt.Fprintf(stdout, tr("  no backups\n"))
+	}
+	start := t.page * tuiPageSize
+	for i := start; i < len(t.entries) && i < start+tuiPageSize; i++ {
+		e := t.entries[i]
+		uploaded := ""
+		if e.S3Key == "" {
+			uploaded = tr("  (not uploaded)")
+		}
+		fmt.Fprintf(stdout, "  %3d  %-12s %s  %10s  %s%s%s\n", i+1, e.Profile, e.Time.Local().Format("2006-01-02 15:04"),
+			formatBytes(e.Size), verificationSummary(e), uploaded, labelSummary(e))
+	}
+	if len(t.entries) > tuiPageSize {
+		fmt.Fprintf(stdout, tr("\n  page %d of %d\n"), t.page+1, (len(t.entries)+tuiPageSize-1)/tuiPageSize)
+	}
+	fmt.Fprintf(stdout, tr("\n  NUMBER  details and actions of a backup\n"))
+	fmt.Fprintf(stdout, tr("  d DATE  show backups taken on a date, e.g. d 2020-06-01 or d 2020-06 (d alone shows all)\n"))
+	fmt.Fprintf(stdout, tr("  n, p    next or previous page\n"))
+	fmt.Fprintf(stdout, tr("  prune   delete plain dumps by the retention rules\n"))
+	fmt.Fprintf(stdout, tr("  q       quit\n\n"))
+}
+
+func (t *tui) details(e *CatalogEntry) error {
+	p := findProfile(t.profiles, e.Profile)
+	for {
+		fmt.Fprintf(stdout, tr("\n=== Backup of %s taken %s ===\n\n"), e.Profile, e.Time.Local().Format("2006-01-02 15:04"))
+		fmt.Fprintf(stdout, tr("  run id:         %s\n"), e.RunID)
+		fmt.Fprintf(stdout, tr("  size:           %s\n"), formatBytes(e.Size))
+		fmt.Fprintf(stdout, tr("  encrypted size: %s\n"), formatBytes(e.EncryptedSize))
+		fmt.Fprintf(stdout, "  sha256:         %s\n", e.SHA256)
+		if e.Trigger != "" {
+			fmt.Fprintf(stdout, tr("  started by:     %s\n"), e.Trigger)
+		}
+		if e.CryptoMode != "" {
+			fmt.Fprintf(stdout, tr("  crypto mode:    %s\n"), e.CryptoMode)
+		}
+		if e.Label != "" {
+			fmt.Fprintf(stdout, tr("  label:          %s\n"), e.Label)
+		}
+		if e.Note != "" {
+			fmt.Fprintf(stdout, tr("  note:           %s\n"), e.Note)
+		}
+		if e.S3Key != "" {
+			fmt.Fprintf(stdout, tr("  stored at:      %s\n"), entryLocation(e))
+		}
+		if e.EncryptedFile != "" {
+			fmt.Fprintf(stdout, tr("  local file:     %s\n"), e.EncryptedFile)
+		}
+		for _, v := range e.Verifications {
+			result := tr("ok")
+			if !v.OK {
+				result = trf("FAILED: %s", v.Error)
+			}
+			fmt.Fprintf(stdout, "  %s %s %s\n", tr(v.Kind), v.Time.Local().Format("2006-01-02 15:04"), result)
+		}
+		if e.S3Key == "" {
+			fmt.Fprintf(stdout, tr("\n  The backup was not uploaded, so it cannot be restored or verified from here.\n"))
+			return t.pause()
+		}
+		fmt.Fprintf(stdout, tr("\n  r  restore this backup\n  v  verify this backup\n  V  verify by loading it into a temporary database\n  b  back\n\n"))
+		answer, err := t.ask("> ")
+		if err != nil {
+			return err
+		}
+		switch answer {
+		case "r":
+			err = t.restore(p, e)
+		case "v", "V":
+			err = t.verify(p, e, answer == "V")
+		case "b", "":
+			return nil
+		default:
+			fmt.Fprintf(stdout, tr("unknown choice: %s\n"), answer)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *tui) restore(p *Profile, e *CatalogEntry) error {
+	taken := e.Time.Local().Format("2006-01-02 15:04")
+	var ok bool
+	var restore func() error
+	var db string
+	var err error
+	switch {
+	case p.isFiles():
+		var dir string
+		dir, err = t.ask("Directory to extract into: ")
+		if err != nil || dir == "" {
+			return err
+		}
+		ok, err = t.confirm("Files of the backup taken %s will be written under %s.", taken, dir)
+		restore = func() error { return restoreFiles(p, e, dir) }
+	case p.isMultiDatabase():
+		ok, err = t.confirm("The databases %s will be replaced by the backup taken %s.",
+			strings.Join(p.Databases, ", "), taken)
+		restore = func() error { return restoreStream(p, e, "", stdout) }
+	default:
+		db, err = t.ask("Database to restore into [%s]: ", p.databases()[0])
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			db = p.databases()[0]
+		}
+		ok, err = t.confirm("The database %s will be replaced by the backup taken %s.", db, taken)
+		restore = func() error { return restoreStream(p, e, db, stdout) }
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Fprintf(stdout, tr("cancelled\n"))
+		return nil
+	}
+	var snap *CatalogEntry
+	if p.RestoreSnapshot && !p.isFiles() {
+		snap, err = takeRestoreSnapshot(t.config, p, e, db, nil)
+	}
+	if err == nil {
+		err = restore()
+	}
+	if err == nil && !p.isFiles() {
+		_, err = checkRestore(p, db, stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, tr("\nRESTORE FAILED: %v\n"), err)
+	} else {
+		fmt.Fprintf(stdout, tr("\nrestored\n"))
+	}
+	printRollback(p, snap)
+	return t.pause()
+}
+
+func (t *tui) verify(p *Profile, e *CatalogEntry, deep bool) error {
+	fmt.Fprintf(stdout, tr("verifying %s\n"), entryLocation(e))
+	v := &Verification{Time: time.Now(), Kind: "verify", Deep: deep}
+	err := verifyEntry(p, e, deep)
+	if err != nil {
+		v.Error = redactError(err)
+		fmt.Fprintf(stdout, tr("\nVERIFICATION FAILED: %v\n"), err)
+	} else {
+		v.OK = true
+		fmt.Fprintf(stdout, tr("\nthe backup is intact\n"))
+	}
+	if rerr := recordVerification(e, v); rerr != nil {
+		fmt.Fprintf(stderr, tr("cannot record verification: %v\n"), rerr)
+	} else {
+		e.Verifications = append(e.Verifications, v)
+	}
+	return t.pause()
+}
+
+func (t *tui) prune() error {
+	for _, p := range t.profiles {
+		if !p.prunesPlainDumps() {
+			fmt.Fprintf(stdout, tr("%s: neither plain_retention nor plain_keep_last is set; nothing to delete\n"), p.Name)
+			continue
+		}
+		ok, err := t.confirm("Plain dumps of %s %s will be deleted from %s.", p.Name,
+			p.describeRetention(), p.BackupDir)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		removed, err := p.expirePlainDumps(time.Now(), "")
+		for _, path := range removed {
+			fmt.Fprintf(stdout, tr("removed %s\n"), path)
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "%s: %v\n", p.Name, err)
+		} else {
+			fmt.Fprintf(stdout, tr("%s: %d plain dump(s) deleted\n"), p.Name, len(removed))
+		}
+	}
+	return t.pause()
+}
+
+func (t *tui) run() error {
+	for {
+		err := t.load()
+		if err != nil {
+			return err
+		}
+		if t.page*tuiPageSize >= len(t.entries) {
+			t.page = 0
+		}
+		t.list()
+		answer, err := t.ask("> ")
+		if err != nil {
+			return err
+		}
+		switch {
+		case answer == "q":
+			return nil
+		case answer == "n":
+			if (t.page+1)*tuiPageSize < len(t.entries) {
+				t.page++
+			}
+		case answer == "p":
+			if t.page > 0 {
+				t.page--
+			}
+		case answer == "d" || strings.HasPrefix(answer, "d "):
+			t.filter = strings.TrimSpace(strings.TrimPrefix(answer, "d"))
+			t.page = 0
+		case answer == "prune":
+			err = t.prune()
+		case answer == "":
+		default:
+			n, cerr := strconv.Atoi(answer)
+			if cerr != nil || n < 1 || n > len(t.entries) {
+				fmt.Fprintf(stdout, tr("unknown choice: %s\n"), answer)
+				continue
+			}
+			err = t.details(t.entries[n-1])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func tuiCommand(config *Config, profiles []*Profile, args []string) error {
+	t := &tui{config: config, profiles: profiles, in: bufio.NewReader(os.Stdin)}
+	err := t.run()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	"github.com/hangilc/myclinic-backup/internal/cfstream"
+)
+
+// VerifyConfig schedules the verification of stored backups. Each time the
+// schedule fires, a random backup at least MinAgeDays old is downloaded,
+// decrypted and checked against the checksum recorded at backup time.
+type VerifyConfig struct {
+	Schedule   string `yaml:"schedule"`
+	MinAgeDays int    `yaml:"min_age_days"`
+	// Deep also loads the backup into a temporary database, or for a
+	// profile of type files reads the archive through.
+	Deep bool `yaml:"deep"`
+}
+
+// Verification is the result of checking a stored backup.
+type Verification struct {
+	Time time.Time `json:"time"`
+	// Kind is "verify", "drill" or "spot-check".
+	Kind  string `json:"kind"`
+	Deep  bool   `json:"deep"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// RecoveryTime is how long a drill took to download, decrypt and load
+	// the backup.
+	RecoveryTime time.Duration `json:"recovery_time,omitempty"`
+}
+
+// readBackup streams the backup of the entry, downloaded or, for an entry
+// without S3Key as returned by localCopy, from its local encrypted file,
+// through decryption into use, which may be nil. The content is checked
+// against its checksum and authenticated once read to the end, which is
+// done after use returns; until then, use must treat it as untrusted.
+func readBackup(p *Profile, e *CatalogEntry, use func(plain io.Reader) error) error {
+	plain, _, err := openBackupStream(p, e, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	h := sha256.New()
+	r := io.TeeReader(plain, h)
+	var useErr error
+	if use != nil {
+		useErr = use(r)
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	if errors.Is(err, cfstream.ErrAuth) {
+		return fmt.Errorf("decryption failed (wrong key or corrupted data)")
+	}
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != e.SHA256 {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", e.SHA256, sum)
+	}
+	return useErr
+}
+
+// restoreVerify loads the dump into a temporary database which is dropped
+// afterwards.
+func restoreVerify(p *Profile, plain io.Reader) error {
+	db := fmt.Sprintf("%s_verify_%d", p.databases()[0], time.Now().Unix())
+	err := mysqlExecute(p, "CREATE DATABASE "+quoteIdent(db))
+	if err != nil {
+		return err
+	}
+	defer mysqlExecute(p, "DROP DATABASE "+quoteIdent(db))
+	return mysqlLoad(p, db, plain)
+}
+
+func verifyEntry(p *Profile, e *CatalogEntry, deep bool) error {
+	if deep && p.isFiles() {
+		return readBackup(p, e, func(plain io.Reader) error {
+			_, err := checkArchive(plain)
+			if err != nil {
+				return fmt.Errorf("archive is malformed: %v", err)
+			}
+			return nil
+		})
+	}
+	if deep {
+		return readBackup(p, e, func(plain io.Reader) error {
+			return restoreVerify(p, plain)
+		})
+	}
+	return readBackup(p, e, nil)
+}
+
+func recordVerification(e *CatalogEntry, v *Verification) error {
+	recordHistory(&HistoryRecord{RunID: e.RunID, Profile: e.Profile, Kind: v.Kind, Started: v.Time, Finished: time.Now(),
+		Success: v.OK, Error: v.Error, Size: e.EncryptedSize, S3Key: e.S3Key, Label: e.Label})
+	return catalog.Update(func(entries []*CatalogEntry) ([]*CatalogEntry, error) {
+		for _, x := range entries {
+			if x.RunID == e.RunID && x.Profile == e.Profile && x.Time.Equal(e.Time) {
+				x.Verifications = append(x.Verifications, v)
+				return entries, nil
+			}
+		}
+		return nil, fmt.Errorf("backup %s no longer in catalog", e.S3Key)
+	})
+}
+
+// pickForVerification chooses a random uploaded backup of the profile that
+// is older than minAge.
+func pickForVerification(p *Profile, minAge time.Duration) (*CatalogEntry, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*CatalogEntry
+	for _, e := range entries {
+		if e.Profile == p.Name && e.isDump() && e.S3Key != "" && time.Since(e.Time) >= minAge {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+func verifyRandomBackup(p *Profile, prefix string) {
+	e, err := pickForVerification(p, time.Duration(p.Verify.MinAgeDays)*24*time.Hour)
+	if err != nil {
+		fmt.Fprintf(stderr, tr("%sverification: %v\n"), prefix, err)
+		return
+	}
+	if e == nil {
+		fmt.Fprintf(stdout, tr("%sverification: no backup old enough\n"), prefix)
+		return
+	}
+	v := &Verification{Time: time.Now(), Kind: "verify", Deep: p.Verify.Deep}
+	err = verifyEntry(p, e, p.Verify.Deep)
+	if err != nil {
+		v.Error = redactError(err)
+		fmt.Fprintf(stderr, tr("%sverification of %s FAILED: %v\n"), prefix, e.S3Key, err)
+	} else {
+		v.OK = true
+		fmt.Fprintf(stdout, tr("%sverification of %s OK\n"), prefix, e.S3Key)
+	}
+	err = recordVerification(e, v)
+	if err != nil {
+		fmt.Fprintf(stderr, tr("%scannot record verification: %v\n"), prefix, err)
+	}
+}
+
+func verifyCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	from := flags.String("from", "s3", "what to verify: s3 for the stored backup, or local for the copy in encrypted_dir")
+	date := flags.String("date", "", "verifies the backup taken at this time, e.g. 202401021504 (default the latest)")
+	deep := flags.Bool("deep", false, "also loads the backup into a temporary database, or for a profile of type files reads the archive through")
+	flags.Parse(args)
+	if *from != "s3" && *from != "local" {
+		return fmt.Errorf("-from must be s3 or local: %s", *from)
+	}
+	local := *from == "local"
+	if *date != "" && len(profiles) != 1 {
+		return fmt.Errorf("select one profile with -profile to give -date")
+	}
+	failed := 0
+	for _, p := range profiles {
+		prefix := ""
+		if len(profiles) > 1 {
+			prefix = "[" + p.Name + "] "
+		}
+		var e *CatalogEntry
+		var err error
+		switch {
+		case *date != "":
+			e, err = backupTakenAt(p, *date, local)
+		case local:
+			e, err = latestLocal(p)
+		default:
+			e, err = latestUploaded(p)
+		}
+		if err == nil && local {
+			e, err = localCopy(e)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, tr("%sverification: %v\n"), prefix, err)
+			failed++
+			continue
+		}
+		location := entryLocation(e)
+		if local {
+			location = e.EncryptedFile
+		}
+		v := &Verification{Time: time.Now(), Kind: "verify", Deep: *deep}
+		err = verifyEntry(p, e, *deep)
+		if err != nil {
+			v.Error = redactError(err)
+			fmt.Fprintf(stderr, tr("%sverification of %s FAILED: %v\n"), prefix, location, err)
+			failed++
+		} else {
+			v.OK = true
+			fmt.Fprintf(stdout, tr("%sverification of %s OK\n"), prefix, location)
+		}
+		err = recordVerification(e, v)
+		if err != nil {
+			fmt.Fprintf(stderr, tr("%scannot record verification: %v\n"), prefix, err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d verification(s) failed", failed)
+	}
+	return nil
+}
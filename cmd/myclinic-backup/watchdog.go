@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// lastSuccess returns the time of the latest backup of the profile recorded
+// in the catalog, or the zero time if there is none.
+func lastSuccess(p *Profile) (time.Time, error) {
+	entries, err := catalog.Entries()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var last time.Time
+	for _, e := range entries {
+		if e.Profile == p.Name && e.isDump() && e.Time.After(last) {
+			last = e.Time
+		}
+	}
+	return last, nil
+}
+
+// overdueEvent returns an event if the last successful backup of the
+// profile is older than maxAge, and nil otherwise.
+func overdueEvent(p *Profile, maxAge time.Duration, now time.Time) (*Event, error) {
+	last, err := lastSuccess(p)
+	if err != nil {
+		return nil, err
+	}
+	if !last.IsZero() && now.Sub(last) <= maxAge {
+		return nil, nil
+	}
+	summary := trf("backup of %s overdue: no successful backup recorded", p.Name)
+	if !last.IsZero() {
+		summary = trf("backup of %s overdue: last success %s (%s ago, limit %s)",
+			p.Name, last.Format("2006-01-02 15:04"), now.Sub(last).Round(time.Minute), maxAge)
+	}
+	return &Event{
+		Kind:    eventOverdue,
+		Profile: p.Name,
+		Time:    now,
+		Summary: summary,
+	}, nil
+}
+
+// overdueRepeat is how often an ongoing overdue state is reported again.
+const overdueRepeat = 24 * time.Hour
+
+// watchdog reports overdue profiles, or those breaching their recovery
+// objectives, from the daemon: once when a profile becomes so and again
+// every overdueRepeat while it stays so.
+type watchdog struct {
+	mu       sync.Mutex
+	reported map[string]time.Time
+	// probe returns the event to report for the profile, or nil.
+	probe func(p *Profile, now time.Time) (*Event, error)
+}
+
+func newWatchdog(probe func(p *Profile, now time.Time) (*Event, error)) *watchdog {
+	return &watchdog{reported: make(map[string]time.Time), probe: probe}
+}
+
+func (w *watchdog) check(p *Profile, now time.Time) {
+	event, err := w.probe(p, now)
+	if err != nil {
+		fmt.Fprintf(stderr, tr("[%s] watchdog: %v\n"), p.Name, err)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if event == nil {
+		delete(w.reported, p.Name)
+		return
+	}
+	if last, ok := w.reported[p.Name]; ok && now.Sub(last) < overdueRepeat {
+		return
+	}
+	w.reported[p.Name] = now
+	fmt.Fprintf(stderr, "%s\n", event.Summary)
+	err = notify(p.Notify, event)
+	if err != nil {
+		fmt.Fprintf(stderr, tr("[%s] notification failed: %v\n"), p.Name, err)
+	}
+}
+
+// checkCommand is meant to be run by monitoring: it exits with an error if
+// any selected profile is overdue, and sends the overdue notifications.
+func checkCommand(config *Config, profiles []*Profile, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	maxAgeFlag := flags.Duration("max-age", 0, "overrides max_age of the profiles")
+	flags.Parse(args)
+	overdue := 0
+	now := time.Now()
+	for _, p := range profiles {
+		maxAge := p.MaxAge
+		if *maxAgeFlag > 0 {
+			maxAge = *maxAgeFlag
+		}
+		if maxAge == 0 {
+			fmt.Fprintf(stdout, tr("%s: no max_age configured\n"), p.Name)
+			continue
+		}
+		event, err := overdueEvent(p, maxAge, now)
+		if err != nil {
+			return err
+		}
+		if event == nil {
+			fmt.Fprintf(stdout, tr("%s: OK\n"), p.Name)
+			continue
+		}
+		overdue++
+		fmt.Fprintf(stdout, "%s\n", event.Summary)
+		err = notify(p.Notify, event)
+		if err != nil {
+			fmt.Fprintf(stderr, tr("%s: notification failed: %v\n"), p.Name, err)
+		}
+	}
+	if overdue > 0 {
+		return fmt.Errorf("%d profile(s) overdue", overdue)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A backup run writes its intermediates, such as the dump being taken or
+// the file being encrypted, in a work directory of its own named after the
+// run ID, and moves each into place in backup_dir or encrypted_dir only
+// once it is complete. The work directory is removed when the run ends,
+// however it ends, so that no partial file is left among the backups.
+// That is under work_dir if set, and in .work of the backup_dir of the
+// profile otherwise, where moving is renaming. The controller does the same
+// with the dumps it collects, in .work of its store_dir. A process killed
+// outright cannot remove its work directory; the next run of the profile
+// removes those older than a day.
+
+// workDirs are the work directories of the runs going on, which are
+// removed if the process is interrupted.
+var workDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+// workBase returns the directory holding the work directories of the runs
+// of the profile.
+func (c *Config) workBase(p *Profile) string {
+	if c.WorkDir != "" {
+		return filepath.Join(c.WorkDir, p.Name)
+	}
+	return filepath.Join(p.BackupDir, workDirName)
+}
+
+// workDirName is the name of the directory holding work directories in
+// backup_dir, or in the store_dir of the controller.
+const workDirName = ".work"
+
+// createWorkDir creates the work directory of the run, empty: a resumed
+// run starts the interrupted stage over. Work directories of the profile
+// left over from runs older than maxResumeAge are removed.
+func createWorkDir(base string, runID string) (string, error) {
+	infos, err := ioutil.ReadDir(base)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, info := range infos {
+		if info.IsDir() && time.Since(info.ModTime()) > maxResumeAge {
+			os.RemoveAll(filepath.Join(base, info.Name()))
+		}
+	}
+	dir := filepath.Join(base, runID)
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	workDirs.Lock()
+	workDirs.dirs[dir] = true
+	workDirs.Unlock()
+	return dir, nil
+}
+
+// removeWorkDir removes the work directory at the end of the run.
+func removeWorkDir(dir string) error {
+	workDirs.Lock()
+	delete(workDirs.dirs, dir)
+	workDirs.Unlock()
+	err := os.RemoveAll(dir)
+	// The base is removed too once no run uses it.
+	os.Remove(filepath.Dir(dir))
+	return err
+}
+
+// removeWorkDirs removes the work directories of the runs going on when
+// the process is interrupted; see runUntilInterrupted.
+func removeWorkDirs() {
+	workDirs.Lock()
+	defer workDirs.Unlock()
+	for dir := range workDirs.dirs {
+		os.RemoveAll(dir)
+		os.Remove(filepath.Dir(dir))
+	}
+	workDirs.dirs = make(map[string]bool)
+}
+
+// moveIntoPlace moves the complete file src from a work directory to dst.
+// Across file systems it is copied next to dst first, so that dst appears
+// only whole.
+func moveIntoPlace(src string, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
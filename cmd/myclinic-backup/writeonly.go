@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// A write_only profile keeps on the clinic server only credentials which
+// can add backups, so that malware taking over the server cannot read or
+// destroy the backups already stored. Old backups are expired by a
+// lifecycle rule of the bucket, or pruned from another machine, and
+// restores use reader credentials given with -reader-aws-profile. The
+// bucket must have versioning enabled: PutObject can overwrite, and the
+// overwritten backup must survive as an older version.
+//
+// The program enforces the mode: before every upload it checks that the
+// bucket is versioned and that the credentials are denied reading and
+// deleting, and refuses to back up otherwise. iam-policy prints the
+// policies and the lifecycle rule to set up.
+
+var readerAWSProfileFlag = flag.String("reader-aws-profile", "",
+	"AWS profile able to read the backups of write_only profiles, for restores and other commands which read them")
+
+// writeOnlyProbeName is the object stored under the prefix to test the
+// credentials. Its versions accumulate and are expired as noncurrent.
+const writeOnlyProbeName = ".write-only-probe"
+
+// readingCommands read stored backups, or list or change them, which the
+// credentials of write_only profiles cannot. list reads the buckets only
+// with -remote; see readsBackups.
+var readingCommands = map[string]bool{
+	"pre-upgrade":         true,
+	"restore":             true,
+	"fetch":               true,
+	"seed-replica":        true,
+	"standby":             true,
+	"spot-check":          true,
+	"verify":              true,
+	"drill":               true,
+	"schema-check":        true,
+	"hold":                true,
+	"release":             true,
+	"migrate-layout":      true,
+	"catalog":             true,
+	"prune":               true,
+	"gc":                  true,
+	"reconcile-inventory": true,
+	"compliance":          true,
+}
+
+// readsBackups reports whether the command run with args reads stored
+// backups.
+func readsBackups(name string, args []string) bool {
+	if name == "list" {
+		return hasFlag(args, "remote")
+	}
+	return readingCommands[name]
+}
+
+// hasFlag reports whether the boolean flag is set in args, which the
+// command parses itself. The values of other flags are not told from
+// arguments, so args are searched up to "--".
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		value := "true"
+		if i := strings.Index(arg, "="); i >= 0 {
+			arg, value = arg[:i], arg[i+1:]
+		}
+		if arg == name {
+			set, err := strconv.ParseBool(value)
+			return err == nil && set
+		}
+	}
+	return false
+}
+
+// writerCredentials are the credentials a write_only profile uploads with.
+type writerCredentials struct {
+	awsProfile string
+	roleARN    string
+	externalID string
+}
+
+// useReaderCredentials switches the write_only profiles among profiles to
+// the credentials of -reader-aws-profile, for a command reading their
+// backups. Their roles are for writing and are not assumed. What the
+// command uploads, such as a backup taken before a restore, is still
+// uploaded with the credentials of the profile, which the reader's policy
+// does not allow.
+func useReaderCredentials(profiles []*Profile) error {
+	for _, p := range profiles {
+		if !p.WriteOnly {
+			continue
+		}
+		if *readerAWSProfileFlag == "" {
+			return fmt.Errorf("profile %s is write_only and cannot read its backups; give reader credentials with -reader-aws-profile", p.Name)
+		}
+		if p.writer == nil {
+			p.writer = &writerCredentials{p.AWSProfile, p.S3RoleARN, p.S3ExternalID}
+		}
+		p.AWSProfile = *readerAWSProfileFlag
+		p.S3RoleARN = ""
+		p.S3ExternalID = ""
+	}
+	return nil
+}
+
+// uploadSession creates the AWS session the profile uploads with: that of
+// its own credentials even while it reads with the reader's.
+func (p *Profile) uploadSession() (*session.Session, error) {
+	if p.writer == nil {
+		return newS3Session(p)
+	}
+	q := *p
+	q.AWSProfile = p.writer.awsProfile
+	q.S3RoleARN = p.writer.roleARN
+	q.S3ExternalID = p.writer.externalID
+	return newS3Session(&q)
+}
+
+func isAccessDenied(err error) bool {
+	e, ok := err.(awserr.RequestFailure)
+	return ok && e.StatusCode() == 403
+}
+
+// checkWriteOnly confirms that the bucket of the profile is versioned and
+// that the credentials of the session can store objects under its prefix
+// but neither read nor delete them.
+func (p *Profile) checkWriteOnly(sess *session.Session) error {
+	svc := s3.New(sess)
+	v, err := svc.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(p.S3Bucket)})
+	if err != nil {
+		return fmt.Errorf("cannot read the versioning of bucket %s: %v", p.S3Bucket, err)
+	}
+	if aws.StringValue(v.Status) != s3.BucketVersioningStatusEnabled {
+		return fmt.Errorf("write_only: bucket %s must have versioning enabled, or a backup could be destroyed by overwriting it", p.S3Bucket)
+	}
+	key := normalizePrefix(p.S3Prefix) + writeOnlyProbeName
+	put, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(p.S3Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(nil),
+	})
+	if err != nil {
+		return fmt.Errorf("write_only: cannot store %s: %v", key, err)
+	}
+	_, err = svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(p.S3Bucket), Key: aws.String(key)})
+	if err == nil {
+		return fmt.Errorf("write_only: the credentials of profile %s can read backups; see iam-policy", p.Name)
+	}
+	if !isAccessDenied(err) {
+		return fmt.Errorf("write_only: cannot check read access: %v", err)
+	}
+	// Deleting the version, not adding a delete marker, would destroy
+	// the backup.
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket:    aws.String(p.S3Bucket),
+		Key:       aws.String(key),
+		VersionId: put.VersionId,
+	})
+	if err == nil {
+		return fmt.Errorf("write_only: the credentials of profile %s can delete backups; see iam-policy", p.Name)
+	}
+	if !isAccessDenied(err) {
+		return fmt.Errorf("write_only: cannot check delete access: %v", err)
+	}
+	return nil
+}
+
+// writeOnlyPolicies returns the policy of the backup server's credentials,
+// the policy of the reader kept elsewhere, and the lifecycle rule of the
+// prefix, which expires backups after expireDays if it is positive.
+func writeOnlyPolicies(p *Profile, expireDays int) (writer string, reader string, lifecycle string, err error) {
+	prefix := normalizePrefix(p.S3Prefix)
+	bucketArn := "arn:aws:s3:::" + p.S3Bucket
+	objects := bucketArn + "/" + prefix + "*"
+	docs := []interface{}{
+		map[string]interface{}{
+			"Version": "2012-10-17",
+			"Statement": []map[string]interface{}{
+				{
+					"Effect":   "Allow",
+					"Action":   []string{"s3:PutObject", "s3:AbortMultipartUpload"},
+					"Resource": objects,
+				},
+				{
+					"Effect":   "Allow",
+					"Action":   "s3:GetBucketVersioning",
+					"Resource": bucketArn,
+				},
+				{
+					// Denied explicitly, so that no other policy of the
+					// user can grant them.
+					"Effect": "Deny",
+					"Action": []string{"s3:GetObject*", "s3:DeleteObject*", "s3:PutObjectRetention",
+						"s3:PutObjectLegalHold", "s3:PutBucketVersioning", "s3:PutLifecycleConfiguration", "s3:PutBucketPolicy"},
+					"Resource": []string{bucketArn, bucketArn + "/*"},
+				},
+			},
+		},
+		map[string]interface{}{
+			"Version": "2012-10-17",
+			"Statement": []map[string]interface{}{
+				{
+					"Effect": "Allow",
+					"Action": []string{"s3:GetObject", "s3:GetObjectVersion", "s3:DeleteObject", "s3:DeleteObjectVersion",
+						"s3:PutObjectLegalHold", "s3:GetObjectLegalHold"},
+					"Resource": objects,
+				},
+				{
+					"Effect":   "Allow",
+					"Action":   "s3:GetBucketObjectLockConfiguration",
+					"Resource": bucketArn,
+				},
+				{
+					"Effect":   "Allow",
+					"Action":   []string{"s3:ListBucket", "s3:ListBucketVersions"},
+					"Resource": bucketArn,
+					"Condition": map[string]interface{}{
+						"StringLike": map[string]interface{}{"s3:prefix": prefix + "*"},
+					},
+				},
+			},
+		},
+	}
+	rule := map[string]interface{}{
+		"ID":     "myclinic-backup-" + p.Name,
+		"Filter": map[string]interface{}{"Prefix": prefix},
+		"Status": "Enabled",
+		// Overwritten or deleted backups stay recoverable for 30 days.
+		"NoncurrentVersionExpiration":    map[string]interface{}{"NoncurrentDays": 30},
+		"AbortIncompleteMultipartUpload": map[string]interface{}{"DaysAfterInitiation": 7},
+	}
+	if expireDays > 0 {
+		rule["Expiration"] = map[string]interface{}{"Days": expireDays}
+	}
+	docs = append(docs, map[string]interface{}{"Rules": []interface{}{rule}})
+	var out []string
+	for _, doc := range docs {
+		b, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return "", "", "", err
+		}
+		out = append(out, string(b))
+	}
+	return out[0], out[1], out[2], nil
+}
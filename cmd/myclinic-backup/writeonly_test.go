@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestReadsBackups(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{"restore", nil, true},
+		{"gc", nil, true},
+		{"reconcile-inventory", nil, true},
+		{"compliance", []string{"-json"}, true},
+		{"backup", nil, false},
+		{"list", nil, false},
+		{"list", []string{"-remote"}, true},
+		{"list", []string{"--remote"}, true},
+		{"list", []string{"-since", "7d", "-remote=true"}, true},
+		{"list", []string{"-remote=false"}, false},
+		{"list", []string{"--", "-remote"}, false},
+	} {
+		if got := readsBackups(tc.name, tc.args); got != tc.want {
+			t.Errorf("%s %v: got %v, want %v", tc.name, tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestUseReaderCredentials(t *testing.T) {
+	saved := *readerAWSProfileFlag
+	defer func() { *readerAWSProfileFlag = saved }()
+	writer := &Profile{Name: "clinic", WriteOnly: true, AWSProfile: "writer", S3RoleARN: "arn:aws:iam::1:role/w", S3ExternalID: "x"}
+	other := &Profile{Name: "other", AWSProfile: "own"}
+
+	*readerAWSProfileFlag = ""
+	if err := useReaderCredentials([]*Profile{other, writer}); err == nil {
+		t.Fatal("write_only profile read without reader credentials")
+	}
+	*readerAWSProfileFlag = "reader"
+	if err := useReaderCredentials([]*Profile{other, writer}); err != nil {
+		t.Fatal(err)
+	}
+	if writer.AWSProfile != "reader" || writer.S3RoleARN != "" || writer.S3ExternalID != "" {
+		t.Errorf("reads with %s %s %s, want the reader's profile only", writer.AWSProfile, writer.S3RoleARN, writer.S3ExternalID)
+	}
+	if w := writer.writer; w == nil || *w != (writerCredentials{"writer", "arn:aws:iam::1:role/w", "x"}) {
+		t.Errorf("uploads with %+v, want the credentials of the profile", w)
+	}
+	if other.AWSProfile != "own" || other.writer != nil {
+		t.Errorf("profile without write_only switched to %s", other.AWSProfile)
+	}
+	// Switching again keeps the credentials to upload with.
+	if err := useReaderCredentials([]*Profile{writer}); err != nil || writer.writer.awsProfile != "writer" {
+		t.Errorf("switching again: %v, uploads with %+v", err, writer.writer)
+	}
+}
+
+// writeOnlyS3 answers the requests of checkWriteOnly as a bucket with the
+// given versioning status, allowing what is set.
+type writeOnlyS3 struct {
+	versioning string
+	read       bool
+	delete     bool
+}
+
+func (f *writeOnlyS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, versioning := r.URL.Query()["versioning"]
+	switch {
+	case r.Method == http.MethodGet && versioning:
+		fmt.Fprintf(w, "<VersioningConfiguration><Status>%s</Status></VersioningConfiguration>", f.versioning)
+	case r.Method == http.MethodPut:
+		w.Header().Set("x-amz-version-id", "v1")
+	case r.Method == http.MethodHead && !f.read:
+		w.WriteHeader(http.StatusForbidden)
+	case r.Method == http.MethodDelete && !f.delete:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<Error><Code>AccessDenied</Code></Error>")
+	case r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestCheckWriteOnly(t *testing.T) {
+	p := &Profile{Name: "clinic", S3Bucket: "backups", S3Prefix: "clinic"}
+	for _, tc := range []struct {
+		name string
+		s3   writeOnlyS3
+		want string
+	}{
+		{"write only", writeOnlyS3{versioning: "Enabled"}, ""},
+		{"unversioned", writeOnlyS3{versioning: "Suspended"}, "versioning"},
+		{"reading", writeOnlyS3{versioning: "Enabled", read: true}, "can read"},
+		{"deleting", writeOnlyS3{versioning: "Enabled", delete: true}, "can delete"},
+	} {
+		srv := httptest.NewServer(&tc.s3)
+		sess, err := session.NewSession(&aws.Config{
+			Region:           aws.String("ap-northeast-1"),
+			Endpoint:         aws.String(srv.URL),
+			S3ForcePathStyle: aws.Bool(true),
+			Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.checkWriteOnly(sess)
+		srv.Close()
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%s: got %v, want an error on %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -7,4 +7,5 @@ require (
 	github.com/hangilc/crypt-file v0.2.0
 	github.com/stretchr/testify v1.4.0 // indirect
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,119 @@
+package cfstream
+
+import "encoding/binary"
+
+// The GHASH function of GCM, following the generic implementation of
+// crypto/cipher, which does not expose it for incremental use.
+
+type fieldElement struct {
+	low, high uint64
+}
+
+type ghash struct {
+	table [16]fieldElement
+	y     fieldElement
+	// partial holds the bytes of an incomplete block.
+	partial []byte
+	length  uint64
+}
+
+var reductionTable = []uint16{
+	0x0000, 0x1c20, 0x3840, 0x2460, 0x7080, 0x6ca0, 0x48c0, 0x54e0,
+	0xe100, 0xfd20, 0xd940, 0xc560, 0x9180, 0x8da0, 0xa9c0, 0xb5e0,
+}
+
+func reverseBits(i int) int {
+	i = ((i << 2) & 0xc) | ((i >> 2) & 0x3)
+	i = ((i << 1) & 0xa) | ((i >> 1) & 0x5)
+	return i
+}
+
+func double(x *fieldElement) (d fieldElement) {
+	msbSet := x.high&1 == 1
+	d.high = x.high >> 1
+	d.high |= x.low << 63
+	d.low = x.low >> 1
+	if msbSet {
+		d.low ^= 0xe100000000000000
+	}
+	return
+}
+
+func newGHASH(h []byte) *ghash {
+	g := &ghash{}
+	x := fieldElement{binary.BigEndian.Uint64(h[:8]), binary.BigEndian.Uint64(h[8:])}
+	g.table[reverseBits(1)] = x
+	for i := 2; i < 16; i += 2 {
+		g.table[reverseBits(i)] = double(&g.table[reverseBits(i/2)])
+		t := g.table[reverseBits(i)]
+		g.table[reverseBits(i+1)] = fieldElement{t.low ^ x.low, t.high ^ x.high}
+	}
+	return g
+}
+
+func (g *ghash) mul(y *fieldElement) {
+	var z fieldElement
+	for i := 0; i < 2; i++ {
+		word := y.high
+		if i == 1 {
+			word = y.low
+		}
+		for j := 0; j < 64; j += 4 {
+			msw := z.high & 0xf
+			z.high >>= 4
+			z.high |= z.low << 60
+			z.low >>= 4
+			z.low ^= uint64(reductionTable[msw]) << 48
+			t := &g.table[word&0xf]
+			z.low ^= t.low
+			z.high ^= t.high
+			word >>= 4
+		}
+	}
+	*y = z
+}
+
+func (g *ghash) block(b []byte) {
+	g.y.low ^= binary.BigEndian.Uint64(b)
+	g.y.high ^= binary.BigEndian.Uint64(b[8:])
+	g.mul(&g.y)
+}
+
+// write hashes ciphertext.
+func (g *ghash) write(p []byte) {
+	g.length += uint64(len(p))
+	if len(g.partial) > 0 {
+		n := 16 - len(g.partial)
+		if n > len(p) {
+			n = len(p)
+		}
+		g.partial = append(g.partial, p[:n]...)
+		p = p[n:]
+		if len(g.partial) < 16 {
+			return
+		}
+		g.block(g.partial)
+		g.partial = g.partial[:0]
+	}
+	for len(p) >= 16 {
+		g.block(p[:16])
+		p = p[16:]
+	}
+	g.partial = append(g.partial, p...)
+}
+
+// sum returns GHASH of the ciphertext written, without additional data.
+func (g *ghash) sum() []byte {
+	if len(g.partial) > 0 {
+		var b [16]byte
+		copy(b[:], g.partial)
+		g.block(b[:])
+		g.partial = g.partial[:0]
+	}
+	g.y.high ^= g.length * 8
+	g.mul(&g.y)
+	out := make([]byte, 16)
+	binary.BigEndian.PutUint64(out, g.y.low)
+	binary.BigEndian.PutUint64(out[8:], g.y.high)
+	return out
+}
@@ -0,0 +1,112 @@
+package cfstream
+
+import (
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+)
+
+type plainReader struct {
+	dec io.Reader
+	z   io.ReadCloser
+}
+
+// NewPlainReader returns a reader of the decrypted and decompressed content
+// of the crypt-file data read from src. The content is decompressed by
+// decompress, or as zlib if it is nil. Its Read returns io.EOF only after
+// the whole data is authenticated.
+func NewPlainReader(key []byte, src io.Reader, decompress func(io.Reader) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	dec, err := NewReader(key, src)
+	if err != nil {
+		return nil, err
+	}
+	return newPlainReader(dec, decompress)
+}
+
+// NewSealedPlainReader is NewPlainReader reading the data with
+// NewSealedReader, so that nothing is returned before the whole data is
+// authenticated.
+func NewSealedPlainReader(key []byte, src io.Reader, decompress func(io.Reader) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	dec, err := NewSealedReader(key, src)
+	if err != nil {
+		return nil, err
+	}
+	return newPlainReader(dec, decompress)
+}
+
+func newPlainReader(dec io.Reader, decompress func(io.Reader) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if decompress == nil {
+		decompress = zlib.NewReader
+	}
+	z, err := decompress(dec)
+	if err != nil {
+		return nil, err
+	}
+	return &plainReader{dec: dec, z: z}, nil
+}
+
+func (r *plainReader) Read(p []byte) (int, error) {
+	n, err := r.z.Read(p)
+	if err == io.EOF {
+		// The tag follows the compressed data; reading the rest checks it.
+		_, err = io.Copy(ioutil.Discard, r.dec)
+		if err == nil {
+			err = io.EOF
+		}
+	}
+	return n, err
+}
+
+func (r *plainReader) Close() error {
+	return r.z.Close()
+}
+
+type plainWriter struct {
+	z   io.WriteCloser
+	enc io.WriteCloser
+}
+
+// NewPlainWriter returns a writer compressing what is written to it with
+// compress, or as zlib if it is nil, and encrypting it into crypt-file
+// data written to dst. Close completes the data and does not close dst.
+func NewPlainWriter(key []byte, dst io.Writer, compress func(io.Writer) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	enc, err := NewWriter(key, dst)
+	if err != nil {
+		return nil, err
+	}
+	return newPlainWriter(enc, compress)
+}
+
+// NewSealedPlainWriter is NewPlainWriter encrypting with NewSealedWriter.
+func NewSealedPlainWriter(key []byte, dst io.Writer, compress func(io.Writer) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	enc, err := NewSealedWriter(key, dst)
+	if err != nil {
+		return nil, err
+	}
+	return newPlainWriter(enc, compress)
+}
+
+func newPlainWriter(enc io.WriteCloser, compress func(io.Writer) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	if compress == nil {
+		compress = func(w io.Writer) (io.WriteCloser, error) {
+			return zlib.NewWriter(w), nil
+		}
+	}
+	z, err := compress(enc)
+	if err != nil {
+		return nil, err
+	}
+	return &plainWriter{z: z, enc: enc}, nil
+}
+
+func (w *plainWriter) Write(p []byte) (int, error) {
+	return w.z.Write(p)
+}
+
+func (w *plainWriter) Close() error {
+	err := w.z.Close()
+	if err != nil {
+		return err
+	}
+	return w.enc.Close()
+}
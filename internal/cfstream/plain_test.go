@@ -0,0 +1,102 @@
+package cfstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	cflib "github.com/hangilc/crypt-file/lib"
+)
+
+func TestPlainReaderDecryptsCompressAndEncrypt(t *testing.T) {
+	key := testKey(t)
+	for _, size := range testSizes {
+		plain := bytes.Repeat(testData(t, 10), size/10+1)[:size]
+		data, err := cflib.CompressAndEncrypt(key, plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewPlainReader(key, iotest.HalfReader(bytes.NewReader(data)), nil)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: content differs", size)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+	}
+}
+
+func TestPlainRoundTrip(t *testing.T) {
+	key := testKey(t)
+	gz := func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }
+	gunzip := func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+	for _, tc := range []struct {
+		name       string
+		compress   func(io.Writer) (io.WriteCloser, error)
+		decompress func(io.Reader) (io.ReadCloser, error)
+	}{
+		{"zlib", nil, nil},
+		{"gzip", gz, gunzip},
+	} {
+		for _, size := range testSizes {
+			plain := testData(t, size)
+			var buf bytes.Buffer
+			w, err := NewPlainWriter(key, &buf, tc.compress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = w.Write(plain)
+			if err == nil {
+				err = w.Close()
+			}
+			if err != nil {
+				t.Fatalf("%s size %d: %v", tc.name, size, err)
+			}
+			r, err := NewPlainReader(key, &buf, tc.decompress)
+			if err != nil {
+				t.Fatalf("%s size %d: %v", tc.name, size, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s size %d: %v", tc.name, size, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("%s size %d: content differs", tc.name, size)
+			}
+		}
+	}
+}
+
+// The tag is checked even when the compressed content ends well.
+func TestPlainReaderTamperedTag(t *testing.T) {
+	key := testKey(t)
+	data, err := cflib.CompressAndEncrypt(key, testData(t, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cut := range []int{0, 1, tagSize} {
+		tampered := append([]byte(nil), data[:len(data)-cut]...)
+		if cut == 0 {
+			tampered[len(tampered)-1] ^= 0x01
+		}
+		r, err := NewPlainReader(key, bytes.NewReader(tampered), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(r)
+		if !errors.Is(err, ErrAuth) {
+			t.Errorf("%d bytes cut: got %v, want ErrAuth", cut, err)
+		}
+	}
+}
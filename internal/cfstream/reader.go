@@ -0,0 +1,162 @@
+// Package cfstream encrypts and decrypts crypt-file data
+// (github.com/hangilc/crypt-file) as a stream, so that large backups need
+// not be held in memory.
+//
+// Version 1 of the format is a single AES-GCM sealed message, whose tag can
+// only be checked at the end. Plain data is therefore returned before it is
+// authenticated; Read returns ErrAuth at the end of a tampered stream, and
+// callers must treat everything read so far as untrusted in that case.
+// The sealed readers and writers instead hold the whole data in memory.
+package cfstream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	headerSize = 3 + nonceSize
+	nonceSize  = 12
+	tagSize    = 16
+)
+
+// MaxSize is the largest content a stream can hold. GCM counts the blocks
+// of a message in the low 32 bits of the counter, starting at 2, while
+// crypto/cipher's CTR mode carries into the nonce, so beyond 2^32-2
+// blocks the data would no longer be AES-GCM and crypt-file could not
+// read it.
+const MaxSize = (1<<32 - 2) * 16
+
+// ErrTooLarge is returned by writes and reads past MaxSize.
+var ErrTooLarge = errors.New("cfstream: data exceeds the size limit of AES-GCM")
+
+// ErrAuth is returned when the data does not match its authentication tag,
+// meaning a wrong key or corrupted data, or when the data is cut short of
+// its tag.
+var ErrAuth = errors.New("cfstream: message authentication failed")
+
+type reader struct {
+	src    io.Reader
+	ctr    cipher.Stream
+	hash   *ghash
+	tagKey []byte
+	// buf holds ciphertext read ahead, of which the last tagSize bytes may
+	// be the tag.
+	buf []byte
+	eof bool
+	err error
+	// n is the size of the content decrypted so far.
+	n int64
+}
+
+// NewReader returns a reader decrypting the crypt-file data read from src.
+// The content is still compressed as written by crypt-file.
+func NewReader(key []byte, src io.Reader) (io.Reader, error) {
+	nonce, err := readHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	h := make([]byte, 16)
+	block.Encrypt(h, h)
+	j0 := make([]byte, 16)
+	copy(j0, nonce)
+	j0[15] = 1
+	tagKey := make([]byte, 16)
+	block.Encrypt(tagKey, j0)
+	iv := make([]byte, 16)
+	copy(iv, j0)
+	iv[15] = 2
+	return &reader{
+		src:    src,
+		ctr:    cipher.NewCTR(block, iv),
+		hash:   newGHASH(h),
+		tagKey: tagKey,
+	}, nil
+}
+
+// readHeader reads the header of the data from src and returns its nonce.
+func readHeader(src io.Reader) ([]byte, error) {
+	head := make([]byte, headerSize)
+	_, err := io.ReadFull(src, head)
+	if err != nil {
+		return nil, fmt.Errorf("cfstream: cannot read header: %v", err)
+	}
+	if head[0] != 'C' || head[1] != 'F' {
+		return nil, fmt.Errorf("cfstream: not crypt-file data")
+	}
+	if head[2] != 1 {
+		return nil, fmt.Errorf("cfstream: unsupported version %d", head[2])
+	}
+	return head[3:], nil
+}
+
+func (r *reader) fill(n int) {
+	for !r.eof && len(r.buf) < n+tagSize {
+		chunk := make([]byte, n+tagSize-len(r.buf))
+		m, err := r.src.Read(chunk)
+		r.buf = append(r.buf, chunk[:m]...)
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			r.err = err
+			return
+		}
+	}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	r.fill(len(p))
+	if r.err != nil {
+		return 0, r.err
+	}
+	avail := len(r.buf) - tagSize
+	if avail <= 0 && r.eof {
+		r.err = r.finish()
+		return 0, r.err
+	}
+	if avail <= 0 {
+		return 0, nil
+	}
+	n := avail
+	if n > len(p) {
+		n = len(p)
+	}
+	if r.n+int64(n) > MaxSize {
+		r.err = ErrTooLarge
+		return 0, r.err
+	}
+	r.n += int64(n)
+	c := r.buf[:n]
+	r.hash.write(c)
+	r.ctr.XORKeyStream(p[:n], c)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *reader) finish() error {
+	if len(r.buf) != tagSize {
+		return fmt.Errorf("cfstream: truncated data: %w", ErrAuth)
+	}
+	sum := r.hash.sum()
+	for i := range sum {
+		sum[i] ^= r.tagKey[i]
+	}
+	if subtle.ConstantTimeCompare(sum, r.buf) != 1 {
+		return ErrAuth
+	}
+	return io.EOF
+}
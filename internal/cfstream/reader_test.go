@@ -0,0 +1,150 @@
+package cfstream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	cflib "github.com/hangilc/crypt-file/lib"
+)
+
+// readAll decrypts data with NewReader, reading its source and itself in
+// the ways of the readers returned by wrap.
+func readAll(key, data []byte, wrap func(io.Reader) io.Reader) ([]byte, error) {
+	r, err := NewReader(key, wrap(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(wrap(r))
+}
+
+var readerWraps = map[string]func(io.Reader) io.Reader{
+	"whole":    func(r io.Reader) io.Reader { return r },
+	"one byte": iotest.OneByteReader,
+	"half":     iotest.HalfReader,
+	"data err": iotest.DataErrReader,
+}
+
+func TestReaderDecryptsCryptFile(t *testing.T) {
+	key := testKey(t)
+	for _, size := range testSizes {
+		plain := testData(t, size)
+		// Encrypt seals in place.
+		data, err := cflib.Encrypt(key, append([]byte(nil), plain...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, wrap := range readerWraps {
+			got, err := readAll(key, data, wrap)
+			if err != nil {
+				t.Fatalf("size %d %s: %v", size, name, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("size %d %s: content differs", size, name)
+			}
+		}
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range testSizes {
+		plain := testData(t, size)
+		data := encrypt(t, key, plain, 1000)
+		got, err := readAll(key, data, iotest.HalfReader)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: content differs", size)
+		}
+	}
+}
+
+func TestReaderTampered(t *testing.T) {
+	key := testKey(t)
+	plain := testData(t, 1000)
+	data := encrypt(t, key, plain, 1000)
+	for _, tc := range []struct {
+		name string
+		pos  int
+	}{
+		{"nonce", 3},
+		{"first ciphertext byte", headerSize},
+		{"middle", headerSize + 500},
+		{"last ciphertext byte", headerSize + 999},
+		{"tag", len(data) - tagSize},
+		{"last tag byte", len(data) - 1},
+	} {
+		tampered := append([]byte(nil), data...)
+		tampered[tc.pos] ^= 0x01
+		for name, wrap := range readerWraps {
+			_, err := readAll(key, tampered, wrap)
+			if err != ErrAuth {
+				t.Errorf("%s, %s: got %v, want ErrAuth", tc.name, name, err)
+			}
+		}
+	}
+}
+
+func TestReaderWrongKey(t *testing.T) {
+	data := encrypt(t, testKey(t), testData(t, 100), 100)
+	_, err := readAll(testKey(t), data, iotest.OneByteReader)
+	if err != ErrAuth {
+		t.Errorf("got %v, want ErrAuth", err)
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	key := testKey(t)
+	data := encrypt(t, key, testData(t, 100), 100)
+	for _, cut := range []int{1, tagSize - 1, tagSize, tagSize + 1, 100, 100 + tagSize - 1, 100 + tagSize} {
+		for name, wrap := range readerWraps {
+			_, err := readAll(key, data[:len(data)-cut], wrap)
+			if !errors.Is(err, ErrAuth) {
+				t.Errorf("%d bytes cut, %s: got %v, want ErrAuth", cut, name, err)
+			}
+		}
+	}
+}
+
+func TestReaderHeader(t *testing.T) {
+	key := testKey(t)
+	data := encrypt(t, key, testData(t, 10), 10)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", data[:headerSize-1]},
+		{"not crypt-file", append([]byte("XF"), data[2:]...)},
+		{"version", append([]byte{'C', 'F', 2}, data[3:]...)},
+	} {
+		_, err := NewReader(key, bytes.NewReader(tc.data))
+		if err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
+
+func TestReaderSizeLimit(t *testing.T) {
+	key := testKey(t)
+	data := encrypt(t, key, testData(t, 100), 100)
+	r, err := NewReader(key, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reader is put 50 bytes short of the limit, as if it had read
+	// all but those of a 64 GiB stream.
+	r.(*reader).n = MaxSize - 50
+	p := make([]byte, 50)
+	if _, err := io.ReadFull(r, p); err != nil {
+		t.Fatalf("read up to the limit: %v", err)
+	}
+	if _, err := r.Read(p); err != ErrTooLarge {
+		t.Errorf("read past the limit: got %v, want ErrTooLarge", err)
+	}
+}
@@ -0,0 +1,132 @@
+package cfstream
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The sealed writer and reader encrypt and decrypt the same data as
+// NewWriter and NewReader, but with the AES-GCM of crypto/cipher instead
+// of CTR mode and the GHASH of this package, which crypto/cipher does not
+// offer for streaming. That is for callers which must keep to the
+// standard library's implementation, as in FIPS mode. The cost is memory:
+// the whole data is held until it is sealed or opened.
+
+type sealedWriter struct {
+	dst    io.Writer
+	aead   cipher.AEAD
+	head   []byte
+	buf    bytes.Buffer
+	closed bool
+}
+
+// NewSealedWriter is NewWriter holding the content in memory and sealing
+// it at once on Close. Nothing is written to dst before Close.
+func NewSealedWriter(key []byte, dst io.Writer) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, headerSize)
+	head[0], head[1], head[2] = 'C', 'F', 1
+	_, err = io.ReadFull(rand.Reader, head[3:])
+	if err != nil {
+		return nil, err
+	}
+	return &sealedWriter{dst: dst, aead: aead, head: head}, nil
+}
+
+func (w *sealedWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("cfstream: write after close")
+	}
+	if int64(w.buf.Len())+int64(len(p)) > MaxSize {
+		return 0, ErrTooLarge
+	}
+	return w.buf.Write(p)
+}
+
+func (w *sealedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	plain := w.buf.Bytes()
+	sealed := w.aead.Seal(plain[:0], w.head[3:], plain, nil)
+	_, err := w.dst.Write(w.head)
+	if err == nil {
+		_, err = w.dst.Write(sealed)
+	}
+	w.buf.Reset()
+	return err
+}
+
+type sealedReader struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	plain *bytes.Reader
+	err   error
+}
+
+// NewSealedReader is NewReader reading the whole of src into memory and
+// opening it on the first Read, so that no content is returned before it
+// is authenticated.
+func NewSealedReader(key []byte, src io.Reader) (io.Reader, error) {
+	nonce, err := readHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedReader{src: src, aead: aead, nonce: nonce}, nil
+}
+
+func (r *sealedReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.plain == nil {
+		r.err = r.open()
+		if r.err != nil {
+			return 0, r.err
+		}
+	}
+	return r.plain.Read(p)
+}
+
+func (r *sealedReader) open() error {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, io.LimitReader(r.src, MaxSize+tagSize+1))
+	if err != nil {
+		return err
+	}
+	sealed := buf.Bytes()
+	if len(sealed) > MaxSize+tagSize {
+		return ErrTooLarge
+	}
+	if len(sealed) < tagSize {
+		return fmt.Errorf("cfstream: truncated data: %w", ErrAuth)
+	}
+	plain, err := r.aead.Open(sealed[:0], r.nonce, sealed, nil)
+	if err != nil {
+		return ErrAuth
+	}
+	r.plain = bytes.NewReader(plain)
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
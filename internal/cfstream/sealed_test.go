@@ -0,0 +1,138 @@
+package cfstream
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+// sealedEncrypt writes plain through NewSealedWriter in two pieces.
+func sealedEncrypt(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewSealedWriter(key, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := len(plain) / 2
+	for _, p := range [][]byte{plain[:half], plain[half:]} {
+		_, err = w.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes written before Close", buf.Len())
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sealedReadAll(key, data []byte) ([]byte, error) {
+	r, err := NewSealedReader(key, iotest.HalfReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(iotest.OneByteReader(r))
+}
+
+// TestSealedMatchesStream checks that the sealed and the streaming
+// implementations read each other's data.
+func TestSealedMatchesStream(t *testing.T) {
+	key := testKey(t)
+	for _, size := range testSizes {
+		plain := testData(t, size)
+		sealed := sealedEncrypt(t, key, plain)
+		if len(sealed) != headerSize+size+tagSize {
+			t.Fatalf("size %d: %d bytes written", size, len(sealed))
+		}
+		got, err := readAll(key, sealed, iotest.HalfReader)
+		if err != nil {
+			t.Fatalf("size %d, sealed data: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d, sealed data: content differs", size)
+		}
+		got, err = sealedReadAll(key, encrypt(t, key, plain, 1000))
+		if err != nil {
+			t.Fatalf("size %d, streamed data: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d, streamed data: content differs", size)
+		}
+	}
+}
+
+func TestSealedReaderTampered(t *testing.T) {
+	key := testKey(t)
+	data := sealedEncrypt(t, key, testData(t, 1000))
+	for _, pos := range []int{3, headerSize, headerSize + 500, len(data) - 1} {
+		tampered := append([]byte(nil), data...)
+		tampered[pos] ^= 0x01
+		r, err := NewSealedReader(key, bytes.NewReader(tampered))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, 10)
+		n, err := r.Read(p)
+		if n != 0 || err != ErrAuth {
+			t.Errorf("byte %d: read %d bytes, %v; want ErrAuth before any content", pos, n, err)
+		}
+	}
+	_, err := sealedReadAll(testKey(t), data)
+	if err != ErrAuth {
+		t.Errorf("wrong key: got %v, want ErrAuth", err)
+	}
+	for _, cut := range []int{1, tagSize, tagSize + 1, len(data) - headerSize} {
+		_, err := sealedReadAll(key, data[:len(data)-cut])
+		if !errors.Is(err, ErrAuth) {
+			t.Errorf("%d bytes cut: got %v, want ErrAuth", cut, err)
+		}
+	}
+}
+
+func TestSealedPlainRoundTrip(t *testing.T) {
+	key := testKey(t)
+	plain := bytes.Repeat(testData(t, 100), 100)
+	var buf bytes.Buffer
+	w, err := NewSealedPlainWriter(key, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewSealedPlainReader(key, bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("content differs")
+	}
+	// The streaming reader reads it as well.
+	r, err = NewPlainReader(key, bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("content differs from the streaming reader")
+	}
+}
@@ -0,0 +1,102 @@
+package cfstream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+type writer struct {
+	dst    io.Writer
+	ctr    cipher.Stream
+	hash   *ghash
+	tagKey []byte
+	buf    []byte
+	closed bool
+	// n is the size of the content written so far.
+	n int64
+}
+
+// NewWriter returns a writer encrypting what is written to it into
+// crypt-file data written to dst, the same as crypt-file's Encrypt makes
+// of the whole content at once. The content is not compressed. Close
+// writes the authentication tag, without which the data cannot be read, and
+// does not close dst.
+func NewWriter(key []byte, dst io.Writer) (io.WriteCloser, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, headerSize)
+	head[0], head[1], head[2] = 'C', 'F', 1
+	nonce := head[3:]
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	_, err = dst.Write(head)
+	if err != nil {
+		return nil, err
+	}
+	h := make([]byte, 16)
+	block.Encrypt(h, h)
+	j0 := make([]byte, 16)
+	copy(j0, nonce)
+	j0[15] = 1
+	tagKey := make([]byte, 16)
+	block.Encrypt(tagKey, j0)
+	iv := make([]byte, 16)
+	copy(iv, j0)
+	iv[15] = 2
+	return &writer{
+		dst:    dst,
+		ctr:    cipher.NewCTR(block, iv),
+		hash:   newGHASH(h),
+		tagKey: tagKey,
+	}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("cfstream: write after close")
+	}
+	if w.n+int64(len(p)) > MaxSize {
+		return 0, ErrTooLarge
+	}
+	w.n += int64(len(p))
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > 32*1024 {
+			n = 32 * 1024
+		}
+		if cap(w.buf) < n {
+			w.buf = make([]byte, n)
+		}
+		c := w.buf[:n]
+		w.ctr.XORKeyStream(c, p[:n])
+		w.hash.write(c)
+		m, err := w.dst.Write(c)
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	tag := w.hash.sum()
+	for i := range tag {
+		tag[i] ^= w.tagKey[i]
+	}
+	_, err := w.dst.Write(tag)
+	return err
+}
@@ -0,0 +1,139 @@
+package cfstream
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testData(t *testing.T, n int) []byte {
+	t.Helper()
+	p := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// testSizes cross the GHASH block size and the chunk size of Write.
+var testSizes = []int{0, 1, 15, 16, 17, 31, 32, 33, 1000, 32*1024 - 1, 32 * 1024, 32*1024 + 1, 100000}
+
+// encrypt writes plain through NewWriter in pieces of step bytes.
+func encrypt(t *testing.T, key, plain []byte, step int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(key, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := plain; len(p) > 0; {
+		n := step
+		if n > len(p) {
+			n = len(p)
+		}
+		m, err := w.Write(p[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != n {
+			t.Fatalf("wrote %d bytes of %d", m, n)
+		}
+		p = p[n:]
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriterMatchesGCM(t *testing.T) {
+	key := testKey(t)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range testSizes {
+		for _, step := range []int{1, 7, 16, 40000} {
+			plain := testData(t, size)
+			data := encrypt(t, key, plain, step)
+			if len(data) != headerSize+size+tagSize {
+				t.Fatalf("size %d step %d: %d bytes written", size, step, len(data))
+			}
+			if !bytes.Equal(data[:3], []byte{'C', 'F', 1}) {
+				t.Fatalf("size %d step %d: header %x", size, step, data[:3])
+			}
+			got, err := aead.Open(nil, data[3:headerSize], data[headerSize:], nil)
+			if err != nil {
+				t.Fatalf("size %d step %d: %v", size, step, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("size %d step %d: content differs", size, step)
+			}
+		}
+	}
+}
+
+func TestWriterAfterClose(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(testKey(t), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	n := buf.Len()
+	if err := w.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+	if buf.Len() != n {
+		t.Errorf("%d bytes written after Close", buf.Len()-n)
+	}
+}
+
+func TestWriterSizeLimit(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(testKey(t), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writing 64 GiB would take too long; the writer is put just short of
+	// the last block GCM can count instead.
+	w.(*writer).n = MaxSize - 17
+	if _, err := w.Write(testData(t, 16)); err != nil {
+		t.Fatalf("write up to a byte short of the limit: %v", err)
+	}
+	if _, err := w.Write(testData(t, 2)); err != ErrTooLarge {
+		t.Errorf("write past the limit: got %v, want ErrTooLarge", err)
+	}
+	n := buf.Len()
+	if _, err := w.Write(testData(t, 1)); err != nil {
+		t.Fatalf("write up to the limit: %v", err)
+	}
+	if buf.Len() != n+1 {
+		t.Errorf("%d bytes written, want 1", buf.Len()-n)
+	}
+	if _, err := w.Write(testData(t, 1)); err != ErrTooLarge {
+		t.Errorf("write at the limit: got %v, want ErrTooLarge", err)
+	}
+}